@@ -1,37 +1,295 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
 
+	"spymaster/src/certs"
+	"spymaster/src/config"
+	"spymaster/src/events"
+	"spymaster/src/events/backend"
+	"spymaster/src/gql"
+	"spymaster/src/health"
+	"spymaster/src/jobs"
+	"spymaster/src/lockout"
+	"spymaster/src/logging"
+	"spymaster/src/mail"
+	"spymaster/src/metrics"
 	"spymaster/src/mongo"
+	"spymaster/src/operations"
+	"spymaster/src/password"
+	"spymaster/src/ratelimit"
+	"spymaster/src/rpc"
 	"spymaster/src/server"
+	"spymaster/src/spymaster"
+	"spymaster/src/tracing"
+	"spymaster/src/watcher"
 )
 
 // Config ...
 type Config struct {
-	// UserTopic string       `envconfig:"user_notification_topic" default:"user-notifications"`
-	Mongo mongo.Config `envconfig:"mongo"`
+	HTTP       server.HTTPConfig    `envconfig:"http"`
+	Mongo      mongo.Config         `envconfig:"mongo"`
+	Events     backend.Config       `envconfig:"events"`
+	GRPC       rpc.Config           `envconfig:"grpc"`
+	GraphQL    gql.Config           `envconfig:"graphql"`
+	Watcher    watcher.Config       `envconfig:"watcher"`
+	Operations operations.Config    `envconfig:"operations"`
+	Jobs       jobs.Config          `envconfig:"jobs"`
+	Health     health.Config        `envconfig:"health"`
+	RateLimit  ratelimit.Config     `envconfig:"rate_limit"`
+	Auth       spymaster.AuthConfig `envconfig:"auth"`
+	Mail       mail.Config          `envconfig:"mail"`
+	Password   password.Config      `envconfig:"password"`
+	Tracing    tracing.Config       `envconfig:"tracing"`
+	Log        logging.Config       `envconfig:"log"`
 }
 
 func main() {
 	var conf Config
-	err := envconfig.Process("spymaster", &conf)
+	effective, err := config.Load("spymaster", &conf, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to load env config: %s", err.Error())
+		logging.Fatal("Invalid configuration", "error", err)
 	}
 
-	fmt.Println(splash)
+	fmt.Print(splash)
+	logging.Setup(conf.Log)
+
+	flushTraces, err := tracing.Setup(context.Background(), conf.Tracing)
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "error", err)
+	}
 
 	mc, err := mongo.Connect(conf.Mongo)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %s", err)
+		logging.Fatal("Failed to connect to MongoDB", "error", err)
+	}
+
+	// stop is canceled on SIGINT or SIGTERM; background is canceled once requests are drained
+	stop, stopped := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopped()
+	background, cancel := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	goWork := func(run func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(background)
+		}()
+	}
+
+	broker := events.NewBroker()
+	eb, err := backend.New(conf.Events)
+	if err != nil {
+		logging.Fatal("Failed to create the events backend", "backend", conf.Events.Backend, "error", err)
+	}
+	var next events.Publisher
+	if eb != nil {
+		next = eb
+	}
+	// the in-process subscribers get every event right away, the message broker gets them in order through the
+	// outbox, which is only relayed by the jobs
+	journal := events.NewJournal(mc, next)
+	journal.SetInline(broker)
+	journal.SetOrdered(conf.Jobs.Enabled)
+	svc := spymaster.NewService(mc, journal, spymaster.SystemClock{}, spymaster.BcryptHasher{})
+	policy, err := password.New(conf.Password)
+	if err != nil {
+		logging.Fatal("Failed to create the password policy", "error", err)
+	}
+	svc.SetPasswordPolicy(policy)
+	svc.SetMaxPerPage(conf.HTTP.MaxPerPage)
+	var lockouts *lockout.Tracker
+	if conf.Auth.Lockout.Enabled {
+		lockouts = lockout.NewTracker(mc, conf.Auth.Lockout, spymaster.SystemClock{})
+	}
+	mailer, err := mail.New(conf.Mail)
+	if err != nil {
+		logging.Fatal("Failed to create the mailer", "backend", conf.Mail.Backend, "error", err)
+	}
+	auth, err := spymaster.NewAuthenticator(svc, mc, lockouts, mailer, conf.Auth)
+	if err != nil {
+		logging.Fatal("Failed to create the authenticator", "error", err)
 	}
 
-	r := server.CreateRouter(mc)
-	r.Run(":7000") // listen and serve on 0.0.0.0:7000
+	if conf.Watcher.Enabled {
+		goWork(watcher.New(mc, journal, conf.Watcher).Run)
+	}
+
+	dispatcher := operations.NewDispatcher(mc, svc, conf.Operations)
+	goWork(dispatcher.Run)
+
+	var scheduler *jobs.Scheduler
+	if conf.Jobs.Enabled {
+		scheduler = jobs.NewScheduler(mc, conf.Jobs)
+		registerJobs(scheduler, conf.Jobs, journal, eb)
+		goWork(scheduler.Run)
+	}
+
+	lis, err := net.Listen("tcp", conf.GRPC.Address)
+	if err != nil {
+		logging.Fatal("Failed to listen for gRPC", "address", conf.GRPC.Address, "error", err)
+	}
+	gs := rpc.NewServer(svc, broker, auth)
+	go func() {
+		slog.Info("Serving gRPC", "address", conf.GRPC.Address)
+		if err := gs.Serve(lis); err != nil {
+			logging.Fatal("gRPC server stopped", "error", err)
+		}
+	}()
+
+	// the gauges of the stored data are read when scraped, users being counted at most once a minute
+	prometheus.MustRegister(metrics.NewCollector(metrics.Sources{
+		UsersByCountry: mc.CountUsersByCountry,
+		Outbox:         journal.Backlog,
+	}, 5*time.Second, time.Minute))
+
+	readiness := &health.Readiness{}
+	checks := health.NewRegistry(conf.Health)
+	for _, check := range health.Mongo(mc) {
+		checks.Register(check)
+	}
+	if pinger, ok := eb.(events.Pinger); ok {
+		checks.Register(health.Broker(pinger))
+	}
+	checks.Register(health.OutboxLag(journal, conf.Health.OutboxLag))
+
+	var limiter *ratelimit.Limiter
+	if conf.RateLimit.Enabled {
+		var store ratelimit.Store = ratelimit.NewMemoryStore()
+		if conf.RateLimit.Backend == ratelimit.Mongo {
+			store = mc
+		}
+		limiter = ratelimit.New(store, conf.RateLimit)
+	}
+
+	r := server.CreateRouter(server.ContextParams{
+		MongoClient: mc,
+		Service:     svc,
+		Broker:      broker,
+		Journal:     journal,
+		Operations:  dispatcher,
+		Jobs:        scheduler,
+		Readiness:   readiness,
+		Health:      checks,
+		Auth:        auth,
+		Config:      effective,
+		GraphQL:     conf.GraphQL,
+		Limiter:     limiter,
+		MaxPerPage:  conf.HTTP.MaxPerPage,
+		// the client IP is what clients are rate limited by when they aren't identified
+		TrustedProxies: conf.HTTP.TrustedProxies,
+	})
+	srv := server.NewHTTPServer(conf.HTTP, r)
+	// event streams never go idle on their own, ending them lets Shutdown complete
+	srv.RegisterOnShutdown(broker.Close)
+	serve := srv.ListenAndServe
+	if conf.HTTP.TLS.Enabled() {
+		reloader, err := certs.NewReloader(conf.HTTP.TLS.CertFile, conf.HTTP.TLS.KeyFile)
+		if err != nil {
+			logging.Fatal("Failed to load the HTTP certificate", "error", err)
+		}
+		if srv.TLSConfig, err = server.NewTLSConfig(conf.HTTP.TLS, reloader); err != nil {
+			logging.Fatal("Invalid HTTP TLS configuration", "error", err)
+		}
+		goWork(func(ctx context.Context) { reloader.Watch(ctx, conf.HTTP.TLS.ReloadInterval) })
+		// the certificate comes from the TLS configuration
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	go func() {
+		slog.Info("Serving HTTP", "address", conf.HTTP.Address, "tls", conf.HTTP.TLS.Enabled())
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("HTTP server stopped", "error", err)
+		}
+	}()
+
+	<-stop.Done()
+	stopped()
+	shutdown(conf.HTTP, readiness, srv, gs)
+
+	// no more writes can come in: the queued ones are executed, for as long as requests were given to drain, then
+	// the workers finish theirs before the publisher and database go away
+	drain, cancelDrain := context.WithTimeout(context.Background(), conf.HTTP.ShutdownTimeout)
+	if err := dispatcher.Shutdown(drain); err != nil {
+		slog.Error("Abandoned queued asynchronous writes", "error", err)
+	}
+	cancelDrain()
+	cancel()
+	workers.Wait()
+	if eb != nil {
+		if err := eb.Close(); err != nil {
+			slog.Error("Failed flushing the events backend", "backend", conf.Events.Backend, "error", err)
+		}
+	}
+	mc.Close()
+
+	ctx, cancelFlush := context.WithTimeout(context.Background(), conf.HTTP.ShutdownTimeout)
+	defer cancelFlush()
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("Failed flushing traces", "error", err)
+	}
+	slog.Info("Stopped")
+}
+
+// shutdown stops serving: it reports the instance as not ready for a while so load balancers stop routing to it,
+// then waits for in-flight requests and calls
+func shutdown(conf server.HTTPConfig, readiness *health.Readiness, srv *http.Server, gs *grpc.Server) {
+	slog.Info("Shutting down", "drain_delay", conf.ShutdownDelay)
+	readiness.Drain()
+	time.Sleep(conf.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server didn't shut down cleanly", "error", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		gs.Stop()
+	}
+}
+
+// registerJobs adds the background jobs to the scheduler
+func registerJobs(scheduler *jobs.Scheduler, conf jobs.Config, journal *events.Journal, eb events.Backend) {
+	// only the external broker is given what failed to go out or was held back, the in-memory one got everything inline
+	err := scheduler.Register("outbox-relay", conf.OutboxRelay, func(ctx context.Context) (string, error) {
+		n, err := journal.Relay(ctx, eb, conf.RelayDelay)
+		return fmt.Sprintf("relayed %d events", n), err
+	})
+	if err != nil {
+		logging.Fatal("Failed to register job", "error", err)
+	}
+
+	err = scheduler.Register("event-retention", conf.Retention, func(ctx context.Context) (string, error) {
+		n, err := journal.Prune(ctx, time.Now().Add(-conf.EventRetention))
+		return fmt.Sprintf("removed %d events", n), err
+	})
+	if err != nil {
+		logging.Fatal("Failed to register job", "error", err)
+	}
 }
 
 const splash = `
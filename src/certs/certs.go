@@ -0,0 +1,159 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// LoadPool reads a bundle of PEM encoded CA certificates
+func LoadPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ParseClientAuth maps a client certificate policy name to its tls.ClientAuthType
+// - none: no client certificate is asked for
+// - optional: a certificate is asked for and verified when given, so callers without one still get through
+// - require: every caller must present a valid certificate
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth %q, expected none, optional or require", s)
+}
+
+// Reloader serves a certificate and key pair, loading them again whenever the files change
+// - certificates renewed on disk (by cert-manager, certbot...) are picked up without a restart
+type Reloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewReloader loads the pair, failing if it's unusable
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the pair again; the previous one keeps being served if it fails
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks the files every interval, reloading the pair when either was modified, until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.lastModified()
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			// the pair may be halfway written, it's tried again on the next check
+			slog.WarnContext(ctx, "Failed reloading certificate", "file", r.certFile, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Reloaded certificate", "file", r.certFile)
+	}
+}
+
+// lastModified is the latest modification time of the two files
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ClientConfig creates the TLS configuration of a client trusting the CAs in caFile, or the system ones when empty,
+// and presenting the certificate and key PEM encoded together in certKeyFile, if any
+func ClientConfig(caFile, certKeyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if certKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certKeyFile, certKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// Subject returns the subject of the certificate a client configuration presents, in RFC 2253 form
+func Subject(conf *tls.Config) (string, error) {
+	if len(conf.Certificates) == 0 {
+		return "", errors.New("no client certificate configured")
+	}
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return leaf.Subject.String(), nil
+}
@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/password"
+	"spymaster/src/ratelimit"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+// Login opens a session for the user whose nickname or email and password are given
+// - failed logins all get the same answer, whether a user has the login or not
+func Login(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	var payload types.Login
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	token, err := auth.Login(c.Request.Context(), payload.Login, payload.Password, c.ClientIP())
+	var lockedOut *spymaster.LockedOutError
+	var mfaRequired *spymaster.MFARequiredError
+	switch {
+	case errors.As(err, &lockedOut):
+		c.Header("Retry-After", strconv.Itoa(ratelimit.Seconds(lockedOut.RetryAfter)))
+		Fail(c, http.StatusTooManyRequests, gin.H{"message": "Too many failed logins"})
+	case errors.As(err, &mfaRequired):
+		c.Header("Cache-Control", "no-store")
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "MFA code required", "mfa_token": mfaRequired.Token, "expires_at": mfaRequired.ExpiresAt})
+	case err == spymaster.ErrInvalidCredentials:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Invalid login or password"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, token)
+	}
+}
+
+// LoginMFA finishes a login with the MFA token it answered and a code, or a recovery code
+func LoginMFA(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	var payload types.MFALoginPost
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	token, err := auth.LoginMFA(c.Request.Context(), payload.MFAToken, payload.Code, c.ClientIP())
+	var lockedOut *spymaster.LockedOutError
+	switch {
+	case errors.As(err, &lockedOut):
+		c.Header("Retry-After", strconv.Itoa(ratelimit.Seconds(lockedOut.RetryAfter)))
+		Fail(c, http.StatusTooManyRequests, gin.H{"message": "Too many failed logins"})
+	case err == spymaster.ErrInvalidToken:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Invalid or expired MFA token"})
+	case err == spymaster.ErrInvalidCredentials:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Invalid code"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, token)
+	}
+}
+
+// Logout ends the session of the token the request is authenticated with
+func Logout(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	token := BearerToken(c)
+	if auth == nil || token == "" {
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+		return
+	}
+
+	err := auth.Logout(c.Request.Context(), token)
+	switch {
+	case err == spymaster.ErrUnauthenticated:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// BearerToken returns the token of the request's Authorization header, empty when there's none
+func BearerToken(c *gin.Context) string {
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// sessionUserID returns the user whose session token authenticates the request
+func sessionUserID(c *gin.Context) (string, bool) {
+	session, ok := c.Get("session")
+	if !ok {
+		return "", false
+	}
+	return session.(types.Session).UserID, true
+}
+
+// ListLockouts lists the accounts and clients which failed logging in recently, locked out ones first
+func ListLockouts(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	records, err := auth.Lockouts(c.Request.Context())
+	if err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": records})
+}
+
+// ClearLockout forgets the failed logins of an account or a client, lifting its lockout
+func ClearLockout(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	err := auth.ClearLockout(c.Request.Context(), c.Param("id"))
+	switch {
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusNotFound, gin.H{"message": "Lockout not found"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// VerifyEmail marks the email a verification token was mailed to as verified
+func VerifyEmail(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil || !auth.Mails() {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Email verification is disabled"})
+		return
+	}
+
+	var payload types.TokenPost
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	_, err := auth.VerifyEmail(c.Request.Context(), payload.Token)
+	switch {
+	case err == spymaster.ErrInvalidToken:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid or expired token"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// ResendVerification mails the logged in user a new link verifying their email
+func ResendVerification(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil || !auth.Mails() {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Email verification is disabled"})
+		return
+	}
+	userID, ok := sessionUserID(c)
+	if !ok {
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+		return
+	}
+
+	err := auth.ResendVerification(c.Request.Context(), userID)
+	switch {
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// RequestPasswordReset mails the users whose nickname or email is given a link to reset their password
+// - the answer is the same whether a user has the login or not
+func RequestPasswordReset(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil || !auth.Mails() {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Password reset is disabled"})
+		return
+	}
+
+	var payload types.PasswordResetRequest
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	if err := auth.RequestPasswordReset(c.Request.Context(), payload.Login); err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password for the user a reset token was mailed to, ending all their sessions
+func ResetPassword(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil || !auth.Mails() {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Password reset is disabled"})
+		return
+	}
+
+	var payload types.PasswordReset
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	err := auth.ResetPassword(c.Request.Context(), payload.Token, payload.Password)
+	var refused *password.Error
+	switch {
+	case errors.As(err, &refused):
+		FailPassword(c, refused)
+	case err == spymaster.ErrInvalidToken:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid or expired token"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// EnrollMFA gives the logged in user a new TOTP secret and its otpauth URI, to confirm with a code
+func EnrollMFA(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	userID, ok := sessionUserID(c)
+	if auth == nil || !ok {
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+		return
+	}
+
+	enrollment, err := auth.EnrollMFA(c.Request.Context(), userID)
+	switch {
+	case err == spymaster.ErrMFADisabled:
+		Fail(c, http.StatusNotFound, gin.H{"message": "MFA is disabled"})
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+	case err == spymaster.ErrMFAEnabled:
+		Fail(c, http.StatusConflict, gin.H{"message": "MFA is already enabled"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, enrollment)
+	}
+}
+
+// ConfirmMFA enables the MFA the logged in user enrolled with, given a code, answering their recovery codes
+func ConfirmMFA(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	userID, ok := sessionUserID(c)
+	if auth == nil || !ok {
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+		return
+	}
+
+	var payload types.MFACode
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	codes, err := auth.ConfirmMFA(c.Request.Context(), userID, payload.Code)
+	switch {
+	case err == spymaster.ErrMFADisabled:
+		Fail(c, http.StatusNotFound, gin.H{"message": "MFA is disabled"})
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusUnauthorized, gin.H{"message": "Not logged in"})
+	case err == spymaster.ErrMFAEnabled:
+		Fail(c, http.StatusConflict, gin.H{"message": "MFA is already enabled"})
+	case err == spymaster.ErrMFANotEnrolled:
+		Fail(c, http.StatusConflict, gin.H{"message": "MFA enrollment not started"})
+	case err == spymaster.ErrInvalidCode:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid code"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, codes)
+	}
+}
+
+// ResetMFA removes the second factor of a user, who logs in with their password alone until enrolling again
+func ResetMFA(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	err := auth.ResetMFA(c.Request.Context(), c.Param("id"))
+	switch {
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusNotFound, gin.H{"message": "User not found"})
+	case err == spymaster.ErrInvalidID:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid ID"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// CreateAPIKey creates an API key with the scopes asked for, answering the key itself this once
+func CreateAPIKey(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	var payload types.APIKeyPost
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		Fail(c, http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload received: %s", err)})
+		return
+	}
+
+	createdBy, _ := sessionUserID(c)
+	key, err := auth.CreateAPIKey(c.Request.Context(), &payload, createdBy)
+	switch {
+	case err == spymaster.ErrInvalidScopes:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Validation error", "details": gin.H{
+			"scopes": fmt.Sprintf("Scopes must be one or more of %s", strings.Join(types.Scopes, ", ")),
+		}})
+	case err == spymaster.ErrInvalidExpiry:
+		Fail(c, http.StatusBadRequest, gin.H{"message": "Validation error", "details": gin.H{"expires_at": "Expiry must be in the future"}})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusCreated, key)
+	}
+}
+
+// ListAPIKeys lists the API keys, the latest created first
+func ListAPIKeys(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	keys, err := auth.ListAPIKeys(c.Request.Context())
+	if err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// RevokeAPIKey stops an API key from working
+func RevokeAPIKey(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	if auth == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Login is disabled"})
+		return
+	}
+
+	err := auth.RevokeAPIKey(c.Request.Context(), c.Param("id"))
+	switch {
+	case err == spymaster.ErrNotFound:
+		Fail(c, http.StatusNotFound, gin.H{"message": "API key not found"})
+	case err != nil:
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
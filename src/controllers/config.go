@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/config"
+)
+
+// GetConfig returns the configuration the instance runs with, secrets redacted, and where each value came from
+func GetConfig(c *gin.Context) {
+	effective := c.MustGet("config").(*config.Effective)
+	if effective == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Configuration not available"})
+		return
+	}
+	c.JSON(http.StatusOK, effective)
+}
@@ -2,13 +2,18 @@ package controllers
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"spymaster/src/health"
 	"spymaster/src/mongo"
+	"spymaster/src/password"
+	"spymaster/src/requestid"
+	"spymaster/src/spymaster"
 )
 
 // Ping returns a ping response
@@ -22,10 +27,16 @@ func Ping(c *gin.Context) {
 // Health returns a Health response
 // - suitable for any check wanting to hit backend services
 func Health(c *gin.Context) {
+	if readiness, ok := c.Get("readiness"); ok && readiness.(*health.Readiness).Draining() {
+		Fail(c, http.StatusServiceUnavailable, gin.H{"message": "DRAINING"})
+		return
+	}
+
 	mc := c.MustGet("mongo").(mongo.Client)
-	err := mc.Ping()
+	err := mc.Ping(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		slog.WarnContext(c.Request.Context(), "Health check failed", "error", err)
+		Fail(c, http.StatusServiceUnavailable, gin.H{"message": "DOWN"})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -33,10 +44,63 @@ func Health(c *gin.Context) {
 	})
 }
 
+// Fail answers with an error body, aborting the handlers left
+// - the body carries the request ID, so a reported error can be tied to the logs
+func Fail(c *gin.Context, status int, body gin.H) {
+	body["request_id"] = requestid.FromContext(c.Request.Context())
+	c.AbortWithStatusJSON(status, body)
+}
+
+// FailPassword answers a refused password with the rules it breaks
+func FailPassword(c *gin.Context, refused *password.Error) {
+	Fail(c, http.StatusBadRequest, gin.H{
+		"message": "Validation error",
+		"details": gin.H{
+			"password": "Password " + strings.Join(refused.Problems, ", "),
+		},
+	})
+}
+
+// Livez reports whether the process is alive
+// - dependencies aren't checked, restarting the instance wouldn't fix them
+func Livez(c *gin.Context) {
+	registry := c.MustGet("health").(*health.Registry)
+	writeHealth(c, registry.Liveness())
+}
+
+// Readyz reports whether the instance should be sent traffic, with the result of every dependency check
+// - non-critical dependencies failing only degrade the instance (warn), which is still ready
+func Readyz(c *gin.Context) {
+	registry := c.MustGet("health").(*health.Registry)
+	report := registry.Readiness(c.Request.Context())
+	if readiness, ok := c.Get("readiness"); ok && readiness.(*health.Readiness).Draining() {
+		report.Status, report.Output = health.Fail, "draining"
+	}
+	writeHealth(c, report)
+}
+
+func writeHealth(c *gin.Context, report health.Report) {
+	status := http.StatusOK
+	if report.Status == health.Fail {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Content-Type", health.ContentType)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, report)
+}
+
 // Utils
 
+// DefaultMaxPerPage is the largest page size allowed unless configured otherwise
+const DefaultMaxPerPage = spymaster.DefaultMaxPerPage
+
 // Pagination takes care of the pagination parameters and headers
-func Pagination() gin.HandlerFunc {
+// - page sizes over maxPerPage are rejected, DefaultMaxPerPage when 0, as they would have a single request read
+// the whole collection
+func Pagination(maxPerPage int) gin.HandlerFunc {
+	if maxPerPage <= 0 {
+		maxPerPage = DefaultMaxPerPage
+	}
 	return func(c *gin.Context) {
 		var perPage, pageNumber int
 		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodPost {
@@ -44,20 +108,22 @@ func Pagination() gin.HandlerFunc {
 			str, found := c.GetQuery("per_page")
 			if found {
 				n, err := strconv.ParseInt(str, 10, 32)
-				if err != nil || n <= 0 {
-					e := fmt.Sprintf("Invalid value %q - expected an integer greater than zero", str)
-					c.JSON(http.StatusBadRequest, gin.H{
+				if err != nil || n <= 0 || n > int64(maxPerPage) {
+					e := fmt.Sprintf("Invalid value %q - expected an integer between 1 and %d", str, maxPerPage)
+					Fail(c, http.StatusBadRequest, gin.H{
 						"message": "Validation error",
 						"details": gin.H{
 							"per_page": e,
 						},
 					})
-					c.Abort()
 					return
 				}
 				perPage = int(n)
 			} else {
 				perPage = 100
+				if perPage > maxPerPage {
+					perPage = maxPerPage
+				}
 			}
 
 			str, found = c.GetQuery("page")
@@ -65,13 +131,12 @@ func Pagination() gin.HandlerFunc {
 				n, err := strconv.ParseInt(str, 10, 32)
 				if err != nil || n <= 0 {
 					e := fmt.Sprintf("Invalid value %q - expected an integer greater than zero", str)
-					c.JSON(http.StatusBadRequest, gin.H{
+					Fail(c, http.StatusBadRequest, gin.H{
 						"message": "Validation error",
 						"details": gin.H{
 							"page": e,
 						},
 					})
-					c.Abort()
 					return
 				}
 				pageNumber = int(n)
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/events"
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	replayBatch       = 100
+	streamBuffer      = 256
+)
+
+// StreamUserEvents streams user events as server-sent events
+// - clients resume with the Last-Event-ID header (or last_event_id query parameter), replaying the missed events from the journal
+// - events can be narrowed down with the comma separated `type` and the `user_id` query parameters
+func StreamUserEvents(c *gin.Context) {
+	journal := c.MustGet("journal").(*events.Journal)
+	broker := c.MustGet("broker").(*events.Broker)
+
+	q := events.Query{UserID: c.Query("user_id"), Limit: replayBatch}
+	if types := c.Query("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			q.Types = append(q.Types, events.Type(strings.TrimSpace(t)))
+		}
+	}
+
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+	if lastID != "" {
+		seq, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || seq < 0 {
+			Fail(c, http.StatusBadRequest, gin.H{
+				"message": "Validation error",
+				"details": gin.H{
+					"Last-Event-ID": fmt.Sprintf("Invalid value %q - expected an event sequence number", lastID),
+				},
+			})
+			return
+		}
+		q.AfterSequence = seq
+	}
+
+	// subscribe before replaying so nothing published in between gets lost
+	live, cancel := broker.Subscribe(streamBuffer)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	// seen is the sequence of the last event the stream accounted for, sent or filtered out, -1 until it has a
+	// starting point; the journal is only read again when live events skip past it
+	seen := int64(-1)
+
+	// replay sends whatever matching events the journal has after seen, moving seen past them
+	replay := func() bool {
+		q.AfterSequence = max(seen, 0)
+		for {
+			missed, err := journal.Since(ctx, q)
+			if err != nil {
+				c.SSEvent("error", gin.H{"message": "Failed reading the event log"})
+				return false
+			}
+			for _, e := range missed {
+				writeEvent(c.Writer, e)
+				q.AfterSequence = e.Sequence
+			}
+			c.Writer.Flush()
+			if len(missed) < q.Limit {
+				seen = max(seen, q.AfterSequence)
+				return true
+			}
+		}
+	}
+
+	if lastID != "" {
+		seen = q.AfterSequence
+		if !replay() {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case e, ok := <-live:
+			if !ok {
+				return
+			}
+			if seen >= 0 && e.Sequence <= seen {
+				continue // already replayed
+			}
+			if seen >= 0 && e.Sequence > seen+1 {
+				// a gap means we missed something, events which never reached this broker or dropped ones as the
+				// subscriber fell behind; the journal knows which
+				if !replay() {
+					return
+				}
+				if e.Sequence <= seen {
+					continue
+				}
+			}
+			seen = e.Sequence
+			if !q.Matches(e) {
+				continue
+			}
+			writeEvent(c.Writer, e)
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeEvent writes a single event in the text/event-stream format, using its sequence as ID
+func writeEvent(w io.Writer, e events.Event) {
+	sse.Encode(w, sse.Event{
+		Id:    strconv.FormatInt(e.Sequence, 10),
+		Event: string(e.Type),
+		Data:  e,
+	})
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/jobs"
+)
+
+const defaultJobRuns = 20
+
+// ListJobs lists the background jobs with their schedule and last run, and which instance leads
+func ListJobs(c *gin.Context) {
+	scheduler := c.MustGet("jobs").(*jobs.Scheduler)
+	if scheduler == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Background jobs are disabled"})
+		return
+	}
+
+	list, err := scheduler.Jobs(c.Request.Context())
+	if err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+	leader, err := scheduler.Leader(c.Request.Context())
+	if err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance": scheduler.Instance(),
+		"leader":   leader,
+		"jobs":     list,
+	})
+}
+
+// ListJobRuns lists the latest runs of a background job, most recent first
+func ListJobRuns(c *gin.Context) {
+	scheduler := c.MustGet("jobs").(*jobs.Scheduler)
+	if scheduler == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Background jobs are disabled"})
+		return
+	}
+
+	limit := defaultJobRuns
+	if value, found := c.GetQuery("limit"); found {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			Fail(c, http.StatusBadRequest, gin.H{
+				"message": "Validation error",
+				"details": gin.H{"limit": "Expected a number between 1 and 100"},
+			})
+			return
+		}
+		limit = n
+	}
+
+	runs, found, err := scheduler.Runs(c.Request.Context(), c.Param("name"), limit)
+	if err != nil {
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		return
+	}
+	if !found {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Not Found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
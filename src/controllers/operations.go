@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/operations"
+)
+
+// preferAsync reports whether the client sent `Prefer: respond-async` (RFC 7240) and asynchronous processing is available
+func preferAsync(c *gin.Context) bool {
+	if d, ok := c.Get("operations"); !ok || d.(*operations.Dispatcher) == nil {
+		return false
+	}
+	for _, header := range c.Request.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			token := strings.TrimSpace(strings.SplitN(pref, ";", 2)[0])
+			if strings.EqualFold(token, "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dispatch queues the command, answering with the operation tracking it
+func dispatch(c *gin.Context, cmd operations.Command) {
+	dispatcher := c.MustGet("operations").(*operations.Dispatcher)
+
+	op, err := dispatcher.Submit(c.Request.Context(), cmd)
+	if err != nil {
+		switch err {
+		case operations.ErrQueueFull:
+			c.Header("Retry-After", "1")
+			Fail(c, http.StatusServiceUnavailable, gin.H{"message": "Too many pending operations"})
+		case operations.ErrShutdown:
+			Fail(c, http.StatusServiceUnavailable, gin.H{"message": "Shutting down"})
+		default:
+			Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		}
+		return
+	}
+
+	c.Header("Location", "/operations/"+op.ID)
+	c.Header("Preference-Applied", "respond-async")
+	c.JSON(http.StatusAccepted, op)
+}
+
+// GetOperation returns the status of an asynchronous operation, with its result or error once done
+// - there's none to find when asynchronous processing is disabled
+func GetOperation(c *gin.Context) {
+	dispatcher, _ := c.MustGet("operations").(*operations.Dispatcher)
+	if dispatcher == nil {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Not Found"})
+		return
+	}
+
+	op, err := dispatcher.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == operations.ErrNotFound {
+			Fail(c, http.StatusNotFound, gin.H{"message": "Not Found"})
+		} else {
+			Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+		}
+		return
+	}
+
+	if !op.Done() {
+		c.Header("Retry-After", "1")
+	}
+	c.JSON(http.StatusOK, op)
+}
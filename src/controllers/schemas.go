@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/events"
+)
+
+// ListEventSchemas lists the published user event types with every version of their data schema
+func ListEventSchemas(c *gin.Context) {
+	type version struct {
+		Version    int    `json:"version"`
+		Type       string `json:"cloudevents_type"`
+		DataSchema string `json:"dataschema"`
+		Href       string `json:"href"`
+	}
+	type eventType struct {
+		Type     string    `json:"type"`
+		Latest   int       `json:"latest"`
+		Versions []version `json:"versions"`
+	}
+
+	var types []eventType
+	for _, s := range events.Schemas() {
+		if len(types) == 0 || types[len(types)-1].Type != s.Type {
+			types = append(types, eventType{Type: s.Type})
+		}
+		t := &types[len(types)-1]
+		ceType := s.CloudEventType()
+		t.Latest = s.Version
+		t.Versions = append(t.Versions, version{
+			Version:    s.Version,
+			Type:       ceType,
+			DataSchema: s.URI,
+			Href:       "/schemas/" + ceType,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"types": types, "current_version": events.SchemaVersion})
+}
+
+// GetEventSchema returns the JSON schema of a versioned CloudEvents type, e.g. com.spymaster.user.updated.v1
+func GetEventSchema(c *gin.Context) {
+	s, ok := events.LookupSchema(c.Param("type"))
+	if !ok {
+		Fail(c, http.StatusNotFound, gin.H{"message": "Schema not found"})
+		return
+	}
+	c.Data(http.StatusOK, "application/schema+json", s.Document)
+}
@@ -1,12 +1,16 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 
+	"spymaster/src/metrics"
+	"spymaster/src/operations"
+	"spymaster/src/password"
 	"spymaster/src/spymaster"
 	"spymaster/types"
 )
@@ -16,8 +20,10 @@ var exactSearchFields = []string{"_id", "country"}
 
 // ListUsers lists all users that meet the query parameters
 func ListUsers(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
 	perPage := c.MustGet("per_page").(int)
 	pageNumber := c.MustGet("page_number").(int)
+	metrics.ObservePageSize(perPage)
 
 	exact := map[string]interface{}{}
 	for _, field := range exactSearchFields {
@@ -35,9 +41,18 @@ func ListUsers(c *gin.Context) {
 		}
 	}
 
-	response, err := spymaster.ListUsers(c, exact, partial, perPage, pageNumber)
+	response, err := svc.ListUsers(c.Request.Context(), exact, partial, perPage, pageNumber)
+	if err == spymaster.ErrInvalidPage {
+		Fail(c, http.StatusBadRequest, gin.H{
+			"message": "Validation error",
+			"details": gin.H{
+				"page": fmt.Sprintf("Pages of %d users can't start that far", perPage),
+			},
+		})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Server error"})
+		Fail(c, http.StatusInternalServerError, gin.H{"message": "Server error"})
 		return
 	}
 
@@ -47,20 +62,30 @@ func ListUsers(c *gin.Context) {
 
 // CreateUser creates a new user
 func CreateUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
 	var payload = &types.UserPost{}
 	errs := c.ShouldBindJSON(payload)
 	if errs != nil {
 		e := fmt.Sprintf("Invalid payload received: %s", errs)
-		c.JSON(http.StatusBadRequest, e)
+		Fail(c, http.StatusBadRequest, gin.H{"message": e})
+		return
+	}
+
+	if preferAsync(c) {
+		dispatch(c, operations.Command{Kind: operations.CreateUser, Create: payload})
 		return
 	}
 
-	user, err := spymaster.CreateUser(c, payload)
+	user, err := svc.CreateUser(c.Request.Context(), payload)
+	var refused *password.Error
 	if err != nil {
 		if err == spymaster.ErrDup {
-			c.JSON(http.StatusConflict, gin.H{"message": "User/Email already exists"})
+			Fail(c, http.StatusConflict, gin.H{"message": "User/Email already exists"})
+		} else if errors.As(err, &refused) {
+			FailPassword(c, refused)
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Server Error"})
+			Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
 		}
 		return
 	}
@@ -70,24 +95,33 @@ func CreateUser(c *gin.Context) {
 
 // UpdateUser creates a new user
 func UpdateUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
 	id, _ := c.GetQuery("id")
 
 	var payload = &types.UserPatch{}
 	errs := c.ShouldBindWith(payload, binding.JSON)
-	fmt.Printf("\n%#v\n", payload)
-	fmt.Printf("\n%#v\n", &types.UserPatch{})
 	if (errs != nil || *payload == types.UserPatch{}) {
 		e := fmt.Sprintf("Invalid payload received: %s", errs)
-		c.JSON(http.StatusBadRequest, e)
+		Fail(c, http.StatusBadRequest, gin.H{"message": e})
 		return
 	}
 
-	user, err := spymaster.UpdateUser(c, id, payload)
+	if preferAsync(c) {
+		dispatch(c, operations.Command{Kind: operations.UpdateUser, UserID: id, Update: payload})
+		return
+	}
+
+	user, err := svc.UpdateUser(c.Request.Context(), id, payload)
+	var refused *password.Error
 	if err != nil {
 		if err == spymaster.ErrNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"message": "Not Found"})
+			Fail(c, http.StatusNotFound, gin.H{"message": "Not Found"})
+		} else if err == spymaster.ErrInvalidID {
+			Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid ID"})
+		} else if errors.As(err, &refused) {
+			FailPassword(c, refused)
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Server Error"})
+			Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
 		}
 		return
 	}
@@ -97,14 +131,22 @@ func UpdateUser(c *gin.Context) {
 
 // DeleteUser creates a new user
 func DeleteUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
 	id, _ := c.GetQuery("id")
 
-	err := spymaster.DeleteUser(c, id)
+	if preferAsync(c) {
+		dispatch(c, operations.Command{Kind: operations.DeleteUser, UserID: id})
+		return
+	}
+
+	err := svc.DeleteUser(c.Request.Context(), id)
 	if err != nil {
 		if err == spymaster.ErrNotFound {
 			c.Status(http.StatusNoContent)
+		} else if err == spymaster.ErrInvalidID {
+			Fail(c, http.StatusBadRequest, gin.H{"message": "Invalid ID"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Server Error"})
+			Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
 		}
 		return
 	}
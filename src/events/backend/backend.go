@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"fmt"
+
+	"spymaster/src/events"
+	"spymaster/src/events/amqp"
+	"spymaster/src/events/kafka"
+	"spymaster/src/events/nats"
+)
+
+// Config selects which message broker user events are published to, if any
+type Config struct {
+	// Backend is one of none, kafka, amqp or nats
+	Backend string       `envconfig:"backend" default:"none"`
+	Kafka   kafka.Config `envconfig:"kafka"`
+	AMQP    amqp.Config  `envconfig:"amqp"`
+	NATS    nats.Config  `envconfig:"nats"`
+}
+
+// Validate checks the backend exists and the mode of the selected one
+func (conf Config) Validate() error {
+	var mode string
+	switch conf.Backend {
+	case "none", "":
+		return nil
+	case "kafka":
+		mode = conf.Kafka.Mode
+	case "amqp":
+		mode = conf.AMQP.Mode
+	case "nats":
+		mode = conf.NATS.Mode
+	default:
+		return fmt.Errorf("unknown backend %q, expected none, kafka, amqp or nats", conf.Backend)
+	}
+	if _, err := events.ParseMode(mode); err != nil {
+		return fmt.Errorf("%s: %w", conf.Backend, err)
+	}
+	return nil
+}
+
+// New creates the configured backend; it returns nil when none is configured
+func New(conf Config) (events.Backend, error) {
+	var (
+		b   events.Backend
+		err error
+	)
+	// assigning through typed variables keeps a failed constructor from returning a non-nil interface
+	switch conf.Backend {
+	case "none", "":
+		return nil, nil
+	case "kafka":
+		var p *kafka.Publisher
+		p, err = kafka.New(conf.Kafka)
+		b = p
+	case "amqp":
+		var p *amqp.Publisher
+		p, err = amqp.New(conf.AMQP)
+		b = p
+	case "nats":
+		var p *nats.Publisher
+		p, err = nats.New(conf.NATS)
+		b = p
+	default:
+		return nil, fmt.Errorf("invalid events backend %q - expected one of none, kafka, amqp or nats", conf.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,216 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"spymaster/types"
+)
+
+const (
+	// SpecVersion is the CloudEvents specification version events follow
+	SpecVersion = "1.0"
+	// Source identifies spymaster as the producer of the events
+	Source = "/spymaster/users"
+	// SchemaVersion is the version of the event data sent to external brokers
+	// - bump it, and add the matching schemas, whenever UserData changes in a way consumers could notice
+	SchemaVersion = 1
+
+	// StructuredContentType is the content type of events sent in structured mode
+	StructuredContentType = "application/cloudevents+json"
+	// DataContentType is the content type of the event data
+	DataContentType = "application/json"
+
+	typePrefix = "com.spymaster."
+)
+
+// Mode is how a CloudEvent is laid out in a message
+type Mode string
+
+const (
+	// Binary sends the event attributes as message headers and only the data as body
+	Binary Mode = "binary"
+	// Structured sends the whole event, attributes included, as a JSON body
+	Structured Mode = "structured"
+)
+
+// ParseMode validates a configured mode
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case Binary, Structured:
+		return Mode(s), nil
+	case "":
+		return Binary, nil
+	}
+	return "", fmt.Errorf("invalid mode %q - expected binary or structured", s)
+}
+
+// CloudEvent is a user event in the CloudEvents 1.0 JSON format
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype,omitempty"`
+	DataSchema      string    `json:"dataschema,omitempty"`
+	// Sequence is the sequence extension, carrying the journal sequence as a string
+	Sequence string `json:"sequence,omitempty"`
+	// TraceParent and TraceState are the distributed tracing extension, carrying the W3C trace context of the write
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+	// RequestID is the requestid extension, carrying the ID of the API request the write comes from
+	RequestID string          `json:"requestid,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// UserData is the data of every user event, see the JSON schemas for what each type carries
+type UserData struct {
+	UserID string      `json:"user_id"`
+	User   *types.User `json:"user,omitempty"`
+	// Before and ChangedFields are only set on updates
+	Before        *types.User `json:"before,omitempty"`
+	ChangedFields []string    `json:"changed_fields,omitempty"`
+	// LockedUntil is only set on lockouts
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Message is a CloudEvent ready to be sent by any transport
+// - in binary mode Attributes must be sent as headers, named as the transport's protocol binding
+// says (e.g. ce_ prefixed for Kafka), while in structured mode they are already part of Body
+type Message struct {
+	ContentType string
+	Attributes  map[string]string
+	Body        []byte
+}
+
+// CloudEventType returns the versioned CloudEvents type of an event type, e.g. com.spymaster.user.updated.v1
+func CloudEventType(t Type, version int) string {
+	return typePrefix + string(t) + ".v" + strconv.Itoa(version)
+}
+
+// ParseCloudEventType splits a CloudEvents type into the event type and its schema version
+func ParseCloudEventType(s string) (Type, int, error) {
+	i := strings.LastIndex(s, ".v")
+	if !strings.HasPrefix(s, typePrefix) || i < len(typePrefix) {
+		return "", 0, fmt.Errorf("unknown event type %q", s)
+	}
+	version, err := strconv.Atoi(s[i+2:])
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid version in event type %q", s)
+	}
+	return Type(s[len(typePrefix):i]), version, nil
+}
+
+// ToCloudEvent converts an event into the current CloudEvents representation
+func ToCloudEvent(e Event) (CloudEvent, error) {
+	data, err := json.Marshal(UserData{
+		UserID:        e.UserID,
+		User:          snapshot(e.User),
+		Before:        snapshot(e.Before),
+		ChangedFields: e.ChangedFields,
+		LockedUntil:   e.LockedUntil,
+	})
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	ceType := CloudEventType(e.Type, SchemaVersion)
+	ce := CloudEvent{
+		SpecVersion:     SpecVersion,
+		ID:              e.ID,
+		Source:          Source,
+		Type:            ceType,
+		Subject:         e.UserID,
+		Time:            e.OccurredAt.UTC(),
+		DataContentType: DataContentType,
+		DataSchema:      SchemaURI(ceType),
+		TraceParent:     e.TraceParent,
+		TraceState:      e.TraceState,
+		RequestID:       e.RequestID,
+		Data:            data,
+	}
+	if e.Sequence > 0 {
+		ce.Sequence = strconv.FormatInt(e.Sequence, 10)
+	}
+	return ce, nil
+}
+
+// Encode turns an event into a message in the given mode
+func Encode(e Event, mode Mode) (Message, error) {
+	ce, err := ToCloudEvent(e)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if mode == Structured {
+		body, err := json.Marshal(ce)
+		return Message{ContentType: StructuredContentType, Body: body}, err
+	}
+
+	attrs := map[string]string{
+		"specversion": ce.SpecVersion,
+		"id":          ce.ID,
+		"source":      ce.Source,
+		"type":        ce.Type,
+		"subject":     ce.Subject,
+		"time":        ce.Time.Format(time.RFC3339Nano),
+		"dataschema":  ce.DataSchema,
+	}
+	for name, value := range map[string]string{"sequence": ce.Sequence, "traceparent": ce.TraceParent, "tracestate": ce.TraceState, "requestid": ce.RequestID} {
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+	return Message{ContentType: ce.DataContentType, Attributes: attrs, Body: ce.Data}, nil
+}
+
+// Decode reads a CloudEvent back from a message in either mode
+func Decode(m Message) (CloudEvent, error) {
+	var ce CloudEvent
+	if strings.HasPrefix(m.ContentType, StructuredContentType) {
+		if err := json.Unmarshal(m.Body, &ce); err != nil {
+			return ce, err
+		}
+	} else {
+		ce = CloudEvent{
+			SpecVersion:     m.Attributes["specversion"],
+			ID:              m.Attributes["id"],
+			Source:          m.Attributes["source"],
+			Type:            m.Attributes["type"],
+			Subject:         m.Attributes["subject"],
+			DataContentType: m.ContentType,
+			DataSchema:      m.Attributes["dataschema"],
+			Sequence:        m.Attributes["sequence"],
+			TraceParent:     m.Attributes["traceparent"],
+			TraceState:      m.Attributes["tracestate"],
+			RequestID:       m.Attributes["requestid"],
+			Data:            m.Body,
+		}
+		if t := m.Attributes["time"]; t != "" {
+			var err error
+			if ce.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+				return ce, fmt.Errorf("invalid time attribute: %w", err)
+			}
+		}
+	}
+
+	if ce.SpecVersion != SpecVersion {
+		return ce, fmt.Errorf("unsupported specversion %q", ce.SpecVersion)
+	}
+	if ce.ID == "" || ce.Source == "" || ce.Type == "" {
+		return ce, fmt.Errorf("missing required attributes")
+	}
+	return ce, nil
+}
+
+// UserData decodes the event data
+func (ce CloudEvent) UserData() (UserData, error) {
+	var d UserData
+	err := json.Unmarshal(ce.Data, &d)
+	return d, err
+}
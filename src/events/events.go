@@ -0,0 +1,192 @@
+package events
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/tracing"
+	"spymaster/types"
+)
+
+// Type identifies what happened to a user
+type Type string
+
+const (
+	// UserCreated is emitted after a user is inserted
+	UserCreated Type = "user.created"
+	// UserUpdated is emitted after a user is modified
+	UserUpdated Type = "user.updated"
+	// UserDeleted is emitted after a user is removed
+	UserDeleted Type = "user.deleted"
+	// UserLocked is emitted when a user is locked out after too many failed logins
+	UserLocked Type = "user.locked"
+)
+
+// Event holds a single user change notification
+// - Sequence is assigned when the event is recorded in the Journal and orders events globally
+type Event struct {
+	ID         string      `bson:"_id" json:"id"`
+	Sequence   int64       `bson:"sequence" json:"sequence,omitempty"`
+	Type       Type        `bson:"type" json:"type"`
+	UserID     string      `bson:"user_id" json:"user_id"`
+	User       *types.User `bson:"user,omitempty" json:"user,omitempty"`
+	OccurredAt time.Time   `bson:"occurred_at" json:"occurred_at"`
+	// Before is the user as it was prior to an update, when known
+	Before *types.User `bson:"before,omitempty" json:"before,omitempty"`
+	// ChangedFields lists the fields modified by an update, password included though never its value
+	ChangedFields []string `bson:"changed_fields,omitempty" json:"changed_fields,omitempty"`
+	// LockedUntil is when the lockout of a locked user ends
+	LockedUntil *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	// Outbox is set while a recorded event still has to be relayed to the publishers after the Journal
+	Outbox bool `bson:"outbox,omitempty" json:"-"`
+	// RequestID is the ID of the API request the event comes from, stamped by the Journal; out-of-band writes have none
+	RequestID string `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	// Carrier is the trace context of the write the event comes from, stamped by the Journal
+	tracing.Carrier `bson:",inline"`
+}
+
+// Publisher is implemented by anything able to forward events to interested parties
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Backend is a Publisher forwarding events to an external message broker
+type Backend interface {
+	Publisher
+	// Close flushes whatever is still pending and releases the connection
+	Close() error
+}
+
+// Pinger is implemented by backends able to tell whether their broker can be reached
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// NewID returns a new unique event ID
+func NewID() string {
+	return bson.NewObjectId().Hex()
+}
+
+// New builds an event for the given user; the password is never carried along
+func New(t Type, userID string, user *types.User) Event {
+	e := Event{
+		ID:         NewID(),
+		Type:       t,
+		UserID:     userID,
+		OccurredAt: time.Now().UTC(),
+	}
+	e.User = snapshot(user)
+	return e
+}
+
+// NewUpdate builds an update event carrying both snapshots of the user and what changed between them
+func NewUpdate(userID string, before, after *types.User) Event {
+	e := New(UserUpdated, userID, after)
+	e.Before = snapshot(before)
+	e.ChangedFields = ChangedFields(before, after)
+	return e
+}
+
+// snapshot copies a user without its password nor its second factor
+func snapshot(user *types.User) *types.User {
+	if user == nil {
+		return nil
+	}
+	u := *user
+	u.Password = ""
+	u.MFA = nil
+	return &u
+}
+
+// reported holds the user fields changed_fields may list, as enumerated by the user.updated schema; fields every
+// write changes, like updated_at, or which aren't part of the user as published, are left out
+var reported = map[string]bool{
+	"first_name": true, "last_name": true, "nickname": true, "password": true, "email": true, "country": true, "email_verified_at": true,
+}
+
+// Reported tells whether a user field, named as in the JSON and BSON documents, is listed in changed_fields
+func Reported(field string) bool {
+	return reported[field]
+}
+
+// ChangedFields returns the JSON names of the reported user fields which differ between before and after
+func ChangedFields(before, after *types.User) []string {
+	if before == nil || after == nil {
+		return nil
+	}
+	b, a := reflect.ValueOf(*before), reflect.ValueOf(*after)
+	var changed []string
+	for i := 0; i < b.NumField(); i++ {
+		name := strings.Split(b.Type().Field(i).Tag.Get("json"), ",")[0]
+		if !reported[name] {
+			continue
+		}
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Broker is an in-process publisher that fans events out to every subscriber
+type Broker struct {
+	mu     sync.RWMutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// NewBroker creates an empty Broker
+func NewBroker() *Broker {
+	return &Broker{subs: map[chan Event]struct{}{}}
+}
+
+// Publish sends the event to all subscribers
+// - slow subscribers with a full buffer miss the event instead of blocking the caller
+func (b *Broker) Publish(ctx context.Context, e Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a new subscriber and returns its channel together with a function to cancel it
+func (b *Broker) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close closes every subscriber channel, ending the streams fed by them; later subscriptions get a closed channel
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
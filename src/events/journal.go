@@ -0,0 +1,190 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"spymaster/src/metrics"
+	"spymaster/src/requestid"
+	"spymaster/src/tracing"
+)
+
+const relayBatch = 100
+
+// Query narrows down the events read back from a Store
+type Query struct {
+	// AfterSequence only returns events recorded after the given sequence
+	AfterSequence int64
+	// Types only returns events of the given types, all of them when empty
+	Types []Type
+	// UserID only returns events about the given user, all of them when empty
+	UserID string
+	Limit  int
+}
+
+// Matches reports whether e would be returned by the query, ignoring AfterSequence and Limit
+func (q Query) Matches(e Event) bool {
+	if q.UserID != "" && q.UserID != e.UserID {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists events in the order they are appended
+type Store interface {
+	AppendEvent(ctx context.Context, e Event) (Event, error)
+	ListEvents(ctx context.Context, q Query) ([]Event, error)
+	// ListOutbox returns, in sequence order, the events still to be relayed which occurred before the given time
+	ListOutbox(ctx context.Context, before time.Time, limit int) ([]Event, error)
+	// CountOutbox counts the events still to be relayed
+	CountOutbox(ctx context.Context) (int, error)
+	// OutboxBefore tells whether events of the user recorded before the given sequence are still to be relayed
+	OutboxBefore(ctx context.Context, userID string, sequence int64) (bool, error)
+	// MarkRelayed takes an event out of the outbox
+	MarkRelayed(ctx context.Context, id string) error
+	// DeleteEvents removes the relayed events which occurred before the given time, returning how many were
+	DeleteEvents(ctx context.Context, before time.Time) (int, error)
+}
+
+// Journal is a Publisher recording every event before handing it to the next publisher
+// - this lets consumers which were away catch up on what they missed
+// - events stay in the outbox until the next publisher took them, see Relay
+// - events are recorded once the write they are about is done, not along with it: a crash in between loses them
+type Journal struct {
+	store Store
+	next  Publisher
+	// inline is given every event as it's recorded, whatever happened to the earlier ones, see SetInline
+	inline Publisher
+	// ordered holds the events of a user back behind their outbox backlog, see SetOrdered
+	ordered bool
+}
+
+// NewJournal creates a Journal persisting events in store and forwarding them to next
+func NewJournal(store Store, next Publisher) *Journal {
+	return &Journal{store: store, next: next}
+}
+
+// SetInline sets the publisher given every event as soon as it's recorded, like the in-process broker: events are
+// never relayed to it, so it isn't held back by the outbox and its failures are only logged
+func (j *Journal) SetInline(p Publisher) {
+	j.inline = p
+}
+
+// SetOrdered holds the events of a user back in the outbox while earlier ones are still there, so next gets them in
+// order; it's only meant for when Relay runs, held back events would wait forever otherwise
+func (j *Journal) SetOrdered(ordered bool) {
+	j.ordered = ordered
+}
+
+// Publish records the event, assigning its sequence, and forwards it
+// - the event carries the request ID and the trace context of its span, so it can be followed past the publishers
+// - when ordered, an event of a user whose earlier events are still in the outbox is left there too, for Relay to
+// forward to next in order; the inline publisher gets it right away regardless
+func (j *Journal) Publish(ctx context.Context, e Event) (err error) {
+	ctx, span := tracing.Start(ctx, "events.Publish", attribute.String("event.id", e.ID), attribute.String("event.type", string(e.Type)))
+	defer func() { tracing.End(span, err) }()
+
+	e.Outbox = true
+	e.RequestID, e.Carrier = requestid.FromContext(ctx), tracing.Inject(ctx)
+	e, err = j.store.AppendEvent(ctx, e)
+	if err != nil {
+		return err
+	}
+	metrics.EventRecorded(string(e.Type))
+	if j.inline != nil {
+		if err := j.inline.Publish(ctx, e); err != nil {
+			slog.ErrorContext(ctx, "Failed publishing event inline", "event_id", e.ID, "event_type", e.Type, "error", err)
+		}
+	}
+	if j.next != nil {
+		if j.ordered {
+			behind, err := j.store.OutboxBefore(ctx, e.UserID, e.Sequence)
+			if err != nil || behind {
+				return err
+			}
+		}
+		start := time.Now()
+		err = j.next.Publish(ctx, e)
+		metrics.EventPublished(string(e.Type), time.Since(start), err)
+		if err != nil {
+			return err
+		}
+	}
+	return j.store.MarkRelayed(ctx, e.ID)
+}
+
+// Relay publishes the events left in the outbox for at least minAge, oldest first, returning how many were relayed
+// - it stops at the first failure so the events of a user are never relayed out of order
+// - publisher is only given what failed before or was held back, i.e. next rather than the inline publisher, and
+// can be nil to just drain the outbox
+func (j *Journal) Relay(ctx context.Context, publisher Publisher, minAge time.Duration) (relayed int, err error) {
+	defer func() { metrics.EventsRelayed(relayed) }()
+	for {
+		pending, err := j.store.ListOutbox(ctx, time.Now().Add(-minAge), relayBatch)
+		if err != nil {
+			return relayed, err
+		}
+		for _, e := range pending {
+			if publisher != nil {
+				if err := j.relay(ctx, publisher, e); err != nil {
+					return relayed, err
+				}
+			}
+			if err := j.store.MarkRelayed(ctx, e.ID); err != nil {
+				return relayed, err
+			}
+			relayed++
+		}
+		if len(pending) < relayBatch {
+			return relayed, nil
+		}
+	}
+}
+
+// relay publishes an event left in the outbox, traced as part of the write it comes from
+func (j *Journal) relay(ctx context.Context, publisher Publisher, e Event) (err error) {
+	ctx, span := tracing.Start(tracing.Extract(ctx, e.Carrier), "events.Relay", attribute.String("event.id", e.ID), attribute.String("event.type", string(e.Type)))
+	defer func() { tracing.End(span, err) }()
+	return publisher.Publish(ctx, e)
+}
+
+// OldestOutbox returns the event waiting the longest to be relayed, reporting false when the outbox is empty
+func (j *Journal) OldestOutbox(ctx context.Context) (Event, bool, error) {
+	pending, err := j.store.ListOutbox(ctx, time.Now(), 1)
+	if err != nil || len(pending) == 0 {
+		return Event{}, false, err
+	}
+	return pending[0], true, nil
+}
+
+// Backlog counts the events waiting to be relayed and tells when the oldest of them occurred
+func (j *Journal) Backlog(ctx context.Context) (int, time.Time, error) {
+	n, err := j.store.CountOutbox(ctx)
+	if err != nil || n == 0 {
+		return n, time.Time{}, err
+	}
+	oldest, _, err := j.OldestOutbox(ctx)
+	return n, oldest.OccurredAt, err
+}
+
+// Prune removes the relayed events which occurred before the given time, returning how many were removed
+// - consumers resuming from an older event will only get what's left
+func (j *Journal) Prune(ctx context.Context, before time.Time) (int, error) {
+	return j.store.DeleteEvents(ctx, before)
+}
+
+// Since returns the recorded events matching q
+func (j *Journal) Since(ctx context.Context, q Query) ([]Event, error) {
+	return j.store.ListEvents(ctx, q)
+}
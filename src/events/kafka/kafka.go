@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"spymaster/src/events"
+)
+
+// HeaderPrefix is prepended to the CloudEvents attributes sent as headers in binary mode
+const HeaderPrefix = "ce_"
+
+// Config holds the Kafka producer configuration
+type Config struct {
+	Brokers []string `envconfig:"brokers" default:"0.0.0.0:9092"`
+	Topic   string   `envconfig:"topic" default:"user-notifications"`
+	// Acks is one of none, leader or all
+	Acks string `envconfig:"acks" default:"all"`
+	// Compression is one of none, gzip, snappy, lz4 or zstd
+	Compression string `envconfig:"compression" default:"snappy"`
+	// BatchMaxBytes caps the size of a batch sent to a partition
+	BatchMaxBytes int32 `envconfig:"batch_max_bytes" default:"1048576"`
+	// Linger is how long to wait for more messages before sending a batch
+	Linger time.Duration `envconfig:"linger" default:"5ms"`
+	// DeliveryTimeout caps how long to wait for the brokers to acknowledge a message, retries included, at least 1s;
+	// the journal relays it later when it's not
+	DeliveryTimeout time.Duration `envconfig:"delivery_timeout" default:"5s"`
+	ClientID        string        `envconfig:"client_id" default:"spymaster"`
+	// Mode is the CloudEvents mode, binary (ce_ headers) or structured
+	Mode string `envconfig:"mode" default:"binary"`
+}
+
+// Publisher publishes user events to a Kafka topic
+// - messages are keyed by user ID, so all events of a user land in the same partition, in order
+type Publisher struct {
+	client  *kgo.Client
+	topic   string
+	mode    events.Mode
+	timeout time.Duration
+}
+
+// New creates a Publisher; no connection is made until the first event is published
+func New(conf Config) (*Publisher, error) {
+	mode, err := events.ParseMode(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(conf.Brokers...),
+		kgo.ClientID(conf.ClientID),
+		kgo.DefaultProduceTopic(conf.Topic),
+		kgo.ProducerBatchMaxBytes(conf.BatchMaxBytes),
+		kgo.ProducerLinger(conf.Linger),
+	}
+	if conf.DeliveryTimeout > 0 {
+		opts = append(opts, kgo.RecordDeliveryTimeout(conf.DeliveryTimeout))
+	}
+
+	switch conf.Acks {
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case "all", "":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	default:
+		return nil, fmt.Errorf("invalid acks %q - expected one of none, leader or all", conf.Acks)
+	}
+
+	switch conf.Compression {
+	case "none", "":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	case "gzip":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	case "snappy":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.SnappyCompression()))
+	case "lz4":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.Lz4Compression()))
+	case "zstd":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.ZstdCompression()))
+	default:
+		return nil, fmt.Errorf("invalid compression %q - expected one of none, gzip, snappy, lz4 or zstd", conf.Compression)
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{client: client, topic: conf.Topic, mode: mode, timeout: conf.DeliveryTimeout}, nil
+}
+
+// Publish sends the event as a CloudEvent and waits for the broker to acknowledge it as configured
+// - it gives up after DeliveryTimeout, so writes don't hang while the brokers are down
+func (p *Publisher) Publish(ctx context.Context, e events.Event) error {
+	msg, err := events.Encode(e, p.mode)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record := &kgo.Record{
+		Topic:   p.topic,
+		Key:     []byte(e.UserID),
+		Value:   msg.Body,
+		Headers: []kgo.RecordHeader{{Key: "content-type", Value: []byte(msg.ContentType)}},
+	}
+	for _, name := range sortedKeys(msg.Attributes) {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: HeaderPrefix + name, Value: []byte(msg.Attributes[name])})
+	}
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	return p.client.ProduceSync(ctx, record).FirstErr()
+}
+
+// Ping reports whether any of the brokers can be reached
+func (p *Publisher) Ping(ctx context.Context) error {
+	return p.client.Ping(ctx)
+}
+
+// Flush waits for every buffered message to be sent
+func (p *Publisher) Flush(ctx context.Context) error {
+	return p.client.Flush(ctx)
+}
+
+// Close flushes pending messages and closes the connections to the brokers
+func (p *Publisher) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := p.client.Flush(ctx)
+	p.client.Close()
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
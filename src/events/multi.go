@@ -0,0 +1,20 @@
+package events
+
+import (
+	"context"
+	"errors"
+)
+
+// Multi is a Publisher forwarding every event to all of its publishers
+type Multi []Publisher
+
+// Publish sends the event to every publisher, even if some of them fail
+func (m Multi) Publish(ctx context.Context, e Event) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Publish(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
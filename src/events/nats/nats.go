@@ -0,0 +1,130 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"spymaster/src/events"
+)
+
+// Config holds the NATS JetStream publisher configuration
+type Config struct {
+	URL string `envconfig:"url" default:"nats://0.0.0.0:4222"`
+	// Stream is created (or updated) on startup to capture every subject under SubjectPrefix
+	Stream string `envconfig:"stream" default:"SPYMASTER_USERS"`
+	// SubjectPrefix is prepended to the event type, e.g. spymaster.user.created
+	SubjectPrefix string `envconfig:"subject_prefix" default:"spymaster"`
+	// DuplicateWindow is how long JetStream remembers event IDs to drop redelivered ones
+	DuplicateWindow time.Duration `envconfig:"duplicate_window" default:"2m"`
+	// Mode is the CloudEvents mode, binary (ce- headers) or structured
+	Mode string `envconfig:"mode" default:"binary"`
+}
+
+// HeaderPrefix is prepended to the CloudEvents attributes sent as headers in binary mode
+const HeaderPrefix = "ce-"
+
+// ErrClosed is returned when publishing through a closed Publisher
+var ErrClosed = errors.New("nats publisher is closed")
+
+// Publisher publishes user events to a JetStream stream, waiting for each to be stored
+type Publisher struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	prefix string
+	mode   events.Mode
+
+	// mu serializes publishes so the events of a user are stored in order
+	mu     sync.Mutex
+	closed bool
+}
+
+// New creates a Publisher, connecting to the server and making sure the stream exists
+func New(conf Config) (*Publisher, error) {
+	mode, err := events.ParseMode(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := nats.Connect(conf.URL, nats.Name("spymaster"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       conf.Stream,
+		Subjects:   []string{conf.SubjectPrefix + ".user.>"},
+		Storage:    jetstream.FileStorage,
+		Duplicates: conf.DuplicateWindow,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set up NATS stream %q: %w", conf.Stream, err)
+	}
+	return &Publisher{conn: conn, js: js, prefix: conf.SubjectPrefix, mode: mode}, nil
+}
+
+// Subject returns the subject an event type is published on
+func (p *Publisher) Subject(t events.Type) string {
+	return p.prefix + "." + string(t)
+}
+
+// Publish stores the event in the stream as a CloudEvent, using its ID for deduplication
+func (p *Publisher) Publish(ctx context.Context, e events.Event) error {
+	m, err := events.Encode(e, p.mode)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(p.Subject(e.Type))
+	msg.Data = m.Body
+	msg.Header.Set("Content-Type", m.ContentType)
+	for name, value := range m.Attributes {
+		msg.Header.Set(HeaderPrefix+name, value)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	_, err = p.js.PublishMsg(ctx, msg, jetstream.WithMsgID(e.ID))
+	return err
+}
+
+// Ping reports whether JetStream can be reached
+func (p *Publisher) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	_, err := p.js.AccountInfo(ctx)
+	return err
+}
+
+// Close drains the connection; every published event is already stored
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	return p.conn.Drain()
+}
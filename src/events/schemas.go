@@ -0,0 +1,84 @@
+package events
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Schema is the JSON Schema of the data of one version of an event type
+type Schema struct {
+	// Type is the CloudEvents type without its version, e.g. com.spymaster.user.updated
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	// URI is the schema $id, sent as the dataschema attribute
+	URI      string          `json:"uri"`
+	Document json.RawMessage `json:"-"`
+}
+
+// schemas holds every known schema keyed by versioned CloudEvents type, loaded from schemas/<type>.v<version>.json
+var schemas = loadSchemas()
+
+func loadSchemas() map[string]Schema {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	loaded := map[string]Schema{}
+	for _, entry := range entries {
+		ceType := strings.TrimSuffix(entry.Name(), ".json")
+		t, version, err := ParseCloudEventType(ceType)
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %s", entry.Name(), err))
+		}
+		doc, err := schemaFiles.ReadFile("schemas/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		var header struct {
+			ID string `json:"$id"`
+		}
+		if err := json.Unmarshal(doc, &header); err != nil || header.ID != SchemaURI(ceType) {
+			panic(fmt.Sprintf("schema %s must have %s as $id", entry.Name(), SchemaURI(ceType)))
+		}
+		loaded[ceType] = Schema{Type: typePrefix + string(t), Version: version, URI: header.ID, Document: doc}
+	}
+	return loaded
+}
+
+// CloudEventType returns the versioned CloudEvents type the schema applies to
+func (s Schema) CloudEventType() string {
+	return s.Type + ".v" + strconv.Itoa(s.Version)
+}
+
+// SchemaURI returns the URI identifying the data schema of a versioned CloudEvents type
+func SchemaURI(ceType string) string {
+	return "urn:spymaster:schema:" + ceType
+}
+
+// Schemas lists every known schema, sorted by type and version
+func Schemas() []Schema {
+	list := make([]Schema, 0, len(schemas))
+	for _, s := range schemas {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].Version < list[j].Version
+	})
+	return list
+}
+
+// LookupSchema returns the schema of a versioned CloudEvents type, e.g. com.spymaster.user.updated.v1
+func LookupSchema(ceType string) (Schema, bool) {
+	s, ok := schemas[ceType]
+	return s, ok
+}
@@ -0,0 +1,123 @@
+package gql
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// Request is a GraphQL over HTTP request
+type Request struct {
+	Query         string                 `json:"query" form:"query" binding:"required"`
+	OperationName string                 `json:"operationName" form:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler serves GraphQL queries and mutations as JSON
+// - subscriptions are streamed as server-sent events, one `next` event per result
+func Handler(schema graphql.Schema, conf Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req Request
+		var err error
+		if c.Request.Method == http.MethodGet {
+			err = c.ShouldBindQuery(&req)
+			if err == nil && c.Query("variables") != "" {
+				err = json.Unmarshal([]byte(c.Query("variables")), &req.Variables)
+			}
+		} else {
+			err = c.ShouldBindJSON(&req)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResult(err))
+			return
+		}
+
+		doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResult(err))
+			return
+		}
+		if err := checkLimits(doc, req.Variables, conf); err != nil {
+			c.JSON(http.StatusBadRequest, errorResult(err))
+			return
+		}
+
+		params := graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        c.Request.Context(),
+		}
+
+		switch operation(doc, req.OperationName) {
+		case ast.OperationTypeSubscription:
+			subscribe(c, params)
+		case ast.OperationTypeMutation:
+			if c.Request.Method == http.MethodGet {
+				c.JSON(http.StatusMethodNotAllowed, errorResult(errMutationOverGet))
+				return
+			}
+			c.JSON(http.StatusOK, graphql.Do(params))
+		default:
+			c.JSON(http.StatusOK, graphql.Do(params))
+		}
+	}
+}
+
+var errMutationOverGet = gqlerrors.NewFormattedError("mutations must be sent with POST")
+
+// subscribe streams subscription results until the client goes away
+func subscribe(c *gin.Context, params graphql.Params) {
+	results := graphql.Subscribe(params)
+	defer func() {
+		// let the executor finish sending whatever it was producing
+		go func() {
+			for range results {
+			}
+		}()
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case res, ok := <-results:
+			if !ok {
+				c.SSEvent("complete", "")
+				return
+			}
+			c.SSEvent("next", res)
+			c.Writer.Flush()
+		}
+	}
+}
+
+// operation returns the type of the operation that will be executed
+func operation(doc *ast.Document, name string) string {
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" || op.Name != nil && op.Name.Value == name {
+			return op.Operation
+		}
+	}
+	return ast.OperationTypeQuery
+}
+
+func errorResult(err error) *graphql.Result {
+	return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+}
@@ -0,0 +1,152 @@
+package gql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// Config holds the GraphQL endpoint configuration
+type Config struct {
+	MaxDepth      int `envconfig:"max_depth" default:"8"`
+	MaxComplexity int `envconfig:"max_complexity" default:"1000"`
+}
+
+// hashingCost is what a mutation hashing a password costs, bcrypt making it far slower than reading a field; with the
+// default maximum complexity a request hashes at most 10 passwords
+const hashingCost = 100
+
+// checkLimits rejects documents nested deeper than maxDepth or estimated to cost more than maxComplexity
+// - every field costs one, hashingCost for mutations hashing a password, plus the cost of its selections multiplied
+// by its `first` argument if it has one
+func checkLimits(doc *ast.Document, variables map[string]interface{}, conf Config) error {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	w := walker{fragments: fragments, variables: variables}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		depth, complexity := w.selectionSet(op.SelectionSet, map[string]bool{})
+		if conf.MaxDepth > 0 && depth > conf.MaxDepth {
+			return fmt.Errorf("query depth %d exceeds the maximum of %d", depth, conf.MaxDepth)
+		}
+		if conf.MaxComplexity > 0 && complexity > conf.MaxComplexity {
+			return fmt.Errorf("query complexity %d exceeds the maximum of %d", complexity, conf.MaxComplexity)
+		}
+	}
+	return nil
+}
+
+type walker struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+}
+
+// selectionSet returns the depth and complexity of a selection set
+// - visiting tracks the fragments being expanded so cycles don't recurse forever
+func (w walker) selectionSet(set *ast.SelectionSet, visiting map[string]bool) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, sel := range set.Selections {
+		var d, c int
+		switch s := sel.(type) {
+		case *ast.Field:
+			childDepth, childComplexity := w.selectionSet(s.SelectionSet, visiting)
+			d = childDepth + 1
+			c = w.cost(s) + w.multiplier(s)*childComplexity
+		case *ast.InlineFragment:
+			d, c = w.selectionSet(s.SelectionSet, visiting)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			f, ok := w.fragments[name]
+			if !ok || visiting[name] {
+				continue
+			}
+			visiting[name] = true
+			d, c = w.selectionSet(f.SelectionSet, visiting)
+			delete(visiting, name)
+		}
+		if d > depth {
+			depth = d
+		}
+		complexity += c
+	}
+	return
+}
+
+// cost is what a field costs on its own: createUser always hashes a password, updateUser when its input sets one
+func (w walker) cost(f *ast.Field) int {
+	switch f.Name.Value {
+	case "createUser":
+		return hashingCost
+	case "updateUser":
+		if w.setsPassword(f) {
+			return hashingCost
+		}
+	}
+	return 1
+}
+
+// setsPassword tells whether the input argument of a field carries a password, inline or as a variable
+func (w walker) setsPassword(f *ast.Field) bool {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "input" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.ObjectValue:
+			for _, field := range v.Fields {
+				if field.Name.Value == "password" {
+					return true
+				}
+			}
+		case *ast.Variable:
+			input, _ := w.variables[v.Name.Value].(map[string]interface{})
+			_, ok := input["password"]
+			return ok
+		}
+	}
+	return false
+}
+
+// multiplier is the number of items a field may return, based on its `first` argument
+func (w walker) multiplier(f *ast.Field) int {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			// variables aren't coerced yet, those the resolver would turn down cost the default
+			switch n := w.variables[v.Name.Value].(type) {
+			case float64:
+				if n > 0 && n <= math.MaxInt32 {
+					return int(n)
+				}
+			case int:
+				if n > 0 {
+					return n
+				}
+			}
+		}
+		return defaultFirst
+	}
+	if f.Name.Value == "users" {
+		return defaultFirst
+	}
+	return 1
+}
@@ -0,0 +1,459 @@
+package gql
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+
+	"spymaster/src/events"
+	"spymaster/src/password"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+const (
+	defaultFirst = 100
+	eventsBuffer = 64
+)
+
+// exactFilterFields and partialFilterFields follow controllers.ListUsers: the keys are the GraphQL names
+var exactFilterFields = map[string]string{"id": "_id", "country": "country"}
+var partialFilterFields = map[string]string{"firstName": "first_name", "lastName": "last_name", "nickname": "nickname", "email": "email"}
+
+var userType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(types.User).ID.Hex(), nil }},
+		"firstName": &graphql.Field{Type: graphql.String, Resolve: userField(func(u types.User) interface{} { return u.FirstName })},
+		"lastName":  &graphql.Field{Type: graphql.String, Resolve: userField(func(u types.User) interface{} { return u.LastName })},
+		"nickname":  &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u types.User) interface{} { return u.Nickname })},
+		"email":     &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u types.User) interface{} { return u.Email })},
+		"country":   &graphql.Field{Type: graphql.String, Resolve: userField(func(u types.User) interface{} { return u.Country })},
+		"createdAt": &graphql.Field{Type: graphql.DateTime, Resolve: userField(func(u types.User) interface{} { return u.CreatedAt })},
+		"updatedAt": &graphql.Field{Type: graphql.DateTime, Resolve: userField(func(u types.User) interface{} { return u.UpdatedAt })},
+		"emailVerifiedAt": &graphql.Field{Type: graphql.DateTime, Resolve: userField(func(u types.User) interface{} {
+			if u.EmailVerifiedAt == nil {
+				return nil
+			}
+			return *u.EmailVerifiedAt
+		})},
+	},
+})
+
+var userEdgeType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserEdge",
+	Fields: graphql.Fields{
+		"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+	},
+})
+
+var pageInfoType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PageInfo",
+	Fields: graphql.Fields{
+		"hasNextPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		"hasPreviousPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		"startCursor":     &graphql.Field{Type: graphql.String},
+		"endCursor":       &graphql.Field{Type: graphql.String},
+	},
+})
+
+var userConnectionType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserConnection",
+	Fields: graphql.Fields{
+		"edges":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userEdgeType)))},
+		"pageInfo":   &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+var userFilterType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "UserFilter",
+	Description: "id and country are exact matches, the remaining fields are case insensitive partial matches",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"id":        &graphql.InputObjectFieldConfig{Type: graphql.ID},
+		"country":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"nickname":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var createUserInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "CreateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"nickname":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"password":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"country":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var updateUserInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "UpdateUserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"nickname":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"password":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"country":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var userEventTypeEnum = graphql.NewEnum(graphql.EnumConfig{
+	Name: "UserEventType",
+	Values: graphql.EnumValueConfigMap{
+		"CREATED": &graphql.EnumValueConfig{Value: events.UserCreated},
+		"UPDATED": &graphql.EnumValueConfig{Value: events.UserUpdated},
+		"DELETED": &graphql.EnumValueConfig{Value: events.UserDeleted},
+		"LOCKED":  &graphql.EnumValueConfig{Value: events.UserLocked},
+	},
+})
+
+var userEventType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserEvent",
+	Fields: graphql.Fields{
+		"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: eventField(func(e events.Event) interface{} { return e.ID })},
+		"type":       &graphql.Field{Type: graphql.NewNonNull(userEventTypeEnum), Resolve: eventField(func(e events.Event) interface{} { return e.Type })},
+		"userId":     &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: eventField(func(e events.Event) interface{} { return e.UserID })},
+		"occurredAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: eventField(func(e events.Event) interface{} { return e.OccurredAt })},
+		"user": &graphql.Field{Type: userType, Resolve: eventField(func(e events.Event) interface{} {
+			if e.User == nil {
+				return nil
+			}
+			return *e.User
+		})},
+		"lockedUntil": &graphql.Field{Type: graphql.DateTime, Resolve: eventField(func(e events.Event) interface{} {
+			if e.LockedUntil == nil {
+				return nil
+			}
+			return *e.LockedUntil
+		})},
+	},
+})
+
+// NewSchema builds the GraphQL schema on top of the spymaster Service
+// - subscriptions are fed by broker
+// - every field on users is authorized by auth, like its REST counterpart, for the principal of the request context;
+// auth may be nil when login is disabled
+func NewSchema(svc *spymaster.Service, broker *events.Broker, auth *spymaster.Authenticator) (graphql.Schema, error) {
+	r := resolver{service: svc, broker: broker, auth: auth}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(userConnectionType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: userFilterType},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultFirst},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: r.users,
+			},
+			"user": &graphql.Field{
+				Type:    userType,
+				Args:    graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: r.user,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type:    graphql.NewNonNull(userType),
+				Args:    graphql.FieldConfigArgument{"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createUserInputType)}},
+				Resolve: r.createUser,
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateUserInputType)},
+				},
+				Resolve: r.updateUser,
+			},
+			"deleteUser": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.Boolean),
+				Args:    graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: r.deleteUser,
+			},
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"userChanged": &graphql.Field{
+				Type: graphql.NewNonNull(userEventType),
+				Args: graphql.FieldConfigArgument{
+					"types":  &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(userEventTypeEnum))},
+					"userId": &graphql.ArgumentConfig{Type: graphql.ID},
+				},
+				Subscribe: r.userChanged,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:        query,
+		Mutation:     mutation,
+		Subscription: subscription,
+	})
+}
+
+type resolver struct {
+	service *spymaster.Service
+	broker  *events.Broker
+	auth    *spymaster.Authenticator
+}
+
+// authorize checks the principal of the request may act with scope, on the user given by the id argument if any
+func (r resolver) authorize(p graphql.ResolveParams, scope string) error {
+	id, _ := p.Args["id"].(string)
+	switch r.auth.AuthorizeUser(p.Context, scope, id) {
+	case spymaster.ErrUnauthenticated:
+		return fmt.Errorf("authentication required")
+	case spymaster.ErrForbidden:
+		return fmt.Errorf("insufficient scope, %s needed", scope)
+	}
+	return nil
+}
+
+func (r resolver) users(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	first, _ := p.Args["first"].(int)
+	if first <= 0 {
+		return nil, fmt.Errorf("first must be greater than zero")
+	}
+	if maxPerPage := r.service.MaxPerPage(); first > maxPerPage {
+		return nil, fmt.Errorf("first must be at most %d", maxPerPage)
+	}
+	offset := 0
+	if after, ok := p.Args["after"].(string); ok && after != "" {
+		n, err := decodeCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		offset = n + 1
+	}
+
+	exact := map[string]interface{}{}
+	partial := map[string]string{}
+	if filter, ok := p.Args["filter"].(map[string]interface{}); ok {
+		for name, value := range filter {
+			if field, found := exactFilterFields[name]; found {
+				exact[field] = value
+			} else if field, found := partialFilterFields[name]; found {
+				partial[field] = value.(string)
+			}
+		}
+	}
+
+	// cursors are offsets
+	result, err := r.service.ListUsersFrom(p.Context, exact, partial, offset, first)
+	if err == spymaster.ErrInvalidPage {
+		return nil, fmt.Errorf("after is out of range")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server error")
+	}
+	users := result.Users
+
+	edges := []map[string]interface{}{}
+	for i, u := range users {
+		edges = append(edges, map[string]interface{}{"cursor": encodeCursor(offset + i), "node": u})
+	}
+	pageInfo := map[string]interface{}{
+		"hasNextPage":     offset+len(users) < result.TotalCount,
+		"hasPreviousPage": offset > 0,
+	}
+	if len(edges) > 0 {
+		pageInfo["startCursor"] = edges[0]["cursor"]
+		pageInfo["endCursor"] = edges[len(edges)-1]["cursor"]
+	}
+
+	return map[string]interface{}{
+		"edges":      edges,
+		"pageInfo":   pageInfo,
+		"totalCount": result.TotalCount,
+	}, nil
+}
+
+func (r resolver) user(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	user, err := r.service.GetUser(p.Context, p.Args["id"].(string))
+	if err == spymaster.ErrNotFound || err == spymaster.ErrInvalidID {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server error")
+	}
+	return user, nil
+}
+
+func (r resolver) createUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	input := p.Args["input"].(map[string]interface{})
+	payload := &types.UserPost{
+		FirstName: optionalString(input, "firstName"),
+		LastName:  optionalString(input, "lastName"),
+		Nickname:  input["nickname"].(string),
+		Password:  input["password"].(string),
+		Email:     input["email"].(string),
+		Country:   optionalString(input, "country"),
+	}
+	user, err := r.service.CreateUser(p.Context, payload)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return user, nil
+}
+
+func (r resolver) updateUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersWrite); err != nil {
+		return nil, err
+	}
+	input := p.Args["input"].(map[string]interface{})
+	payload := &types.UserPatch{
+		FirstName: optionalString(input, "firstName"),
+		LastName:  optionalString(input, "lastName"),
+		Nickname:  optionalString(input, "nickname"),
+		Password:  optionalString(input, "password"),
+		Email:     optionalString(input, "email"),
+		Country:   optionalString(input, "country"),
+	}
+	if *payload == (types.UserPatch{}) {
+		return nil, fmt.Errorf("at least one field must be updated")
+	}
+	user, err := r.service.UpdateUser(p.Context, p.Args["id"].(string), payload)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return user, nil
+}
+
+func (r resolver) deleteUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersDelete); err != nil {
+		return nil, err
+	}
+	err := r.service.DeleteUser(p.Context, p.Args["id"].(string))
+	if err == spymaster.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return true, nil
+}
+
+// userChanged forwards the matching broker events until the subscription context is done
+func (r resolver) userChanged(p graphql.ResolveParams) (interface{}, error) {
+	if err := r.authorize(p, types.ScopeUsersRead); err != nil {
+		return nil, err
+	}
+	wanted := map[events.Type]bool{}
+	if list, ok := p.Args["types"].([]interface{}); ok {
+		for _, t := range list {
+			wanted[t.(events.Type)] = true
+		}
+	}
+	userID, _ := p.Args["userId"].(string)
+
+	in, cancel := r.broker.Subscribe(eventsBuffer)
+	out := make(chan interface{})
+	go func() {
+		defer close(out)
+		defer cancel()
+		for {
+			select {
+			case <-p.Context.Done():
+				return
+			case e, ok := <-in:
+				if !ok {
+					return
+				}
+				if len(wanted) > 0 && !wanted[e.Type] || userID != "" && userID != e.UserID {
+					continue
+				}
+				select {
+				case out <- e:
+				case <-p.Context.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Utils
+
+func userField(f func(types.User) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return f(p.Source.(types.User)), nil
+	}
+}
+
+func eventField(f func(events.Event) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return f(p.Source.(events.Event)), nil
+	}
+}
+
+func optionalString(input map[string]interface{}, key string) *string {
+	if v, ok := input[key].(string); ok {
+		return &v
+	}
+	return nil
+}
+
+func serviceError(err error) error {
+	var refused *password.Error
+	if errors.As(err, &refused) {
+		return refused
+	}
+	switch err {
+	case spymaster.ErrDup:
+		return fmt.Errorf("user/email already exists")
+	case spymaster.ErrNotFound, spymaster.ErrInvalidID:
+		return fmt.Errorf("user not found")
+	}
+	return fmt.Errorf("server error")
+}
+
+const cursorPrefix = "offset:"
+
+func encodeCursor(offset int) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(b), cursorPrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(string(b), cursorPrefix))
+		if err == nil && n >= 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid cursor %q", cursor)
+}
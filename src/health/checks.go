@@ -0,0 +1,266 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spymaster/src/events"
+	"spymaster/src/mongo"
+)
+
+// Config holds the health check configuration
+type Config struct {
+	// Timeout caps how long a check may take, unless the check sets its own
+	Timeout time.Duration `envconfig:"timeout" default:"2s"`
+	// CacheTTL is how long a check result is reused before running the check again, unless the check sets its own
+	CacheTTL time.Duration `envconfig:"cache_ttl" default:"5s"`
+	// OutboxLag is how long an event may wait in the outbox before readiness is degraded
+	OutboxLag time.Duration `envconfig:"outbox_lag" default:"5m"`
+}
+
+// Status is the health of a check or of the whole service, as in the health check response format draft
+// (https://datatracker.ietf.org/doc/html/draft-inadarei-api-health-check)
+type Status string
+
+const (
+	// Pass is healthy
+	Pass Status = "pass"
+	// Warn is healthy with some concerns, e.g. a non-critical dependency failing
+	Warn Status = "warn"
+	// Fail is unhealthy
+	Fail Status = "fail"
+)
+
+// ContentType is the media type of health reports
+const ContentType = "application/health+json"
+
+// Result is the outcome of a check
+type Result struct {
+	ComponentType string      `json:"componentType,omitempty"`
+	ObservedValue interface{} `json:"observedValue,omitempty"`
+	ObservedUnit  string      `json:"observedUnit,omitempty"`
+	Status        Status      `json:"status"`
+	Time          time.Time   `json:"time"`
+	Output        string      `json:"output,omitempty"`
+}
+
+// Report is the health of the service with the results of its checks, keyed by check name
+type Report struct {
+	Status      Status              `json:"status"`
+	Description string              `json:"description,omitempty"`
+	Output      string              `json:"output,omitempty"`
+	Checks      map[string][]Result `json:"checks,omitempty"`
+}
+
+// Check is a named probe of a dependency
+type Check struct {
+	// Name is the component and the measurement, e.g. mongo:responseTime
+	Name string
+	// ComponentType is datastore, component or system
+	ComponentType string
+	// Critical checks failing make the service unready, other failures only degrade it
+	Critical bool
+	// Timeout and TTL override Config.Timeout and Config.CacheTTL when set
+	Timeout time.Duration
+	TTL     time.Duration
+	Run     func(ctx context.Context) Result
+}
+
+type entry struct {
+	Check
+	mu      sync.Mutex
+	result  Result
+	expires time.Time
+}
+
+// Registry runs the registered checks, caching their results
+type Registry struct {
+	conf    Config
+	started time.Time
+
+	mu     sync.RWMutex
+	checks []*entry
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry(conf Config) *Registry {
+	return &Registry{conf: conf, started: time.Now()}
+}
+
+// Register adds a check
+func (r *Registry) Register(check Check) {
+	if check.Timeout == 0 {
+		check.Timeout = r.conf.Timeout
+	}
+	if check.TTL == 0 {
+		check.TTL = r.conf.CacheTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, &entry{Check: check})
+}
+
+// Liveness reports the process is up; dependencies are left out so their failures don't get it restarted
+func (r *Registry) Liveness() Report {
+	report := Report{Status: Pass, Description: "spymaster"}
+	if r != nil {
+		report.Checks = map[string][]Result{"uptime": {{
+			ComponentType: "system",
+			ObservedValue: int64(time.Since(r.started).Seconds()),
+			ObservedUnit:  "s",
+			Status:        Pass,
+			Time:          time.Now().UTC(),
+		}}}
+	}
+	return report
+}
+
+// Readiness runs every check concurrently; a nil Registry has none and always passes
+// - the service fails if a critical check fails, and is degraded (warn) if any other check fails or warns
+func (r *Registry) Readiness(ctx context.Context) Report {
+	report := Report{Status: Pass, Description: "spymaster", Checks: map[string][]Result{}}
+	if r == nil {
+		return report
+	}
+	r.mu.RLock()
+	checks := append([]*entry(nil), r.checks...)
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, e := range checks {
+		wg.Add(1)
+		go func(i int, e *entry) {
+			defer wg.Done()
+			results[i] = e.get(ctx)
+		}(i, e)
+	}
+	wg.Wait()
+
+	var failing []string
+	for i, e := range checks {
+		res := results[i]
+		report.Checks[e.Name] = append(report.Checks[e.Name], res)
+		switch {
+		case res.Status == Fail && e.Critical:
+			report.Status = Fail
+		case res.Status != Pass && report.Status == Pass:
+			report.Status = Warn
+		}
+		if res.Status != Pass {
+			failing = append(failing, e.Name)
+		}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		report.Output = fmt.Sprintf("%s: %s", map[Status]string{Warn: "degraded", Fail: "unavailable"}[report.Status], strings.Join(failing, ", "))
+	}
+	return report
+}
+
+// get returns the cached result, running the check again once it expired
+func (e *entry) get(ctx context.Context) Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Now().Before(e.expires) {
+		return e.result
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+	done := make(chan Result, 1)
+	go func() { done <- e.Run(checkCtx) }()
+
+	var res Result
+	select {
+	case res = <-done:
+	case <-checkCtx.Done():
+		res = Result{Status: Fail, Output: fmt.Sprintf("timed out after %s", e.Timeout)}
+	}
+	res.ComponentType, res.Time = e.ComponentType, time.Now().UTC()
+	// a request given up on says nothing about the dependency
+	if ctx.Err() == nil {
+		e.result, e.expires = res, time.Now().Add(e.TTL)
+	}
+	return res
+}
+
+// Ping creates a check reporting how long ping takes to answer, in milliseconds
+func Ping(name, componentType string, critical bool, ping func(ctx context.Context) error) Check {
+	return Check{
+		Name:          name,
+		ComponentType: componentType,
+		Critical:      critical,
+		Run: func(ctx context.Context) Result {
+			start := time.Now()
+			if err := ping(ctx); err != nil {
+				return failed(ctx, name, err)
+			}
+			return Result{Status: Pass, ObservedValue: time.Since(start).Milliseconds(), ObservedUnit: "ms"}
+		},
+	}
+}
+
+// failed logs why a check failed, and reports it without the detail as reports are served to anyone
+func failed(ctx context.Context, name string, err error) Result {
+	slog.WarnContext(ctx, "Health check failed", "check", name, "error", err)
+	return Result{Status: Fail, Output: "check failed"}
+}
+
+// Mongo creates the checks of the database: the critical ping, and the non-critical presence of the indexes
+func Mongo(mc *mongo.Client) []Check {
+	return []Check{
+		Ping("mongo:responseTime", "datastore", true, mc.Ping),
+		{
+			Name:          "mongo:indexes",
+			ComponentType: "datastore",
+			TTL:           time.Minute,
+			Run: func(ctx context.Context) Result {
+				missing, err := mc.MissingIndexes()
+				if err != nil {
+					return failed(ctx, "mongo:indexes", err)
+				}
+				if len(missing) > 0 {
+					slog.WarnContext(ctx, "Indexes missing", "indexes", strings.Join(missing, "; "))
+					return Result{Status: Fail, ObservedValue: len(missing), Output: "missing indexes"}
+				}
+				return Result{Status: Pass, ObservedValue: 0}
+			},
+		},
+	}
+}
+
+// Broker creates the non-critical check of the message broker; events which can't be published are relayed later
+func Broker(p events.Pinger) Check {
+	return Ping("broker:connected", "component", false, p.Ping)
+}
+
+// OutboxLag creates the non-critical check of how long, in seconds, the oldest event waiting in the outbox has been
+// - it warns past max, the broker or the relay being behind
+func OutboxLag(journal *events.Journal, max time.Duration) Check {
+	return Check{
+		Name:          "outbox:lag",
+		ComponentType: "component",
+		Run: func(ctx context.Context) Result {
+			oldest, ok, err := journal.OldestOutbox(ctx)
+			if err != nil {
+				return failed(ctx, "outbox:lag", err)
+			}
+			var lag time.Duration
+			if ok {
+				lag = time.Since(oldest.OccurredAt)
+			}
+			res := Result{Status: Pass, ObservedValue: int64(lag.Seconds()), ObservedUnit: "s"}
+			if lag > max {
+				slog.WarnContext(ctx, "Events waiting in the outbox", "event_id", oldest.ID, "lag", lag)
+				res.Status, res.Output = Warn, fmt.Sprintf("events waiting for more than %s", max)
+			}
+			return res
+		},
+	}
+}
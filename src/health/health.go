@@ -0,0 +1,21 @@
+package health
+
+import (
+	"sync/atomic"
+)
+
+// Readiness tells whether the instance should be sent traffic
+// - it's flipped once shutting down, so load balancers stop routing to the instance before it stops serving
+type Readiness struct {
+	draining atomic.Bool
+}
+
+// Drain marks the instance as no longer ready
+func (r *Readiness) Drain() {
+	r.draining.Store(true)
+}
+
+// Draining reports whether the instance is shutting down; a nil Readiness never is
+func (r *Readiness) Draining() bool {
+	return r != nil && r.draining.Load()
+}
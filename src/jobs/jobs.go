@@ -0,0 +1,319 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/robfig/cron/v3"
+)
+
+// Config holds the background job scheduler configuration
+type Config struct {
+	Enabled bool `envconfig:"enabled" default:"true"`
+	// LeaseTTL is how long leadership lasts without being renewed; it's renewed every third of it
+	LeaseTTL time.Duration `envconfig:"lease_ttl" default:"15s"`
+	// Timeout caps how long a job may run, and how long its lock is held if the instance running it dies
+	Timeout time.Duration `envconfig:"timeout" default:"5m"`
+
+	// OutboxRelay is the schedule of the outbox relay, in cron syntax (descriptors like @every 30s included)
+	OutboxRelay string `envconfig:"outbox_relay" default:"@every 30s"`
+	// RelayDelay is how old an event must be before the relay considers its inline publish failed
+	RelayDelay time.Duration `envconfig:"relay_delay" default:"1m"`
+	// Retention is the schedule of the event log retention job
+	Retention string `envconfig:"retention" default:"@daily"`
+	// EventRetention is how long events are kept in the event log
+	EventRetention time.Duration `envconfig:"event_retention" default:"720h"`
+}
+
+// Validate checks the schedules and durations
+func (conf Config) Validate() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.LeaseTTL <= 0 || conf.Timeout <= 0 {
+		return errors.New("lease_ttl and timeout must be positive")
+	}
+	for _, spec := range []string{conf.OutboxRelay, conf.Retention} {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+// Func is the work done by a job, returning a short summary of what it did
+type Func func(ctx context.Context) (string, error)
+
+// RunStatus is the outcome of a job run
+type RunStatus string
+
+const (
+	// Running jobs haven't finished yet, or their instance died while running them
+	Running RunStatus = "running"
+	// Succeeded jobs carry the summary of what they did
+	Succeeded RunStatus = "succeeded"
+	// Failed jobs carry their error
+	Failed RunStatus = "failed"
+)
+
+// Run records a single execution of a job
+type Run struct {
+	ID          string     `bson:"_id" json:"id"`
+	Job         string     `bson:"job" json:"job"`
+	Instance    string     `bson:"instance" json:"instance"`
+	Status      RunStatus  `bson:"status" json:"status"`
+	Summary     string     `bson:"summary,omitempty" json:"summary,omitempty"`
+	Error       string     `bson:"error,omitempty" json:"error,omitempty"`
+	ScheduledAt time.Time  `bson:"scheduled_at" json:"scheduled_at"`
+	StartedAt   time.Time  `bson:"started_at" json:"started_at"`
+	FinishedAt  *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// Lease is a named lock held by an instance until it expires
+// - Tick, when set, must increase with every acquisition, so a scheduled run is only ever started once
+type Lease struct {
+	Name      string    `bson:"_id" json:"name"`
+	Holder    string    `bson:"holder" json:"holder"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+	Tick      time.Time `bson:"tick,omitempty" json:"tick,omitempty"`
+}
+
+// Store persists leases and job runs
+type Store interface {
+	// AcquireLease takes or renews the lease, reporting false when another holder has it (or the tick already ran)
+	AcquireLease(ctx context.Context, lease Lease) (bool, error)
+	// ReleaseLease expires the lease if still held by holder
+	ReleaseLease(ctx context.Context, name, holder string) error
+	GetLease(ctx context.Context, name string) (Lease, error)
+	SaveJobRun(ctx context.Context, run Run) error
+	// ListJobRuns returns the latest runs of a job, most recent first
+	ListJobRuns(ctx context.Context, job string, limit int) ([]Run, error)
+	IsNotFound(err error) bool
+}
+
+const leaderLease = "scheduler.leader"
+
+type job struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	fn       Func
+}
+
+// Scheduler runs the registered jobs on their schedule, on a single instance at a time
+// - every instance competes for the leader lease; only the leader starts jobs
+// - each run also takes a per job lock for the scheduled time, so a leadership change can't run it twice
+type Scheduler struct {
+	store    Store
+	conf     Config
+	instance string
+	leader   atomic.Bool
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// NewScheduler creates a Scheduler identified by the host name and a random suffix
+func NewScheduler(store Store, conf Config) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		store:    store,
+		conf:     conf,
+		instance: fmt.Sprintf("%s-%s", host, bson.NewObjectId().Hex()[18:]),
+		jobs:     map[string]*job{},
+	}
+}
+
+// Register adds a job run on the given cron schedule
+func (s *Scheduler) Register(name, spec string, fn Func) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for job %s: %w", spec, name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[name] = &job{name: name, spec: spec, schedule: schedule, fn: fn}
+	return nil
+}
+
+// Instance returns the name this instance holds leases with
+func (s *Scheduler) Instance() string {
+	return s.instance
+}
+
+// IsLeader reports whether this instance currently starts the jobs
+func (s *Scheduler) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// Run competes for leadership and runs the jobs until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			s.schedule(ctx, j)
+		}(j)
+	}
+	s.mu.Unlock()
+
+	s.elect(ctx)
+	wg.Wait()
+}
+
+// elect keeps trying to take or renew the leader lease, releasing it once ctx is done
+func (s *Scheduler) elect(ctx context.Context) {
+	ticker := time.NewTicker(s.conf.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		acquired, err := s.store.AcquireLease(ctx, Lease{Name: leaderLease, Holder: s.instance, ExpiresAt: time.Now().Add(s.conf.LeaseTTL)})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed acquiring the jobs leader lease", "instance", s.instance, "error", err)
+		}
+		if acquired != s.leader.Swap(acquired) {
+			slog.InfoContext(ctx, "Jobs leadership changed", "instance", s.instance, "leader", acquired)
+		}
+
+		select {
+		case <-ctx.Done():
+			if s.leader.Swap(false) {
+				// let another instance take over right away instead of waiting for the lease to expire
+				release, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				s.store.ReleaseLease(release, leaderLease, s.instance)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// schedule waits for each scheduled time of the job, running it when this instance leads
+func (s *Scheduler) schedule(ctx context.Context, j *job) {
+	for {
+		next := j.schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if s.IsLeader() {
+			s.run(ctx, j, next)
+		}
+	}
+}
+
+// run executes a job once for the scheduled time, unless another instance already did
+func (s *Scheduler) run(ctx context.Context, j *job, scheduled time.Time) {
+	lock := "job." + j.name
+	acquired, err := s.store.AcquireLease(ctx, Lease{Name: lock, Holder: s.instance, ExpiresAt: time.Now().Add(s.conf.Timeout), Tick: scheduled})
+	if err != nil || !acquired {
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed locking job", "job", j.name, "error", err)
+		}
+		return
+	}
+	defer s.store.ReleaseLease(context.Background(), lock, s.instance)
+
+	run := Run{
+		ID:          bson.NewObjectId().Hex(),
+		Job:         j.name,
+		Instance:    s.instance,
+		Status:      Running,
+		ScheduledAt: scheduled.UTC(),
+		StartedAt:   time.Now().UTC(),
+	}
+	s.save(run)
+
+	jobCtx, cancel := context.WithTimeout(ctx, s.conf.Timeout)
+	summary, err := j.fn(jobCtx)
+	cancel()
+
+	finished := time.Now().UTC()
+	run.FinishedAt, run.Summary, run.Status = &finished, summary, Succeeded
+	if err != nil {
+		run.Status, run.Error = Failed, err.Error()
+		slog.ErrorContext(ctx, "Job failed", "job", j.name, "run_id", run.ID, "error", err)
+	}
+	s.save(run)
+}
+
+func (s *Scheduler) save(run Run) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.store.SaveJobRun(ctx, run); err != nil {
+		slog.ErrorContext(ctx, "Failed recording job run", "job", run.Job, "run_id", run.ID, "error", err)
+	}
+}
+
+// JobInfo describes a registered job
+type JobInfo struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	LastRun  *Run      `json:"last_run,omitempty"`
+}
+
+// Jobs describes the registered jobs, sorted by name, with their last run
+func (s *Scheduler) Jobs(ctx context.Context) ([]JobInfo, error) {
+	s.mu.Lock()
+	list := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		list = append(list, j)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].name < list[k].name })
+
+	infos := make([]JobInfo, 0, len(list))
+	for _, j := range list {
+		info := JobInfo{Name: j.name, Schedule: j.spec, NextRun: j.schedule.Next(time.Now()).UTC()}
+		runs, err := s.store.ListJobRuns(ctx, j.name, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) > 0 {
+			info.LastRun = &runs[0]
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Runs returns the latest runs of a registered job, reporting false for unknown jobs
+func (s *Scheduler) Runs(ctx context.Context, name string, limit int) ([]Run, bool, error) {
+	s.mu.Lock()
+	_, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	runs, err := s.store.ListJobRuns(ctx, name, limit)
+	return runs, true, err
+}
+
+// Leader returns the lease of the current leader, which may be held by another instance
+func (s *Scheduler) Leader(ctx context.Context) (*Lease, error) {
+	lease, err := s.store.GetLease(ctx, leaderLease)
+	if err != nil {
+		if s.store.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if time.Now().After(lease.ExpiresAt) {
+		return nil, nil
+	}
+	return &lease, nil
+}
@@ -0,0 +1,318 @@
+package lockout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Kind is what failed logins are counted against
+type Kind string
+
+const (
+	// Account counts the failed logins made with a nickname or email, whether or not a user has it
+	Account Kind = "account"
+	// IP counts the failed logins coming from a client IP, whatever account they were made with
+	IP Kind = "ip"
+)
+
+// ErrNotFound indicates that there's no record with the given ID
+var ErrNotFound = errors.New("lockout not found")
+
+// Config holds the lockout configuration
+type Config struct {
+	Enabled bool `envconfig:"enabled" default:"true"`
+	// AccountAttempts and IPAttempts are how many failed logins an account or an IP may make within Window before
+	// being locked out; an IP makes attempts on behalf of many accounts, so it's allowed more
+	AccountAttempts int           `envconfig:"account_attempts" default:"5"`
+	IPAttempts      int           `envconfig:"ip_attempts" default:"20"`
+	Window          time.Duration `envconfig:"window" default:"15m"`
+	// Duration is how long a first lockout lasts; each following one lasts twice as long, up to MaxDuration
+	Duration    time.Duration `envconfig:"duration" default:"5m"`
+	MaxDuration time.Duration `envconfig:"max_duration" default:"24h"`
+	// Delay is how long to wait before trying again after a failed login; it doubles with every failure within Window,
+	// up to MaxDelay
+	Delay    time.Duration `envconfig:"delay" default:"1s"`
+	MaxDelay time.Duration `envconfig:"max_delay" default:"30s"`
+}
+
+// Validate checks the thresholds and durations make sense
+func (conf Config) Validate() error {
+	if !conf.Enabled {
+		return nil
+	}
+	switch {
+	case conf.AccountAttempts < 1 || conf.IPAttempts < 1:
+		return errors.New("account_attempts and ip_attempts must be at least 1")
+	case conf.Window <= 0 || conf.Duration <= 0:
+		return errors.New("window and duration must be positive")
+	case conf.MaxDuration < conf.Duration:
+		return errors.New("max_duration can't be shorter than duration")
+	case conf.Delay < 0 || conf.MaxDelay < conf.Delay:
+		return errors.New("delay can't be negative nor longer than max_delay")
+	}
+	return nil
+}
+
+// Record holds the recent failed logins of an account or an IP, and whether it's locked out
+type Record struct {
+	// ID is derived from the kind and the key, so it can be put in URLs whatever the key holds
+	ID   string `bson:"_id" json:"id"`
+	Kind Kind   `bson:"kind" json:"kind"`
+	// Key is the nickname or email logged in with, lower cased, or the IP
+	Key string `bson:"key" json:"key"`
+	// Failures are the times of the latest failed logins, oldest first, since the last lockout
+	Failures []time.Time `bson:"failures" json:"failures"`
+	// Lockouts counts the lockouts so far, each one lasting twice as long as the previous one
+	Lockouts    int        `bson:"lockouts" json:"lockouts"`
+	LockedUntil *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	// ExpiresAt is when the record is forgotten, once its failures are out of the window and its lockout is over
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Locked tells whether the record is locked out at t
+func (r Record) Locked(t time.Time) bool {
+	return r.LockedUntil != nil && r.LockedUntil.After(t)
+}
+
+// Store keeps the records
+type Store interface {
+	// GetLockouts fetches the records with the given IDs, those missing are left out
+	GetLockouts(ctx context.Context, ids ...string) ([]Record, error)
+	// RecordFailure appends a failure at t to the record, keeping the latest keep of them, and creates it if needed
+	RecordFailure(ctx context.Context, r Record, t time.Time, keep int) (Record, error)
+	// ForgetFailure removes the failures at t from the record, if any
+	ForgetFailure(ctx context.Context, id string, t time.Time) error
+	// LockOut locks the record out until, unless it already is at t, telling whether it did
+	// - its failures are cleared and its lockouts counted
+	LockOut(ctx context.Context, id string, t, until, expiresAt time.Time) (bool, error)
+	ListLockouts(ctx context.Context) ([]Record, error)
+	DeleteLockout(ctx context.Context, id string) error
+
+	IsNotFound(err error) bool
+}
+
+// Clock tells the Tracker what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+// Tracker counts failed logins and locks out the accounts and IPs making too many of them
+// - a nil Tracker tracks nothing and never locks anyone out
+type Tracker struct {
+	store Store
+	conf  Config
+	clock Clock
+}
+
+// NewTracker creates a Tracker keeping its records in store
+func NewTracker(store Store, conf Config, clock Clock) *Tracker {
+	return &Tracker{store: store, conf: conf, clock: clock}
+}
+
+// ID returns the ID of the record of an account or an IP
+func ID(kind Kind, key string) string {
+	sum := sha256.Sum256([]byte(string(kind) + ":" + normalize(kind, key)))
+	return hex.EncodeToString(sum[:12])
+}
+
+// normalize lower cases accounts, so changing the case of a nickname or an email doesn't buy attempts
+func normalize(kind Kind, key string) string {
+	if kind == Account {
+		return strings.ToLower(strings.TrimSpace(key))
+	}
+	return key
+}
+
+// Attempt is a login attempt started with Begin, counted as a failure until it's known to be right
+type Attempt struct {
+	Account string
+	IP      string
+	At      time.Time
+}
+
+// Begin counts a login attempt with account from ip as a failure before it's checked, telling how long it has to wait
+// when it can't be made now
+// - the attempt is recorded first and only then compared with those before it, so concurrent attempts see each other
+// and can't all skip the delay
+// - an attempt is ended by Fail when wrong or when it has to wait, piling those up locks the account or the IP out,
+// and by Release when right
+func (t *Tracker) Begin(ctx context.Context, account, ip string) (Attempt, time.Duration, error) {
+	attempt := Attempt{Account: account, IP: ip}
+	if t == nil {
+		return attempt, 0, nil
+	}
+	// MongoDB keeps times to the millisecond, the attempt has to be found again as recorded
+	attempt.At = t.clock.Now().Truncate(time.Millisecond)
+	var wait time.Duration
+	for _, r := range attempt.counted() {
+		record := Record{ID: ID(r.kind, r.key), Kind: r.kind, Key: normalize(r.kind, r.key), ExpiresAt: attempt.At.Add(t.conf.Window)}
+		record, err := t.store.RecordFailure(ctx, record, attempt.At, t.attempts(r.kind))
+		if err != nil {
+			return attempt, 0, err
+		}
+		prior := before(record, attempt.At)
+		until := t.retryAt(prior, attempt.At)
+		if len(t.recent(prior, attempt.At)) >= t.attempts(r.kind) && !prior.Locked(attempt.At) {
+			// enough attempts are being made to lock it out once they fail
+			until = attempt.At.Add(t.conf.Duration)
+		}
+		if d := until.Sub(attempt.At); d > wait {
+			wait = d
+		}
+	}
+	return attempt, wait, nil
+}
+
+// before returns the record as it was before the failure at t was recorded
+func before(r Record, t time.Time) Record {
+	for i := len(r.Failures) - 1; i >= 0; i-- {
+		if r.Failures[i].Equal(t) {
+			r.Failures = append(r.Failures[:i:i], r.Failures[i+1:]...)
+			break
+		}
+	}
+	return r
+}
+
+// retryAt returns when the record may attempt a login again
+func (t *Tracker) retryAt(r Record, now time.Time) time.Time {
+	if r.Locked(now) {
+		return *r.LockedUntil
+	}
+	recent := t.recent(r, now)
+	if len(recent) == 0 {
+		return now
+	}
+	delay := t.conf.Delay
+	for i := 1; i < len(recent) && delay < t.conf.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.conf.MaxDelay {
+		delay = t.conf.MaxDelay
+	}
+	return recent[len(recent)-1].Add(delay)
+}
+
+// recent returns the failures of the record within the window
+func (t *Tracker) recent(r Record, now time.Time) []time.Time {
+	for i, failure := range r.Failures {
+		if now.Sub(failure) < t.conf.Window {
+			return r.Failures[i:]
+		}
+	}
+	return nil
+}
+
+// Fail ends an attempt which turned out wrong or had to wait, it stays counted; returns the records it locked out
+func (t *Tracker) Fail(ctx context.Context, attempt Attempt) ([]Record, error) {
+	if t == nil {
+		return nil, nil
+	}
+	records, err := t.store.GetLockouts(ctx, ID(Account, attempt.Account), ID(IP, attempt.IP))
+	if err != nil {
+		return nil, err
+	}
+	return t.lock(ctx, records)
+}
+
+// Release ends an attempt which turned out right, it's no longer counted as a failure
+// - failures are known by their time, one made within the same millisecond is forgotten too
+func (t *Tracker) Release(ctx context.Context, attempt Attempt) error {
+	if t == nil {
+		return nil
+	}
+	for _, r := range attempt.counted() {
+		err := t.store.ForgetFailure(ctx, ID(r.kind, r.key), attempt.At)
+		if err != nil && !t.store.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// counted returns the kinds and keys an attempt is counted against
+func (a Attempt) counted() []struct {
+	kind Kind
+	key  string
+} {
+	return []struct {
+		kind Kind
+		key  string
+	}{{Account, a.Account}, {IP, a.IP}}
+}
+
+// attempts returns how many failures an account or an IP may make within the window
+func (t *Tracker) attempts(kind Kind) int {
+	if kind == IP {
+		return t.conf.IPAttempts
+	}
+	return t.conf.AccountAttempts
+}
+
+// lock locks out the records which made too many failures, returning those it locked out
+func (t *Tracker) lock(ctx context.Context, records []Record) ([]Record, error) {
+	now := t.clock.Now()
+	var locked []Record
+	for _, record := range records {
+		if len(t.recent(record, now)) < t.attempts(record.Kind) || record.Locked(now) {
+			continue
+		}
+
+		duration := t.conf.Duration
+		for i := 0; i < record.Lockouts && duration < t.conf.MaxDuration; i++ {
+			duration *= 2
+		}
+		if duration > t.conf.MaxDuration {
+			duration = t.conf.MaxDuration
+		}
+		until := now.Add(duration)
+		// the record is kept past the lockout, so the next one lasts longer if failures carry on right after it
+		ok, err := t.store.LockOut(ctx, record.ID, now, until, until.Add(t.conf.Window))
+		if err != nil {
+			return locked, err
+		}
+		if ok {
+			record.LockedUntil, record.Failures = &until, nil
+			record.Lockouts++
+			locked = append(locked, record)
+		}
+	}
+	return locked, nil
+}
+
+// Succeed forgets the failures of an account once it logged in; those of the IP are kept, a client trying many
+// accounts getting one right is still suspicious
+func (t *Tracker) Succeed(ctx context.Context, account string) error {
+	if t == nil {
+		return nil
+	}
+	err := t.store.DeleteLockout(ctx, ID(Account, account))
+	if t.store.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the records of the accounts and IPs which failed logging in recently, or are locked out
+func (t *Tracker) List(ctx context.Context) ([]Record, error) {
+	if t == nil {
+		return []Record{}, nil
+	}
+	return t.store.ListLockouts(ctx)
+}
+
+// Clear forgets a record, lifting its lockout; ErrNotFound when there's none
+func (t *Tracker) Clear(ctx context.Context, id string) error {
+	if t == nil {
+		return ErrNotFound
+	}
+	err := t.store.DeleteLockout(ctx, id)
+	if t.store.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
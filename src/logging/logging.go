@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"spymaster/src/requestid"
+	"spymaster/src/tracing"
+)
+
+const (
+	// JSON logs a JSON object per line, meant for log collectors
+	JSON = "json"
+	// Text logs key=value pairs, easier on the eye when running locally
+	Text = "text"
+
+	// Redacted replaces the values of sensitive fields
+	Redacted = "REDACTED"
+)
+
+// Config holds the logging configuration
+type Config struct {
+	// Level is debug, info, warn or error
+	Level  string `envconfig:"level" default:"info"`
+	Format string `envconfig:"format" default:"json"`
+}
+
+// Validate checks the level and format are known
+func (conf Config) Validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return fmt.Errorf("unknown level %q, expected debug, info, warn or error", conf.Level)
+	}
+	if conf.Format != JSON && conf.Format != Text {
+		return fmt.Errorf("unknown format %q, expected %s or %s", conf.Format, JSON, Text)
+	}
+	return nil
+}
+
+// New creates a logger writing to w as configured
+// - the values of sensitive fields are redacted, however deep they are in what's logged
+// - records logged with a context carry its request ID and trace ID
+func New(conf Config, w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(conf.Level))
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var handler slog.Handler = slog.NewJSONHandler(w, opts)
+	if conf.Format == Text {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// Setup makes the configured logger the default one, standard library log calls included
+func Setup(conf Config) *slog.Logger {
+	logger := New(conf, os.Stderr)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Fatal logs an error and exits
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request and trace IDs found in the context of a record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := requestid.FromContext(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id := tracing.TraceID(ctx); id != "" {
+			r.AddAttrs(slog.String("trace_id", id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// sensitive tells whether a field holds personal data or secrets, by its name
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "email") || key == "nickname" || key == "username" ||
+		key == "name" || strings.HasSuffix(key, "_name") || key == "firstname" || key == "lastname"
+}
+
+var (
+	// emails matches email addresses, which errors like duplicate keys quote
+	emails = regexp.MustCompile(`[^\s"'{}:,<>]+@[^\s"'{}:,<>]+\.[a-zA-Z]+`)
+	// dupKeys matches the values MongoDB quotes in duplicate key errors, nicknames among them
+	dupKeys = regexp.MustCompile(`dup key: \{[^}]*\}`)
+)
+
+// redactText hides the email addresses and duplicate key values found in a string
+func redactText(s string) string {
+	s = dupKeys.ReplaceAllString(s, "dup key: { "+Redacted+" }")
+	return emails.ReplaceAllString(s, Redacted)
+}
+
+// redact hides the values of sensitive attributes and of the sensitive fields of structs and maps,
+// as well as email addresses and duplicate keys found in strings and errors
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if sensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactText(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactText(err.Error()))
+			break
+		}
+		a.Value = slog.AnyValue(scrub(reflect.ValueOf(a.Value.Any())))
+	}
+	return a
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// scrub copies structs and maps into maps keyed by their JSON names, leaving out the values of sensitive fields
+// - values which describe themselves, like times, IDs or errors, are kept as they are
+func scrub(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t.Implements(marshalerType) || t.Implements(textMarshalerType) || t.Implements(errorType) || t.Implements(stringerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return scrub(v.Elem())
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if sensitive(name) {
+				m[name] = Redacted
+				continue
+			}
+			m[name] = scrub(v.Field(i))
+		}
+		return m
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			if sensitive(k.String()) {
+				m[k.String()] = Redacted
+				continue
+			}
+			m[k.String()] = scrub(v.MapIndex(k))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = scrub(v.Index(i))
+		}
+		return s
+	}
+	return v.Interface()
+}
@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes messages to a directory instead of sending them, one .eml file each
+// - files hold tokens, they are only readable by their owner
+type FileMailer struct {
+	from string
+	dir  string
+}
+
+// NewFileMailer creates a FileMailer writing to dir, creating it if needed
+func NewFileMailer(from, dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{from: from, dir: dir}, nil
+}
+
+// Send writes a message, named after the time it was sent so listing the directory sorts them
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	now := time.Now()
+	body, err := encode(m.from, msg, now)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.dir, name), body, 0o600)
+}
+
+// MemoryMailer keeps the messages it's given, for tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send keeps a message, once checked it could be sent
+func (m *MemoryMailer) Send(_ context.Context, msg Message) error {
+	if _, err := encode("test@spymaster.localhost", msg, time.Now()); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset forgets the messages sent so far
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
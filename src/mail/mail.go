@@ -0,0 +1,121 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	// None mails nothing, the flows relying on mail are disabled
+	None = "none"
+	// SMTP hands messages to an SMTP server
+	SMTP = "smtp"
+	// File writes messages to a directory, one .eml file each, for development
+	File = "file"
+)
+
+// Config holds the mail configuration
+type Config struct {
+	// Backend is none, smtp or file
+	Backend string `envconfig:"backend" default:"none"`
+	// From is the sender of every message, e.g. Spymaster <no-reply@example.com>
+	From string     `envconfig:"from" default:"Spymaster <no-reply@spymaster.localhost>"`
+	SMTP SMTPConfig `envconfig:"smtp"`
+	// Dir is where the file backend writes messages
+	Dir string `envconfig:"dir" default:"mail"`
+}
+
+// Validate checks the backend is known and has what it needs
+func (conf Config) Validate() error {
+	switch conf.Backend {
+	case None:
+		return nil
+	case SMTP, File:
+	default:
+		return fmt.Errorf("unknown backend %q, expected %s, %s or %s", conf.Backend, None, SMTP, File)
+	}
+	if _, err := netmail.ParseAddress(conf.From); err != nil {
+		return fmt.Errorf("invalid from address %q: %w", conf.From, err)
+	}
+	if conf.Backend == File && conf.Dir == "" {
+		return errors.New("dir is required by the file backend")
+	}
+	if conf.Backend == SMTP {
+		return conf.SMTP.Validate()
+	}
+	return nil
+}
+
+// Message is a plain text email
+// - bodies carry tokens, they must never be logged
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New creates the mailer of the configured backend, nil for none
+func New(conf Config) (Mailer, error) {
+	switch conf.Backend {
+	case SMTP:
+		return NewSMTPMailer(conf.From, conf.SMTP), nil
+	case File:
+		m, err := NewFileMailer(conf.From, conf.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, nil
+}
+
+// encode renders a message as sent, headers included
+// - the recipient is parsed, and the subject encoded, so neither can inject headers
+func encode(from string, m Message, now time.Time) ([]byte, error) {
+	sender, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	to, err := netmail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", sender)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const (
+	// StartTLS upgrades the connection to TLS, usually on port 587
+	StartTLS = "starttls"
+	// ImplicitTLS connects over TLS right away, usually on port 465
+	ImplicitTLS = "implicit"
+	// NoTLS sends in clear, only meant for local relays
+	NoTLS = "none"
+)
+
+// SMTPConfig holds the SMTP server configuration
+type SMTPConfig struct {
+	Host     string `envconfig:"host"`
+	Port     int    `envconfig:"port" default:"587"`
+	Username string `envconfig:"username"`
+	Password string `envconfig:"password" secret:"true"`
+	// TLS is starttls, implicit or none
+	TLS string `envconfig:"tls" default:"starttls"`
+	// Timeout bounds sending a message, connecting included
+	Timeout time.Duration `envconfig:"timeout" default:"10s"`
+}
+
+// Validate checks the server is set and reachable securely
+func (conf SMTPConfig) Validate() error {
+	switch {
+	case conf.Host == "":
+		return errors.New("smtp host is required")
+	case conf.Port < 1 || conf.Port > 65535:
+		return fmt.Errorf("smtp port must be between 1 and 65535, got %d", conf.Port)
+	case conf.TLS != StartTLS && conf.TLS != ImplicitTLS && conf.TLS != NoTLS:
+		return fmt.Errorf("unknown smtp tls %q, expected %s, %s or %s", conf.TLS, StartTLS, ImplicitTLS, NoTLS)
+	case conf.Timeout <= 0:
+		return fmt.Errorf("smtp timeout must be positive, got %s", conf.Timeout)
+	}
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server, one connection each
+type SMTPMailer struct {
+	from string
+	conf SMTPConfig
+}
+
+// NewSMTPMailer creates an SMTPMailer sending as from
+func NewSMTPMailer(from string, conf SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{from: from, conf: conf}
+}
+
+// Send hands a message to the server
+// - net/smtp refuses to authenticate over a connection in clear, unless the server is local
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	body, err := encode(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, _ := netmail.ParseAddress(m.from)
+	to, _ := netmail.ParseAddress(msg.To)
+
+	ctx, cancel := context.WithTimeout(ctx, m.conf.Timeout)
+	defer cancel()
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.conf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.conf.TLS == StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(m.tlsConfig()); err != nil {
+			return err
+		}
+	}
+	if m.conf.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.conf.Username, m.conf.Password, m.conf.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *SMTPMailer) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(m.conf.Host, strconv.Itoa(m.conf.Port))
+	if m.conf.TLS == ImplicitTLS {
+		return (&tls.Dialer{Config: m.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+func (m *SMTPMailer) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: m.conf.Host, MinVersion: tls.VersionTLS12}
+}
@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "spymaster"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests served, by route template and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route template and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	pageSizes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "page_size",
+		Help:      "Page sizes (per_page) requested when listing.",
+		Buckets:   []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_total",
+		Help:      "HTTP requests turned down (429) for going over the rate limit, by route template.",
+	}, []string{"route"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken by storage operations, by method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"method"})
+	mongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "operation_errors_total",
+		Help:      "Storage operations which failed, by method; not found and duplicate key answers aren't failures.",
+	}, []string{"method"})
+
+	eventsRecorded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "events",
+		Name:      "recorded_total",
+		Help:      "User events recorded in the event log, by type.",
+	}, []string{"type"})
+	eventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "events",
+		Name:      "published_total",
+		Help:      "User events handed to the publishers, by type and outcome (success or failure).",
+	}, []string{"type", "outcome"})
+	publishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "events",
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken by the publishers to take an event.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	eventsRelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "outbox",
+		Name:      "relayed_total",
+		Help:      "User events relayed from the outbox after their first publish failed.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records a served HTTP request; route is the template it matched, like /operations/:id
+func ObserveRequest(method, route string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequests.WithLabelValues(method, route, code).Inc()
+	httpDuration.WithLabelValues(method, route, code).Observe(d.Seconds())
+}
+
+// ObservePageSize records the page size of a listing
+func ObservePageSize(perPage int) {
+	pageSizes.Observe(float64(perPage))
+}
+
+// RateLimited counts a request turned down for going over the rate limit
+func RateLimited(route string) {
+	rateLimited.WithLabelValues(route).Inc()
+}
+
+// ObserveMongo records a storage operation
+func ObserveMongo(method string, d time.Duration, failed bool) {
+	mongoDuration.WithLabelValues(method).Observe(d.Seconds())
+	if failed {
+		mongoErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// EventRecorded counts an event appended to the event log
+func EventRecorded(eventType string) {
+	eventsRecorded.WithLabelValues(eventType).Inc()
+}
+
+// EventPublished records an event handed to the publishers
+func EventPublished(eventType string, d time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	eventsPublished.WithLabelValues(eventType, outcome).Inc()
+	publishDuration.Observe(d.Seconds())
+}
+
+// EventsRelayed counts events relayed from the outbox
+func EventsRelayed(n int) {
+	eventsRelayed.Add(float64(n))
+}
+
+// Sources read the gauges reflecting the stored data
+type Sources struct {
+	// UsersByCountry counts users by country
+	UsersByCountry func(ctx context.Context) (map[string]int, error)
+	// Outbox counts the events waiting in the outbox, and tells when the oldest of them occurred
+	Outbox func(ctx context.Context) (int, time.Time, error)
+}
+
+var (
+	usersDesc = prometheus.NewDesc(namespace+"_users", "Users, by country code; other for anything not a two letter code.", []string{"country"}, nil)
+	backlog   = prometheus.NewDesc(namespace+"_outbox_events", "User events waiting in the outbox to be published.", nil, nil)
+	lag       = prometheus.NewDesc(namespace+"_outbox_oldest_age_seconds", "How long the oldest event in the outbox has waited, 0 when empty.", nil, nil)
+)
+
+// otherCountry labels the users whose country isn't a two letter code, countries being free text
+const otherCountry = "other"
+
+type collector struct {
+	sources Sources
+	timeout time.Duration
+	ttl     time.Duration
+
+	// mu guards the user counts, kept for ttl as counting scans every user
+	mu      sync.Mutex
+	counts  map[string]int
+	countAt time.Time
+}
+
+// NewCollector creates the collector of the gauges read from sources, each read taking up to timeout
+// - the outbox is read on every scrape, users are only counted again once their counts are older than ttl
+// - a failed read leaves its gauges out of the scrape rather than failing it
+func NewCollector(sources Sources, timeout, ttl time.Duration) prometheus.Collector {
+	return &collector{sources: sources, timeout: timeout, ttl: ttl}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+	ch <- backlog
+	ch <- lag
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	if c.sources.UsersByCountry != nil {
+		for country, n := range c.usersByCountry(ctx) {
+			ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(n), country)
+		}
+	}
+
+	if c.sources.Outbox != nil {
+		n, oldest, err := c.sources.Outbox(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed reading the outbox for metrics", "error", err)
+			return
+		}
+		age := 0.0
+		if n > 0 {
+			age = time.Since(oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(backlog, prometheus.GaugeValue, float64(n))
+		ch <- prometheus.MustNewConstMetric(lag, prometheus.GaugeValue, age)
+	}
+}
+
+// usersByCountry returns the user counts by country label, counting them again when the last counts expired
+func (c *collector) usersByCountry(ctx context.Context) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts != nil && time.Since(c.countAt) < c.ttl {
+		return c.counts
+	}
+
+	counts, err := c.sources.UsersByCountry(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed counting users for metrics", "error", err)
+		return nil
+	}
+	c.counts, c.countAt = map[string]int{}, time.Now()
+	for country, n := range counts {
+		c.counts[countryLabel(country)] += n
+	}
+	return c.counts
+}
+
+// countryLabel bounds the country label to two letter codes, in upper case, so users can't create series at will
+func countryLabel(country string) string {
+	if len(country) != 2 {
+		return otherCountry
+	}
+	for _, r := range country {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return otherCountry
+		}
+	}
+	return strings.ToUpper(country)
+}
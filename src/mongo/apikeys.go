@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/types"
+)
+
+const apiKeysCollection = "api_keys"
+
+// CreateAPIKey inserts an API key
+func (c Client) CreateAPIKey(ctx context.Context, key types.APIKey) (err error) {
+	_, end := observe(ctx, "CreateAPIKey", apiKeysCollection)
+	defer end(&err)
+
+	collection, done := c.collection(apiKeysCollection)
+	defer done()
+
+	return collection.Insert(key)
+}
+
+// GetAPIKey fetches an API key by its ID
+func (c Client) GetAPIKey(ctx context.Context, id string) (key types.APIKey, err error) {
+	ctx, end := observe(ctx, "GetAPIKey", apiKeysCollection)
+	defer end(&err)
+
+	collection, done := c.collection(apiKeysCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": id}).One(&key)
+	return
+}
+
+// ListAPIKeys lists the API keys, revoked and expired ones included, the latest created first
+func (c Client) ListAPIKeys(ctx context.Context) (keys []types.APIKey, err error) {
+	ctx, end := observe(ctx, "ListAPIKeys", apiKeysCollection)
+	defer end(&err)
+
+	collection, done := c.collection(apiKeysCollection)
+	defer done()
+
+	keys = []types.APIKey{}
+	err = safeFind(ctx, collection, bson.M{}).Sort("-created_at").All(&keys)
+	return
+}
+
+// RevokeAPIKey marks an API key revoked at t, unless it already is
+func (c Client) RevokeAPIKey(ctx context.Context, id string, t time.Time) (err error) {
+	ctx, end := observe(ctx, "RevokeAPIKey", apiKeysCollection)
+	defer end(&err)
+
+	collection, done := c.collection(apiKeysCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"revoked_at": t}})
+}
+
+// TouchAPIKey records an API key was used at t, unless it was already since before
+// - keys used for every request are only written to once in a while
+func (c Client) TouchAPIKey(ctx context.Context, id string, t, before time.Time) (err error) {
+	ctx, end := observe(ctx, "TouchAPIKey", apiKeysCollection)
+	defer end(&err)
+
+	collection, done := c.collection(apiKeysCollection)
+	defer done()
+
+	criteria := bson.M{
+		"_id": id,
+		"$or": []bson.M{
+			{"last_used_at": bson.M{"$exists": false}},
+			{"last_used_at": bson.M{"$lt": before}},
+		},
+	}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"last_used_at": t}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package mongo
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/types"
+)
+
+const (
+	resumeTokensCollection = "resume_tokens"
+
+	changeStreamMaxAwait = time.Second
+
+	// codeChangeStreamHistoryLost is returned when the resume token points to an oplog entry that no longer exists
+	codeChangeStreamHistoryLost = 286
+)
+
+// UserChange is a write to the users collection as reported by a change stream
+type UserChange struct {
+	// Operation is one of insert, update, replace or delete
+	Operation string
+	UserID    string
+	// User is the document after the change; it's nil for deletes or if the document couldn't be decoded
+	User *types.User
+	// EventID is the event_id carried by the written document, see types.User
+	EventID string
+	// UpdatedFields lists the fields set by an update, and RemovedFields those it unset
+	UpdatedFields []string
+	RemovedFields []string
+	ResumeToken   []byte
+}
+
+type changeDocument struct {
+	OperationType string    `bson:"operationType"`
+	FullDocument  *bson.Raw `bson:"fullDocument"`
+	DocumentKey   struct {
+		ID bson.ObjectId `bson:"_id"`
+	} `bson:"documentKey"`
+	UpdateDescription *struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// WatchUsers follows the changes made to the users collection, starting after resumeToken if given,
+// calling handle for each of them until ctx is done or an error occurs
+func (c Client) WatchUsers(ctx context.Context, resumeToken []byte, handle func(UserChange) error) error {
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	opts := mgo.ChangeStreamOptions{
+		FullDocument:   mgo.UpdateLookup,
+		MaxAwaitTimeMS: changeStreamMaxAwait,
+	}
+	if len(resumeToken) > 0 {
+		opts.ResumeAfter = &bson.Raw{Kind: 0x03, Data: resumeToken}
+	}
+
+	stream, err := collection.Watch([]bson.M{
+		{"$match": bson.M{"operationType": bson.M{"$in": []string{"insert", "update", "replace", "delete"}}}},
+	}, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for ctx.Err() == nil {
+		var doc changeDocument
+		if !stream.Next(&doc) {
+			if err := stream.Err(); err != nil {
+				return err
+			}
+			continue // timed out waiting for changes
+		}
+
+		change := UserChange{
+			Operation: doc.OperationType,
+			UserID:    doc.DocumentKey.ID.Hex(),
+		}
+		if token := stream.ResumeToken(); token != nil {
+			change.ResumeToken = token.Data
+		}
+		if doc.FullDocument != nil {
+			var stamp struct {
+				EventID string `bson:"event_id"`
+			}
+			doc.FullDocument.Unmarshal(&stamp)
+			change.EventID = stamp.EventID
+
+			var user types.User
+			if err := doc.FullDocument.Unmarshal(&user); err != nil {
+				slog.ErrorContext(ctx, "Failed decoding changed user", "user_id", change.UserID, "error", err)
+			} else {
+				change.User = &user
+			}
+		}
+		if doc.UpdateDescription != nil {
+			for field := range doc.UpdateDescription.UpdatedFields {
+				change.UpdatedFields = append(change.UpdatedFields, field)
+			}
+			change.RemovedFields = doc.UpdateDescription.RemovedFields
+		}
+
+		if err := handle(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsHistoryLost returns whether err informs that a change stream can't be resumed from the given token anymore
+func (c Client) IsHistoryLost(err error) bool {
+	qe, ok := err.(*mgo.QueryError)
+	return ok && qe.Code == codeChangeStreamHistoryLost
+}
+
+// LoadResumeToken returns the last resume token saved under name, if any
+func (c Client) LoadResumeToken(ctx context.Context, name string) (token []byte, err error) {
+	ctx, end := observe(ctx, "LoadResumeToken", resumeTokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(resumeTokensCollection)
+	defer done()
+
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err = safeFind(ctx, collection, bson.M{"_id": name}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	return doc.Token.Data, err
+}
+
+// SaveResumeToken stores token under name; an empty token removes it
+func (c Client) SaveResumeToken(ctx context.Context, name string, token []byte) (err error) {
+	ctx, end := observe(ctx, "SaveResumeToken", resumeTokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(resumeTokensCollection)
+	defer done()
+
+	criteria := bson.M{"_id": name}
+	filter(ctx, criteria)
+	if len(token) == 0 {
+		err := collection.Remove(comment(ctx, criteria))
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	_, err = collection.Upsert(comment(ctx, criteria), bson.M{"$set": bson.M{
+		"token":      bson.Raw{Kind: 0x03, Data: token},
+		"updated_at": time.Now().UTC(),
+	}})
+	return err
+}
@@ -0,0 +1,150 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/events"
+)
+
+const (
+	eventsCollection   = "events"
+	countersCollection = "counters"
+
+	defaultEventsLimit = 100
+)
+
+// AppendEvent stores an event in the event log, assigning it the next sequence number
+// - the sequence comes from a counter document, so it's shared by every instance writing to the database
+func (c Client) AppendEvent(ctx context.Context, e events.Event) (appended events.Event, err error) {
+	ctx, end := observe(ctx, "AppendEvent", eventsCollection)
+	defer end(&err)
+
+	counters, done := c.collection(countersCollection)
+	defer done()
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	_, err = counters.Find(comment(ctx, bson.M{"_id": eventsCollection})).Apply(change, &counter)
+	if err != nil {
+		return e, err
+	}
+	e.Sequence = counter.Seq
+
+	err = counters.Database.C(eventsCollection).Insert(e)
+	return e, err
+}
+
+// ListEvents reads back events from the event log in sequence order
+func (c Client) ListEvents(ctx context.Context, q events.Query) (list []events.Event, err error) {
+	ctx, end := observe(ctx, "ListEvents", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	criteria := bson.M{"sequence": bson.M{"$gt": q.AfterSequence}}
+	if len(q.Types) > 0 {
+		criteria["type"] = bson.M{"$in": q.Types}
+	}
+	if q.UserID != "" {
+		criteria["user_id"] = q.UserID
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultEventsLimit
+	}
+
+	r := []events.Event{}
+	err = safeFind(ctx, collection, criteria).Sort("sequence").Limit(limit).All(&r)
+	return r, err
+}
+
+// GetEvent returns the event with the given ID from the event log
+func (c Client) GetEvent(ctx context.Context, id string) (e events.Event, err error) {
+	ctx, end := observe(ctx, "GetEvent", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": id}).One(&e)
+	return e, err
+}
+
+// ListOutbox returns the events still to be relayed which occurred before the given time, in sequence order
+func (c Client) ListOutbox(ctx context.Context, before time.Time, limit int) (list []events.Event, err error) {
+	ctx, end := observe(ctx, "ListOutbox", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	r := []events.Event{}
+	criteria := bson.M{"outbox": true, "occurred_at": bson.M{"$lt": before}}
+	err = safeFind(ctx, collection, criteria).Sort("sequence").Limit(limit).All(&r)
+	return r, err
+}
+
+// CountOutbox counts the events still to be relayed
+func (c Client) CountOutbox(ctx context.Context) (n int, err error) {
+	ctx, end := observe(ctx, "CountOutbox", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	return safeFind(ctx, collection, bson.M{"outbox": true}).Count()
+}
+
+// OutboxBefore tells whether events of the user recorded before sequence are still to be relayed
+func (c Client) OutboxBefore(ctx context.Context, userID string, sequence int64) (found bool, err error) {
+	ctx, end := observe(ctx, "OutboxBefore", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	n, err := safeFind(ctx, collection, bson.M{"outbox": true, "user_id": userID, "sequence": bson.M{"$lt": sequence}}).Limit(1).Count()
+	return n > 0, err
+}
+
+// MarkRelayed takes an event out of the outbox
+func (c Client) MarkRelayed(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "MarkRelayed", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$unset": bson.M{"outbox": ""}})
+}
+
+// DeleteEvents removes the relayed events which occurred before the given time
+func (c Client) DeleteEvents(ctx context.Context, before time.Time) (removed int, err error) {
+	ctx, end := observe(ctx, "DeleteEvents", eventsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(eventsCollection)
+	defer done()
+
+	criteria := bson.M{"outbox": bson.M{"$ne": true}, "occurred_at": bson.M{"$lt": before}}
+	filter(ctx, criteria)
+	info, err := collection.RemoveAll(comment(ctx, criteria))
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
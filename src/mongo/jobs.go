@@ -0,0 +1,106 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/jobs"
+)
+
+const (
+	leasesCollection  = "leases"
+	jobRunsCollection = "job_runs"
+
+	// jobRunsRetention is how long job runs are kept around for inspection
+	jobRunsRetention = 7 * 24 * time.Hour
+)
+
+// AcquireLease takes the lease if it's free, expired or already held by the same holder
+// - with a tick, the lease is only taken for ticks later than the last one it was taken for
+// - when the lease exists but can't be taken, the upsert runs into the _id index, which means someone else has it
+func (c Client) AcquireLease(ctx context.Context, lease jobs.Lease) (acquired bool, err error) {
+	ctx, end := observe(ctx, "AcquireLease", leasesCollection)
+	defer end(&err)
+
+	collection, done := c.collection(leasesCollection)
+	defer done()
+
+	criteria := bson.M{
+		"_id": lease.Name,
+		"$or": []bson.M{
+			{"holder": lease.Holder},
+			{"expires_at": bson.M{"$lte": time.Now()}},
+		},
+	}
+	set := bson.M{"holder": lease.Holder, "expires_at": lease.ExpiresAt}
+	if !lease.Tick.IsZero() {
+		criteria["tick"] = bson.M{"$lt": lease.Tick}
+		set["tick"] = lease.Tick
+	}
+
+	filter(ctx, criteria)
+	_, err = collection.Upsert(comment(ctx, criteria), bson.M{"$set": set})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLease expires the lease if it's still held by holder
+func (c Client) ReleaseLease(ctx context.Context, name, holder string) (err error) {
+	ctx, end := observe(ctx, "ReleaseLease", leasesCollection)
+	defer end(&err)
+
+	collection, done := c.collection(leasesCollection)
+	defer done()
+
+	criteria := bson.M{"_id": name, "holder": holder}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"expires_at": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// GetLease fetches a lease by name
+func (c Client) GetLease(ctx context.Context, name string) (lease jobs.Lease, err error) {
+	ctx, end := observe(ctx, "GetLease", leasesCollection)
+	defer end(&err)
+
+	collection, done := c.collection(leasesCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": name}).One(&lease)
+	return
+}
+
+// SaveJobRun inserts or replaces a job run
+func (c Client) SaveJobRun(ctx context.Context, run jobs.Run) (err error) {
+	ctx, end := observe(ctx, "SaveJobRun", jobRunsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(jobRunsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": run.ID}
+	filter(ctx, criteria)
+	_, err = collection.Upsert(comment(ctx, criteria), run)
+	return err
+}
+
+// ListJobRuns returns the latest runs of a job, most recent first
+func (c Client) ListJobRuns(ctx context.Context, job string, limit int) (runs []jobs.Run, err error) {
+	ctx, end := observe(ctx, "ListJobRuns", jobRunsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(jobRunsCollection)
+	defer done()
+
+	r := []jobs.Run{}
+	err = safeFind(ctx, collection, bson.M{"job": job}).Sort("-started_at").Limit(limit).All(&r)
+	return r, err
+}
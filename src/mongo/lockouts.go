@@ -0,0 +1,114 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/lockout"
+)
+
+const lockoutsCollection = "lockouts"
+
+// GetLockouts fetches the lockout records with the given IDs, those missing are left out
+func (c Client) GetLockouts(ctx context.Context, ids ...string) (records []lockout.Record, err error) {
+	ctx, end := observe(ctx, "GetLockouts", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	records = []lockout.Record{}
+	err = safeFind(ctx, collection, bson.M{"_id": bson.M{"$in": ids}}).All(&records)
+	return
+}
+
+// RecordFailure appends a failed login at t to the record, keeping the latest keep of them, and creates it if needed
+// - the record is kept at least until its own expiry, a lockout may have pushed it further than the window
+func (c Client) RecordFailure(ctx context.Context, r lockout.Record, t time.Time, keep int) (record lockout.Record, err error) {
+	ctx, end := observe(ctx, "RecordFailure", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": r.ID}
+	filter(ctx, criteria)
+	_, err = collection.Find(comment(ctx, criteria)).Apply(mgo.Change{
+		Update: bson.M{
+			"$setOnInsert": bson.M{"kind": r.Kind, "key": r.Key, "lockouts": 0},
+			"$push":        bson.M{"failures": bson.M{"$each": []time.Time{t}, "$slice": -keep}},
+			"$max":         bson.M{"expires_at": r.ExpiresAt},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &record)
+	return
+}
+
+// ForgetFailure removes the failed logins at t from the record
+func (c Client) ForgetFailure(ctx context.Context, id string, t time.Time) (err error) {
+	ctx, end := observe(ctx, "ForgetFailure", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$pull": bson.M{"failures": t}})
+}
+
+// LockOut locks the record out until, unless it already is at t, clearing its failures and counting the lockout
+func (c Client) LockOut(ctx context.Context, id string, t, until, expiresAt time.Time) (locked bool, err error) {
+	ctx, end := observe(ctx, "LockOut", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	criteria := bson.M{
+		"_id": id,
+		"$or": []bson.M{
+			{"locked_until": bson.M{"$exists": false}},
+			{"locked_until": bson.M{"$lte": t}},
+		},
+	}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{
+		"$set": bson.M{"locked_until": until, "expires_at": expiresAt, "failures": []time.Time{}},
+		"$inc": bson.M{"lockouts": 1},
+	})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListLockouts lists the lockout records, the latest locked out first
+func (c Client) ListLockouts(ctx context.Context) (records []lockout.Record, err error) {
+	ctx, end := observe(ctx, "ListLockouts", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	records = []lockout.Record{}
+	err = safeFind(ctx, collection, bson.M{}).Sort("-locked_until", "-expires_at").All(&records)
+	return
+}
+
+// DeleteLockout removes a lockout record
+func (c Client) DeleteLockout(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "DeleteLockout", lockoutsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(lockoutsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id}
+	filter(ctx, criteria)
+	return collection.Remove(comment(ctx, criteria))
+}
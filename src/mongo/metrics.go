@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"spymaster/src/metrics"
+	"spymaster/src/tracing"
+)
+
+// observe starts the span and the timing of a storage method, both ended by the returned function given the method's error
+// - meant to be used with the method's named error: ctx, end := observe(ctx, "GetUser", usersCollection); defer end(&err)
+// - not found and duplicate key errors are answers rather than failures, they aren't counted or traced as errors
+func observe(ctx context.Context, method, collection string) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "mongo."+method,
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.operation.name", method),
+		attribute.String("db.collection.name", collection),
+	)
+	return ctx, func(err *error) {
+		failed := *err != nil && *err != mgo.ErrNotFound && !mgo.IsDup(*err) && *err != ErrInvalidID
+		metrics.ObserveMongo(method, time.Since(start), failed)
+		if failed {
+			tracing.End(span, *err)
+			return
+		}
+		span.End()
+	}
+}
+
+// filter records the shape of the query run by a storage method on its span, its values left out
+func filter(ctx context.Context, query interface{}) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("db.query.text", tracing.Shape(query)))
+}
@@ -0,0 +1,111 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/types"
+)
+
+// StartMFA sets the second factor of a user about to enroll, unless they already enabled one
+// - ErrNotFound is returned when there's no such user or their MFA is enabled
+func (c Client) StartMFA(ctx context.Context, userID string, mfa types.MFA) (err error) {
+	ctx, end := observe(ctx, "StartMFA", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID), "mfa.enabled_at": bson.M{"$exists": false}}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"mfa": mfa}})
+}
+
+// EnableMFA enables the second factor a user enrolled with, as long as it's still secret, with the code step
+// they confirmed it with and the hashes of their recovery codes
+func (c Client) EnableMFA(ctx context.Context, userID, secret string, step int64, at time.Time, recoveryCodes []string) (err error) {
+	ctx, end := observe(ctx, "EnableMFA", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID), "mfa.secret": secret, "mfa.enabled_at": bson.M{"$exists": false}}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{
+		"mfa.enabled_at":     at,
+		"mfa.last_step":      step,
+		"mfa.recovery_codes": recoveryCodes,
+	}})
+}
+
+// UseMFAStep records a code of a user's second factor was accepted for step, telling whether no code was accepted
+// for it or a later one before
+func (c Client) UseMFAStep(ctx context.Context, userID string, step int64) (used bool, err error) {
+	ctx, end := observe(ctx, "UseMFAStep", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		return false, ErrInvalidID
+	}
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID), "mfa.enabled_at": bson.M{"$exists": true}, "mfa.last_step": bson.M{"$lt": step}}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"mfa.last_step": step}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UseRecoveryCode removes the hash of a recovery code from a user's second factor, telling whether it was there
+func (c Client) UseRecoveryCode(ctx context.Context, userID, hash string) (used bool, err error) {
+	ctx, end := observe(ctx, "UseRecoveryCode", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		return false, ErrInvalidID
+	}
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID), "mfa.enabled_at": bson.M{"$exists": true}, "mfa.recovery_codes": hash}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{"$pull": bson.M{"mfa.recovery_codes": hash}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteMFA removes the second factor of a user, whether enabled or not
+func (c Client) DeleteMFA(ctx context.Context, userID string) (err error) {
+	ctx, end := observe(ctx, "DeleteMFA", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID)}
+	filter(ctx, criteria)
+	return collection.Update(comment(ctx, criteria), bson.M{"$unset": bson.M{"mfa": ""}})
+}
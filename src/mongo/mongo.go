@@ -1,20 +1,57 @@
 package mongo
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/certs"
+	"spymaster/src/requestid"
 )
 
 // Config holds the required configuration for a MongoDB connection
 type Config struct {
 	Hosts    []string `envconfig:"hosts_tls" default:"0.0.0.0:27017"`
-	Database string   `envconfig:"-" default:"spymaster"`
-	User     string   `envconfig:"-" default:"spymaster"`
-	Password string   `envconfig:"-" default:"face1t"`
+	Database string   `envconfig:"database" default:"spymaster"`
+	User     string   `envconfig:"user" default:"spymaster"`
+	// Password has no default, set it through SPYMASTER_MONGO_PASSWORD or SPYMASTER_MONGO_PASSWORD_FILE
+	Password string `envconfig:"password" secret:"true"`
+
+	// TLS encrypts connections, verifying the cluster against TLSCAFile or the system CAs when it's empty
+	TLS       bool   `envconfig:"tls"`
+	TLSCAFile string `envconfig:"tls_ca_file"`
+	// TLSCertificateKeyFile is the client certificate and its key, PEM encoded together, presented to the cluster
+	TLSCertificateKeyFile string `envconfig:"tls_certificate_key_file"`
+	// AuthMechanism is empty to authenticate with User and Password, or MONGODB-X509 to use the client certificate
+	AuthMechanism string `envconfig:"auth_mechanism"`
+}
+
+// X509 is the mechanism authenticating with the TLS client certificate, whose subject is the user name
+const X509 = "MONGODB-X509"
+
+// Validate checks the configuration can be used to connect
+func (conf Config) Validate() error {
+	switch {
+	case len(conf.Hosts) == 0:
+		return errors.New("hosts_tls is required")
+	case conf.Database == "":
+		return errors.New("database is required")
+	case conf.AuthMechanism != "" && conf.AuthMechanism != X509:
+		return fmt.Errorf("unsupported auth_mechanism %q, expected %s or none", conf.AuthMechanism, X509)
+	case conf.AuthMechanism == X509 && (!conf.TLS || conf.TLSCertificateKeyFile == ""):
+		return errors.New("x.509 authentication requires tls and tls_certificate_key_file")
+	case conf.AuthMechanism == "" && conf.User != "" && conf.Password == "":
+		return fmt.Errorf("password is required for user %s", conf.User)
+	}
+	return nil
 }
 
 // Client represents a MongoDB client
@@ -35,7 +72,7 @@ const (
 
 // Connect connects to a MongoDB cluster and returns a client
 func Connect(conf Config) (*Client, error) {
-	log.Printf("Connecting to MongoDB @ %s", conf.Hosts)
+	slog.Info("Connecting to MongoDB", "hosts", conf.Hosts)
 
 	dialInfo := &mgo.DialInfo{
 		Addrs:    conf.Hosts,
@@ -44,12 +81,17 @@ func Connect(conf Config) (*Client, error) {
 		Password: conf.Password,
 		Timeout:  time.Second * 10,
 	}
+	if err := configureTLS(conf, dialInfo); err != nil {
+		return nil, fmt.Errorf("invalid MongoDB TLS configuration: %w", err)
+	}
 	session, err := mgo.DialWithInfo(dialInfo)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %s", err)
 		return nil, err
 	}
-	ensureIndices(session, conf.Database)
+	if err := ensureIndices(session, conf.Database); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed creating indexes: %w", err)
+	}
 	session.SetMode(mgo.Monotonic, true)
 	database := session.DB(conf.Database)
 	return &Client{
@@ -59,27 +101,125 @@ func Connect(conf Config) (*Client, error) {
 	}, nil
 }
 
-func ensureIndices(s *mgo.Session, db string) {
+// configureTLS dials the cluster over TLS if enabled, authenticating with the client certificate when asked to
+func configureTLS(conf Config, dialInfo *mgo.DialInfo) error {
+	if !conf.TLS {
+		if conf.AuthMechanism == X509 {
+			return errors.New("x.509 authentication requires TLS")
+		}
+		return nil
+	}
+
+	tlsConf, err := certs.ClientConfig(conf.TLSCAFile, conf.TLSCertificateKeyFile)
+	if err != nil {
+		return err
+	}
+	dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: dialInfo.Timeout}, "tcp", addr.String(), tlsConf)
+	}
+
+	switch conf.AuthMechanism {
+	case "":
+	case X509:
+		subject, err := certs.Subject(tlsConf)
+		if err != nil {
+			return err
+		}
+		dialInfo.Mechanism, dialInfo.Source = X509, "$external"
+		dialInfo.Username, dialInfo.Password = subject, ""
+	default:
+		return fmt.Errorf("unsupported auth mechanism %q", conf.AuthMechanism)
+	}
+	return nil
+}
+
+// index is an index the service relies on
+type index struct {
+	collection string
+	index      mgo.Index
+}
+
+// indexes are created on connection and checked by MissingIndexes
+var indexes = []index{
+	{usersCollection, keyIndex([]string{"_id", "country"}, false)},
+	{usersCollection, keyIndex([]string{"nickname", "email"}, true)},
+	{usersCollection, keyIndex([]string{"nickname", "country"}, false)},
+	{usersCollection, keyIndex([]string{"email"}, false)},
+
+	{eventsCollection, keyIndex([]string{"sequence"}, true)},
+	{eventsCollection, keyIndex([]string{"user_id", "sequence"}, false)},
+	{eventsCollection, keyIndex([]string{"outbox", "sequence"}, false)},
+	{eventsCollection, keyIndex([]string{"occurred_at"}, false)},
+
+	// operations are removed by MongoDB shortly after expires_at
+	{operationsCollection, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second, Background: true}},
+
+	{jobRunsCollection, keyIndex([]string{"job", "-started_at"}, false)},
+	{jobRunsCollection, mgo.Index{Key: []string{"started_at"}, ExpireAfter: jobRunsRetention, Background: true}},
+
+	// rate limiting buckets are removed once full again
+	{rateLimitsCollection, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second, Background: true}},
+
+	// sessions and lockouts are removed by MongoDB once over
+	{sessionsCollection, keyIndex([]string{"user_id"}, false)},
+	{sessionsCollection, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second, Background: true}},
+	{lockoutsCollection, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second, Background: true}},
+
+	// mailed tokens too, whether used or not
+	{tokensCollection, keyIndex([]string{"user_id", "purpose"}, false)},
+	{tokensCollection, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second, Background: true}},
+
+	{apiKeysCollection, keyIndex([]string{"created_at"}, false)},
+}
+
+func ensureIndices(s *mgo.Session, db string) error {
 	session := s.Copy()
 	defer session.Close()
-	c := session.DB(db).C("users")
-	createIndex(c, []string{"_id", "country"}, false)
-	createIndex(c, []string{"nickname", "email"}, true)
-	createIndex(c, []string{"nickname", "country"}, false)
+	for _, i := range indexes {
+		if err := session.DB(db).C(i.collection).EnsureIndex(i.index); err != nil {
+			return fmt.Errorf("%s %v: %w", i.collection, i.index.Key, err)
+		}
+	}
+	return nil
 }
 
-func createIndex(c *mgo.Collection, keys []string, unique bool) {
-	i := mgo.Index{
+func keyIndex(keys []string, unique bool) mgo.Index {
+	return mgo.Index{
 		Key:        keys,
 		Unique:     unique,
 		DropDups:   true,
 		Background: true,
 		Sparse:     true,
 	}
-	err := c.EnsureIndex(i)
-	if err != nil {
-		log.Fatal(err)
+}
+
+// MissingIndexes lists the indexes the service relies on which don't exist (anymore), as collection.key,key
+func (c Client) MissingIndexes() ([]string, error) {
+	existing, listed := map[string]bool{}, map[string]bool{}
+	for _, i := range indexes {
+		if listed[i.collection] {
+			continue
+		}
+		listed[i.collection] = true
+		cl, release := c.collection(i.collection)
+		list, err := cl.Indexes()
+		release()
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range list {
+			existing[i.collection+"."+strings.Join(idx.Key, ",")] = true
+		}
+	}
+
+	var missing []string
+	for _, i := range indexes {
+		name := i.collection + "." + strings.Join(i.index.Key, ",")
+		if !existing[name] {
+			missing = append(missing, name)
+		}
 	}
+	return missing, nil
 }
 
 // Copy creates a new session by calling session.Copy on the initial session obtained at dial time
@@ -93,6 +233,13 @@ func (c Client) Copy() Client {
 	}
 }
 
+// collection returns a collection bound to a fresh copy of the session, together with the function releasing it
+// - this lets a single Client be shared by concurrent callers
+func (c Client) collection(name string) (*mgo.Collection, func()) {
+	session := c.session.Copy()
+	return session.DB(c.db).C(name), session.Close
+}
+
 // Close closes the MongoDB session
 func (c Client) Close() {
 	c.session.Close()
@@ -115,11 +262,48 @@ func (c Client) IsInvalidID(err error) bool {
 }
 
 // safeFind is a wrapper around the regular mgo driver find function that adds a query execution timeout
-func safeFind(cl *mgo.Collection, query bson.M) *mgo.Query {
-	return cl.Find(query).SetMaxTime(defaultMaxQueryTime)
+// - the shape of the query is recorded on the span in ctx, and the query is tagged with the request ID
+func safeFind(ctx context.Context, cl *mgo.Collection, query bson.M) *mgo.Query {
+	filter(ctx, query)
+	return cl.Find(comment(ctx, query)).SetMaxTime(defaultMaxQueryTime)
 }
 
-// Ping runs a trivial ping command just to get in touch with the server.
-func (c Client) Ping() error {
-	return c.session.Ping()
+// comment tags a filter with the ID of the request served with ctx, as $comment, so the profiler and the slow
+// query log tie operations back to API calls; the filter is copied rather than modified
+func comment(ctx context.Context, query bson.M) bson.M {
+	id := requestid.FromContext(ctx)
+	if id == "" {
+		return query
+	}
+	tagged := make(bson.M, len(query)+1)
+	for k, v := range query {
+		tagged[k] = v
+	}
+	tagged["$comment"] = "request_id:" + id
+	return tagged
+}
+
+// Ping runs a trivial ping command just to get in touch with the server, giving up once ctx is done
+func (c Client) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	session := c.session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		// so the ping given up on doesn't hold its connection much longer than the caller waited
+		if wait := time.Until(deadline); wait > 0 {
+			session.SetSocketTimeout(wait)
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer session.Close()
+		done <- session.Ping()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,37 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/operations"
+)
+
+const operationsCollection = "operations"
+
+// SaveOperation inserts or replaces an operation
+func (c Client) SaveOperation(ctx context.Context, op operations.Operation) (err error) {
+	ctx, end := observe(ctx, "SaveOperation", operationsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(operationsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": op.ID}
+	filter(ctx, criteria)
+	_, err = collection.Upsert(comment(ctx, criteria), op)
+	return err
+}
+
+// GetOperation fetches an operation by ID
+func (c Client) GetOperation(ctx context.Context, id string) (op operations.Operation, err error) {
+	ctx, end := observe(ctx, "GetOperation", operationsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(operationsCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": id}).One(&op)
+	return
+}
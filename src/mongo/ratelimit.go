@@ -0,0 +1,68 @@
+package mongo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const rateLimitsCollection = "rate_limits"
+
+// bucket is the state of a rate limiting bucket; it's removed by MongoDB once full again, as it then limits nothing
+type bucket struct {
+	Key       string    `bson:"_id"`
+	TAT       time.Time `bson:"tat"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// bucketKey hashes the key of a bucket, which may be a client IP or a user ID, so none is kept in the database
+func bucketKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetBucket returns when the rate limiting bucket of key is full again, zero when it has none
+func (c Client) GetBucket(ctx context.Context, key string) (tat time.Time, err error) {
+	ctx, end := observe(ctx, "GetBucket", rateLimitsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(rateLimitsCollection)
+	defer done()
+
+	var b bucket
+	err = safeFind(ctx, collection, bson.M{"_id": bucketKey(key)}).One(&b)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return b.TAT, err
+}
+
+// SwapBucket sets when the rate limiting bucket of key is full again to next if it still is old
+// - a bucket created concurrently runs into the _id index, which means it changed
+func (c Client) SwapBucket(ctx context.Context, key string, old, next time.Time) (swapped bool, err error) {
+	ctx, end := observe(ctx, "SwapBucket", rateLimitsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(rateLimitsCollection)
+	defer done()
+
+	if old.IsZero() {
+		err = collection.Insert(bucket{Key: bucketKey(key), TAT: next, ExpiresAt: next})
+		if mgo.IsDup(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	criteria := bson.M{"_id": bucketKey(key), "tat": old}
+	filter(ctx, criteria)
+	err = collection.Update(comment(ctx, criteria), bson.M{"$set": bson.M{"tat": next, "expires_at": next}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,61 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/types"
+)
+
+const sessionsCollection = "sessions"
+
+// CreateSession inserts a session
+func (c Client) CreateSession(ctx context.Context, session types.Session) (err error) {
+	_, end := observe(ctx, "CreateSession", sessionsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(sessionsCollection)
+	defer done()
+
+	return collection.Insert(session)
+}
+
+// GetSession fetches a session by the hash of its token
+func (c Client) GetSession(ctx context.Context, id string) (session types.Session, err error) {
+	ctx, end := observe(ctx, "GetSession", sessionsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(sessionsCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": id}).One(&session)
+	return
+}
+
+// DeleteSession removes a session by the hash of its token
+func (c Client) DeleteSession(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "DeleteSession", sessionsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(sessionsCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id}
+	filter(ctx, criteria)
+	return collection.Remove(comment(ctx, criteria))
+}
+
+// DeleteSessions removes every session of a user
+func (c Client) DeleteSessions(ctx context.Context, userID string) (err error) {
+	ctx, end := observe(ctx, "DeleteSessions", sessionsCollection)
+	defer end(&err)
+
+	collection, done := c.collection(sessionsCollection)
+	defer done()
+
+	criteria := bson.M{"user_id": userID}
+	filter(ctx, criteria)
+	_, err = collection.RemoveAll(comment(ctx, criteria))
+	return
+}
@@ -0,0 +1,78 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/types"
+)
+
+const tokensCollection = "tokens"
+
+// CreateToken inserts a mailed token
+func (c Client) CreateToken(ctx context.Context, token types.Token) (err error) {
+	_, end := observe(ctx, "CreateToken", tokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(tokensCollection)
+	defer done()
+
+	return collection.Insert(token)
+}
+
+// GetToken fetches a token by its hash and purpose, leaving it for later use
+func (c Client) GetToken(ctx context.Context, id, purpose string) (token types.Token, err error) {
+	ctx, end := observe(ctx, "GetToken", tokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(tokensCollection)
+	defer done()
+
+	err = safeFind(ctx, collection, bson.M{"_id": id, "purpose": purpose}).One(&token)
+	return
+}
+
+// AttemptToken counts an attempt at using a token by its hash and purpose, returning it as counted
+// - ErrNotFound is returned when there's no such token or it was attempted max times already
+func (c Client) AttemptToken(ctx context.Context, id, purpose string, max int) (token types.Token, err error) {
+	ctx, end := observe(ctx, "AttemptToken", tokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(tokensCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id, "purpose": purpose, "attempts": bson.M{"$not": bson.M{"$gte": max}}}
+	filter(ctx, criteria)
+	_, err = collection.Find(comment(ctx, criteria)).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"attempts": 1}}, ReturnNew: true}, &token)
+	return
+}
+
+// ConsumeToken removes a token by its hash and purpose, returning it; a token can only be consumed once
+func (c Client) ConsumeToken(ctx context.Context, id, purpose string) (token types.Token, err error) {
+	ctx, end := observe(ctx, "ConsumeToken", tokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(tokensCollection)
+	defer done()
+
+	criteria := bson.M{"_id": id, "purpose": purpose}
+	filter(ctx, criteria)
+	_, err = collection.Find(comment(ctx, criteria)).Apply(mgo.Change{Remove: true}, &token)
+	return
+}
+
+// DeleteTokens removes the tokens of a user for a purpose
+func (c Client) DeleteTokens(ctx context.Context, userID, purpose string) (err error) {
+	ctx, end := observe(ctx, "DeleteTokens", tokensCollection)
+	defer end(&err)
+
+	collection, done := c.collection(tokensCollection)
+	defer done()
+
+	criteria := bson.M{"user_id": userID, "purpose": purpose}
+	filter(ctx, criteria)
+	_, err = collection.RemoveAll(comment(ctx, criteria))
+	return
+}
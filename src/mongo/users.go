@@ -1,33 +1,48 @@
 package mongo
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"regexp"
-	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 
+	"spymaster/src/tracing"
 	"spymaster/types"
 )
 
 const usersCollection = "users"
 
 // ListUsers lists the users for a given customer with a certain query
-func (c Client) ListUsers(exactSearch map[string]interface{}, partialSearch map[string]string, perPage, pageNumber int) ([]types.User, int, error) {
+func (c Client) ListUsers(ctx context.Context, exactSearch map[string]interface{}, partialSearch map[string]string, perPage, pageNumber int) (users []types.User, total int, err error) {
+	ctx, end := observe(ctx, "ListUsers", usersCollection)
+	defer end(&err)
+
 	criteria := bson.M{}
 	for field, val := range exactSearch {
+		if id, ok := val.(string); ok && field == "_id" {
+			if !bson.IsObjectIdHex(id) {
+				return []types.User{}, 0, nil
+			}
+			val = bson.ObjectIdHex(id)
+		}
+		if fold, ok := val.(types.EqualFold); ok {
+			val = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(string(fold)) + "$", Options: "i"}
+		}
 		criteria[field] = val
 	}
 	for field, val := range partialSearch {
 		criteria[field] = bson.RegEx{Pattern: regexp.QuoteMeta(val), Options: "i"}
 	}
 
-	log.Printf("Mongo: Trying to find a user that matches criteria: %+v", criteria)
+	slog.DebugContext(ctx, "Listing users", "query", tracing.Shape(criteria), "per_page", perPage, "page", pageNumber)
+
+	collection, done := c.collection(usersCollection)
+	defer done()
 
-	collection := c.Database.C(usersCollection)
-	query := safeFind(collection, criteria).Sort("nickname")
-	total, err := query.Count()
+	query := safeFind(ctx, collection, criteria).Sort("nickname")
+	total, err = query.Count()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -37,64 +52,102 @@ func (c Client) ListUsers(exactSearch map[string]interface{}, partialSearch map[
 	}
 
 	var r []types.User
-	query.All(&r)
-
-	log.Println(r)
-
+	err = query.All(&r)
 	return r, total, err
 }
 
-// CreateUser creates a user for a given customer
-func (c Client) CreateUser(payload types.UserPost) (user types.User, err error) {
-	collection := c.Database.C(usersCollection)
-	now := time.Now().UTC()
-
-	user = types.User{
-		ID:        bson.NewObjectId(),
-		Nickname:  payload.Nickname,
-		Password:  payload.Password,
-		Email:     payload.Email,
-		CreatedAt: now,
-		UpdatedAt: now,
-	}
-	if payload.FirstName != nil {
-		user.FirstName = *payload.FirstName
-	}
-	if payload.LastName != nil {
-		user.LastName = *payload.LastName
-	}
-	if payload.Country != nil {
-		user.Country = *payload.Country
+// GetUser fetches a single user by ID
+func (c Client) GetUser(ctx context.Context, userID string) (user types.User, err error) {
+	ctx, end := observe(ctx, "GetUser", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
+		err = ErrInvalidID
+		return
 	}
 
-	err = collection.Insert(user)
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"_id": bson.ObjectIdHex(userID)}
+	err = safeFind(ctx, collection, criteria).One(&user)
 	return
 }
 
-// UpdateUser updates a user for a given customer
-func (c Client) UpdateUser(userID string, payload types.UserPatch) (user types.User, err error) {
-	collection := c.Database.C(usersCollection)
+// maxLoginMatches caps the users a login is checked against; nicknames and emails are only unique together
+const maxLoginMatches = 10
 
-	u := bson.ObjectIdHex(userID)
-	if err != nil {
+// FindUsersByLogin fetches the users whose nickname or email is login
+func (c Client) FindUsersByLogin(ctx context.Context, login string) (users []types.User, err error) {
+	ctx, end := observe(ctx, "FindUsersByLogin", usersCollection)
+	defer end(&err)
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	criteria := bson.M{"$or": []bson.M{{"nickname": login}, {"email": login}}}
+	users = []types.User{}
+	err = safeFind(ctx, collection, criteria).Limit(maxLoginMatches).All(&users)
+	return
+}
+
+// CreateUser inserts a fully built user
+func (c Client) CreateUser(ctx context.Context, user types.User) (err error) {
+	_, end := observe(ctx, "CreateUser", usersCollection)
+	defer end(&err)
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	return collection.Insert(user)
+}
+
+// UpdateUser updates a user for a given customer, returning it as it was before and after the update
+func (c Client) UpdateUser(ctx context.Context, userID string, payload types.UserPatch) (before, after types.User, err error) {
+	ctx, end := observe(ctx, "UpdateUser", usersCollection)
+	defer end(&err)
+
+	if !bson.IsObjectIdHex(userID) {
 		err = ErrInvalidID
 		return
 	}
+	u := bson.ObjectIdHex(userID)
 
-	payload.UpdatedAt = time.Now().UTC()
+	collection, done := c.collection(usersCollection)
+	defer done()
 
+	// the old document is returned so the change can be described, the new one is just the patch on top of it
+	// - a new email drops the verification of the old one, so the update differs whether the email changes or not
 	criteria := bson.M{"_id": u}
+	if payload.Email != nil && payload.EmailVerifiedAt == nil {
+		changing := bson.M{"_id": u, "email": bson.M{"$ne": *payload.Email}}
+		change := mgo.Change{
+			Update: bson.M{"$set": payload, "$unset": bson.M{"email_verified_at": ""}},
+		}
+		_, err = safeFind(ctx, collection, changing).Apply(change, &before)
+		if err != mgo.ErrNotFound {
+			if err == nil {
+				after = payload.Apply(before)
+			}
+			return
+		}
+	}
 	change := mgo.Change{
 		Update:    bson.M{"$set": payload},
-		ReturnNew: true,
+		ReturnNew: false,
+	}
+	_, err = safeFind(ctx, collection, criteria).Apply(change, &before)
+	if err != nil {
+		return
 	}
-	_, err = safeFind(collection, criteria).Apply(change, &user)
+	after = payload.Apply(before)
 	return
 }
 
 // DeleteUser deletes a user for a given customer
-func (c Client) DeleteUser(userID string) (err error) {
-	collection := c.Database.C(usersCollection)
+func (c Client) DeleteUser(ctx context.Context, userID string) (err error) {
+	ctx, end := observe(ctx, "DeleteUser", usersCollection)
+	defer end(&err)
 
 	isHex := bson.IsObjectIdHex(userID)
 	if !isHex {
@@ -103,10 +156,38 @@ func (c Client) DeleteUser(userID string) (err error) {
 	}
 	u := bson.ObjectIdHex(userID)
 
+	collection, done := c.collection(usersCollection)
+	defer done()
+
 	criteria := bson.M{"_id": u}
 	change := mgo.Change{
 		Remove: true,
 	}
-	_, err = safeFind(collection, criteria).Apply(change, nil)
+	_, err = safeFind(ctx, collection, criteria).Apply(change, nil)
 	return err
 }
+
+// CountUsersByCountry counts the users of every country; users without one are counted under ""
+func (c Client) CountUsersByCountry(ctx context.Context) (counts map[string]int, err error) {
+	ctx, end := observe(ctx, "CountUsersByCountry", usersCollection)
+	defer end(&err)
+
+	collection, done := c.collection(usersCollection)
+	defer done()
+
+	var groups []struct {
+		Country string `bson:"_id"`
+		Count   int    `bson:"count"`
+	}
+	pipeline := []bson.M{{"$group": bson.M{"_id": "$country", "count": bson.M{"$sum": 1}}}}
+	filter(ctx, pipeline)
+	err = collection.Pipe(pipeline).SetMaxTime(defaultMaxQueryTime).All(&groups)
+	if err != nil {
+		return nil, err
+	}
+	counts = map[string]int{}
+	for _, g := range groups {
+		counts[g.Country] += g.Count
+	}
+	return counts, nil
+}
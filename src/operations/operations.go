@@ -0,0 +1,329 @@
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"spymaster/src/password"
+	"spymaster/src/requestid"
+	"spymaster/src/spymaster"
+	"spymaster/src/tracing"
+	"spymaster/types"
+)
+
+// Config holds the asynchronous command processing configuration
+type Config struct {
+	// Workers is how many commands are executed concurrently
+	Workers int `envconfig:"workers" default:"4"`
+	// Queue is how many commands can wait for a worker before new ones are refused
+	Queue int `envconfig:"queue" default:"100"`
+	// TTL is how long an operation can be looked up after it was last updated
+	TTL time.Duration `envconfig:"ttl" default:"24h"`
+	// Timeout caps how long a single command may run
+	Timeout time.Duration `envconfig:"timeout" default:"30s"`
+}
+
+// Validate checks there are workers and room to queue commands for them
+func (conf Config) Validate() error {
+	if conf.Workers < 1 || conf.Queue < 1 {
+		return errors.New("workers and queue must be at least 1")
+	}
+	if conf.TTL <= 0 || conf.Timeout <= 0 {
+		return errors.New("ttl and timeout must be positive")
+	}
+	return nil
+}
+
+// Kind identifies the command an operation runs
+type Kind string
+
+const (
+	// CreateUser runs spymaster.Service.CreateUser
+	CreateUser Kind = "user.create"
+	// UpdateUser runs spymaster.Service.UpdateUser
+	UpdateUser Kind = "user.update"
+	// DeleteUser runs spymaster.Service.DeleteUser
+	DeleteUser Kind = "user.delete"
+)
+
+// Status is where an operation is in its lifecycle
+type Status string
+
+const (
+	// Pending operations wait for a worker
+	Pending Status = "pending"
+	// Running operations are being executed
+	Running Status = "running"
+	// Succeeded operations carry their result, if the command has one
+	Succeeded Status = "succeeded"
+	// Failed operations carry the error, as the synchronous endpoint would have reported it
+	Failed Status = "failed"
+)
+
+var (
+	// ErrQueueFull is returned when no more commands can be accepted for now
+	ErrQueueFull = errors.New("operation queue is full")
+	// ErrNotFound is returned for unknown or expired operations
+	ErrNotFound = errors.New("operation not found")
+	// ErrShutdown is returned once the dispatcher stopped accepting commands
+	ErrShutdown = errors.New("operations are no longer accepted")
+)
+
+// Command is a user write to execute asynchronously
+// - it only lives in memory, as create and update payloads may hold a plain text password
+type Command struct {
+	Kind   Kind
+	UserID string
+	Create *types.UserPost
+	Update *types.UserPatch
+}
+
+// Error is the failure of an operation, with the HTTP status the synchronous endpoint would have answered
+type Error struct {
+	Status  int    `bson:"status" json:"status"`
+	Message string `bson:"message" json:"message"`
+}
+
+// Operation tracks the execution of a Command
+// - its ID is random, and only the principal which submitted it can look it up
+type Operation struct {
+	ID        string      `bson:"_id" json:"id"`
+	Kind      Kind        `bson:"kind" json:"kind"`
+	Status    Status      `bson:"status" json:"status"`
+	UserID    string      `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Result    *types.User `bson:"result,omitempty" json:"result,omitempty"`
+	Error     *Error      `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time   `bson:"expires_at" json:"expires_at"`
+	// RequestID is the ID of the request which submitted the operation, carried on to its writes and events
+	RequestID string `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	// Owner is the ID of the principal which submitted the operation, empty when anonymous
+	Owner string `bson:"owner,omitempty" json:"-"`
+}
+
+// Done reports whether the operation finished, successfully or not
+func (op Operation) Done() bool {
+	return op.Status == Succeeded || op.Status == Failed
+}
+
+// Store persists operations, dropping them once they expire
+type Store interface {
+	SaveOperation(ctx context.Context, op Operation) error
+	GetOperation(ctx context.Context, id string) (Operation, error)
+	IsNotFound(err error) bool
+}
+
+type job struct {
+	op  Operation
+	cmd Command
+	// trace is the trace context of the submitting request, so the execution is traced as part of it
+	trace tracing.Carrier
+}
+
+// Dispatcher queues commands and executes them on a pool of workers
+type Dispatcher struct {
+	store   Store
+	service *spymaster.Service
+	conf    Config
+	queue   chan job
+	wg      sync.WaitGroup
+	// mu guards closed, so nothing is sent on the queue once Shutdown closed it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewDispatcher creates a Dispatcher; commands are only executed once Run is called
+func NewDispatcher(store Store, service *spymaster.Service, conf Config) *Dispatcher {
+	return &Dispatcher{
+		store:   store,
+		service: service,
+		conf:    conf,
+		queue:   make(chan job, conf.Queue),
+	}
+}
+
+// Submit records a pending operation for the command and queues it
+func (d *Dispatcher) Submit(ctx context.Context, cmd Command) (Operation, error) {
+	now := time.Now().UTC()
+	op := Operation{
+		ID:        newID(),
+		Kind:      cmd.Kind,
+		Status:    Pending,
+		UserID:    cmd.UserID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(d.conf.TTL),
+		RequestID: requestid.FromContext(ctx),
+		Owner:     spymaster.PrincipalFrom(ctx).ID(),
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return Operation{}, ErrShutdown
+	}
+	if len(d.queue) == cap(d.queue) {
+		return Operation{}, ErrQueueFull
+	}
+	if err := d.store.SaveOperation(ctx, op); err != nil {
+		return Operation{}, err
+	}
+
+	select {
+	case d.queue <- job{op: op, cmd: cmd, trace: tracing.Inject(ctx)}:
+		return op, nil
+	default:
+		// lost the race for the last slot, the pending operation will just expire
+		return Operation{}, ErrQueueFull
+	}
+}
+
+// Get returns an operation, unless it expired or was submitted by another principal than the one of ctx
+func (d *Dispatcher) Get(ctx context.Context, id string) (Operation, error) {
+	op, err := d.store.GetOperation(ctx, id)
+	if err != nil {
+		if d.store.IsNotFound(err) {
+			return op, ErrNotFound
+		}
+		return op, err
+	}
+	// expired operations are only removed from the store once in a while
+	if time.Now().After(op.ExpiresAt) || op.Owner != spymaster.PrincipalFrom(ctx).ID() {
+		return Operation{}, ErrNotFound
+	}
+	return op, nil
+}
+
+// Run starts the workers and blocks until they're done: once Shutdown drained the queue, or once ctx is done and
+// they finished what they were executing
+// - commands still queued when ctx is done are abandoned, their operations stay pending until they expire
+func (d *Dispatcher) Run(ctx context.Context) {
+	for i := 0; i < d.conf.Workers; i++ {
+		d.wg.Add(1)
+		go d.work(ctx)
+	}
+	d.wg.Wait()
+}
+
+// Shutdown stops accepting commands and waits until the workers executed those already queued, or until ctx is done
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			d.execute(j)
+		}
+	}
+}
+
+// execute runs a command, recording its progress; it isn't bound to the Run context so it's never cut short
+func (d *Dispatcher) execute(j job) {
+	ctx := requestid.NewContext(tracing.Extract(context.Background(), j.trace), j.op.RequestID)
+	ctx, cancel := context.WithTimeout(ctx, d.conf.Timeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "operations."+string(j.cmd.Kind), attribute.String("operation.id", j.op.ID))
+	defer span.End()
+
+	op := j.op
+	d.save(ctx, &op, Running)
+
+	result, opErr := d.run(ctx, j.cmd)
+	op.Result, op.Error = result, opErr
+	if opErr != nil {
+		span.SetStatus(codes.Error, opErr.Message)
+		d.save(ctx, &op, Failed)
+	} else {
+		d.save(ctx, &op, Succeeded)
+	}
+}
+
+func (d *Dispatcher) save(ctx context.Context, op *Operation, status Status) {
+	now := time.Now().UTC()
+	op.Status, op.UpdatedAt, op.ExpiresAt = status, now, now.Add(d.conf.TTL)
+	if err := d.store.SaveOperation(ctx, *op); err != nil {
+		slog.ErrorContext(ctx, "Failed saving operation", "operation_id", op.ID, "status", status, "error", err)
+	}
+}
+
+// run executes the command, mapping errors as the synchronous endpoints do
+func (d *Dispatcher) run(ctx context.Context, cmd Command) (*types.User, *Error) {
+	var (
+		user types.User
+		err  error
+	)
+	switch cmd.Kind {
+	case CreateUser:
+		user, err = d.service.CreateUser(ctx, cmd.Create)
+	case UpdateUser:
+		user, err = d.service.UpdateUser(ctx, cmd.UserID, cmd.Update)
+	case DeleteUser:
+		// deletes are idempotent, the synchronous endpoint answers a 204 for users who don't exist
+		err = d.service.DeleteUser(ctx, cmd.UserID)
+		if err == nil || err == spymaster.ErrNotFound {
+			return nil, nil
+		}
+	default:
+		return nil, &Error{Status: http.StatusInternalServerError, Message: "Unknown operation"}
+	}
+
+	var refused *password.Error
+	if errors.As(err, &refused) {
+		return nil, &Error{Status: http.StatusBadRequest, Message: "Password " + strings.Join(refused.Problems, ", ")}
+	}
+	switch err {
+	case nil:
+		return &user, nil
+	case spymaster.ErrDup:
+		return nil, &Error{Status: http.StatusConflict, Message: "User/Email already exists"}
+	case spymaster.ErrNotFound:
+		return nil, &Error{Status: http.StatusNotFound, Message: "Not Found"}
+	case spymaster.ErrInvalidID:
+		return nil, &Error{Status: http.StatusBadRequest, Message: "Invalid ID"}
+	}
+	return nil, &Error{Status: http.StatusInternalServerError, Message: "Server Error"}
+}
+
+// newID returns a random operation ID, 128 bits hex encoded, so operations can't be guessed
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
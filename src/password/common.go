@@ -0,0 +1,20 @@
+package password
+
+// common lists the passwords and words tried first, likeliest first; it's short, breached passwords are meant to be
+// screened by the corpus
+var common = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "iloveyou", "monkey", "dragon", "master",
+	"sunshine", "princess", "football", "baseball", "shadow", "superman", "trustno", "login", "hello", "freedom",
+	"whatever", "qazwsx", "michael", "jennifer", "jordan", "hunter", "buster", "soccer", "harley", "batman",
+	"andrew", "tigger", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars", "klaster",
+	"george", "computer", "michelle", "jessica", "pepper", "zxcvbn", "ashley", "passw0rd", "secret", "summer",
+	"winter", "spring", "autumn", "flower", "cookie", "cheese", "ginger", "orange", "purple", "silver",
+	"yellow", "maggie", "chelsea", "matrix", "mustang", "access", "killer", "pussy", "fuckyou", "biteme",
+	"banana", "apple", "chocolate", "butterfly", "liverpool", "arsenal", "angel", "lovely", "loveme", "family",
+	"friends", "forever", "blessed", "jesus", "heaven", "money", "internet", "samsung", "google", "facebook",
+	"default", "changeme", "temp", "guest", "root", "test", "user", "service", "server", "system",
+	"spymaster", "qwerty123", "superstar", "shannon", "william", "joshua", "nicole", "amanda", "justin", "taylor",
+	"pass", "word", "love", "baby", "girl", "boy", "dog", "cat", "god", "sex",
+	"abc", "abcd", "qwer", "asdf", "zxcv", "1234", "12345", "123456789", "111111", "000000",
+	"monday", "friday", "sunday", "january", "december", "london", "paris", "berlin", "america", "canada",
+}
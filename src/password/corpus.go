@@ -0,0 +1,137 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// prefixLength is how many characters of a hash are given to a corpus, as the Pwned Passwords range API does
+	prefixLength = 5
+	hashLength   = 40
+)
+
+// FileCorpus looks breached passwords up in a sorted file of hashes, searching it rather than loading it, so files
+// of hundreds of millions of hashes can be used
+type FileCorpus struct {
+	f    *os.File
+	size int64
+}
+
+// OpenFileCorpus opens a file of upper case hex SHA-1 hashes, one per line and sorted, each optionally followed by
+// :count
+func OpenFileCorpus(path string) (*FileCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileCorpus{f: f, size: info.Size()}, nil
+}
+
+// Close closes the file
+func (c *FileCorpus) Close() error {
+	return c.f.Close()
+}
+
+// Range returns the suffixes of the hashes starting with prefix
+func (c *FileCorpus) Range(_ context.Context, prefix string) ([]string, error) {
+	if !validPrefix(prefix) {
+		return nil, ErrInvalidPrefix
+	}
+	offset, err := c.search(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+	r := bufio.NewReader(io.NewSectionReader(c.f, offset, c.size-offset))
+	for {
+		line, err := r.ReadString('\n')
+		hash := parseLine(line)
+		if !strings.HasPrefix(hash, prefix) {
+			if err == nil || err == io.EOF {
+				return suffixes, nil
+			}
+			return nil, err
+		}
+		suffixes = append(suffixes, hash[prefixLength:])
+		if err == io.EOF {
+			return suffixes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// search returns the offset of the first line whose hash isn't lower than prefix, by bisecting the file
+// - lines before lo are all lower than prefix, and the first line starting at or after hi isn't
+func (c *FileCorpus) search(prefix string) (int64, error) {
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := c.lineAt(mid)
+		if err != nil {
+			return 0, err
+		}
+		if line != "" && parseLine(line) < prefix {
+			lo = start + int64(len(line))
+		} else {
+			hi = mid
+		}
+	}
+	start, _, err := c.lineAt(lo)
+	return start, err
+}
+
+// lineAt returns the first line starting at or after offset, and where it starts; the line is empty past the end
+func (c *FileCorpus) lineAt(offset int64) (int64, string, error) {
+	start := offset
+	r := bufio.NewReader(io.NewSectionReader(c.f, offset, c.size-offset))
+	if offset > 0 {
+		// offset may be in the middle of a line, which has to be skipped, unless it's right after a line break
+		r = bufio.NewReader(io.NewSectionReader(c.f, offset-1, c.size-offset+1))
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return c.size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start = offset - 1 + int64(len(skipped))
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, line, nil
+}
+
+// parseLine returns the hash of a line, in upper case
+func parseLine(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	if len(hash) != hashLength {
+		return ""
+	}
+	return strings.ToUpper(hash)
+}
+
+func validPrefix(prefix string) bool {
+	if len(prefix) != prefixLength {
+		return false
+	}
+	for _, r := range prefix {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
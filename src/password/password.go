@@ -0,0 +1,156 @@
+package password
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBytes is the most bcrypt hashes, the rest of a longer password would be ignored
+const maxBytes = 72
+
+// Config holds the password policy
+type Config struct {
+	// MinLength is the fewest characters a password may have
+	MinLength int `envconfig:"min_length" default:"8"`
+	// MaxLength is the most bytes a password may have, at most 72 as bcrypt ignores the rest
+	MaxLength int `envconfig:"max_length" default:"72"`
+	// MinScore is the lowest strength accepted, from 0 (too guessable) to 4 (very unguessable), as zxcvbn rates it
+	MinScore int `envconfig:"min_score" default:"2"`
+	// BreachedFile lists the SHA-1 hashes of breached passwords, one per line in upper case hex, sorted, optionally
+	// followed by :count as the Pwned Passwords downloads are; screening is off without it
+	BreachedFile string `envconfig:"breached_file"`
+}
+
+// Validate checks the bounds make sense and the breached passwords file exists
+func (conf Config) Validate() error {
+	switch {
+	case conf.MinLength < 1:
+		return fmt.Errorf("min_length must be at least 1, got %d", conf.MinLength)
+	case conf.MaxLength < conf.MinLength || conf.MaxLength > maxBytes:
+		return fmt.Errorf("max_length must be between min_length and %d, got %d", maxBytes, conf.MaxLength)
+	case conf.MinScore < 0 || conf.MinScore > 4:
+		return fmt.Errorf("min_score must be between 0 and 4, got %d", conf.MinScore)
+	}
+	if conf.BreachedFile != "" {
+		if _, err := os.Stat(conf.BreachedFile); err != nil {
+			return fmt.Errorf("breached_file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Error lists why a password was refused
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "password " + strings.Join(e.Problems, ", ")
+}
+
+// Corpus looks breached passwords up by k-anonymity: given the first 5 characters of the upper case hex SHA-1 of a
+// password, it returns the rest of the hashes starting with them, so the password never leaves the caller
+type Corpus interface {
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Policy checks passwords are long and unguessable enough, and weren't breached
+type Policy struct {
+	conf     Config
+	breached Corpus
+}
+
+// New creates the Policy of conf, opening its breached passwords file if any
+func New(conf Config) (*Policy, error) {
+	p := &Policy{conf: conf}
+	if conf.BreachedFile != "" {
+		corpus, err := OpenFileCorpus(conf.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		p.breached = corpus
+	}
+	return p, nil
+}
+
+// NewWithCorpus creates a Policy screening passwords against corpus rather than a file
+func NewWithCorpus(conf Config, corpus Corpus) *Policy {
+	return &Policy{conf: conf, breached: corpus}
+}
+
+// Check returns an *Error listing every rule the password of the user with nickname and email breaks, nil if none
+// - breached passwords are screened last, only once the rest passed; failing to screen doesn't refuse the password
+// - a nil Policy accepts any password
+func (p *Policy) Check(ctx context.Context, password, nickname, email string) error {
+	if p == nil {
+		return nil
+	}
+	var problems []string
+	if n := utf8.RuneCountInString(password); n < p.conf.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.conf.MinLength))
+	}
+	if len(password) > p.conf.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", p.conf.MaxLength))
+	}
+
+	lower := strings.ToLower(password)
+	nickname, email = strings.ToLower(nickname), strings.ToLower(email)
+	local, _, _ := strings.Cut(email, "@")
+	if len(nickname) >= 3 && strings.Contains(lower, nickname) {
+		problems = append(problems, "must not contain the nickname")
+	}
+	if len(local) >= 3 && strings.Contains(lower, local) {
+		problems = append(problems, "must not contain the email")
+	}
+
+	if len(problems) == 0 {
+		if s := Estimate(password, nickname, local); s.Score < p.conf.MinScore {
+			problem := fmt.Sprintf("is too easy to guess (strength %d of 4, %d needed)", s.Score, p.conf.MinScore)
+			if len(s.Feedback) > 0 {
+				problem += ": " + strings.Join(s.Feedback, ", ")
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) == 0 && p.breached != nil {
+		breached, err := p.isBreached(ctx, password)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed screening breached passwords", "error", err)
+		}
+		if breached {
+			problems = append(problems, "appeared in a data breach, it's likely to be tried first")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// isBreached looks the hash of a password up in the corpus, by its prefix
+func (p *Policy) isBreached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := p.breached.Range(ctx, hash[:prefixLength])
+	if err != nil {
+		return false, err
+	}
+	for _, s := range suffixes {
+		if s == hash[prefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ErrInvalidPrefix is returned by corpora given something else than 5 upper case hex characters
+var ErrInvalidPrefix = errors.New("prefix must be 5 upper case hex characters")
@@ -0,0 +1,245 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Strength is how hard a password is to guess
+type Strength struct {
+	// Score is 0 (too guessable) to 4 (very unguessable), from the guesses as zxcvbn scores them
+	Score int
+	// Guesses is the log10 of how many guesses an attacker trying the likely patterns first needs
+	Guesses float64
+	// Feedback lists what makes the password weaker, in the words of a problem
+	Feedback []string
+}
+
+// keyboardRows are the rows of a qwerty keyboard, walked along by lazy passwords
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890", "qazwsxedc"}
+
+// leet maps the l33t substitutions to the letters they stand for
+var leet = map[rune]rune{'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i'}
+
+// scoreThresholds are the log10 guesses each score starts at, as zxcvbn sets them
+var scoreThresholds = []float64{3, 6, 8, 10}
+
+// Estimate rates a password the way zxcvbn does, if more roughly: it's split in the cheapest patterns an attacker
+// would try (common passwords and words, the user's own inputs, repeats, sequences, keyboard walks, years), anything
+// else being brute forced, and the guesses each pattern takes are multiplied
+func Estimate(password string, userInputs ...string) Strength {
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+	dict := dictionary(userInputs)
+
+	var log10 float64
+	var patterns int
+	feedback := map[string]bool{}
+	bruteForcing := false
+	for i := 0; i < len(runes); {
+		m := longestMatch(runes, lower, i, dict)
+		if m.length == 0 {
+			log10 += math.Log10(cardinality(runes[i]))
+			if !bruteForcing {
+				patterns++
+			}
+			bruteForcing = true
+			i++
+			continue
+		}
+		bruteForcing = false
+		patterns++
+		log10 += math.Log10(m.guesses)
+		feedback[m.feedback] = true
+		i += m.length
+	}
+	// the attacker doesn't know how the patterns are ordered either
+	log10 += logFactorial(patterns)
+
+	s := Strength{Guesses: log10}
+	for _, t := range scoreThresholds {
+		if log10 >= t {
+			s.Score++
+		}
+	}
+	for _, f := range []string{"avoid common words and passwords", "avoid repeated characters", "avoid sequences like abc or 123",
+		"avoid keyboard patterns like qwerty", "avoid years"} {
+		if feedback[f] {
+			s.Feedback = append(s.Feedback, f)
+		}
+	}
+	if len(runes) < 12 && s.Score < 3 {
+		s.Feedback = append(s.Feedback, "add more words")
+	}
+	return s
+}
+
+type match struct {
+	length   int
+	guesses  float64
+	feedback string
+}
+
+// longestMatch returns the longest pattern starting at i, the cheapest of those as long; it's empty when none does
+func longestMatch(runes, lower []rune, i int, dict map[string]int) match {
+	var best match
+	consider := func(m match) {
+		if m.length > best.length || m.length == best.length && m.length > 0 && m.guesses < best.guesses {
+			best = m
+		}
+	}
+
+	for end := len(runes); end-i >= 3; end-- {
+		word, subs := unleet(lower[i:end])
+		if rank, ok := dict[word]; ok {
+			consider(match{length: end - i, guesses: float64(rank) * caseVariations(runes[i:end]) * math.Pow(2, float64(subs)),
+				feedback: "avoid common words and passwords"})
+			break
+		}
+	}
+
+	j := i + 1
+	for j < len(lower) && lower[j] == lower[i] {
+		j++
+	}
+	if j-i >= 3 {
+		consider(match{length: j - i, guesses: cardinality(runes[i]) * float64(j-i), feedback: "avoid repeated characters"})
+	}
+
+	if i+2 < len(lower) {
+		delta := lower[i+1] - lower[i]
+		j = i + 1
+		for (delta == 1 || delta == -1) && j < len(lower) && lower[j]-lower[j-1] == delta {
+			j++
+		}
+		if j-i >= 3 {
+			base := 26.0
+			switch {
+			case strings.ContainsRune("az019", lower[i]):
+				base = 4
+			case unicode.IsDigit(lower[i]):
+				base = 10
+			}
+			consider(match{length: j - i, guesses: base * float64(j-i), feedback: "avoid sequences like abc or 123"})
+		}
+	}
+
+	for _, row := range keyboardRows {
+		for _, r := range []string{row, reverse(row)} {
+			n := 0
+			for n < len(lower)-i && strings.Contains(r, string(lower[i:i+n+1])) {
+				n++
+			}
+			if n >= 4 {
+				consider(match{length: n, guesses: 40 * float64(n), feedback: "avoid keyboard patterns like qwerty"})
+			}
+		}
+	}
+
+	if i+4 <= len(lower) {
+		if year := string(lower[i : i+4]); year >= "1900" && year <= "2049" && isDigits(year) {
+			consider(match{length: 4, guesses: 50, feedback: "avoid years"})
+		}
+	}
+	return best
+}
+
+// dictionary ranks the common passwords and words, the user's own inputs first as they're the likeliest guesses
+func dictionary(userInputs []string) map[string]int {
+	dict := make(map[string]int, len(common)+len(userInputs))
+	for i, w := range common {
+		dict[w] = len(userInputs) + i + 1
+	}
+	for i, w := range userInputs {
+		if w = strings.ToLower(w); len(w) >= 3 {
+			dict[w] = i + 1
+		}
+	}
+	return dict
+}
+
+// unleet undoes l33t substitutions, returning how many there were
+func unleet(runes []rune) (string, int) {
+	var b strings.Builder
+	subs := 0
+	for _, r := range runes {
+		if l, ok := leet[r]; ok {
+			r = l
+			subs++
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), subs
+}
+
+// caseVariations is how many ways the case of a word could have been changed to give runes
+// - capitalized and all upper case words are tried first
+func caseVariations(runes []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0, upper == 1 && unicode.IsUpper(runes[0]):
+		return 2
+	}
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+// cardinality is how many characters of the same kind as r a brute force attack tries
+func cardinality(r rune) float64 {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r < unicode.MaxASCII:
+		return 33
+	}
+	return 100
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func logFactorial(n int) float64 {
+	f := 0.0
+	for i := 2; i <= n; i++ {
+		f += math.Log10(float64(i))
+	}
+	return f
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
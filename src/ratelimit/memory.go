@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets which are full again are forgotten
+const sweepInterval = time.Minute
+
+// MemoryStore keeps the buckets of a single instance
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]time.Time
+	swept   time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]time.Time{}, swept: time.Now()}
+}
+
+// GetBucket returns when the bucket of key is full again, zero when it has none
+func (s *MemoryStore) GetBucket(_ context.Context, key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[key], nil
+}
+
+// SwapBucket sets when the bucket of key is full again to next if it still is old
+// - full buckets are the same as missing ones, they are dropped every now and then so clients seen once don't pile up
+func (s *MemoryStore) SwapBucket(_ context.Context, key string, old, next time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.buckets[key].Equal(old) {
+		return false, nil
+	}
+	s.buckets[key] = next
+
+	now := time.Now()
+	if now.Sub(s.swept) > sweepInterval {
+		for k, tat := range s.buckets {
+			if tat.Before(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	return true, nil
+}
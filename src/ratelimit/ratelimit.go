@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// Memory keeps the buckets in the instance, each instance allowing the configured rate
+	Memory = "memory"
+	// Mongo keeps the buckets in MongoDB, shared by all the instances
+	Mongo = "mongo"
+
+	// swapAttempts caps how many times a bucket updated concurrently is read again
+	swapAttempts = 5
+)
+
+// ErrContended is returned when a bucket kept changing while being taken from
+var ErrContended = errors.New("rate limit bucket contended")
+
+// Config holds the rate limiting configuration
+type Config struct {
+	Enabled bool `envconfig:"enabled" default:"true"`
+	// Backend is memory or mongo
+	Backend string `envconfig:"backend" default:"memory"`
+	// Rate is how many requests per second a client is allowed in the long run
+	Rate float64 `envconfig:"rate" default:"10"`
+	// Burst is how many requests a client may send at once, the size of its bucket
+	Burst int `envconfig:"burst" default:"50"`
+}
+
+// Validate checks the backend is known and the bucket makes sense
+func (conf Config) Validate() error {
+	if !conf.Enabled {
+		return nil
+	}
+	switch {
+	case conf.Backend != Memory && conf.Backend != Mongo:
+		return fmt.Errorf("unknown backend %q, expected %s or %s", conf.Backend, Memory, Mongo)
+	case conf.Rate <= 0:
+		return fmt.Errorf("rate must be positive, got %g", conf.Rate)
+	case conf.Burst < 1:
+		return fmt.Errorf("burst must be at least 1, got %d", conf.Burst)
+	}
+	return nil
+}
+
+// Store keeps the buckets, as the time at which each of them is full again (its theoretical arrival time)
+type Store interface {
+	// GetBucket returns when the bucket of key is full again, zero when it has none
+	GetBucket(ctx context.Context, key string) (time.Time, error)
+	// SwapBucket sets when the bucket of key is full again to next if it still is old, telling whether it did
+	SwapBucket(ctx context.Context, key string, old, next time.Time) (bool, error)
+}
+
+// Result is the state of a bucket once a request was let through or turned down
+type Result struct {
+	Allowed bool
+	// Limit is the size of the bucket and Remaining the requests it still allows right away
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until a turned down request would be let through
+	RetryAfter time.Duration
+	// Window is how long a full bucket takes to refill from empty
+	Window time.Duration
+}
+
+// Limiter lets requests through while their client's bucket has tokens left
+// - buckets are kept as a generic cell rate algorithm does, a single timestamp per client, which makes them cheap to
+// keep in a shared store and to update with a compare and swap
+type Limiter struct {
+	store Store
+	// interval is the time a token takes to come back, tolerance the time a full bucket takes to refill
+	interval  time.Duration
+	tolerance time.Duration
+	burst     int
+}
+
+// New creates a Limiter keeping its buckets in store
+func New(store Store, conf Config) *Limiter {
+	interval := time.Duration(float64(time.Second) / conf.Rate)
+	return &Limiter{store: store, interval: interval, tolerance: interval * time.Duration(conf.Burst), burst: conf.Burst}
+}
+
+// Allow takes a token from the bucket of key
+// - turned down requests don't take any, so clients retrying too early aren't held back any longer
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	for i := 0; i < swapAttempts; i++ {
+		tat, err := l.store.GetBucket(ctx, key)
+		if err != nil {
+			return Result{}, err
+		}
+		now := time.Now()
+		next := tat
+		if next.Before(now) {
+			next = now
+		}
+		next = next.Add(l.interval)
+
+		res := Result{Limit: l.burst, Window: l.tolerance}
+		if allowAt := next.Add(-l.tolerance); now.Before(allowAt) {
+			res.RetryAfter, res.Reset = allowAt.Sub(now), tat.Sub(now)
+			return res, nil
+		}
+
+		swapped, err := l.store.SwapBucket(ctx, key, tat, next)
+		if err != nil {
+			return Result{}, err
+		}
+		if swapped {
+			res.Allowed, res.Reset = true, next.Sub(now)
+			res.Remaining = int((l.tolerance - res.Reset) / l.interval)
+			return res, nil
+		}
+	}
+	return Result{}, ErrContended
+}
+
+// Seconds rounds a duration up to whole seconds, as rate limiting headers give them
+func Seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,39 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// Header is the HTTP header a request ID is given and echoed with
+const Header = "X-Request-ID"
+
+// valid matches the request IDs accepted from callers: short, and safe to log and send to the database
+var valid = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type key struct{}
+
+// New returns a new random request ID
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid tells whether an ID given by a caller can be used as is; other IDs are replaced by a new one
+func Valid(id string) bool {
+	return valid.MatchString(id)
+}
+
+// NewContext returns ctx carrying the ID of the request it serves
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// FromContext returns the ID of the request served with ctx, empty when there's none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
@@ -0,0 +1,349 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"spymaster/src/events"
+	"spymaster/src/password"
+	"spymaster/src/rpc/pb"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+// Config holds the gRPC listener configuration
+type Config struct {
+	Address string `envconfig:"address" default:":7001"`
+}
+
+const (
+	defaultPerPage = 100
+	watchBuffer    = 64
+)
+
+// methodScopes are the scopes needed for each UserService method; health checking and reflection need none
+var methodScopes = map[string]string{
+	pb.UserService_GetUser_FullMethodName:    types.ScopeUsersRead,
+	pb.UserService_ListUsers_FullMethodName:  types.ScopeUsersRead,
+	pb.UserService_WatchUsers_FullMethodName: types.ScopeUsersRead,
+	pb.UserService_CreateUser_FullMethodName: types.ScopeUsersWrite,
+	pb.UserService_UpdateUser_FullMethodName: types.ScopeUsersWrite,
+	pb.UserService_DeleteUser_FullMethodName: types.ScopeUsersDelete,
+}
+
+// Server implements pb.UserServiceServer on top of the spymaster package
+type Server struct {
+	pb.UnimplementedUserServiceServer
+
+	service *spymaster.Service
+	broker  *events.Broker
+	auth    *spymaster.Authenticator
+}
+
+// NewServer creates a gRPC server exposing the UserService, health checking and reflection
+// - broker is where WatchUsers subscribes to user events
+// - callers are identified by the bearer token of their authorization metadata and authorized by auth, as REST
+// requests are; auth may be nil when login is disabled
+func NewServer(svc *spymaster.Service, broker *events.Broker, auth *spymaster.Authenticator) *grpc.Server {
+	s := &Server{service: svc, broker: broker, auth: auth}
+	gs := grpc.NewServer(grpc.UnaryInterceptor(s.authorizeUnary), grpc.StreamInterceptor(s.authorizeStream))
+	pb.RegisterUserServiceServer(gs, s)
+
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus(pb.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(gs, hs)
+
+	reflection.Register(gs)
+	return gs
+}
+
+// GetUser fetches a single user
+func (s *Server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.User, error) {
+	user, err := s.service.GetUser(ctx, req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toUser(user), nil
+}
+
+// ListUsers lists the users matching the request filters
+func (s *Server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	if req.GetPage() < 0 || req.GetPerPage() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page and per_page must be greater than zero")
+	}
+	perPage, pageNumber := int(req.GetPerPage()), int(req.GetPage())
+	maxPerPage := s.service.MaxPerPage()
+	if perPage == 0 {
+		perPage = defaultPerPage
+		if perPage > maxPerPage {
+			perPage = maxPerPage
+		}
+	}
+	if pageNumber == 0 {
+		pageNumber = 1
+	}
+	if perPage > maxPerPage {
+		return nil, status.Errorf(codes.InvalidArgument, "per_page must be at most %d", maxPerPage)
+	}
+
+	exact := map[string]interface{}{}
+	if req.GetId() != "" {
+		exact["_id"] = req.GetId()
+	}
+	if req.GetCountry() != "" {
+		exact["country"] = req.GetCountry()
+	}
+
+	partial := map[string]string{}
+	for field, value := range map[string]string{
+		"first_name": req.GetFirstName(),
+		"last_name":  req.GetLastName(),
+		"nickname":   req.GetNickname(),
+		"email":      req.GetEmail(),
+	} {
+		if value != "" {
+			partial[field] = value
+		}
+	}
+
+	result, err := s.service.ListUsers(ctx, exact, partial, perPage, pageNumber)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &pb.ListUsersResponse{
+		Page:       int32(result.Page),
+		PerPage:    int32(result.PerPage),
+		TotalCount: int32(result.TotalCount),
+	}
+	for _, u := range result.Users {
+		resp.Users = append(resp.Users, toUser(u))
+	}
+	return resp, nil
+}
+
+// CreateUser creates a new user
+func (s *Server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.User, error) {
+	if req.GetNickname() == "" || req.GetPassword() == "" || req.GetEmail() == "" {
+		return nil, status.Error(codes.InvalidArgument, "nickname, password and email are required")
+	}
+
+	payload := &types.UserPost{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Nickname:  req.GetNickname(),
+		Password:  req.GetPassword(),
+		Email:     req.GetEmail(),
+		Country:   req.Country,
+	}
+	user, err := s.service.CreateUser(ctx, payload)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toUser(user), nil
+}
+
+// UpdateUser updates the fields set in the request
+func (s *Server) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
+	payload := &types.UserPatch{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Nickname:  req.Nickname,
+		Password:  req.Password,
+		Email:     req.Email,
+		Country:   req.Country,
+	}
+	if *payload == (types.UserPatch{}) {
+		return nil, status.Error(codes.InvalidArgument, "at least one field must be updated")
+	}
+
+	user, err := s.service.UpdateUser(ctx, req.GetId(), payload)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toUser(user), nil
+}
+
+// DeleteUser deletes a user
+// - like its REST counterpart, deleting a missing user is not an error
+func (s *Server) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*emptypb.Empty, error) {
+	err := s.service.DeleteUser(ctx, req.GetId())
+	if err != nil && err != spymaster.ErrNotFound {
+		return nil, toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// WatchUsers streams user events until the client goes away
+func (s *Server) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	ch, cancel := s.broker.Subscribe(watchBuffer)
+	defer cancel()
+
+	wanted := map[pb.EventType]bool{}
+	for _, t := range req.GetTypes() {
+		wanted[t] = true
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			ev := toEvent(e)
+			if len(wanted) > 0 && !wanted[ev.Type] {
+				continue
+			}
+			if req.GetUserId() != "" && req.GetUserId() != ev.UserId {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authorizeUnary authorizes unary calls, see authorize
+func (s *Server) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var target string
+	if r, ok := req.(interface{ GetId() string }); ok {
+		target = r.GetId()
+	}
+	ctx, err := s.authorize(ctx, info.FullMethod, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeStream authorizes streaming calls, see authorize
+func (s *Server) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(ss.Context(), info.FullMethod, "")
+	if err != nil {
+		return err
+	}
+	return handler(srv, authorizedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorize identifies the caller of method and checks it may call it on the target user, empty when there's none,
+// returning the context carrying its principal
+func (s *Server) authorize(ctx context.Context, method, target string) (context.Context, error) {
+	scope, ok := methodScopes[method]
+	if !ok {
+		return ctx, nil
+	}
+	if token := bearerToken(ctx); s.auth != nil && token != "" {
+		principal, err := s.auth.Identify(ctx, token)
+		if err == spymaster.ErrUnauthenticated {
+			return ctx, status.Error(codes.Unauthenticated, "invalid or expired token")
+		}
+		if err != nil {
+			return ctx, status.Error(codes.Internal, "server error")
+		}
+		ctx = spymaster.WithPrincipal(ctx, principal)
+	}
+	switch s.auth.AuthorizeUser(ctx, scope, target) {
+	case spymaster.ErrUnauthenticated:
+		return ctx, status.Error(codes.Unauthenticated, "authentication required")
+	case spymaster.ErrForbidden:
+		return ctx, status.Errorf(codes.PermissionDenied, "insufficient scope, %s needed", scope)
+	}
+	return ctx, nil
+}
+
+// authorizedStream is a stream whose context carries the principal of its caller
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Utils
+
+// bearerToken returns the token of the authorization metadata, empty when there's none
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		scheme, token, found := strings.Cut(v, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+func toStatus(err error) error {
+	var refused *password.Error
+	if errors.As(err, &refused) {
+		return status.Error(codes.InvalidArgument, refused.Error())
+	}
+	switch err {
+	case spymaster.ErrNotFound:
+		return status.Error(codes.NotFound, "user not found")
+	case spymaster.ErrDup:
+		return status.Error(codes.AlreadyExists, "user/email already exists")
+	case spymaster.ErrInvalidID:
+		return status.Error(codes.InvalidArgument, "invalid user ID")
+	case spymaster.ErrInvalidPage:
+		return status.Error(codes.InvalidArgument, "page out of range")
+	}
+	return status.Error(codes.Internal, "server error")
+}
+
+func toUser(u types.User) *pb.User {
+	user := &pb.User{
+		Id:        u.ID.Hex(),
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		Email:     u.Email,
+		Country:   u.Country,
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+	if u.EmailVerifiedAt != nil {
+		user.EmailVerifiedAt = timestamppb.New(*u.EmailVerifiedAt)
+	}
+	return user
+}
+
+var eventTypes = map[events.Type]pb.EventType{
+	events.UserCreated: pb.EventType_EVENT_TYPE_CREATED,
+	events.UserUpdated: pb.EventType_EVENT_TYPE_UPDATED,
+	events.UserDeleted: pb.EventType_EVENT_TYPE_DELETED,
+	events.UserLocked:  pb.EventType_EVENT_TYPE_LOCKED,
+}
+
+func toEvent(e events.Event) *pb.UserEvent {
+	ev := &pb.UserEvent{
+		Id:         e.ID,
+		Type:       eventTypes[e.Type],
+		UserId:     e.UserID,
+		OccurredAt: timestamppb.New(e.OccurredAt),
+	}
+	if e.User != nil {
+		ev.User = toUser(*e.User)
+	}
+	if e.LockedUntil != nil {
+		ev.LockedUntil = timestamppb.New(*e.LockedUntil)
+	}
+	return ev
+}
@@ -0,0 +1,153 @@
+package scim
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	serviceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	resourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	schemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// GetServiceProviderConfig describes the SCIM features supported by the service
+func GetServiceProviderConfig(c *gin.Context) {
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, gin.H{
+		"schemas": []string{serviceProviderConfigSchema},
+		"patch":   gin.H{"supported": true},
+		"bulk":    gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":  gin.H{"supported": true, "maxResults": maxResults},
+		"changePassword": gin.H{
+			"supported": true,
+		},
+		"sort":                  gin.H{"supported": false},
+		"etag":                  gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{},
+		"meta": gin.H{
+			"resourceType": "ServiceProviderConfig",
+			"location":     "/scim/v2/ServiceProviderConfig",
+		},
+	})
+}
+
+// ListSchemas lists the schemas supported by the service
+func ListSchemas(c *gin.Context) {
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, ListResponse{
+		Schemas:      []string{listResponseSchema},
+		TotalResults: 1,
+		StartIndex:   1,
+		ItemsPerPage: 1,
+		Resources:    []interface{}{userSchemaDefinition},
+	})
+}
+
+// GetSchema returns a single schema by its URN
+func GetSchema(c *gin.Context) {
+	if c.Param("id") != userSchema {
+		writeError(c, http.StatusNotFound, "", "Schema not found")
+		return
+	}
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, userSchemaDefinition)
+}
+
+// ListResourceTypes lists the resource types exposed by the service
+func ListResourceTypes(c *gin.Context) {
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, ListResponse{
+		Schemas:      []string{listResponseSchema},
+		TotalResults: 1,
+		StartIndex:   1,
+		ItemsPerPage: 1,
+		Resources:    []interface{}{userResourceType},
+	})
+}
+
+// GetResourceType returns a single resource type by name
+func GetResourceType(c *gin.Context) {
+	if c.Param("id") != "User" {
+		writeError(c, http.StatusNotFound, "", "Resource type not found")
+		return
+	}
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, userResourceType)
+}
+
+var userResourceType = gin.H{
+	"schemas":     []string{resourceTypeSchema},
+	"id":          "User",
+	"name":        "User",
+	"endpoint":    "/Users",
+	"description": "User Account",
+	"schema":      userSchema,
+	"meta": gin.H{
+		"resourceType": "ResourceType",
+		"location":     "/scim/v2/ResourceTypes/User",
+	},
+}
+
+// attribute builds a schema attribute definition with the defaults shared by most string attributes
+func attribute(name, description string, required bool, extra gin.H) gin.H {
+	a := gin.H{
+		"name":        name,
+		"type":        "string",
+		"multiValued": false,
+		"description": description,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  "readWrite",
+		"returned":    "default",
+		"uniqueness":  "none",
+	}
+	for k, v := range extra {
+		a[k] = v
+	}
+	return a
+}
+
+// userSchemaDefinition only lists the core attributes the service maps onto its users
+var userSchemaDefinition = gin.H{
+	"schemas":     []string{schemaSchema},
+	"id":          userSchema,
+	"name":        "User",
+	"description": "User Account",
+	"attributes": []gin.H{
+		attribute("userName", "Unique identifier for the User, stored as the nickname.", true, gin.H{"uniqueness": "server"}),
+		attribute("name", "The components of the user's name.", false, gin.H{
+			"type": "complex",
+			"subAttributes": []gin.H{
+				attribute("formatted", "The full name.", false, gin.H{"mutability": "readOnly"}),
+				attribute("givenName", "The given name, stored as the first name.", false, nil),
+				attribute("familyName", "The family name, stored as the last name.", false, nil),
+			},
+		}),
+		attribute("password", "The User's cleartext password.", false, gin.H{"mutability": "writeOnly", "returned": "never"}),
+		attribute("emails", "Email addresses for the user; only the primary one is kept.", true, gin.H{
+			"type":        "complex",
+			"multiValued": true,
+			"subAttributes": []gin.H{
+				attribute("value", "Email address.", true, gin.H{"uniqueness": "server"}),
+				attribute("type", "A label indicating the email's function.", false, nil),
+				{"name": "primary", "type": "boolean", "multiValued": false, "required": false, "mutability": "readWrite", "returned": "default"},
+			},
+		}),
+		attribute("addresses", "Physical addresses; only the country of the primary one is kept.", false, gin.H{
+			"type":        "complex",
+			"multiValued": true,
+			"subAttributes": []gin.H{
+				attribute("country", "The country name component.", false, nil),
+				attribute("type", "A label indicating the address' function.", false, nil),
+				{"name": "primary", "type": "boolean", "multiValued": false, "required": false, "mutability": "readWrite", "returned": "default"},
+			},
+		}),
+		{"name": "active", "type": "boolean", "multiValued": false, "required": false, "mutability": "readOnly", "returned": "default", "description": "Always true, users can't be deactivated."},
+	},
+	"meta": gin.H{
+		"resourceType": "Schema",
+		"location":     "/scim/v2/Schemas/" + userSchema,
+	},
+}
@@ -0,0 +1,144 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"spymaster/types"
+)
+
+// condition is a single `attrPath op value` SCIM filter expression
+type condition struct {
+	Attr     string
+	Operator string
+	Value    string
+}
+
+// attributes maps the filterable SCIM attributes onto the user fields and which operators they support:
+// - eq is an exact match, case insensitive unless the attribute is caseExact in the core schema (RFC 7643)
+// - co is a case insensitive partial match
+var attributes = map[string]struct {
+	field     string
+	operators []string
+	caseExact bool
+}{
+	"id":                {"_id", []string{"eq"}, true},
+	"username":          {"nickname", []string{"eq", "co"}, false},
+	"emails.value":      {"email", []string{"eq", "co"}, false},
+	"emails":            {"email", []string{"eq", "co"}, false},
+	"name.givenname":    {"first_name", []string{"eq", "co"}, false},
+	"name.familyname":   {"last_name", []string{"eq", "co"}, false},
+	"addresses.country": {"country", []string{"eq"}, false},
+}
+
+// parseFilter parses the subset of RFC 7644 filters supported by the service:
+// one or more comparisons joined by `and`
+func parseFilter(filter string) ([]condition, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var conds []condition
+	for i := 0; i < len(tokens); {
+		if len(tokens)-i < 3 {
+			return nil, fmt.Errorf("incomplete expression in filter %q", filter)
+		}
+		cond := condition{Attr: tokens[i], Operator: strings.ToLower(tokens[i+1])}
+		value := tokens[i+2]
+		if strings.HasPrefix(value, `"`) {
+			if err := json.Unmarshal([]byte(value), &cond.Value); err != nil {
+				return nil, fmt.Errorf("invalid string %s in filter", value)
+			}
+		} else {
+			cond.Value = value
+		}
+		conds = append(conds, cond)
+		i += 3
+
+		if i < len(tokens) {
+			if strings.ToLower(tokens[i]) != "and" {
+				return nil, fmt.Errorf("unsupported logical operator %q, only \"and\" is supported", tokens[i])
+			}
+			i++
+			if i == len(tokens) {
+				return nil, fmt.Errorf("dangling \"and\" in filter %q", filter)
+			}
+		}
+	}
+	return conds, nil
+}
+
+// toSearch turns filter conditions into the exact and partial criteria understood by spymaster.Service.ListUsers
+func toSearch(conds []condition) (map[string]interface{}, map[string]string, error) {
+	exact := map[string]interface{}{}
+	partial := map[string]string{}
+	for _, c := range conds {
+		a, ok := attributes[strings.ToLower(c.Attr)]
+		if !ok {
+			return nil, nil, fmt.Errorf("filtering on %q is not supported", c.Attr)
+		}
+		supported := false
+		for _, op := range a.operators {
+			supported = supported || op == c.Operator
+		}
+		if !supported {
+			return nil, nil, fmt.Errorf("operator %q is not supported for %q", c.Operator, c.Attr)
+		}
+
+		switch {
+		case c.Operator == "eq" && a.caseExact:
+			exact[a.field] = c.Value
+		case c.Operator == "eq":
+			exact[a.field] = types.EqualFold(c.Value)
+		default:
+			partial[a.field] = c.Value
+		}
+	}
+	return exact, partial, nil
+}
+
+// tokenize splits a filter on whitespace, keeping quoted strings together
+func tokenize(filter string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inString, escaped := false, false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range filter {
+		switch {
+		case inString:
+			current.WriteRune(r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == '"' {
+				inString = false
+				flush()
+			}
+		case r == '"':
+			flush()
+			inString = true
+			current.WriteRune(r)
+		case r == '(' || r == ')' || r == '[' || r == ']':
+			return nil, fmt.Errorf("grouping and complex attribute filters are not supported")
+		case r == ' ' || r == '\t':
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if inString {
+		return nil, fmt.Errorf("unterminated string in filter %q", filter)
+	}
+	flush()
+	return tokens, nil
+}
@@ -0,0 +1,198 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"spymaster/types"
+)
+
+// PatchRequest is the body of a SCIM PATCH request
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations" binding:"required"`
+}
+
+// PatchOperation is a single add, replace or remove operation
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// patchError carries the scimType to report alongside the message
+type patchError struct {
+	scimType string
+	detail   string
+}
+
+func (e *patchError) Error() string {
+	return e.detail
+}
+
+func invalidValue(format string, args ...interface{}) *patchError {
+	return &patchError{scimType: "invalidValue", detail: fmt.Sprintf(format, args...)}
+}
+
+// paths maps the supported lower cased patch paths onto the types.UserPatch field they set
+// - value filters on multi-valued attributes (e.g. emails[type eq "work"].value) are reduced to
+// the attribute itself since users only have a single email and address
+var paths = map[string]func(p *types.UserPatch) **string{
+	"username":          func(p *types.UserPatch) **string { return &p.Nickname },
+	"name.givenname":    func(p *types.UserPatch) **string { return &p.FirstName },
+	"name.familyname":   func(p *types.UserPatch) **string { return &p.LastName },
+	"emails.value":      func(p *types.UserPatch) **string { return &p.Email },
+	"addresses.country": func(p *types.UserPatch) **string { return &p.Country },
+	"password":          func(p *types.UserPatch) **string { return &p.Password },
+}
+
+// required holds the paths which can't be removed
+var required = map[string]bool{"username": true, "emails.value": true, "password": true}
+
+// toUserPatch folds all operations into a single types.UserPatch
+func (r PatchRequest) toUserPatch() (*types.UserPatch, *patchError) {
+	if len(r.Schemas) != 1 || r.Schemas[0] != patchOpSchema {
+		return nil, invalidValue("schemas must be [%q]", patchOpSchema)
+	}
+
+	patch := &types.UserPatch{}
+	for _, op := range r.Operations {
+		var err *patchError
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Path == "" {
+				err = applyObject(patch, op.Value)
+			} else {
+				err = applyPath(patch, op.Path, op.Value)
+			}
+		case "remove":
+			err = removePath(patch, op.Path)
+		default:
+			err = invalidValue("unsupported op %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *patch == (types.UserPatch{}) {
+		return nil, &patchError{scimType: "noTarget", detail: "no supported attribute was modified"}
+	}
+	return patch, nil
+}
+
+// applyObject handles add/replace operations without a path, whose value is a partial User
+func applyObject(patch *types.UserPatch, raw json.RawMessage) *patchError {
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &attrs); err != nil {
+		return invalidValue("value must be an object when no path is given")
+	}
+	for attr, value := range attrs {
+		var err *patchError
+		switch strings.ToLower(attr) {
+		case "name":
+			var sub map[string]json.RawMessage
+			if json.Unmarshal(value, &sub) != nil {
+				return invalidValue("name must be an object")
+			}
+			for k, v := range sub {
+				if e := applyPath(patch, "name."+k, v); e != nil && e.scimType != "invalidPath" {
+					return e
+				}
+			}
+		case "active", "schemas", "id", "meta":
+			// read-only or unsupported attributes are ignored, as allowed by RFC 7644
+		default:
+			err = applyPath(patch, attr, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPath sets the field targeted by path to value
+func applyPath(patch *types.UserPatch, path string, raw json.RawMessage) *patchError {
+	key := normalizePath(path)
+
+	switch key {
+	case "emails", "addresses":
+		return applyMultiValued(patch, key, raw)
+	}
+
+	field, ok := paths[key]
+	if !ok {
+		return &patchError{scimType: "invalidPath", detail: fmt.Sprintf("unsupported path %q", path)}
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return invalidValue("value for %q must be a string", path)
+	}
+	*field(patch) = &value
+	return nil
+}
+
+// applyMultiValued handles values given as the whole emails or addresses list
+func applyMultiValued(patch *types.UserPatch, key string, raw json.RawMessage) *patchError {
+	if key == "emails" {
+		var emails []Email
+		if err := json.Unmarshal(raw, &emails); err != nil {
+			return invalidValue("emails must be a list of emails")
+		}
+		if email := primaryEmail(emails); email != "" {
+			patch.Email = &email
+		}
+		return nil
+	}
+
+	var addresses []Address
+	if err := json.Unmarshal(raw, &addresses); err != nil {
+		return invalidValue("addresses must be a list of addresses")
+	}
+	country := primaryCountry(addresses)
+	patch.Country = &country
+	return nil
+}
+
+// removePath clears the field targeted by path
+func removePath(patch *types.UserPatch, path string) *patchError {
+	if path == "" {
+		return &patchError{scimType: "noTarget", detail: "remove requires a path"}
+	}
+	key := normalizePath(path)
+	switch key {
+	case "name":
+		empty := ""
+		patch.FirstName, patch.LastName = &empty, &empty
+		return nil
+	case "addresses":
+		key = "addresses.country"
+	case "emails":
+		key = "emails.value"
+	}
+
+	field, ok := paths[key]
+	if !ok {
+		return &patchError{scimType: "invalidPath", detail: fmt.Sprintf("unsupported path %q", path)}
+	}
+	if required[key] {
+		return &patchError{scimType: "mutability", detail: fmt.Sprintf("%q is required and can't be removed", path)}
+	}
+	empty := ""
+	*field(patch) = &empty
+	return nil
+}
+
+// normalizePath lower cases a path, strips the core schema URN prefix and any value filter
+func normalizePath(path string) string {
+	p := strings.ToLower(path)
+	p = strings.TrimPrefix(p, strings.ToLower(userSchema)+":")
+	if i := strings.Index(p, "["); i >= 0 {
+		if j := strings.Index(p, "]"); j > i {
+			p = p[:i] + p[j+1:]
+		}
+	}
+	return p
+}
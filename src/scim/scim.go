@@ -0,0 +1,455 @@
+package scim
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"spymaster/src/password"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+const (
+	// ContentType is the media type of every SCIM request and response
+	ContentType = "application/scim+json"
+
+	userSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	listResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	patchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	errorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	// defaultCount is the page size when count isn't given, and maxResults the most resources a listing answers with
+	defaultCount = 100
+	maxResults   = 100
+	// maxStartIndex bounds how deep a listing can start
+	maxStartIndex = math.MaxInt32
+)
+
+// User is the SCIM representation of types.User
+type User struct {
+	Schemas   []string  `json:"schemas"`
+	ID        string    `json:"id,omitempty"`
+	UserName  string    `json:"userName"`
+	Name      *Name     `json:"name,omitempty"`
+	Emails    []Email   `json:"emails,omitempty"`
+	Addresses []Address `json:"addresses,omitempty"`
+	Password  string    `json:"password,omitempty"`
+	Active    bool      `json:"active"`
+	Meta      *Meta     `json:"meta,omitempty"`
+}
+
+// Name holds the components of a user's name
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// Email is a multi-valued email attribute entry
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Address is a multi-valued address attribute entry; only the country is kept
+type Address struct {
+	Country string `json:"country,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Meta holds the resource metadata
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+// ListResponse wraps query results
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// Error is the SCIM error response body
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// RegisterRoutes attaches the SCIM endpoints to the given group, usually mounted at /scim/v2
+// - every endpoint is authorized like its REST counterpart, discovery ones as reads
+func RegisterRoutes(g *gin.RouterGroup) {
+	g.Use(authorize)
+
+	g.GET("/Users", ListUsers)
+	g.GET("/Users/:id", GetUser)
+	g.POST("/Users", CreateUser)
+	g.PUT("/Users/:id", ReplaceUser)
+	g.PATCH("/Users/:id", PatchUser)
+	g.DELETE("/Users/:id", DeleteUser)
+
+	g.GET("/ServiceProviderConfig", GetServiceProviderConfig)
+	g.GET("/Schemas", ListSchemas)
+	g.GET("/Schemas/:id", GetSchema)
+	g.GET("/ResourceTypes", ListResourceTypes)
+	g.GET("/ResourceTypes/:id", GetResourceType)
+}
+
+// methodScopes are the scopes needed for each method
+var methodScopes = map[string]string{
+	http.MethodGet:    types.ScopeUsersRead,
+	http.MethodPost:   types.ScopeUsersWrite,
+	http.MethodPut:    types.ScopeUsersWrite,
+	http.MethodPatch:  types.ScopeUsersWrite,
+	http.MethodDelete: types.ScopeUsersDelete,
+}
+
+// authorize turns down requests whose principal may not act with the scope of their method on the user they target,
+// as SCIM errors
+func authorize(c *gin.Context) {
+	auth := c.MustGet("auth").(*spymaster.Authenticator)
+	scope := methodScopes[c.Request.Method]
+	switch auth.AuthorizeUser(c.Request.Context(), scope, c.Param("id")) {
+	case spymaster.ErrUnauthenticated:
+		c.Header("WWW-Authenticate", "Bearer")
+		writeError(c, http.StatusUnauthorized, "", "Authentication required")
+	case spymaster.ErrForbidden:
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		writeError(c, http.StatusForbidden, "", "Insufficient scope")
+	default:
+		c.Next()
+	}
+}
+
+// ListUsers lists the users matching the SCIM filter, paginated with startIndex and count
+func ListUsers(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	startIndex, err := queryInt(c, "startIndex", 1)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if startIndex > maxStartIndex {
+		writeError(c, http.StatusBadRequest, "invalidValue", fmt.Sprintf("startIndex must be at most %d", maxStartIndex))
+		return
+	}
+	count, err := queryInt(c, "count", defaultCount)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	exact, partial := map[string]interface{}{}, map[string]string{}
+	if filter := c.Query("filter"); filter != "" {
+		conds, err := parseFilter(filter)
+		if err == nil {
+			exact, partial, err = toSearch(conds)
+		}
+		if err != nil {
+			writeError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+	}
+
+	// SCIM paginates by offset; servers may return fewer resources than asked for, up to the advertised maxResults
+	count = min(count, maxResults, svc.MaxPerPage())
+	result, err := svc.ListUsersFrom(c.Request.Context(), exact, partial, startIndex-1, max(count, 1))
+	if err == spymaster.ErrInvalidPage {
+		writeError(c, http.StatusBadRequest, "invalidValue", "startIndex is out of range")
+		return
+	}
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "", "Server error")
+		return
+	}
+
+	resources := []interface{}{}
+	for i := 0; i < len(result.Users) && len(resources) < count; i++ {
+		resources = append(resources, toSCIM(c, result.Users[i]))
+	}
+
+	c.Header("Content-Type", ContentType)
+	c.JSON(http.StatusOK, ListResponse{
+		Schemas:      []string{listResponseSchema},
+		TotalResults: result.TotalCount,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// GetUser fetches a single user
+func GetUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	user, err := svc.GetUser(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+
+	writeUser(c, http.StatusOK, user)
+}
+
+// CreateUser provisions a new user
+// - identity providers rarely send passwords, so a random one is set when it's missing
+func CreateUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	var in User
+	if err := c.ShouldBindJSON(&in); err != nil {
+		writeError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	payload, err := toUserPost(in)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	user, err := svc.CreateUser(c.Request.Context(), payload)
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+
+	c.Header("Location", location(c, user))
+	writeUser(c, http.StatusCreated, user)
+}
+
+// ReplaceUser replaces every mutable attribute of a user
+func ReplaceUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	var in User
+	if err := c.ShouldBindJSON(&in); err != nil {
+		writeError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if in.UserName == "" || primaryEmail(in.Emails) == "" {
+		writeError(c, http.StatusBadRequest, "invalidValue", "userName and emails are required")
+		return
+	}
+
+	userName, email := in.UserName, primaryEmail(in.Emails)
+	givenName, familyName, country := "", "", primaryCountry(in.Addresses)
+	if in.Name != nil {
+		givenName, familyName = in.Name.GivenName, in.Name.FamilyName
+	}
+	payload := &types.UserPatch{
+		FirstName: &givenName,
+		LastName:  &familyName,
+		Nickname:  &userName,
+		Email:     &email,
+		Country:   &country,
+	}
+	if in.Password != "" {
+		payload.Password = &in.Password
+	}
+
+	user, err := svc.UpdateUser(c.Request.Context(), c.Param("id"), payload)
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+
+	writeUser(c, http.StatusOK, user)
+}
+
+// PatchUser applies a SCIM PatchOp to a user
+func PatchUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	var req PatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	payload, err := req.toUserPatch()
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.scimType, err.detail)
+		return
+	}
+
+	user, serr := svc.UpdateUser(c.Request.Context(), c.Param("id"), payload)
+	if serr != nil {
+		writeServiceError(c, serr)
+		return
+	}
+
+	writeUser(c, http.StatusOK, user)
+}
+
+// DeleteUser deprovisions a user
+func DeleteUser(c *gin.Context) {
+	svc := c.MustGet("spymaster").(*spymaster.Service)
+
+	err := svc.DeleteUser(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Utils
+
+func toSCIM(c *gin.Context, u types.User) User {
+	out := User{
+		Schemas:  []string{userSchema},
+		ID:       u.ID.Hex(),
+		UserName: u.Nickname,
+		Active:   true,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     location(c, u),
+			Version:      fmt.Sprintf(`W/"%d"`, u.UpdatedAt.UnixNano()),
+		},
+	}
+	if u.FirstName != "" || u.LastName != "" {
+		out.Name = &Name{
+			Formatted:  strings.TrimSpace(u.FirstName + " " + u.LastName),
+			GivenName:  u.FirstName,
+			FamilyName: u.LastName,
+		}
+	}
+	if u.Email != "" {
+		out.Emails = []Email{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	if u.Country != "" {
+		out.Addresses = []Address{{Country: u.Country, Primary: true}}
+	}
+	return out
+}
+
+func toUserPost(in User) (*types.UserPost, error) {
+	email := primaryEmail(in.Emails)
+	if in.UserName == "" || email == "" {
+		return nil, fmt.Errorf("userName and emails are required")
+	}
+
+	payload := &types.UserPost{
+		Nickname: in.UserName,
+		Email:    email,
+		Password: in.Password,
+	}
+	if in.Name != nil {
+		payload.FirstName = &in.Name.GivenName
+		payload.LastName = &in.Name.FamilyName
+	}
+	if country := primaryCountry(in.Addresses); country != "" {
+		payload.Country = &country
+	}
+	if payload.Password == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		payload.Password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return payload, nil
+}
+
+func primaryEmail(emails []Email) string {
+	for _, e := range emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+func primaryCountry(addresses []Address) string {
+	for _, a := range addresses {
+		if a.Primary {
+			return a.Country
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses[0].Country
+	}
+	return ""
+}
+
+func location(c *gin.Context, u types.User) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/scim/v2/Users/%s", scheme, c.Request.Host, u.ID.Hex())
+}
+
+func queryInt(c *gin.Context, name string, def int) (int, error) {
+	str, found := c.GetQuery(name)
+	if !found {
+		return def, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s - expected an integer", str, name)
+	}
+	return n, nil
+}
+
+func writeUser(c *gin.Context, status int, u types.User) {
+	c.Header("Content-Type", ContentType)
+	c.Header("ETag", fmt.Sprintf(`W/"%d"`, u.UpdatedAt.UnixNano()))
+	c.JSON(status, toSCIM(c, u))
+}
+
+func writeServiceError(c *gin.Context, err error) {
+	var refused *password.Error
+	if errors.As(err, &refused) {
+		writeError(c, http.StatusBadRequest, "invalidValue", refused.Error())
+		return
+	}
+	switch err {
+	case spymaster.ErrNotFound, spymaster.ErrInvalidID:
+		writeError(c, http.StatusNotFound, "", "Resource not found")
+	case spymaster.ErrDup:
+		writeError(c, http.StatusConflict, "uniqueness", "userName or email already exists")
+	default:
+		writeError(c, http.StatusInternalServerError, "", "Server error")
+	}
+}
+
+func writeError(c *gin.Context, status int, scimType, detail string) {
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(status, Error{
+		Schemas:  []string{errorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
@@ -0,0 +1,70 @@
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of a key, for AES-256
+const KeySize = 32
+
+// ErrOpen indicates that a sealed value was tampered with, sealed for something else or with another key
+var ErrOpen = errors.New("can't open sealed value")
+
+// ParseKey decodes a base64 encoded key
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes long, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Box encrypts values to store them, with AES-GCM
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a Box sealing with key
+func New(key []byte) (*Box, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts a value for what it belongs to, e.g. a user ID, so it can't be opened for anything else
+func (b *Box) Seal(plaintext, owner string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(owner))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed for owner
+func (b *Box) Open(sealed, owner string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", ErrOpen
+	}
+	n := b.aead.NonceSize()
+	plaintext, err := b.aead.Open(nil, raw[:n], raw[n:], []byte(owner))
+	if err != nil {
+		return "", ErrOpen
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"spymaster/src/certs"
+)
+
+// HTTPConfig holds the HTTP server configuration
+type HTTPConfig struct {
+	Address           string        `envconfig:"address" default:":7000"`
+	ReadTimeout       time.Duration `envconfig:"read_timeout" default:"15s"`
+	ReadHeaderTimeout time.Duration `envconfig:"read_header_timeout" default:"5s"`
+	// WriteTimeout doesn't apply to event streams, which stay open for as long as clients want
+	WriteTimeout   time.Duration `envconfig:"write_timeout" default:"30s"`
+	IdleTimeout    time.Duration `envconfig:"idle_timeout" default:"120s"`
+	MaxHeaderBytes int           `envconfig:"max_header_bytes" default:"1048576"`
+	// ShutdownDelay is how long the instance reports itself as not ready before it stops accepting connections
+	ShutdownDelay time.Duration `envconfig:"shutdown_delay" default:"5s"`
+	// ShutdownTimeout caps how long in-flight requests are waited for when shutting down
+	ShutdownTimeout time.Duration `envconfig:"shutdown_timeout" default:"30s"`
+	// MaxPerPage caps the page size of listings
+	MaxPerPage int `envconfig:"max_per_page" default:"1000"`
+	// TrustedProxies are the addresses or CIDRs of the proxies whose X-Forwarded-For gives the client IP
+	TrustedProxies []string `envconfig:"trusted_proxies"`
+
+	TLS TLSConfig `envconfig:"tls"`
+}
+
+// Validate checks the page size cap, and that the trusted proxies are addresses or CIDRs
+func (conf HTTPConfig) Validate() error {
+	if conf.MaxPerPage < 1 {
+		return fmt.Errorf("max_per_page must be at least 1, got %d", conf.MaxPerPage)
+	}
+	for _, proxy := range conf.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("trusted proxy %q is neither an address nor a CIDR", proxy)
+			}
+		}
+	}
+	return nil
+}
+
+// TLSConfig holds the HTTPS configuration, which is served instead of plain HTTP once a certificate is set
+type TLSConfig struct {
+	CertFile string `envconfig:"cert_file"`
+	KeyFile  string `envconfig:"key_file"`
+	// ReloadInterval is how often the certificate files are checked for changes
+	ReloadInterval time.Duration `envconfig:"reload_interval" default:"1m"`
+	// ClientAuth is whether callers present a certificate: none, optional (for service callers) or require
+	ClientAuth string `envconfig:"client_auth" default:"none"`
+	// ClientCAFile is the bundle of CAs client certificates are verified against
+	ClientCAFile string `envconfig:"client_ca_file"`
+}
+
+// Validate checks the certificate settings go together
+func (conf TLSConfig) Validate() error {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	clientAuth, err := certs.ParseClientAuth(conf.ClientAuth)
+	if err != nil {
+		return err
+	}
+	if clientAuth != tls.NoClientCert && conf.ClientCAFile == "" {
+		return errors.New("client_ca_file is required to verify client certificates")
+	}
+	return nil
+}
+
+// Enabled reports whether HTTPS is served
+func (conf TLSConfig) Enabled() bool {
+	return conf.CertFile != ""
+}
+
+// NewTLSConfig creates the server side TLS configuration, serving the certificate of the reloader
+func NewTLSConfig(conf TLSConfig, reloader *certs.Reloader) (*tls.Config, error) {
+	clientAuth, err := certs.ParseClientAuth(conf.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	if clientAuth != tls.NoClientCert {
+		if conf.ClientCAFile == "" {
+			return nil, errors.New("client certificates can't be verified without a client CA file")
+		}
+		if tlsConf.ClientCAs, err = certs.LoadPool(conf.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConf, nil
+}
+
+// NewHTTPServer creates an http.Server serving handler as configured
+func NewHTTPServer(conf HTTPConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              conf.Address,
+		Handler:           withoutStreamDeadline(handler),
+		ReadTimeout:       conf.ReadTimeout,
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
+	}
+}
+
+// withoutStreamDeadline lifts the write timeout for the routes streaming server-sent events only: the user event
+// stream and GraphQL subscriptions, whose clients ask for text/event-stream
+// - any other route keeps its deadline, whatever its clients accept
+func withoutStreamDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/events",
+			r.URL.Path == "/graphql" && strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,47 +1,354 @@
 package server
 
 import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
+	"spymaster/src/config"
 	"spymaster/src/controllers"
+	"spymaster/src/events"
+	"spymaster/src/gql"
+	"spymaster/src/health"
+	"spymaster/src/jobs"
+	"spymaster/src/logging"
+	"spymaster/src/metrics"
 	"spymaster/src/mongo"
+	"spymaster/src/operations"
+	"spymaster/src/ratelimit"
+	"spymaster/src/requestid"
+	"spymaster/src/scim"
+	"spymaster/src/spymaster"
+	"spymaster/types"
 )
 
 // ContextParams holds the objects required
 type ContextParams struct {
 	MongoClient *mongo.Client
+	Service     *spymaster.Service
+	Broker      *events.Broker
+	Journal     *events.Journal
+	// Operations executes asynchronous commands; requests preferring them are processed synchronously when nil
+	Operations *operations.Dispatcher
+	// Jobs runs the background jobs, nil when they are disabled
+	Jobs      *jobs.Scheduler
+	Readiness *health.Readiness
+	// Health runs the dependency checks behind /readyz; it has none when nil
+	Health *health.Registry
+	// Auth logs users in; login is disabled when nil
+	Auth *spymaster.Authenticator
+	// Config is the effective configuration, shown to admins; nil when not loaded through config.Load
+	Config  *config.Effective
+	GraphQL gql.Config
+	// Limiter rate limits clients; nothing is limited when nil
+	Limiter *ratelimit.Limiter
+	// MaxPerPage caps the page size of listings, controllers.DefaultMaxPerPage when 0
+	MaxPerPage int
+	// TrustedProxies are the addresses or CIDRs of the proxies whose X-Forwarded-For is believed; none when empty
+	TrustedProxies []string
 }
 
 // CreateRouter creates a gin Engine and attaches backend clients, if needed as well as routes
 // to all enpoints
-func CreateRouter(mc *mongo.Client) *gin.Engine {
-	contextParams := ContextParams{
-		MongoClient: mc,
+func CreateRouter(contextParams ContextParams) *gin.Engine {
+	schema, err := gql.NewSchema(contextParams.Service, contextParams.Broker, contextParams.Auth)
+	if err != nil {
+		logging.Fatal("Failed to build GraphQL schema", "error", err)
 	}
 
-	r := gin.Default()
-	r.Use(ContextObjects(&contextParams))
+	r := gin.New()
+	if err := r.SetTrustedProxies(contextParams.TrustedProxies); err != nil {
+		logging.Fatal("Invalid trusted proxies", "error", err)
+	}
+	r.Use(RequestID(), Logging(), Recovery(), Tracing(), Metrics(), ContextObjects(&contextParams),
+		Authenticate(contextParams.Auth), RateLimit(contextParams.Limiter))
 
 	r.GET("/ping", controllers.Ping)
 	r.GET("/health", controllers.Health)
+	r.GET("/livez", controllers.Livez)
+	r.GET("/readyz", controllers.Readyz)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	users := r.Group("/users", controllers.Pagination(contextParams.MaxPerPage), Authorize(contextParams.Auth, userScopes))
+	{
+		users.GET("", controllers.ListUsers)
+		users.GET("/events", controllers.StreamUserEvents)
+		users.POST("", controllers.CreateUser)
+		users.PATCH("", controllers.UpdateUser)
+		users.DELETE("", controllers.DeleteUser)
+	}
+
+	r.GET("/operations/:id", controllers.GetOperation)
 
-	api := r.Group("/", controllers.Pagination())
+	r.POST("/login", controllers.Login)
+	r.POST("/login/mfa", controllers.LoginMFA)
+	r.POST("/logout", controllers.Logout)
+	r.POST("/email/verify", controllers.VerifyEmail)
+	r.POST("/email/verify/resend", controllers.ResendVerification)
+	r.POST("/password/forgot", controllers.RequestPasswordReset)
+	r.POST("/password/reset", controllers.ResetPassword)
+	r.POST("/mfa/enroll", controllers.EnrollMFA)
+	r.POST("/mfa/confirm", controllers.ConfirmMFA)
+
+	admin := r.Group("/admin", Authorize(contextParams.Auth, adminScopes))
 	{
-		api.GET("/users", controllers.ListUsers)
-		api.POST("/users", controllers.CreateUser)
-		api.PATCH("/users", controllers.UpdateUser)
-		api.DELETE("/users", controllers.DeleteUser)
+		admin.GET("/jobs", controllers.ListJobs)
+		admin.GET("/jobs/:name/runs", controllers.ListJobRuns)
+		admin.GET("/config", controllers.GetConfig)
+		admin.GET("/lockouts", controllers.ListLockouts)
+		admin.DELETE("/lockouts/:id", controllers.ClearLockout)
+		admin.DELETE("/users/:id/mfa", controllers.ResetMFA)
+		admin.GET("/api-keys", controllers.ListAPIKeys)
+		admin.POST("/api-keys", controllers.CreateAPIKey)
+		admin.DELETE("/api-keys/:id", controllers.RevokeAPIKey)
 	}
 
+	r.GET("/schemas", controllers.ListEventSchemas)
+	r.GET("/schemas/:type", controllers.GetEventSchema)
+
+	scim.RegisterRoutes(r.Group("/scim/v2"))
+
+	graphql := gql.Handler(schema, contextParams.GraphQL)
+	r.GET("/graphql", graphql)
+	r.POST("/graphql", graphql)
+
 	return r
 }
 
+// userScopes are the scopes needed for each method of /users
+var userScopes = map[string]string{
+	http.MethodGet:    types.ScopeUsersRead,
+	http.MethodPost:   types.ScopeUsersWrite,
+	http.MethodPatch:  types.ScopeUsersWrite,
+	http.MethodDelete: types.ScopeUsersDelete,
+}
+
+// adminScopes require the admin scope whatever the method
+var adminScopes = map[string]string{
+	http.MethodGet:    types.ScopeAdmin,
+	http.MethodPost:   types.ScopeAdmin,
+	http.MethodDelete: types.ScopeAdmin,
+}
+
+// quietRoutes are polled by probes and scrapers, they are only logged at debug level unless they fail
+var quietRoutes = map[string]bool{"/ping": true, "/health": true, "/livez": true, "/readyz": true, "/metrics": true}
+
+// RequestID takes the request ID given by the caller, or generates one, and echoes it in the response
+// - the ID is carried by the request context, so whatever is logged, recorded or queried while serving the request
+// can be tied back to it
+// - IDs which are too long or hold unexpected characters are replaced, as they end up in logs and database queries
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		c.Request = c.Request.WithContext(requestid.NewContext(c.Request.Context(), id))
+		c.Header(requestid.Header, id)
+		c.Next()
+	}
+}
+
+// Logging logs requests once served
+// - the query string is left out, as it carries search terms
+func Logging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case quietRoutes[c.FullPath()]:
+			level = slog.LevelDebug
+		}
+		slog.Log(c.Request.Context(), level, "Request served",
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+			"size", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// Recovery answers requests whose handler panicked with a 500, logging the panic with its stack
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err interface{}) {
+		slog.ErrorContext(c.Request.Context(), "Panic serving request", "panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+		controllers.Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+	})
+}
+
+// Tracing continues the trace of the caller, given as W3C trace context headers, or starts one with a span per request
+// - the span is named after the route template, unmatched requests only after the method; query strings are left out
+// as they carry search terms
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		name, route := c.Request.Method, c.FullPath()
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := otel.Tracer("spymaster").Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", c.Request.URL.Path),
+		))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Metrics records the count and latency of requests, labelled with the route template they matched
+// - unmatched requests share a single label, so scanners probing random paths can't blow up the series
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// Authenticate tells who the request comes from when it carries a session token or an API key, as a bearer token,
+// putting the principal in the request context
+// - requests without one go through anonymously, those with an unknown, expired or revoked one are turned down with
+// a 401
+func Authenticate(auth *spymaster.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := controllers.BearerToken(c)
+		if auth == nil || token == "" {
+			c.Next()
+			return
+		}
+		principal, err := auth.Identify(c.Request.Context(), token)
+		switch {
+		case err == spymaster.ErrUnauthenticated:
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			controllers.Fail(c, http.StatusUnauthorized, gin.H{"message": "Invalid or expired token"})
+			return
+		case err != nil:
+			controllers.Fail(c, http.StatusInternalServerError, gin.H{"message": "Server Error"})
+			return
+		}
+		c.Request = c.Request.WithContext(spymaster.WithPrincipal(c.Request.Context(), principal))
+		if principal.Session != nil {
+			c.Set("session", *principal.Session)
+		}
+		c.Next()
+	}
+}
+
+// Authorize lets requests to a group through when their principal may act with the scope of their method, on the
+// user given by the id query parameter if any
+// - anonymous requests which need authenticating are turned down with a 401, principals lacking the scope with a 403
+// as are methods without one
+func Authorize(auth *spymaster.Authenticator, scopes map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := scopes[c.Request.Method]
+		switch auth.AuthorizeUser(c.Request.Context(), scope, c.Query("id")) {
+		case spymaster.ErrUnauthenticated:
+			c.Header("WWW-Authenticate", "Bearer")
+			controllers.Fail(c, http.StatusUnauthorized, gin.H{"message": "Authentication required"})
+			return
+		case spymaster.ErrForbidden:
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+			controllers.Fail(c, http.StatusForbidden, gin.H{"message": "Insufficient scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RateLimit turns down clients going over their rate with a 429, telling them when to retry
+// - every answer carries the state of the client's bucket as RateLimit-* headers (draft-ietf-httpapi-ratelimit-headers)
+// - probes and scrapers aren't limited, and requests go through when the limiter's store can't be reached
+func RateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil || quietRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		res, err := limiter.Allow(c.Request.Context(), clientKey(c))
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "Failed rate limiting, letting the request through", "error", err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ratelimit.Seconds(res.Reset)))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", res.Limit, ratelimit.Seconds(res.Window)))
+		if !res.Allowed {
+			route := c.FullPath()
+			if route == "" {
+				route = "unmatched"
+			}
+			metrics.RateLimited(route)
+			c.Header("Retry-After", strconv.Itoa(ratelimit.Seconds(res.RetryAfter)))
+			controllers.Fail(c, http.StatusTooManyRequests, gin.H{"message": "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// clientKey identifies who a request comes from: the user or the API key it's authenticated as, the subject of a
+// verified client certificate, or else the client IP
+// - the client IP is only taken from X-Forwarded-For when the request comes through a trusted proxy
+func clientKey(c *gin.Context) string {
+	if id := spymaster.PrincipalFrom(c.Request.Context()).ID(); id != "" {
+		return id
+	}
+	if tls := c.Request.TLS; tls != nil && len(tls.VerifiedChains) > 0 {
+		return "cert:" + tls.PeerCertificates[0].Subject.CommonName
+	}
+	return "ip:" + c.ClientIP()
+}
+
 // ContextObjects attaches backend clients to the API context
 func ContextObjects(contextParams *ContextParams) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		newMongo := contextParams.MongoClient.Copy()
 		defer newMongo.Close()
 		c.Set("mongo", newMongo)
+		c.Set("spymaster", contextParams.Service)
+		c.Set("broker", contextParams.Broker)
+		c.Set("journal", contextParams.Journal)
+		c.Set("operations", contextParams.Operations)
+		c.Set("jobs", contextParams.Jobs)
+		c.Set("readiness", contextParams.Readiness)
+		c.Set("health", contextParams.Health)
+		c.Set("auth", contextParams.Auth)
+		c.Set("config", contextParams.Config)
 		c.Next()
 	}
 }
@@ -0,0 +1,182 @@
+package spymaster
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"spymaster/types"
+)
+
+var (
+	// ErrInvalidScopes indicates that an API key was asked for without scopes, or with unknown ones
+	ErrInvalidScopes = errors.New("invalid scopes")
+
+	// ErrInvalidExpiry indicates that an API key was asked for with an expiry already past
+	ErrInvalidExpiry = errors.New("expiry must be in the future")
+)
+
+// apiKeyIDLength is the length of the hex ID following APIKeyPrefix in keys
+const apiKeyIDLength = 16
+
+// APIKeyConfig holds the API keys configuration
+type APIKeyConfig struct {
+	// Required turns down requests on users carrying neither a session token nor an API key, whatever the transport;
+	// they go through anonymously otherwise
+	Required bool `envconfig:"required" default:"false"`
+	// TTL is how long keys created without an expiry last; they never expire when 0
+	TTL time.Duration `envconfig:"ttl" default:"2160h"`
+	// TouchInterval is how often a key's last use is written, at most
+	TouchInterval time.Duration `envconfig:"touch_interval" default:"1m"`
+}
+
+// Validate checks durations aren't negative
+func (conf APIKeyConfig) Validate() error {
+	for name, d := range map[string]time.Duration{"ttl": conf.TTL, "touch_interval": conf.TouchInterval} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", name, d)
+		}
+	}
+	return nil
+}
+
+// CreateAPIKey creates an API key given scopes, on behalf of createdBy if not empty
+// - the key is only given out now, only its hash is stored
+func (a *Authenticator) CreateAPIKey(ctx context.Context, payload *types.APIKeyPost, createdBy string) (key types.NewAPIKey, err error) {
+	ctx, end := a.svc.trace(ctx, "CreateAPIKey")
+	defer end(&err)
+
+	scopes, err := validScopes(payload.Scopes)
+	if err != nil {
+		return
+	}
+	now := a.svc.clock.Now().UTC()
+	expiresAt := payload.ExpiresAt
+	switch {
+	case expiresAt != nil && !expiresAt.After(now):
+		return key, ErrInvalidExpiry
+	case expiresAt == nil && a.conf.APIKeys.TTL > 0:
+		t := now.Add(a.conf.APIKeys.TTL)
+		expiresAt = &t
+	}
+
+	id := newAPIKeyID()
+	secret := types.APIKeyPrefix + id + "_" + newToken()
+	k := types.APIKey{ID: id, Name: payload.Name, Hash: hashToken(secret), Scopes: scopes, CreatedBy: createdBy, CreatedAt: now, ExpiresAt: expiresAt}
+	if err = a.store.CreateAPIKey(ctx, k); err != nil {
+		slog.ErrorContext(ctx, "Failed creating API key", "api_key_id", id, "error", err)
+		return
+	}
+	return types.NewAPIKey{APIKey: k, Key: secret}, nil
+}
+
+// ListAPIKeys lists the API keys, revoked and expired ones included
+func (a *Authenticator) ListAPIKeys(ctx context.Context) (keys []types.APIKey, err error) {
+	ctx, end := a.svc.trace(ctx, "ListAPIKeys")
+	defer end(&err)
+
+	keys, err = a.store.ListAPIKeys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed listing API keys", "error", err)
+	}
+	return
+}
+
+// RevokeAPIKey stops an API key from working, it's still listed
+func (a *Authenticator) RevokeAPIKey(ctx context.Context, id string) (err error) {
+	ctx, end := a.svc.trace(ctx, "RevokeAPIKey")
+	defer end(&err)
+
+	err = a.store.RevokeAPIKey(ctx, id, a.svc.clock.Now().UTC())
+	if a.store.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed revoking API key", "api_key_id", id, "error", err)
+	}
+	return
+}
+
+// AuthenticateKey returns the API key a request carries, recording it was used
+// - unknown, revoked and expired keys are all ErrUnauthenticated
+func (a *Authenticator) AuthenticateKey(ctx context.Context, secret string) (key types.APIKey, err error) {
+	ctx, end := a.svc.trace(ctx, "AuthenticateKey")
+	defer end(&err)
+
+	id, ok := parseAPIKey(secret)
+	if !ok {
+		return key, ErrUnauthenticated
+	}
+	key, err = a.store.GetAPIKey(ctx, id)
+	if a.store.IsNotFound(err) {
+		return types.APIKey{}, ErrUnauthenticated
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed fetching API key", "api_key_id", id, "error", err)
+		return
+	}
+	now := a.svc.clock.Now().UTC()
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashToken(secret))) != 1 ||
+		key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+		return types.APIKey{}, ErrUnauthenticated
+	}
+
+	if err := a.store.TouchAPIKey(ctx, id, now, now.Add(-a.conf.APIKeys.TouchInterval)); err != nil {
+		slog.ErrorContext(ctx, "Failed recording API key use", "api_key_id", id, "error", err)
+	}
+	return key, nil
+}
+
+// IsAPIKey tells whether a bearer token is an API key rather than a session token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, types.APIKeyPrefix)
+}
+
+// validScopes returns scopes without duplicates, as long as there is one at least and all are known
+func validScopes(scopes []string) ([]string, error) {
+	var valid []string
+	for _, s := range scopes {
+		known := false
+		for _, k := range types.Scopes {
+			known = known || s == k
+		}
+		if !known {
+			return nil, ErrInvalidScopes
+		}
+		if !(types.APIKey{Scopes: valid}).Allows(s) {
+			valid = append(valid, s)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, ErrInvalidScopes
+	}
+	return valid, nil
+}
+
+// parseAPIKey returns the ID of an API key, which follows its prefix
+func parseAPIKey(secret string) (string, bool) {
+	rest, ok := strings.CutPrefix(secret, types.APIKeyPrefix)
+	if !ok || len(rest) <= apiKeyIDLength || rest[apiKeyIDLength] != '_' {
+		return "", false
+	}
+	id := rest[:apiKeyIDLength]
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// newAPIKeyID returns a random API key ID
+func newAPIKeyID() string {
+	b := make([]byte, apiKeyIDLength/2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
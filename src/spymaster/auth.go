@@ -0,0 +1,465 @@
+package spymaster
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+
+	"spymaster/src/events"
+	"spymaster/src/lockout"
+	"spymaster/src/mail"
+	"spymaster/src/secretbox"
+	"spymaster/src/tracing"
+	"spymaster/types"
+)
+
+var (
+	// ErrInvalidCredentials indicates that no user has the login and password given
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrUnauthenticated indicates that a session token is unknown or expired
+	ErrUnauthenticated = errors.New("invalid or expired session")
+
+	// ErrInvalidToken indicates that a mailed token is unknown, expired, already used or for an email since changed
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+// LockedOutError is returned by Login while the account or the client logging in has to wait before trying again
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// AuthConfig holds the login configuration
+type AuthConfig struct {
+	// SessionTTL is how long a session lasts after logging in
+	SessionTTL time.Duration  `envconfig:"session_ttl" default:"24h"`
+	Lockout    lockout.Config `envconfig:"lockout"`
+	// VerificationTTL and ResetTTL are how long mailed email verification and password reset links work
+	VerificationTTL time.Duration `envconfig:"verification_ttl" default:"48h"`
+	ResetTTL        time.Duration `envconfig:"reset_ttl" default:"1h"`
+	// LinkURL is the app mailed links lead to, its /verify-email and /reset-password pages get the token as a parameter
+	LinkURL string       `envconfig:"link_url" default:"http://localhost:7000"`
+	MFA     MFAConfig    `envconfig:"mfa"`
+	APIKeys APIKeyConfig `envconfig:"api_keys"`
+	// Admins are the IDs of the users who may use the /admin routes when logged in
+	Admins []string `envconfig:"admins"`
+}
+
+// Validate checks durations are positive, links lead somewhere and admins are user IDs
+func (conf AuthConfig) Validate() error {
+	for name, d := range map[string]time.Duration{"session_ttl": conf.SessionTTL, "verification_ttl": conf.VerificationTTL, "reset_ttl": conf.ResetTTL} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", name, d)
+		}
+	}
+	if u, err := url.Parse(conf.LinkURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("link_url must be an absolute URL, got %q", conf.LinkURL)
+	}
+	for _, id := range conf.Admins {
+		if !bson.IsObjectIdHex(id) {
+			return fmt.Errorf("admins must be user IDs, got %q", id)
+		}
+	}
+	return nil
+}
+
+// Authenticator logs users in and tells who holds a session token
+type Authenticator struct {
+	svc      *Service
+	store    AuthStore
+	lockouts *lockout.Tracker
+	mailer   mail.Mailer
+	// box encrypts the MFA secrets, nil when MFA is disabled
+	box  *secretbox.Box
+	conf AuthConfig
+	// decoy is compared with the passwords of logins nobody has, so they take as long to fail as wrong passwords
+	decoy string
+}
+
+// NewAuthenticator creates an Authenticator for the users of svc; lockouts may be nil to never lock anyone out
+// - MFA is disabled unless conf holds a key to encrypt secrets with
+// - mailer may be nil to disable email verification and password resets, otherwise the users created through svc, or
+// changing email, are mailed a verification link
+func NewAuthenticator(svc *Service, store AuthStore, lockouts *lockout.Tracker, mailer mail.Mailer, conf AuthConfig) (*Authenticator, error) {
+	decoy, err := svc.hasher.Hash(newToken())
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{svc: svc, store: store, lockouts: lockouts, mailer: mailer, conf: conf, decoy: decoy}
+	if conf.MFA.Key != "" {
+		key, err := secretbox.ParseKey(conf.MFA.Key)
+		if err != nil {
+			return nil, err
+		}
+		if a.box, err = secretbox.New(key); err != nil {
+			return nil, err
+		}
+	}
+	if mailer != nil {
+		svc.SetVerifier(a)
+	}
+	return a, nil
+}
+
+// Mails tells whether the flows mailing users are enabled
+func (a *Authenticator) Mails() bool {
+	return a.mailer != nil
+}
+
+// Login opens a session for the user whose nickname or email is login, if password is theirs
+// - users with MFA enabled get an *MFARequiredError instead, LoginMFA opens their session given a code
+// - failures are counted against the login and the client ip; past a few of them, attempts have to wait a little
+// longer after each failure, then both are locked out for a while
+// - attempts are counted before the password is checked, so concurrent ones can't skip the wait
+// - whether a user has the login or not, failures look and take the same
+func (a *Authenticator) Login(ctx context.Context, login, password, ip string) (token types.SessionToken, err error) {
+	ctx, end := a.svc.trace(ctx, "Login")
+	defer end(&err)
+
+	attempt, wait, err := a.lockouts.Begin(ctx, login, ip)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed recording login attempt", "error", err)
+		return
+	}
+	if wait > 0 {
+		a.fail(ctx, attempt)
+		return token, &LockedOutError{RetryAfter: wait}
+	}
+
+	users, err := a.store.FindUsersByLogin(ctx, login)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed finding users by login", "error", err)
+		return
+	}
+	var user *types.User
+	for i := range users {
+		if a.compare(ctx, users[i].Password, password) == nil {
+			user = &users[i]
+			break
+		}
+	}
+	if len(users) == 0 {
+		a.compare(ctx, a.decoy, password)
+	}
+	if user == nil {
+		a.fail(ctx, attempt)
+		return token, ErrInvalidCredentials
+	}
+
+	if user.MFA != nil && user.MFA.EnabledAt != nil {
+		if err := a.lockouts.Release(ctx, attempt); err != nil {
+			slog.ErrorContext(ctx, "Failed releasing login attempt", "user_id", user.ID.Hex(), "error", err)
+		}
+		return token, a.challenge(ctx, *user, login)
+	}
+	return a.open(ctx, *user, attempt)
+}
+
+// open clears the failed logins of the account of attempt and opens a session for user
+func (a *Authenticator) open(ctx context.Context, user types.User, attempt lockout.Attempt) (types.SessionToken, error) {
+	if err := a.lockouts.Release(ctx, attempt); err != nil {
+		slog.ErrorContext(ctx, "Failed releasing login attempt", "user_id", user.ID.Hex(), "error", err)
+	}
+	if err := a.lockouts.Succeed(ctx, attempt.Account); err != nil {
+		slog.ErrorContext(ctx, "Failed clearing failed logins", "user_id", user.ID.Hex(), "error", err)
+	}
+
+	secret := newToken()
+	now := a.svc.clock.Now().UTC()
+	session := types.Session{ID: hashToken(secret), UserID: user.ID.Hex(), CreatedAt: now, ExpiresAt: now.Add(a.conf.SessionTTL)}
+	if err := a.store.CreateSession(ctx, session); err != nil {
+		slog.ErrorContext(ctx, "Failed creating session", "user_id", session.UserID, "error", err)
+		return types.SessionToken{}, err
+	}
+	return types.SessionToken{Token: secret, UserID: session.UserID, ExpiresAt: session.ExpiresAt}, nil
+}
+
+// fail ends a failed login attempt, notifying the users of an account it locked out
+func (a *Authenticator) fail(ctx context.Context, attempt lockout.Attempt) {
+	locked, err := a.lockouts.Fail(ctx, attempt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed recording failed login", "error", err)
+	}
+	for _, r := range locked {
+		slog.WarnContext(ctx, "Locked out after failed logins", "kind", r.Kind, "lockout_id", r.ID, "locked_until", r.LockedUntil)
+		if r.Kind != lockout.Account {
+			continue
+		}
+		users, err := a.store.FindUsersByLogin(ctx, attempt.Account)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed finding users by login", "error", err)
+		}
+		for _, u := range users {
+			e := events.New(events.UserLocked, u.ID.Hex(), nil)
+			e.LockedUntil = r.LockedUntil
+			a.svc.publish(ctx, e.ID, e)
+		}
+	}
+}
+
+// Authenticate returns the session a token opened
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (session types.Session, err error) {
+	ctx, end := a.svc.trace(ctx, "Authenticate")
+	defer end(&err)
+
+	session, err = a.store.GetSession(ctx, hashToken(token))
+	if a.store.IsNotFound(err) || (err == nil && !session.ExpiresAt.After(a.svc.clock.Now())) {
+		return types.Session{}, ErrUnauthenticated
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed fetching session", "error", err)
+	}
+	return
+}
+
+// Logout ends the session a token opened
+func (a *Authenticator) Logout(ctx context.Context, token string) (err error) {
+	ctx, end := a.svc.trace(ctx, "Logout")
+	defer end(&err)
+
+	err = a.store.DeleteSession(ctx, hashToken(token))
+	if a.store.IsNotFound(err) {
+		return ErrUnauthenticated
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed deleting session", "error", err)
+	}
+	return
+}
+
+// Lockouts lists the accounts and clients which failed logging in recently, or are locked out
+func (a *Authenticator) Lockouts(ctx context.Context) (records []lockout.Record, err error) {
+	ctx, end := a.svc.trace(ctx, "Lockouts")
+	defer end(&err)
+
+	return a.lockouts.List(ctx)
+}
+
+// ClearLockout forgets the failed logins of an account or a client, lifting its lockout
+func (a *Authenticator) ClearLockout(ctx context.Context, id string) (err error) {
+	ctx, end := a.svc.trace(ctx, "ClearLockout")
+	defer end(&err)
+
+	err = a.lockouts.Clear(ctx, id)
+	if err == lockout.ErrNotFound {
+		return ErrNotFound
+	}
+	return
+}
+
+// RequestVerification mails a user a link verifying their email, the links mailed before stop working
+func (a *Authenticator) RequestVerification(ctx context.Context, user types.User) (err error) {
+	ctx, end := a.svc.trace(ctx, "RequestVerification")
+	defer end(&err)
+
+	if a.mailer == nil {
+		return nil
+	}
+	if err = a.store.DeleteTokens(ctx, user.ID.Hex(), types.VerifyEmail); err != nil {
+		slog.ErrorContext(ctx, "Failed deleting verification tokens", "user_id", user.ID.Hex(), "error", err)
+		return
+	}
+	secret, err := a.createToken(ctx, types.VerifyEmail, user, a.conf.VerificationTTL)
+	if err != nil {
+		return
+	}
+	return a.send(ctx, user, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email by following this link, which works for %s:\n\n%s\n\n"+
+			"If you didn't sign up, you can ignore this message.\n", user.Nickname, a.conf.VerificationTTL, a.link("/verify-email", secret)),
+	})
+}
+
+// ResendVerification mails the user a new verification link, unless their email is verified already
+func (a *Authenticator) ResendVerification(ctx context.Context, userID string) (err error) {
+	ctx, end := a.svc.trace(ctx, "ResendVerification")
+	defer end(&err)
+
+	user, err := a.svc.GetUser(ctx, userID)
+	if err != nil || user.EmailVerifiedAt != nil {
+		return
+	}
+	return a.RequestVerification(ctx, user)
+}
+
+// VerifyEmail marks the email a verification token was mailed to as verified, if the user still has it
+func (a *Authenticator) VerifyEmail(ctx context.Context, token string) (user types.User, err error) {
+	ctx, end := a.svc.trace(ctx, "VerifyEmail")
+	defer end(&err)
+
+	t, err := a.consumeToken(ctx, token, types.VerifyEmail)
+	if err != nil {
+		return
+	}
+	user, err = a.holder(ctx, t)
+	if err != nil || user.EmailVerifiedAt != nil {
+		return
+	}
+	now := a.svc.clock.Now().UTC()
+	return a.svc.UpdateUser(ctx, t.UserID, &types.UserPatch{EmailVerifiedAt: &now})
+}
+
+// RequestPasswordReset mails the users whose nickname or email is login a link to reset their password
+// - whether a user has the login or not, the request looks the same to the caller: failing to mail them, or to
+// create their token, is only logged
+func (a *Authenticator) RequestPasswordReset(ctx context.Context, login string) (err error) {
+	ctx, end := a.svc.trace(ctx, "RequestPasswordReset")
+	defer end(&err)
+
+	users, err := a.store.FindUsersByLogin(ctx, login)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed finding users by login", "error", err)
+		return
+	}
+	for _, user := range users {
+		secret, err := a.createToken(ctx, types.ResetPassword, user, a.conf.ResetTTL)
+		if err != nil {
+			// logged by createToken
+			continue
+		}
+		// logged by send
+		_ = a.send(ctx, user, mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nYou can choose a new password by following this link, which works once for %s:\n\n%s\n\n"+
+				"If you didn't ask for it, you can ignore this message, your password is unchanged.\n", user.Nickname, a.conf.ResetTTL, a.link("/reset-password", secret)),
+		})
+	}
+	return nil
+}
+
+// ResetPassword sets the password of the user a reset token was mailed to, then logs them out everywhere
+// - following the link proves owning the email, it's verified too, and lockouts of the account are lifted
+func (a *Authenticator) ResetPassword(ctx context.Context, token, password string) (err error) {
+	ctx, end := a.svc.trace(ctx, "ResetPassword")
+	defer end(&err)
+
+	// the token is only used up once the password is accepted, so a refused one can be fixed
+	t, err := a.store.GetToken(ctx, hashToken(token), types.ResetPassword)
+	if t, err = a.validToken(ctx, t, err); err != nil {
+		return
+	}
+	user, err := a.holder(ctx, t)
+	if err != nil {
+		return
+	}
+	if err = a.svc.CheckPassword(ctx, password, user); err != nil {
+		return
+	}
+	if _, err = a.consumeToken(ctx, token, types.ResetPassword); err != nil {
+		return
+	}
+	patch := &types.UserPatch{Password: &password}
+	if user.EmailVerifiedAt == nil {
+		now := a.svc.clock.Now().UTC()
+		patch.EmailVerifiedAt = &now
+	}
+	if _, err = a.svc.UpdateUser(ctx, t.UserID, patch); err != nil {
+		return
+	}
+
+	if err := a.store.DeleteTokens(ctx, t.UserID, types.ResetPassword); err != nil {
+		slog.ErrorContext(ctx, "Failed deleting password reset tokens", "user_id", t.UserID, "error", err)
+	}
+	if err = a.store.DeleteSessions(ctx, t.UserID); err != nil {
+		slog.ErrorContext(ctx, "Failed deleting sessions", "user_id", t.UserID, "error", err)
+		return
+	}
+	for _, login := range []string{user.Nickname, user.Email} {
+		if err := a.lockouts.Succeed(ctx, login); err != nil {
+			slog.ErrorContext(ctx, "Failed clearing failed logins", "user_id", t.UserID, "error", err)
+		}
+	}
+	return nil
+}
+
+// createToken stores a token mailed to user for purpose, returning the token itself
+func (a *Authenticator) createToken(ctx context.Context, purpose string, user types.User, ttl time.Duration) (string, error) {
+	secret := newToken()
+	now := a.svc.clock.Now().UTC()
+	t := types.Token{ID: hashToken(secret), Purpose: purpose, UserID: user.ID.Hex(), Email: user.Email, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	if err := a.store.CreateToken(ctx, t); err != nil {
+		slog.ErrorContext(ctx, "Failed creating token", "user_id", t.UserID, "purpose", purpose, "error", err)
+		return "", err
+	}
+	return secret, nil
+}
+
+// consumeToken uses up a mailed token, which has to be unexpired
+func (a *Authenticator) consumeToken(ctx context.Context, token, purpose string) (types.Token, error) {
+	t, err := a.store.ConsumeToken(ctx, hashToken(token), purpose)
+	return a.validToken(ctx, t, err)
+}
+
+// validToken turns the token a store returned into ErrInvalidToken when it's missing or expired
+func (a *Authenticator) validToken(ctx context.Context, t types.Token, err error) (types.Token, error) {
+	if a.store.IsNotFound(err) || (err == nil && !t.ExpiresAt.After(a.svc.clock.Now())) {
+		return types.Token{}, ErrInvalidToken
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed fetching token", "error", err)
+	}
+	return t, err
+}
+
+// holder returns the user a token was mailed to, as long as they still have the email it was mailed to
+func (a *Authenticator) holder(ctx context.Context, t types.Token) (user types.User, err error) {
+	user, err = a.svc.GetUser(ctx, t.UserID)
+	if err == ErrNotFound || (err == nil && user.Email != t.Email) {
+		return types.User{}, ErrInvalidToken
+	}
+	return
+}
+
+// send mails a message to user; the message is never logged, it holds a token
+func (a *Authenticator) send(ctx context.Context, user types.User, m mail.Message) error {
+	_, span := tracing.Start(ctx, "mail.Send")
+	err := a.mailer.Send(ctx, m)
+	tracing.End(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed mailing user", "user_id", user.ID.Hex(), "subject", m.Subject, "error", err)
+	}
+	return err
+}
+
+// link returns the URL of the app page at path, given token
+func (a *Authenticator) link(path, token string) string {
+	return strings.TrimRight(a.conf.LinkURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// compare checks a password against a hash in its own span, as it's meant to be slow
+func (a *Authenticator) compare(ctx context.Context, hash, password string) error {
+	_, span := tracing.Start(ctx, "spymaster.ComparePassword")
+	defer span.End()
+	return a.svc.hasher.Compare(hash, password)
+}
+
+// newToken returns a random token, long enough not to be guessed
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken returns what's stored of a token; tokens are random and long, a fast hash keeps them safe
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package spymaster
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"spymaster/types"
+)
+
+// Store is the persistence layer the Service relies on
+type Store interface {
+	ListUsers(ctx context.Context, exactSearch map[string]interface{}, partialSearch map[string]string, perPage, pageNumber int) ([]types.User, int, error)
+	GetUser(ctx context.Context, userID string) (types.User, error)
+	CreateUser(ctx context.Context, user types.User) error
+	UpdateUser(ctx context.Context, userID string, payload types.UserPatch) (before, after types.User, err error)
+	DeleteUser(ctx context.Context, userID string) error
+
+	IsDup(err error) bool
+	IsNotFound(err error) bool
+	IsInvalidID(err error) bool
+}
+
+// AuthStore is the persistence layer the Authenticator relies on
+type AuthStore interface {
+	GetUser(ctx context.Context, userID string) (types.User, error)
+	FindUsersByLogin(ctx context.Context, login string) ([]types.User, error)
+	CreateSession(ctx context.Context, session types.Session) error
+	GetSession(ctx context.Context, id string) (types.Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	DeleteSessions(ctx context.Context, userID string) error
+	CreateToken(ctx context.Context, token types.Token) error
+	GetToken(ctx context.Context, id, purpose string) (types.Token, error)
+	AttemptToken(ctx context.Context, id, purpose string, max int) (types.Token, error)
+	ConsumeToken(ctx context.Context, id, purpose string) (types.Token, error)
+	DeleteTokens(ctx context.Context, userID, purpose string) error
+	StartMFA(ctx context.Context, userID string, mfa types.MFA) error
+	EnableMFA(ctx context.Context, userID, secret string, step int64, at time.Time, recoveryCodes []string) error
+	UseMFAStep(ctx context.Context, userID string, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID, hash string) (bool, error)
+	DeleteMFA(ctx context.Context, userID string) error
+	CreateAPIKey(ctx context.Context, key types.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (types.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]types.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, t time.Time) error
+	TouchAPIKey(ctx context.Context, id string, t, before time.Time) error
+
+	IsNotFound(err error) bool
+}
+
+// Verifier is told about the users whose email needs verifying, created or changing email
+type Verifier interface {
+	RequestVerification(ctx context.Context, user types.User) error
+}
+
+// Clock tells the Service what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock backed by the system time
+type SystemClock struct{}
+
+// Now returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Hasher turns plain text passwords into something safe to store
+type Hasher interface {
+	Hash(password string) (string, error)
+	Compare(hash, password string) error
+}
+
+// BcryptHasher is a Hasher using bcrypt
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash returns the bcrypt hash of password
+func (h BcryptHasher) Hash(password string) (string, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(b), err
+}
+
+// Compare returns nil when password matches hash
+func (h BcryptHasher) Compare(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
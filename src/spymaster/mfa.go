@@ -0,0 +1,310 @@
+package spymaster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"spymaster/src/secretbox"
+	"spymaster/src/totp"
+	"spymaster/types"
+)
+
+var (
+	// ErrMFADisabled indicates that no key to encrypt MFA secrets with is configured
+	ErrMFADisabled = errors.New("MFA is disabled")
+
+	// ErrMFAEnabled indicates that a user already enabled MFA, it has to be reset before enrolling again
+	ErrMFAEnabled = errors.New("MFA already enabled")
+
+	// ErrMFANotEnrolled indicates that a user confirming MFA didn't start enrolling, or enrolled again meanwhile
+	ErrMFANotEnrolled = errors.New("MFA enrollment not started")
+
+	// ErrInvalidCode indicates that an MFA code is wrong, or was used already
+	ErrInvalidCode = errors.New("invalid MFA code")
+)
+
+// recoveryCodeEncoding renders recovery codes in lower case, easier to read and type
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// MFARequiredError is returned by Login when the user has MFA enabled, Token lets them finish with a code
+type MFARequiredError struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+func (e *MFARequiredError) Error() string {
+	return "MFA code required"
+}
+
+// MFAConfig holds the TOTP second factor configuration
+type MFAConfig struct {
+	// Key encrypts the TOTP secrets, base64 encoded 32 bytes; MFA enrollment is disabled without it
+	Key string `envconfig:"key" secret:"true"`
+	// Issuer names the service in authenticator apps
+	Issuer string `envconfig:"issuer" default:"Spymaster"`
+	// Skew is how many time steps before or after the current one codes are accepted from, for clock drift
+	Skew int `envconfig:"skew" default:"1"`
+	// ChallengeTTL is how long users have to give a code once their password was checked
+	ChallengeTTL time.Duration `envconfig:"challenge_ttl" default:"5m"`
+	// RecoveryCodes is how many recovery codes users get when enabling MFA
+	RecoveryCodes int `envconfig:"recovery_codes" default:"10"`
+	// MaxAttempts is how many codes may be given for a login before its password has to be checked again
+	MaxAttempts int `envconfig:"max_attempts" default:"5"`
+}
+
+// Validate checks the key, if any, can be used and the rest makes sense
+func (conf MFAConfig) Validate() error {
+	if conf.Key != "" {
+		if _, err := secretbox.ParseKey(conf.Key); err != nil {
+			return err
+		}
+	}
+	switch {
+	case conf.Skew < 0 || conf.Skew > 10:
+		return fmt.Errorf("skew must be between 0 and 10, got %d", conf.Skew)
+	case conf.ChallengeTTL <= 0:
+		return fmt.Errorf("challenge_ttl must be positive, got %s", conf.ChallengeTTL)
+	case conf.RecoveryCodes < 1:
+		return fmt.Errorf("recovery_codes must be at least 1, got %d", conf.RecoveryCodes)
+	case conf.MaxAttempts < 1:
+		return fmt.Errorf("max_attempts must be at least 1, got %d", conf.MaxAttempts)
+	}
+	return nil
+}
+
+// EnrollMFA gives a user a new TOTP secret, to add to their authenticator app then confirm with a code
+// - the secret is only stored encrypted and never given out again; enrolling again replaces it until confirmed
+func (a *Authenticator) EnrollMFA(ctx context.Context, userID string) (enrollment types.MFAEnrollment, err error) {
+	ctx, end := a.svc.trace(ctx, "EnrollMFA")
+	defer end(&err)
+
+	if a.box == nil {
+		return enrollment, ErrMFADisabled
+	}
+	user, err := a.user(ctx, userID)
+	if err != nil {
+		return
+	}
+	if user.MFA != nil && user.MFA.EnabledAt != nil {
+		return enrollment, ErrMFAEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return
+	}
+	sealed, err := a.box.Seal(secret, userID)
+	if err != nil {
+		return
+	}
+	err = a.store.StartMFA(ctx, userID, types.MFA{Secret: sealed})
+	if a.store.IsNotFound(err) {
+		return enrollment, ErrMFAEnabled
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed starting MFA enrollment", "user_id", userID, "error", err)
+		return
+	}
+	return types.MFAEnrollment{Secret: secret, URI: totp.URI(a.conf.MFA.Issuer, user.Nickname, secret)}, nil
+}
+
+// ConfirmMFA enables the MFA a user enrolled with, given a code proving their app has the secret, and gives them
+// recovery codes, only stored hashed
+func (a *Authenticator) ConfirmMFA(ctx context.Context, userID, code string) (codes types.RecoveryCodes, err error) {
+	ctx, end := a.svc.trace(ctx, "ConfirmMFA")
+	defer end(&err)
+
+	if a.box == nil {
+		return codes, ErrMFADisabled
+	}
+	user, err := a.user(ctx, userID)
+	if err != nil {
+		return
+	}
+	switch {
+	case user.MFA == nil:
+		return codes, ErrMFANotEnrolled
+	case user.MFA.EnabledAt != nil:
+		return codes, ErrMFAEnabled
+	}
+
+	secret, err := a.box.Open(user.MFA.Secret, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed decrypting MFA secret", "user_id", userID, "error", err)
+		return
+	}
+	now := a.svc.clock.Now().UTC()
+	step, ok := totp.Validate(secret, code, now, a.conf.MFA.Skew)
+	if !ok {
+		return codes, ErrInvalidCode
+	}
+
+	hashes := make([]string, a.conf.MFA.RecoveryCodes)
+	codes.RecoveryCodes = make([]string, a.conf.MFA.RecoveryCodes)
+	for i := range hashes {
+		codes.RecoveryCodes[i] = newRecoveryCode()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes.RecoveryCodes[i]))
+	}
+	err = a.store.EnableMFA(ctx, userID, user.MFA.Secret, step, now, hashes)
+	if a.store.IsNotFound(err) {
+		return types.RecoveryCodes{}, ErrMFANotEnrolled
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed enabling MFA", "user_id", userID, "error", err)
+		return types.RecoveryCodes{}, err
+	}
+	slog.InfoContext(ctx, "Enabled MFA", "user_id", userID)
+	return
+}
+
+// LoginMFA finishes the login of a user with MFA enabled, opening their session given a code
+// - a recovery code stands in for a code, once
+// - wrong codes are counted as failed logins, as wrong passwords are
+// - each code given uses up one of the MaxAttempts of the token before being checked, so concurrent guesses are
+// counted too; the token is removed after the last one
+func (a *Authenticator) LoginMFA(ctx context.Context, mfaToken, code, ip string) (token types.SessionToken, err error) {
+	ctx, end := a.svc.trace(ctx, "LoginMFA")
+	defer end(&err)
+
+	t, err := a.store.AttemptToken(ctx, hashToken(mfaToken), types.MFALogin, a.conf.MFA.MaxAttempts)
+	if t, err = a.validToken(ctx, t, err); err != nil {
+		return
+	}
+
+	attempt, wait, err := a.lockouts.Begin(ctx, t.Login, ip)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed recording login attempt", "error", err)
+		return
+	}
+	if wait > 0 {
+		a.fail(ctx, attempt)
+		return token, &LockedOutError{RetryAfter: wait}
+	}
+
+	user, err := a.user(ctx, t.UserID)
+	if err == ErrNotFound || (err == nil && (user.MFA == nil || user.MFA.EnabledAt == nil)) {
+		return token, ErrInvalidToken
+	}
+	if err != nil {
+		return
+	}
+	ok, err := a.checkCode(ctx, user, code)
+	if err != nil {
+		return
+	}
+	if !ok {
+		a.fail(ctx, attempt)
+		if t.Attempts >= a.conf.MFA.MaxAttempts {
+			if _, err := a.store.ConsumeToken(ctx, t.ID, types.MFALogin); err != nil && !a.store.IsNotFound(err) {
+				slog.ErrorContext(ctx, "Failed consuming MFA token", "user_id", t.UserID, "error", err)
+			}
+		}
+		return token, ErrInvalidCredentials
+	}
+
+	_, err = a.store.ConsumeToken(ctx, t.ID, types.MFALogin)
+	if a.store.IsNotFound(err) {
+		return token, ErrInvalidToken
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed consuming MFA token", "user_id", t.UserID, "error", err)
+		return
+	}
+	return a.open(ctx, user, attempt)
+}
+
+// ResetMFA removes the second factor of a user, for admins to help those who lost it and their recovery codes
+func (a *Authenticator) ResetMFA(ctx context.Context, userID string) (err error) {
+	ctx, end := a.svc.trace(ctx, "ResetMFA")
+	defer end(&err)
+
+	err = a.store.DeleteMFA(ctx, userID)
+	if err != nil {
+		err = a.svc.translateError(err)
+		logFailure(ctx, "Failed resetting MFA", err, "user_id", userID)
+		return
+	}
+	if err := a.store.DeleteTokens(ctx, userID, types.MFALogin); err != nil {
+		slog.ErrorContext(ctx, "Failed deleting MFA tokens", "user_id", userID, "error", err)
+	}
+	slog.WarnContext(ctx, "Reset MFA", "user_id", userID)
+	return nil
+}
+
+// challenge starts the MFA step of a login, returning the *MFARequiredError telling the user to give a code
+func (a *Authenticator) challenge(ctx context.Context, user types.User, login string) error {
+	secret := newToken()
+	now := a.svc.clock.Now().UTC()
+	t := types.Token{ID: hashToken(secret), Purpose: types.MFALogin, UserID: user.ID.Hex(), Email: user.Email, Login: login,
+		CreatedAt: now, ExpiresAt: now.Add(a.conf.MFA.ChallengeTTL)}
+	if err := a.store.CreateToken(ctx, t); err != nil {
+		slog.ErrorContext(ctx, "Failed creating MFA token", "user_id", t.UserID, "error", err)
+		return err
+	}
+	return &MFARequiredError{Token: secret, ExpiresAt: t.ExpiresAt}
+}
+
+// checkCode tells whether code is a valid TOTP or recovery code of the user, using it up
+// - without a key the TOTP secrets can't be read, recovery codes still work
+func (a *Authenticator) checkCode(ctx context.Context, user types.User, code string) (bool, error) {
+	userID := user.ID.Hex()
+	if a.box != nil {
+		secret, err := a.box.Open(user.MFA.Secret, userID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed decrypting MFA secret", "user_id", userID, "error", err)
+			return false, err
+		}
+		if step, ok := totp.Validate(secret, code, a.svc.clock.Now(), a.conf.MFA.Skew); ok {
+			used, err := a.store.UseMFAStep(ctx, userID, step)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed recording MFA code", "user_id", userID, "error", err)
+			}
+			return used, err
+		}
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if len(normalized) != 16 {
+		return false, nil
+	}
+	used, err := a.store.UseRecoveryCode(ctx, userID, hashToken(normalized))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed using recovery code", "user_id", userID, "error", err)
+	}
+	if used {
+		slog.InfoContext(ctx, "Used MFA recovery code", "user_id", userID)
+	}
+	return used, err
+}
+
+// user fetches a user as stored, MFA included
+func (a *Authenticator) user(ctx context.Context, userID string) (user types.User, err error) {
+	user, err = a.store.GetUser(ctx, userID)
+	if err != nil {
+		err = a.svc.translateError(err)
+		logFailure(ctx, "Failed fetching user", err, "user_id", userID)
+	}
+	return
+}
+
+// newRecoveryCode returns a random recovery code, e.g. abcd-efgh-ijkl-mnop
+// - 80 random bits, a fast hash keeps them safe
+func newRecoveryCode() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	s := recoveryCodeEncoding.EncodeToString(b)
+	return s[:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:]
+}
+
+// normalizeRecoveryCode drops what users may type differently in a recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
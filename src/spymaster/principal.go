@@ -0,0 +1,113 @@
+package spymaster
+
+import (
+	"context"
+	"errors"
+
+	"spymaster/types"
+)
+
+// ErrForbidden indicates that whoever makes a request isn't allowed to do what it asks
+var ErrForbidden = errors.New("insufficient scope")
+
+// Principal is who a request is made by: a user with a session, an API key, or nobody when both are nil
+type Principal struct {
+	Session *types.Session
+	Key     *types.APIKey
+}
+
+// ID identifies the principal as user:<user id> or key:<key id>, it's empty when anonymous
+func (p Principal) ID() string {
+	switch {
+	case p.Session != nil:
+		return "user:" + p.Session.UserID
+	case p.Key != nil:
+		return "key:" + p.Key.ID
+	}
+	return ""
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal of a request
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal carried by ctx, anonymous when there's none
+func PrincipalFrom(ctx context.Context) Principal {
+	p, _ := ctx.Value(principalKey{}).(Principal)
+	return p
+}
+
+// Identify returns the principal a bearer token stands for, a session token or an API key
+// - unknown, expired and revoked ones are ErrUnauthenticated
+func (a *Authenticator) Identify(ctx context.Context, token string) (Principal, error) {
+	if IsAPIKey(token) {
+		key, err := a.AuthenticateKey(ctx, token)
+		if err != nil {
+			return Principal{}, err
+		}
+		return Principal{Key: &key}, nil
+	}
+	session, err := a.Authenticate(ctx, token)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{Session: &session}, nil
+}
+
+// Authorize checks the principal of ctx may act with scope
+// - API keys may do what their scopes allow
+// - users may do anything with users, see AuthorizeUser for which ones, only those listed as admins may administer
+// - anonymous callers may read users unless authentication is required, never change, delete them nor administer;
+// they get ErrUnauthenticated rather than ErrForbidden, logging in may help
+// - a nil Authenticator, authentication being off altogether, lets anything but administering through
+func (a *Authenticator) Authorize(ctx context.Context, scope string) error {
+	p := PrincipalFrom(ctx)
+	known := false
+	for _, s := range types.Scopes {
+		known = known || s == scope
+	}
+	switch {
+	case !known:
+		return ErrForbidden
+	case p.Key != nil:
+		if !p.Key.Allows(scope) {
+			return ErrForbidden
+		}
+	case p.Session != nil:
+		if scope == types.ScopeAdmin && !a.admin(p.Session.UserID) {
+			return ErrForbidden
+		}
+	case scope == types.ScopeAdmin:
+		return ErrUnauthenticated
+	case a == nil:
+	case scope != types.ScopeUsersRead || a.conf.APIKeys.Required:
+		return ErrUnauthenticated
+	}
+	return nil
+}
+
+// AuthorizeUser checks the principal of ctx may act with scope on the user with the given ID, empty for new users
+// - on top of Authorize, users who aren't admins may only change and delete themselves, and never create users
+func (a *Authenticator) AuthorizeUser(ctx context.Context, scope, userID string) error {
+	if err := a.Authorize(ctx, scope); err != nil {
+		return err
+	}
+	session := PrincipalFrom(ctx).Session
+	if session != nil && scope != types.ScopeUsersRead && !a.admin(session.UserID) && (userID == "" || userID != session.UserID) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// admin tells whether a user is listed as an admin
+func (a *Authenticator) admin(userID string) bool {
+	for _, id := range a.conf.Admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,17 @@
 package spymaster
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
+	"math"
 
-	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"go.opentelemetry.io/otel/attribute"
 
-	"spymaster/src/mongo"
+	"spymaster/src/events"
+	"spymaster/src/password"
+	"spymaster/src/tracing"
 	"spymaster/types"
 )
 
@@ -16,17 +21,58 @@ var (
 
 	// ErrNotFound indicates that an entry is missing
 	ErrNotFound = errors.New("entry not found")
+
+	// ErrInvalidID indicates that the given ID is not a valid identifier
+	ErrInvalidID = errors.New("invalid ID")
+
+	// ErrInvalidPage indicates that a page is larger than allowed, or out of range
+	ErrInvalidPage = errors.New("invalid page")
 )
 
-func ListUsers(c *gin.Context, exact map[string]interface{}, partial map[string]string, perPage, pageNumber int) (response types.UsersResult, err error) {
-	mc := c.MustGet("mongo").(mongo.Client)
+// DefaultMaxPerPage is the largest page size allowed unless configured otherwise
+const DefaultMaxPerPage = 1000
+
+// Service holds the user management business logic, independently of the transport calling it
+type Service struct {
+	store     Store
+	publisher events.Publisher
+	clock     Clock
+	hasher    Hasher
+	verifier  Verifier
+	policy    *password.Policy
+	// maxPerPage caps the page size of listings, DefaultMaxPerPage when 0
+	maxPerPage int
+}
+
+// NewService creates a Service with its dependencies
+func NewService(store Store, publisher events.Publisher, clock Clock, hasher Hasher) *Service {
+	return &Service{
+		store:     store,
+		publisher: publisher,
+		clock:     clock,
+		hasher:    hasher,
+	}
+}
+
+// ListUsers lists the users matching the exact and partial search criteria
+// - pages larger than MaxPerPage, or starting past what the store can skip, are ErrInvalidPage
+func (s *Service) ListUsers(ctx context.Context, exact map[string]interface{}, partial map[string]string, perPage, pageNumber int) (response types.UsersResult, err error) {
+	ctx, end := s.trace(ctx, "ListUsers")
+	defer end(&err)
 
-	users, totalCount, err := mc.ListUsers(exact, partial, perPage, pageNumber)
+	if perPage < 1 || perPage > s.MaxPerPage() || pageNumber < 1 || pageNumber-1 > math.MaxInt32/perPage {
+		return response, ErrInvalidPage
+	}
+	users, totalCount, err := s.store.ListUsers(ctx, exact, partial, perPage, pageNumber)
 	if err != nil {
-		log.Printf("ListUsers: %s", err)
+		slog.ErrorContext(ctx, "Failed listing users", "error", err)
 		return
 	}
 
+	for i := range users {
+		redact(&users[i])
+	}
+
 	response = types.UsersResult{
 		Page:       pageNumber,
 		PerPage:    perPage,
@@ -37,56 +83,297 @@ func ListUsers(c *gin.Context, exact map[string]interface{}, partial map[string]
 	return
 }
 
-// CreateUser creates a new user
-func CreateUser(c *gin.Context, payload *types.UserPost) (user types.User, err error) {
-	mc := c.MustGet("mongo").(mongo.Client)
+// ListUsersFrom lists up to limit users matching the search criteria, past the first offset of them, for transports
+// paginating by offset
+// - the store is read at most two pages of limit users at a time, limit is capped like page sizes
+func (s *Service) ListUsersFrom(ctx context.Context, exact map[string]interface{}, partial map[string]string, offset, limit int) (response types.UsersResult, err error) {
+	ctx, end := s.trace(ctx, "ListUsersFrom")
+	defer end(&err)
 
-	user, err = mc.CreateUser(*payload)
+	if offset < 0 || limit < 1 {
+		return response, ErrInvalidPage
+	}
+	page := offset/limit + 1
+	response, err = s.ListUsers(ctx, exact, partial, limit, page)
 	if err != nil {
-		if mc.IsDup(err) {
-			err = ErrDup
+		return
+	}
+	users := response.Users[min(offset%limit, len(response.Users)):]
+	if offset%limit != 0 && len(response.Users) == limit {
+		next, err := s.ListUsers(ctx, exact, partial, limit, page+1)
+		if err != nil && err != ErrInvalidPage {
+			return types.UsersResult{}, err
 		}
-		log.Printf("Failed adding user: %s", err)
+		users = append(users, next.Users...)
+	}
+	response.Users = users[:min(limit, len(users))]
+	return
+}
+
+// GetUser fetches a single user
+func (s *Service) GetUser(ctx context.Context, id string) (user types.User, err error) {
+	ctx, end := s.trace(ctx, "GetUser")
+	defer end(&err)
+
+	user, err = s.store.GetUser(ctx, id)
+	if err != nil {
+		err = s.translateError(err)
+		logFailure(ctx, "Failed fetching user", err, "user_id", id)
+		return
+	}
+
+	redact(&user)
+	return
+}
+
+// CreateUser creates a new user
+func (s *Service) CreateUser(ctx context.Context, payload *types.UserPost) (user types.User, err error) {
+	ctx, end := s.trace(ctx, "CreateUser")
+	defer end(&err)
+
+	if err = s.policy.Check(ctx, payload.Password, payload.Nickname, payload.Email); err != nil {
+		logFailure(ctx, "Refused password", err)
+		return
+	}
+	hash, err := s.hash(ctx, payload.Password)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed hashing password", "error", err)
 		return
 	}
 
-	//TODO: Insert queue update here
+	now := s.clock.Now().UTC()
+	user = types.User{
+		ID:        bson.NewObjectId(),
+		Nickname:  payload.Nickname,
+		Password:  hash,
+		Email:     payload.Email,
+		CreatedAt: now,
+		UpdatedAt: now,
+		EventID:   events.NewID(),
+	}
+	if payload.FirstName != nil {
+		user.FirstName = *payload.FirstName
+	}
+	if payload.LastName != nil {
+		user.LastName = *payload.LastName
+	}
+	if payload.Country != nil {
+		user.Country = *payload.Country
+	}
+
+	err = s.store.CreateUser(ctx, user)
+	if err != nil {
+		err = s.translateError(err)
+		logFailure(ctx, "Failed adding user", err, "user_id", user.ID.Hex())
+		return types.User{}, err
+	}
+
+	redact(&user)
+	s.publish(ctx, user.EventID, events.New(events.UserCreated, user.ID.Hex(), &user))
+	s.verify(ctx, user)
 
 	return
 }
 
 // UpdateUser updates a user
-func UpdateUser(c *gin.Context, id string, payload *types.UserPatch) (user types.User, err error) {
-	mc := c.MustGet("mongo").(mongo.Client)
+func (s *Service) UpdateUser(ctx context.Context, id string, payload *types.UserPatch) (user types.User, err error) {
+	ctx, end := s.trace(ctx, "UpdateUser")
+	defer end(&err)
 
-	user, err = mc.UpdateUser(id, *payload)
-	if err != nil {
-		if mc.IsNotFound(err) {
-			err = ErrNotFound
+	patch := *payload
+	if patch.Password != nil {
+		if err = s.checkPatchPassword(ctx, id, patch); err != nil {
+			return
+		}
+		hash, err := s.hash(ctx, *patch.Password)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed hashing password", "user_id", id, "error", err)
+			return user, err
 		}
-		log.Printf("Failed updating user: %s", err)
+		patch.Password = &hash
+	}
+	patch.UpdatedAt = s.clock.Now().UTC()
+	patch.EventID = events.NewID()
+
+	before, user, err := s.store.UpdateUser(ctx, id, patch)
+	if err != nil {
+		err = s.translateError(err)
+		logFailure(ctx, "Failed updating user", err, "user_id", id)
 		return
 	}
 
-	//TODO: Insert queue update here
+	// built before redacting the user, so a password change is still listed as changed
+	e := events.NewUpdate(user.ID.Hex(), &before, &user)
+	redact(&user)
+	s.publish(ctx, patch.EventID, e)
+	if user.Email != before.Email {
+		s.verify(ctx, user)
+	}
 
 	return
 }
 
 // DeleteUser deletes a user
-func DeleteUser(c *gin.Context, id string) error {
-	mc := c.MustGet("mongo").(mongo.Client)
+func (s *Service) DeleteUser(ctx context.Context, id string) (err error) {
+	ctx, end := s.trace(ctx, "DeleteUser")
+	defer end(&err)
 
-	err := mc.DeleteUser(id)
+	err = s.store.DeleteUser(ctx, id)
 	if err != nil {
-		if mc.IsNotFound(err) {
-			err = ErrNotFound
-		}
-		log.Printf("Failed deleting user: %s", err)
+		err = s.translateError(err)
+		logFailure(ctx, "Failed deleting user", err, "user_id", id)
 		return err
 	}
 
-	//TODO: Insert queue update here
+	s.publish(ctx, events.NewID(), events.New(events.UserDeleted, id, nil))
 
 	return nil
 }
+
+// SetPasswordPolicy has the passwords users are created or updated with checked by p; nil checks none
+func (s *Service) SetPasswordPolicy(p *password.Policy) {
+	s.policy = p
+}
+
+// CheckPassword tells whether a password would be accepted for the user, returning a *password.Error if not
+func (s *Service) CheckPassword(ctx context.Context, pw string, user types.User) (err error) {
+	ctx, end := s.trace(ctx, "CheckPassword")
+	defer end(&err)
+
+	err = s.policy.Check(ctx, pw, user.Nickname, user.Email)
+	if err != nil {
+		logFailure(ctx, "Refused password", err, "user_id", user.ID.Hex())
+	}
+	return
+}
+
+// checkPatchPassword checks the password of an update against the nickname and email the user will have
+func (s *Service) checkPatchPassword(ctx context.Context, id string, patch types.UserPatch) error {
+	if s.policy == nil {
+		return nil
+	}
+	var user types.User
+	if patch.Nickname == nil || patch.Email == nil {
+		var err error
+		user, err = s.store.GetUser(ctx, id)
+		if err != nil {
+			err = s.translateError(err)
+			logFailure(ctx, "Failed fetching user", err, "user_id", id)
+			return err
+		}
+	}
+	patched := patch.Apply(user)
+	err := s.policy.Check(ctx, *patch.Password, patched.Nickname, patched.Email)
+	if err != nil {
+		logFailure(ctx, "Refused password", err, "user_id", id)
+	}
+	return err
+}
+
+// SetMaxPerPage caps the page size of listings, DefaultMaxPerPage when 0
+func (s *Service) SetMaxPerPage(n int) {
+	s.maxPerPage = n
+}
+
+// MaxPerPage returns the largest page size of listings
+func (s *Service) MaxPerPage() int {
+	if s.maxPerPage <= 0 {
+		return DefaultMaxPerPage
+	}
+	return s.maxPerPage
+}
+
+// SetVerifier has the emails of users created or changing email verified by v
+func (s *Service) SetVerifier(v Verifier) {
+	s.verifier = v
+}
+
+// verify asks for the email of a user to be verified; the write already happened so failures are only logged
+func (s *Service) verify(ctx context.Context, user types.User) {
+	if s.verifier == nil {
+		return
+	}
+	if err := s.verifier.RequestVerification(ctx, user); err != nil {
+		slog.ErrorContext(ctx, "Failed requesting email verification", "user_id", user.ID.Hex(), "error", err)
+	}
+}
+
+// redact clears what's never given out of a user, its password hash and second factor
+func redact(user *types.User) {
+	user.Password = ""
+	user.MFA = nil
+}
+
+// logFailure logs a failed call with args; answers given to the caller, like a missing user, only get a debug line
+func logFailure(ctx context.Context, msg string, err error, args ...interface{}) {
+	level := slog.LevelError
+	if answered(err) {
+		level = slog.LevelDebug
+	}
+	slog.Log(ctx, level, msg, append(args, "error", err)...)
+}
+
+// trace starts the span of a service method, ended by the returned function given the method's error
+// - answers given to the caller, like a missing user, a duplicate or an invalid ID, don't fail the span
+func (s *Service) trace(ctx context.Context, method string) (context.Context, func(*error)) {
+	ctx, span := tracing.Start(ctx, "spymaster."+method)
+	return ctx, func(err *error) {
+		if *err != nil && answered(*err) {
+			span.SetAttributes(attribute.String("spymaster.outcome", (*err).Error()))
+			span.End()
+			return
+		}
+		tracing.End(span, *err)
+	}
+}
+
+// answered tells whether err is an answer given to the caller, like a missing user or wrong credentials, rather
+// than a failure
+func answered(err error) bool {
+	var lockedOut *LockedOutError
+	var mfaRequired *MFARequiredError
+	var refused *password.Error
+	switch {
+	case err == ErrNotFound, err == ErrDup, err == ErrInvalidID, err == ErrInvalidCredentials, err == ErrUnauthenticated,
+		err == ErrInvalidToken, err == ErrMFADisabled, err == ErrMFAEnabled, err == ErrMFANotEnrolled, err == ErrInvalidCode,
+		err == ErrInvalidScopes, err == ErrInvalidExpiry, err == ErrForbidden, err == ErrInvalidPage:
+		return true
+	case errors.As(err, &lockedOut), errors.As(err, &mfaRequired), errors.As(err, &refused):
+		return true
+	}
+	return false
+}
+
+// hash hashes a password in its own span, as it's meant to be slow
+func (s *Service) hash(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Start(ctx, "spymaster.HashPassword")
+	hash, err := s.hasher.Hash(password)
+	tracing.End(span, err)
+	return hash, err
+}
+
+// translateError maps storage errors into the errors exposed by this package
+func (s *Service) translateError(err error) error {
+	switch {
+	case s.store.IsDup(err):
+		return ErrDup
+	case s.store.IsNotFound(err):
+		return ErrNotFound
+	case s.store.IsInvalidID(err):
+		return ErrInvalidID
+	}
+	return err
+}
+
+// publish notifies about a change; the write already happened so failures are only logged
+// - id is the event ID stamped on the written document, which lets change stream consumers
+// tell API writes apart from out-of-band ones
+func (s *Service) publish(ctx context.Context, id string, e events.Event) {
+	if s.publisher == nil {
+		return
+	}
+	e.ID = id
+	if err := s.publisher.Publish(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "Failed publishing event", "event_id", e.ID, "event_type", e.Type, "user_id", e.UserID, "error", err)
+	}
+}
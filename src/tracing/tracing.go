@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/globalsign/mgo/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// None exports nothing, trace context is still propagated
+	None = "none"
+	// OTLP exports spans to an OpenTelemetry collector over HTTP
+	OTLP = "otlp"
+	// Stdout prints spans as JSON, meant for local debugging
+	Stdout = "stdout"
+)
+
+// Config holds the tracing configuration
+type Config struct {
+	// Exporter is none, otlp or stdout
+	Exporter string `envconfig:"exporter" default:"none"`
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `envconfig:"endpoint" default:"localhost:4318"`
+	// Insecure sends spans over plain HTTP, e.g. to a collector running alongside
+	Insecure bool `envconfig:"insecure"`
+	// SampleRatio is the share of the traces started here which are recorded; callers' sampling decisions are kept
+	SampleRatio float64 `envconfig:"sample_ratio" default:"1"`
+	ServiceName string  `envconfig:"service_name" default:"spymaster"`
+}
+
+// Validate checks the exporter is known and the ratio makes sense
+func (conf Config) Validate() error {
+	switch {
+	case conf.Exporter != None && conf.Exporter != OTLP && conf.Exporter != Stdout:
+		return fmt.Errorf("unknown exporter %q, expected %s, %s or %s", conf.Exporter, None, OTLP, Stdout)
+	case conf.SampleRatio < 0 || conf.SampleRatio > 1:
+		return fmt.Errorf("sample_ratio must be between 0 and 1, got %g", conf.SampleRatio)
+	case conf.Exporter == OTLP && conf.Endpoint == "":
+		return errors.New("endpoint is required by the otlp exporter")
+	}
+	return nil
+}
+
+// Setup installs the W3C trace context propagator and, unless the exporter is none, a tracer provider exporting spans
+// - the returned function flushes the spans still buffered, call it when shutting down
+func Setup(ctx context.Context, conf Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case OTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed creating the %s exporter: %w", conf.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(conf.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named after the layer and the operation, e.g. spymaster.GetUser
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("spymaster").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span, marking it as failed when err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Carrier is the W3C trace context of a span, as carried by events and messages
+type Carrier struct {
+	TraceParent string `bson:"traceparent,omitempty" json:"traceparent,omitempty"`
+	TraceState  string `bson:"tracestate,omitempty" json:"tracestate,omitempty"`
+}
+
+// Inject returns the trace context of the span in ctx, empty when there's none
+func Inject(ctx context.Context) Carrier {
+	headers := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, headers)
+	return Carrier{TraceParent: headers["traceparent"], TraceState: headers["tracestate"]}
+}
+
+// Extract returns ctx carrying the trace context in c as the remote parent of the next spans
+func Extract(ctx context.Context, c Carrier) context.Context {
+	if c.TraceParent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": c.TraceParent, "tracestate": c.TraceState})
+}
+
+// TraceID returns the ID of the trace the span in ctx belongs to, empty when there's none
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Shape describes a query without its values, which may be personal data, e.g. {"country":"?","nickname":{"$regex":"?"}}
+// - field names and operators are kept so slow queries can be told apart and matched with their indexes
+func Shape(query interface{}) string {
+	b, err := json.Marshal(shape(reflect.ValueOf(query)))
+	if err != nil {
+		return "?"
+	}
+	return string(b)
+}
+
+func shape(v reflect.Value) interface{} {
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		if v.IsNil() {
+			return "?"
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return "?"
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return "?"
+		}
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			m[k.String()] = shape(v.MapIndex(k))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		// operators like $and or pipelines list documents whose shape matters, lists of values like $in's don't
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return "?"
+		}
+		elems, values := make([]interface{}, v.Len()), true
+		for i := range elems {
+			elems[i] = shape(v.Index(i))
+			values = values && elems[i] == "?"
+		}
+		if values {
+			return "?"
+		}
+		return elems
+	case reflect.Struct:
+		// regular expressions are the one struct value a filter has, the search term is left out like any other
+		if v.Type() == reflect.TypeOf(bson.RegEx{}) {
+			return map[string]interface{}{"$regex": "?"}
+		}
+	}
+	return "?"
+}
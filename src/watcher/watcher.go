@@ -0,0 +1,272 @@
+package watcher
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spymaster/src/events"
+	"spymaster/src/mongo"
+)
+
+// Config holds the change stream watcher configuration
+type Config struct {
+	// Enabled turns the watcher on; it requires MongoDB to run as a replica set
+	Enabled bool `envconfig:"enabled" default:"false"`
+	// DeleteGrace is how long a delete, or an insert carrying an event_id, is given to show up in the event log before
+	// it's considered out-of-band
+	DeleteGrace time.Duration `envconfig:"delete_grace" default:"2s"`
+	// RetryInterval is the wait between attempts when the change stream fails
+	RetryInterval time.Duration `envconfig:"retry_interval" default:"5s"`
+}
+
+const (
+	resumeTokenName = "users-watcher"
+	// resolveInterval is how often the event log is checked again for the events of pending changes
+	resolveInterval = 100 * time.Millisecond
+)
+
+// Watcher turns writes made directly to the users collection (fixtures, scripts, the mongo shell)
+// into user events, skipping those already emitted by the API
+type Watcher struct {
+	mongo     *mongo.Client
+	publisher events.Publisher
+	conf      Config
+
+	mu      sync.Mutex
+	pending []*pending
+	// held is the resume token of the latest change handled while others were pending, saved once they're resolved
+	held []byte
+}
+
+// pending is a change the API may have made without its event being in the log yet, the API writing the document
+// before recording the event; it's announced unless the event shows up before the deadline
+type pending struct {
+	change   mongo.UserChange
+	event    events.Event
+	deadline time.Time
+}
+
+// New creates a Watcher publishing out-of-band changes to publisher
+func New(mc *mongo.Client, publisher events.Publisher, conf Config) *Watcher {
+	return &Watcher{mongo: mc, publisher: publisher, conf: conf}
+}
+
+// Run watches the users collection until ctx is done, resuming from the last persisted token
+// - failures are retried, so it only returns once ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	go w.resolve(ctx)
+	for ctx.Err() == nil {
+		// the stream resumes from before the pending changes, they're handled again
+		w.mu.Lock()
+		w.pending, w.held = nil, nil
+		w.mu.Unlock()
+
+		token, err := w.mongo.LoadResumeToken(ctx, resumeTokenName)
+		if err == nil {
+			err = w.mongo.WatchUsers(ctx, token, func(change mongo.UserChange) error {
+				return w.handle(ctx, change)
+			})
+		}
+		if err == nil {
+			continue
+		}
+
+		slog.ErrorContext(ctx, "Users change stream failed", "error", err)
+		if w.mongo.IsHistoryLost(err) {
+			// the oplog moved past our token, the changes in between are lost anyway
+			slog.WarnContext(ctx, "Users change stream resume token is too old, starting over from now")
+			if err := w.mongo.SaveResumeToken(ctx, resumeTokenName, nil); err != nil {
+				slog.ErrorContext(ctx, "Failed clearing the users change stream resume token", "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(w.conf.RetryInterval):
+		}
+	}
+}
+
+// handle publishes the event matching a change, unless the API already did, and saves the resume token
+// - the token is only saved after publishing so a crash replays the change rather than losing it
+// - deletes and inserts carrying an event_id may be the API's, whose event isn't in the log yet; they're left pending
+// rather than waited for, and the token saved once they're resolved
+func (w *Watcher) handle(ctx context.Context, change mongo.UserChange) error {
+	var e events.Event
+	deferred := false
+	switch change.Operation {
+	case "insert":
+		e = events.New(events.UserCreated, change.UserID, change.User)
+		deferred = change.EventID != ""
+	case "update", "replace":
+		if change.Operation == "update" && contains(change.UpdatedFields, "event_id") {
+			break
+		}
+		if change.Operation == "replace" {
+			// the API never replaces documents, a replacement only carries the event of an API write when copied over
+			journaled, err := w.journaled(ctx, change)
+			if err != nil {
+				return err
+			}
+			if journaled {
+				break
+			}
+		}
+		// there's no pre-image to diff against, but the change stream tells what an update touched; only the fields
+		// the event schema knows of are listed
+		var changed []string
+		touchedInternal := false
+		for _, f := range append(change.UpdatedFields, change.RemovedFields...) {
+			switch {
+			case internal(f):
+				touchedInternal = true
+			case events.Reported(f):
+				changed = append(changed, f)
+			}
+		}
+		// the second factor is written by logins and enrollments, it's not part of what events tell about users
+		if change.Operation == "update" && touchedInternal && len(changed) == 0 {
+			break
+		}
+		e = events.New(events.UserUpdated, change.UserID, change.User)
+		e.ChangedFields = changed
+		sort.Strings(e.ChangedFields)
+	case "delete":
+		e = events.New(events.UserDeleted, change.UserID, nil)
+		deferred = true
+	}
+
+	if deferred {
+		emitted, err := w.emitted(ctx, change)
+		if err != nil {
+			return err
+		}
+		if !emitted {
+			w.mu.Lock()
+			w.pending = append(w.pending, &pending{change: change, event: e, deadline: time.Now().Add(w.conf.DeleteGrace)})
+			w.mu.Unlock()
+		}
+		e = events.Event{}
+	}
+
+	if e.ID != "" {
+		if err := w.publish(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	if len(change.ResumeToken) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		w.held = change.ResumeToken
+		return nil
+	}
+	return w.mongo.SaveResumeToken(ctx, resumeTokenName, change.ResumeToken)
+}
+
+// resolve checks the event log again for the events of pending changes past their deadline until ctx is done,
+// announcing those still missing, and saves the held resume token once none is left
+// - changes are pending in the order they were handled, so are their deadlines
+func (w *Watcher) resolve(ctx context.Context) {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		due := append([]*pending(nil), w.pending...)
+		w.mu.Unlock()
+		if len(due) == 0 {
+			continue
+		}
+
+		resolved := map[*pending]bool{}
+		for _, p := range due {
+			if time.Now().Before(p.deadline) {
+				break
+			}
+			emitted, err := w.emitted(ctx, p.change)
+			if err == nil && !emitted {
+				err = w.publish(ctx, p.event)
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed resolving a pending user change", "user_id", p.change.UserID, "error", err)
+				break
+			}
+			resolved[p] = true
+		}
+
+		w.mu.Lock()
+		left := w.pending[:0]
+		for _, p := range w.pending {
+			if !resolved[p] {
+				left = append(left, p)
+			}
+		}
+		w.pending = left
+		if len(w.pending) == 0 && w.held != nil {
+			if err := w.mongo.SaveResumeToken(ctx, resumeTokenName, w.held); err != nil {
+				slog.ErrorContext(ctx, "Failed saving the users change stream resume token", "error", err)
+			} else {
+				w.held = nil
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// publish announces an out-of-band change
+func (w *Watcher) publish(ctx context.Context, e events.Event) error {
+	slog.InfoContext(ctx, "Publishing out-of-band event", "event_id", e.ID, "event_type", e.Type, "user_id", e.UserID)
+	return w.publisher.Publish(ctx, e)
+}
+
+// emitted tells whether the event of a delete or an insert was already recorded by the API
+func (w *Watcher) emitted(ctx context.Context, change mongo.UserChange) (bool, error) {
+	if change.Operation == "delete" {
+		found, err := w.mongo.ListEvents(ctx, events.Query{Types: []events.Type{events.UserDeleted}, UserID: change.UserID, Limit: 1})
+		return len(found) > 0, err
+	}
+	return w.journaled(ctx, change)
+}
+
+// journaled tells whether the event_id a changed document carries is that of the journaled event of this very
+// version of the user, rather than one copied along by a write made outside of the API
+func (w *Watcher) journaled(ctx context.Context, change mongo.UserChange) (bool, error) {
+	if change.EventID == "" || change.User == nil {
+		return false, nil
+	}
+	e, err := w.mongo.GetEvent(ctx, change.EventID)
+	if w.mongo.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.UserID == change.UserID && e.User != nil && e.User.UpdatedAt.Equal(change.User.UpdatedAt), nil
+}
+
+// internal tells whether a field of the user documents, or a path within one, is never part of events
+func internal(field string) bool {
+	return field == "mfa" || strings.HasPrefix(field, "mfa.")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"spymaster/src/gql"
+	"spymaster/src/rpc/pb"
+	"spymaster/src/server"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+func TestAPIKeys(t *testing.T) {
+	Convey("Given an API key allowed to read users only", t, withCleanup(func() {
+		_, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+
+		body, _ := json.Marshal(types.APIKeyPost{Name: "reporting", Scopes: []string{types.ScopeUsersRead, types.ScopeUsersRead}})
+		req, _ := http.NewRequest("POST", "/admin/api-keys", bytes.NewReader(body))
+		recorder := httptest.NewRecorder()
+		var created types.NewAPIKey
+		serveAndUnmarshal(recorder, asAdmin(req), &created)
+		So(recorder.Code, ShouldEqual, http.StatusCreated)
+		So(created.Key, ShouldStartWith, types.APIKeyPrefix+created.ID+"_")
+		So(created.Scopes, ShouldResemble, []string{types.ScopeUsersRead})
+		So(created.ExpiresAt, ShouldNotBeNil)
+		So(*created.ExpiresAt, ShouldHappenWithin, time.Minute, time.Now().Add(time.Hour))
+
+		call := func(method, path, key string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, strings.NewReader(`{"country":"UK"}`))
+			req.Header.Set("Authorization", "Bearer "+key)
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("It lists users, recording it was used", func() {
+			So(call("GET", "/users", created.Key).Code, ShouldEqual, http.StatusOK)
+
+			var listed struct {
+				APIKeys []types.APIKey `json:"api_keys"`
+			}
+			req, _ := http.NewRequest("GET", "/admin/api-keys", nil)
+			serveAndUnmarshal(httptest.NewRecorder(), asAdmin(req), &listed)
+			So(listed.APIKeys, ShouldHaveLength, 2)
+			for _, key := range listed.APIKeys {
+				if key.ID == created.ID {
+					So(key.Name, ShouldEqual, "reporting")
+					So(key.LastUsedAt, ShouldNotBeNil)
+				}
+			}
+		})
+
+		Convey("It can't change nor delete users", func() {
+			for method, scope := range map[string]string{"PATCH": types.ScopeUsersWrite, "DELETE": types.ScopeUsersDelete} {
+				recorder := call(method, "/users?id="+bson.NewObjectId().Hex(), created.Key)
+				So(recorder.Code, ShouldEqual, http.StatusForbidden)
+				So(recorder.Header().Get("WWW-Authenticate"), ShouldContainSubstring, `scope="`+scope+`"`)
+			}
+		})
+
+		Convey("It can't delete users through GraphQL, SCIM nor gRPC either", func() {
+			id := bson.NewObjectId().Hex()
+			p, _ := json.Marshal(map[string]interface{}{"query": `mutation { deleteUser(id: "` + id + `") }`})
+			req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(p))
+			req.Header.Set("Authorization", "Bearer "+created.Key)
+			var result graphqlResponse
+			serveAndUnmarshal(httptest.NewRecorder(), req, &result)
+			So(result.Errors, ShouldNotBeEmpty)
+			So(result.Errors[0].Message, ShouldEqual, "insufficient scope, users:delete needed")
+
+			recorder := call("DELETE", "/scim/v2/Users/"+id, created.Key)
+			So(recorder.Code, ShouldEqual, http.StatusForbidden)
+			So(recorder.Body.String(), ShouldContainSubstring, "Insufficient scope")
+
+			conn, stop := dialGRPC()
+			defer stop()
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+created.Key)
+			_, err := pb.NewUserServiceClient(conn).DeleteUser(ctx, &pb.DeleteUserRequest{Id: id})
+			So(status.Code(err), ShouldEqual, codes.PermissionDenied)
+			_, err = pb.NewUserServiceClient(conn).GetUser(ctx, &pb.GetUserRequest{Id: id})
+			So(status.Code(err), ShouldEqual, codes.NotFound)
+		})
+
+		Convey("It stops working once revoked", func() {
+			req, _ := http.NewRequest("DELETE", "/admin/api-keys/"+created.ID, nil)
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, asAdmin(req))
+			So(recorder.Code, ShouldEqual, http.StatusNoContent)
+			So(call("GET", "/users", created.Key).Code, ShouldEqual, http.StatusUnauthorized)
+
+			recorder = httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("It stops working once expired", func() {
+			So(mc.Database.C("api_keys").UpdateId(created.ID, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Second)}}), ShouldBeNil)
+			So(call("GET", "/users", created.Key).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("It can't administer", func() {
+			for _, path := range []string{"/admin/api-keys", "/admin/lockouts", "/admin/jobs", "/admin/config"} {
+				recorder := call("GET", path, created.Key)
+				So(recorder.Code, ShouldEqual, http.StatusForbidden)
+				So(recorder.Header().Get("WWW-Authenticate"), ShouldContainSubstring, `scope="admin"`)
+			}
+		})
+
+		Convey("Keys with a known ID but the wrong secret are turned down", func() {
+			So(call("GET", "/users", types.APIKeyPrefix+created.ID+"_forged").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Only its hash is stored", func() {
+			var stored bson.M
+			So(mc.Database.C("api_keys").FindId(created.ID).One(&stored), ShouldBeNil)
+			for _, v := range stored {
+				So(v, ShouldNotEqual, created.Key)
+			}
+		})
+	}))
+
+	Convey("API keys are refused unknown scopes and past expiries", t, withCleanup(func() {
+		past := time.Now().Add(-time.Hour)
+		for _, payload := range []types.APIKeyPost{
+			{Name: "nope", Scopes: []string{"users:admin"}},
+			{Name: "nope", Scopes: []string{}},
+			{Name: "nope", Scopes: []string{types.ScopeUsersRead}, ExpiresAt: &past},
+		} {
+			body, _ := json.Marshal(payload)
+			req, _ := http.NewRequest("POST", "/admin/api-keys", bytes.NewReader(body))
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, asAdmin(req))
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+		}
+	}))
+
+	Convey("Given a server requiring authentication", t, withCleanup(func() {
+		strict, err := spymaster.NewAuthenticator(svc, mc, nil, nil, spymaster.AuthConfig{SessionTTL: time.Hour, APIKeys: spymaster.APIKeyConfig{Required: true}})
+		So(err, ShouldBeNil)
+		router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Auth: strict,
+			GraphQL: gql.Config{MaxDepth: 8, MaxComplexity: 1000}})
+		get := func(token string) int {
+			req, _ := http.NewRequest("GET", "/users", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		Convey("Anonymous requests to /users are turned down", func() {
+			So(get(""), ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Anonymous requests to GraphQL and SCIM are turned down too", func() {
+			p, _ := json.Marshal(map[string]interface{}{"query": `{ users { totalCount } }`})
+			req, _ := http.NewRequest("POST", "/graphql", bytes.NewReader(p))
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Body.String(), ShouldContainSubstring, "authentication required")
+
+			req, _ = http.NewRequest("GET", "/scim/v2/Users", nil)
+			recorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Users and API keys get through", func() {
+			_, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+			So(err, ShouldBeNil)
+			session, err := strict.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+			So(err, ShouldBeNil)
+			So(get(session.Token), ShouldEqual, http.StatusOK)
+
+			key, err := strict.CreateAPIKey(context.Background(), &types.APIKeyPost{Name: "sync", Scopes: []string{types.ScopeUsersRead}}, "")
+			So(err, ShouldBeNil)
+			So(key.ExpiresAt, ShouldBeNil)
+			So(get(key.Key), ShouldEqual, http.StatusOK)
+		})
+	}))
+
+	Convey("Given a user listed as admin and one who isn't", t, withCleanup(func() {
+		chief, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "kittridge", Password: "impossible", Email: "kittridge@imf.fake"})
+		So(err, ShouldBeNil)
+		ethan, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+		withAdmins, err := spymaster.NewAuthenticator(svc, mc, nil, nil, spymaster.AuthConfig{SessionTTL: time.Hour, Admins: []string{chief.ID.Hex()}})
+		So(err, ShouldBeNil)
+		router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Auth: withAdmins,
+			GraphQL: gql.Config{MaxDepth: 8, MaxComplexity: 1000}})
+		mint := func(nickname string) int {
+			req, _ := http.NewRequest("POST", "/admin/api-keys", strings.NewReader(`{"name":"mine","scopes":["users:delete"]}`))
+			if nickname != "" {
+				session, err := withAdmins.Login(context.Background(), nickname, "impossible", "192.0.2.1")
+				So(err, ShouldBeNil)
+				req.Header.Set("Authorization", "Bearer "+session.Token)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		Convey("Only the admin can create API keys", func() {
+			So(mint(""), ShouldEqual, http.StatusUnauthorized)
+			So(mint("ethan"), ShouldEqual, http.StatusForbidden)
+			So(mint("kittridge"), ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("Users may only change and delete themselves, unless they're admins, and anonymous callers nobody", func() {
+			write := func(method, path, nickname string) int {
+				req, _ := http.NewRequest(method, path, strings.NewReader(`{"country":"UK"}`))
+				if nickname != "" {
+					session, err := withAdmins.Login(context.Background(), nickname, "impossible", "192.0.2.1")
+					So(err, ShouldBeNil)
+					req.Header.Set("Authorization", "Bearer "+session.Token)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				return recorder.Code
+			}
+			So(write("PATCH", "/users?id="+chief.ID.Hex(), ""), ShouldEqual, http.StatusUnauthorized)
+			So(write("DELETE", "/users?id="+chief.ID.Hex(), ""), ShouldEqual, http.StatusUnauthorized)
+			So(write("PATCH", "/users?id="+chief.ID.Hex(), "ethan"), ShouldEqual, http.StatusForbidden)
+			So(write("DELETE", "/scim/v2/Users/"+chief.ID.Hex(), "ethan"), ShouldEqual, http.StatusForbidden)
+			So(write("POST", "/users", "ethan"), ShouldEqual, http.StatusForbidden)
+			So(write("PATCH", "/users?id="+ethan.ID.Hex(), "ethan"), ShouldEqual, http.StatusOK)
+			So(write("PATCH", "/users?id="+ethan.ID.Hex(), "kittridge"), ShouldEqual, http.StatusOK)
+			So(write("DELETE", "/users?id="+ethan.ID.Hex(), "kittridge"), ShouldEqual, http.StatusNoContent)
+		})
+	}))
+}
@@ -0,0 +1,313 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/src/lockout"
+	"spymaster/src/mail"
+	"spymaster/src/server"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+func TestLogin(t *testing.T) {
+	Convey("Given a user", t, withCleanup(func() {
+		user, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+
+		login := func(login, password, ip string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(types.Login{Login: login, Password: password})
+			req, _ := http.NewRequest("POST", "/login", bytes.NewReader(body))
+			req.RemoteAddr = ip + ":1234"
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Logging in with the nickname or the email opens a session", func() {
+			for _, name := range []string{"ethan", "ethan@imf.fake"} {
+				recorder := login(name, "impossible", "192.0.2.1")
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				var token types.SessionToken
+				So(json.Unmarshal(recorder.Body.Bytes(), &token), ShouldBeNil)
+				So(token.UserID, ShouldEqual, user.ID.Hex())
+				So(token.Token, ShouldNotBeEmpty)
+
+				n, err := mc.Database.C("sessions").FindId(token.Token).Count()
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+			}
+
+			Convey("Whose token authenticates requests until logging out", func() {
+				var token types.SessionToken
+				So(json.Unmarshal(login("ethan", "impossible", "192.0.2.1").Body.Bytes(), &token), ShouldBeNil)
+				logout := func() int {
+					req, _ := http.NewRequest("POST", "/logout", nil)
+					req.Header.Set("Authorization", "Bearer "+token.Token)
+					recorder := httptest.NewRecorder()
+					r.ServeHTTP(recorder, req)
+					return recorder.Code
+				}
+				So(logout(), ShouldEqual, http.StatusNoContent)
+				So(logout(), ShouldEqual, http.StatusUnauthorized)
+			})
+		})
+
+		Convey("Wrong passwords and unknown logins get the same answer", func() {
+			wrong := login("ethan", "possible", "192.0.2.1")
+			unknown := login("jim", "impossible", "192.0.2.1")
+			So(wrong.Code, ShouldEqual, http.StatusUnauthorized)
+			So(unknown.Code, ShouldEqual, http.StatusUnauthorized)
+
+			var wrongBody, unknownBody errorResponse
+			So(json.Unmarshal(wrong.Body.Bytes(), &wrongBody), ShouldBeNil)
+			So(json.Unmarshal(unknown.Body.Bytes(), &unknownBody), ShouldBeNil)
+			So(wrongBody, ShouldResemble, unknownBody)
+		})
+
+		Convey("Too many failures lock the account out and notify the user", func() {
+			received, cancel := broker.Subscribe(10)
+			defer cancel()
+			for i := 0; i < 3; i++ {
+				So(login("Ethan", "possible", "192.0.2.1").Code, ShouldEqual, http.StatusUnauthorized)
+			}
+
+			recorder := login("ethan", "impossible", "192.0.2.2")
+			So(recorder.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "60")
+
+			e := <-received
+			So(e.Type, ShouldEqual, events.UserLocked)
+			So(e.UserID, ShouldEqual, user.ID.Hex())
+			So(e.LockedUntil, ShouldNotBeNil)
+
+			Convey("Until an admin clears the lockout", func() {
+				var listed struct {
+					Lockouts []lockout.Record `json:"lockouts"`
+				}
+				req, _ := http.NewRequest("GET", "/admin/lockouts", nil)
+				serveAndUnmarshal(httptest.NewRecorder(), asAdmin(req), &listed)
+				So(listed.Lockouts, ShouldHaveLength, 3)
+				So(listed.Lockouts[0].Kind, ShouldEqual, lockout.Account)
+				So(listed.Lockouts[0].Key, ShouldEqual, "ethan")
+				So(listed.Lockouts[0].Lockouts, ShouldEqual, 1)
+				failures := map[string]int{}
+				for _, record := range listed.Lockouts[1:] {
+					So(record.Kind, ShouldEqual, lockout.IP)
+					failures[record.Key] = len(record.Failures)
+				}
+				So(failures, ShouldResemble, map[string]int{"192.0.2.1": 3, "192.0.2.2": 1})
+
+				recorder := httptest.NewRecorder()
+				req, _ = http.NewRequest("DELETE", "/admin/lockouts/"+listed.Lockouts[0].ID, nil)
+				r.ServeHTTP(recorder, asAdmin(req))
+				So(recorder.Code, ShouldEqual, http.StatusNoContent)
+
+				So(login("ethan", "impossible", "192.0.2.2").Code, ShouldEqual, http.StatusOK)
+
+				recorder = httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Which only an admin can clear", func() {
+				req, _ := http.NewRequest("DELETE", "/admin/lockouts/"+lockout.ID(lockout.Account, "ethan"), nil)
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				So(login("ethan", "impossible", "192.0.2.3").Code, ShouldEqual, http.StatusTooManyRequests)
+			})
+		})
+
+		Convey("Concurrent failures can't get more guesses in, and lock the account out", func() {
+			codes := make(chan int, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					codes <- login("ethan", fmt.Sprintf("possible%d", i), fmt.Sprintf("192.0.2.%d", i)).Code
+				}(i)
+			}
+			wg.Wait()
+			close(codes)
+
+			counted := map[int]int{}
+			for code := range codes {
+				counted[code]++
+			}
+			So(counted[http.StatusUnauthorized], ShouldBeLessThanOrEqualTo, 3)
+			So(counted[http.StatusUnauthorized]+counted[http.StatusTooManyRequests], ShouldEqual, 10)
+			So(login("ethan", "impossible", "192.0.2.100").Code, ShouldEqual, http.StatusTooManyRequests)
+		})
+
+		Convey("Unknown tokens are turned down", func() {
+			req, _ := http.NewRequest("GET", "/users", nil)
+			req.Header.Set("Authorization", "Bearer forged")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(recorder.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "invalid_token")
+		})
+	}))
+}
+
+func TestEmailVerification(t *testing.T) {
+	Convey("Given a user just created", t, withCleanup(func() {
+		user, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+		So(user.EmailVerifiedAt, ShouldBeNil)
+
+		Convey("They are mailed a verification link", func() {
+			token := mailedToken("ethan@imf.fake", "/verify-email")
+
+			Convey("Which verifies their email once", func() {
+				So(postToken("/email/verify", types.TokenPost{Token: token}), ShouldEqual, http.StatusNoContent)
+				verified, err := svc.GetUser(context.Background(), user.ID.Hex())
+				So(err, ShouldBeNil)
+				So(verified.EmailVerifiedAt, ShouldNotBeNil)
+
+				So(postToken("/email/verify", types.TokenPost{Token: token}), ShouldEqual, http.StatusBadRequest)
+
+				Convey("Until they change their email, which has to be verified again", func() {
+					email := "hunt@imf.fake"
+					changed, err := svc.UpdateUser(context.Background(), user.ID.Hex(), &types.UserPatch{Email: &email})
+					So(err, ShouldBeNil)
+					So(changed.EmailVerifiedAt, ShouldBeNil)
+					stored, err := svc.GetUser(context.Background(), user.ID.Hex())
+					So(err, ShouldBeNil)
+					So(stored.EmailVerifiedAt, ShouldBeNil)
+					So(mailedToken("hunt@imf.fake", "/verify-email"), ShouldNotBeEmpty)
+				})
+
+				Convey("Setting the same email again keeps it verified", func() {
+					email := "ethan@imf.fake"
+					changed, err := svc.UpdateUser(context.Background(), user.ID.Hex(), &types.UserPatch{Email: &email})
+					So(err, ShouldBeNil)
+					So(changed.EmailVerifiedAt, ShouldNotBeNil)
+				})
+			})
+
+			Convey("Which stops working once the email changed", func() {
+				email := "hunt@imf.fake"
+				_, err := svc.UpdateUser(context.Background(), user.ID.Hex(), &types.UserPatch{Email: &email})
+				So(err, ShouldBeNil)
+				So(postToken("/email/verify", types.TokenPost{Token: token}), ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("Forged tokens are turned down", func() {
+			So(postToken("/email/verify", types.TokenPost{Token: "forged"}), ShouldEqual, http.StatusBadRequest)
+		})
+	}))
+}
+
+func TestPasswordReset(t *testing.T) {
+	Convey("Given a user logged in", t, withCleanup(func() {
+		user, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+		session, err := auth.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+		So(err, ShouldBeNil)
+		mailer.Reset()
+
+		Convey("Asking for a reset for an unknown login looks the same, but mails nobody", func() {
+			So(postToken("/password/forgot", types.PasswordResetRequest{Login: "jim"}), ShouldEqual, http.StatusAccepted)
+			So(mailer.Messages(), ShouldBeEmpty)
+		})
+
+		Convey("Failing to mail them looks the same too", func() {
+			unreachable, err := spymaster.NewAuthenticator(svc, mc, nil, failingMailer{}, spymaster.AuthConfig{SessionTTL: time.Hour,
+				ResetTTL: time.Hour, LinkURL: "https://app.imf.fake"})
+			So(err, ShouldBeNil)
+			router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Auth: unreachable})
+			for _, login := range []string{"jim", "ethan"} {
+				body, _ := json.Marshal(types.PasswordResetRequest{Login: login})
+				req, _ := http.NewRequest("POST", "/password/forgot", bytes.NewReader(body))
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusAccepted)
+			}
+		})
+
+		Convey("Asking for a reset mails them a link", func() {
+			So(postToken("/password/forgot", types.PasswordResetRequest{Login: "ethan"}), ShouldEqual, http.StatusAccepted)
+			token := mailedToken("ethan@imf.fake", "/reset-password")
+
+			Convey("Which sets a new password once, ending their sessions and verifying their email", func() {
+				So(postToken("/password/reset", types.PasswordReset{Token: token, Password: "possible"}), ShouldEqual, http.StatusNoContent)
+				So(postToken("/password/reset", types.PasswordReset{Token: token, Password: "again"}), ShouldEqual, http.StatusBadRequest)
+
+				_, err := auth.Authenticate(context.Background(), session.Token)
+				So(err, ShouldEqual, spymaster.ErrUnauthenticated)
+				_, err = auth.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+				So(err, ShouldEqual, spymaster.ErrInvalidCredentials)
+				_, err = auth.Login(context.Background(), "ethan", "possible", "192.0.2.1")
+				So(err, ShouldBeNil)
+
+				stored, err := svc.GetUser(context.Background(), user.ID.Hex())
+				So(err, ShouldBeNil)
+				So(stored.EmailVerifiedAt, ShouldNotBeNil)
+			})
+
+			Convey("Which stops working once expired", func() {
+				So(mc.Database.C("tokens").Update(bson.M{"user_id": user.ID.Hex()}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Second)}}), ShouldBeNil)
+				So(postToken("/password/reset", types.PasswordReset{Token: token, Password: "possible"}), ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("Only the hash of the token is stored", func() {
+				n, err := mc.Database.C("tokens").FindId(token).Count()
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+			})
+		})
+	}))
+}
+
+// linkPattern finds the links mailed to users
+var linkPattern = regexp.MustCompile(`https://app\.imf\.fake(/[a-z-]+)\?token=(\S+)`)
+
+// mailedToken returns the token of the latest link to page mailed to address
+func mailedToken(address, page string) string {
+	messages := mailer.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := linkPattern.FindStringSubmatch(messages[i].Body)
+		if messages[i].To == address && m != nil && m[1] == page {
+			token, err := url.QueryUnescape(m[2])
+			So(err, ShouldBeNil)
+			return token
+		}
+	}
+	So(messages, ShouldNotBeEmpty)
+	return ""
+}
+
+// postToken posts payload to path, returning the status code
+// failingMailer never manages to send anything
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, mail.Message) error {
+	return errors.New("mail server unreachable")
+}
+
+func postToken(path string, payload interface{}) int {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder.Code
+}
@@ -1,6 +1,7 @@
 package controllers_test
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -12,9 +13,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo/bson"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
 
+	"spymaster/src/events"
+	"spymaster/src/gql"
+	"spymaster/src/lockout"
+	"spymaster/src/mail"
 	"spymaster/src/mongo"
+	"spymaster/src/operations"
 	"spymaster/src/server"
+	"spymaster/src/spymaster"
 	"spymaster/types"
 )
 
@@ -25,8 +33,16 @@ type errorResponse struct {
 }
 
 var (
-	mc *mongo.Client
-	r  *gin.Engine
+	mc      *mongo.Client
+	r       *gin.Engine
+	broker  *events.Broker
+	journal *events.Journal
+	svc     *spymaster.Service
+	auth    *spymaster.Authenticator
+	mailer  *mail.MemoryMailer
+	ops     *operations.Dispatcher
+	// adminKey is the API key asAdmin authenticates requests with, created on first use after every clean up
+	adminKey string
 )
 
 func TestMain(m *testing.M) {
@@ -87,7 +103,32 @@ func setup() {
 		log.Fatalf("Failed to connect to MongoDB: %s", err)
 	}
 
-	r = server.CreateRouter(mc)
+	broker = events.NewBroker()
+	journal = events.NewJournal(mc, nil)
+	journal.SetInline(broker)
+	svc = spymaster.NewService(mc, journal, spymaster.SystemClock{}, spymaster.BcryptHasher{Cost: bcrypt.MinCost})
+	ops = operations.NewDispatcher(mc, svc, operations.Config{Workers: 2, Queue: 10, TTL: time.Minute, Timeout: 5 * time.Second})
+	go ops.Run(context.Background())
+	// no delay between attempts, so failing logins in a row is quick
+	lockouts := lockout.NewTracker(mc, lockout.Config{Enabled: true, AccountAttempts: 3, IPAttempts: 10, Window: time.Minute, Duration: time.Minute, MaxDuration: 10 * time.Minute},
+		spymaster.SystemClock{})
+	mailer = &mail.MemoryMailer{}
+	auth, err = spymaster.NewAuthenticator(svc, mc, lockouts, mailer, spymaster.AuthConfig{SessionTTL: time.Hour, VerificationTTL: time.Hour,
+		ResetTTL: time.Hour, LinkURL: "https://app.imf.fake",
+		MFA:     spymaster.MFAConfig{Key: mfaKey, Issuer: "Spymaster", Skew: 1, ChallengeTTL: time.Minute, RecoveryCodes: 3, MaxAttempts: 5},
+		APIKeys: spymaster.APIKeyConfig{TTL: time.Hour, TouchInterval: time.Minute}})
+	if err != nil {
+		log.Fatalf("Failed to create the authenticator: %s", err)
+	}
+	r = server.CreateRouter(server.ContextParams{
+		MongoClient: mc,
+		Service:     svc,
+		Broker:      broker,
+		Journal:     journal,
+		Operations:  ops,
+		Auth:        auth,
+		GraphQL:     gql.Config{MaxDepth: 8, MaxComplexity: 1000},
+	})
 	cleanUp()
 }
 
@@ -98,11 +139,15 @@ func shutdown() {
 
 func cleanUp() {
 	// Clean up the MongoDB collections
-	_, err := mc.Database.C("users").RemoveAll(bson.M{})
-	if err != nil {
-		log.Fatalf("Failed cleaning up MongoDB for tests")
-		return
+	for _, collection := range []string{"users", "events", "counters", "operations", "leases", "job_runs", "rate_limits", "sessions", "lockouts", "tokens", "api_keys"} {
+		_, err := mc.Database.C(collection).RemoveAll(bson.M{})
+		if err != nil {
+			log.Fatalf("Failed cleaning up MongoDB for tests")
+			return
+		}
 	}
+	mailer.Reset()
+	adminKey = ""
 }
 
 func withCleanup(f func()) func() {
@@ -124,6 +169,24 @@ func serveAndUnmarshal(rec *httptest.ResponseRecorder, req *http.Request, result
 	}
 }
 
+// asAdmin authenticates req with an API key given every scope
+func asAdmin(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+adminToken())
+	return req
+}
+
+// adminToken is the API key asAdmin authenticates with, created on first use
+func adminToken() string {
+	if adminKey == "" {
+		key, err := auth.CreateAPIKey(context.Background(), &types.APIKeyPost{Name: "admin", Scopes: types.Scopes}, "")
+		if err != nil {
+			panic(err.Error())
+		}
+		adminKey = key.Key
+	}
+	return adminKey
+}
+
 func createUser(u types.User) (nu *types.User, err error) {
 	now := time.Now().UTC()
 	u.ID = bson.NewObjectId()
@@ -0,0 +1,127 @@
+package events_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/types"
+)
+
+func TestCloudEvents(t *testing.T) {
+	Convey("Given user events", t, func() {
+		now := time.Date(2021, 12, 15, 10, 0, 0, 0, time.UTC)
+		before := &types.User{ID: bson.NewObjectId(), Nickname: "genie", Email: "genie@lamp.fake", Password: "hash", CreatedAt: now, UpdatedAt: now}
+		after := *before
+		after.Country, after.Password, after.UpdatedAt = "PT", "other hash", now.Add(time.Hour)
+		userID := before.ID.Hex()
+
+		created := events.New(events.UserCreated, userID, before)
+		updated := events.NewUpdate(userID, before, &after)
+		updated.Sequence = 42
+		updated.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		updated.RequestID = "req-1"
+		deleted := events.New(events.UserDeleted, userID, nil)
+
+		Convey("Types are namespaced and versioned", func() {
+			ce, err := events.ToCloudEvent(updated)
+			So(err, ShouldBeNil)
+			So(ce.Type, ShouldEqual, "com.spymaster.user.updated.v1")
+			So(ce.Sequence, ShouldEqual, "42")
+
+			t, version, err := events.ParseCloudEventType(ce.Type)
+			So(err, ShouldBeNil)
+			So(t, ShouldEqual, events.UserUpdated)
+			So(version, ShouldEqual, 1)
+
+			_, _, err = events.ParseCloudEventType("com.example.user.updated.v1")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Updates list what changed, the timestamp aside", func() {
+			So(updated.ChangedFields, ShouldResemble, []string{"password", "country"})
+			So(updated.Before.Password, ShouldBeEmpty)
+			So(updated.User.Password, ShouldBeEmpty)
+		})
+
+		Convey("Both modes round trip", func() {
+			for _, mode := range []events.Mode{events.Binary, events.Structured} {
+				m, err := events.Encode(updated, mode)
+				So(err, ShouldBeNil)
+				if mode == events.Binary {
+					So(m.ContentType, ShouldEqual, events.DataContentType)
+					So(m.Attributes["type"], ShouldEqual, "com.spymaster.user.updated.v1")
+				} else {
+					So(m.ContentType, ShouldEqual, events.StructuredContentType)
+					So(m.Attributes, ShouldBeEmpty)
+				}
+
+				ce, err := events.Decode(m)
+				So(err, ShouldBeNil)
+				So(ce.ID, ShouldEqual, updated.ID)
+				So(ce.Subject, ShouldEqual, userID)
+				So(ce.Time.Equal(updated.OccurredAt), ShouldBeTrue)
+				So(ce.TraceParent, ShouldEqual, updated.TraceParent)
+				So(ce.RequestID, ShouldEqual, "req-1")
+				data, err := ce.UserData()
+				So(err, ShouldBeNil)
+				So(data.Before.Country, ShouldBeEmpty)
+				So(data.User.Country, ShouldEqual, "PT")
+			}
+
+			_, err := events.ParseMode("json")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Messages missing required attributes are rejected", func() {
+			m, err := events.Encode(created, events.Binary)
+			So(err, ShouldBeNil)
+			delete(m.Attributes, "id")
+			_, err = events.Decode(m)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Every event validates against the schema it points to", func() {
+			compiler := jsonschema.NewCompiler()
+			for _, s := range events.Schemas() {
+				doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(s.Document))
+				So(err, ShouldBeNil)
+				So(compiler.AddResource(s.URI, doc), ShouldBeNil)
+			}
+
+			for _, e := range []events.Event{created, updated, deleted} {
+				ce, err := events.ToCloudEvent(e)
+				So(err, ShouldBeNil)
+				schema, err := compiler.Compile(ce.DataSchema)
+				So(err, ShouldBeNil)
+				data, err := jsonschema.UnmarshalJSON(bytes.NewReader(ce.Data))
+				So(err, ShouldBeNil)
+				So(schema.Validate(data), ShouldBeNil)
+			}
+
+			Convey("And a password would not", func() {
+				schema, err := compiler.Compile(events.SchemaURI("com.spymaster.user.created.v1"))
+				So(err, ShouldBeNil)
+				data, err := jsonschema.UnmarshalJSON(bytes.NewReader([]byte(`{"user_id":"x","user":{"id":"` + userID + `","nickname":"n","email":"e","password":"p","created_at":"2021-12-15T10:00:00Z","updated_at":"2021-12-15T10:00:00Z"}}`)))
+				So(err, ShouldBeNil)
+				So(schema.Validate(data), ShouldNotBeNil)
+			})
+		})
+
+		Convey("The registry lists a schema per type and version", func() {
+			var listed []string
+			for _, s := range events.Schemas() {
+				listed = append(listed, s.CloudEventType())
+			}
+			So(listed, ShouldResemble, []string{"com.spymaster.user.created.v1", "com.spymaster.user.deleted.v1", "com.spymaster.user.locked.v1", "com.spymaster.user.updated.v1"})
+
+			_, ok := events.LookupSchema("com.spymaster.user.updated.v2")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package events_test
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/types"
+)
+
+// message is what a consumer of any backend sees of a published event
+type message struct {
+	// Route is the partition key, routing key or subject the message was published with
+	Route string
+	// Event is the CloudEvent decoded from the message, whatever mode it was sent in
+	Event events.CloudEvent
+}
+
+// harness plugs a backend and its local stand-in into the conformance suite
+type harness struct {
+	// open creates a publisher connected to the stand-in, sending CloudEvents in the given mode
+	open func(mode events.Mode) (events.Backend, error)
+	// consume returns the first n messages published since the harness was set up
+	consume func(ctx context.Context, n int) []message
+	// route is the Route expected for an event
+	route func(e events.Event) string
+}
+
+// runConformance checks the guarantees every events backend must give, in both CloudEvents modes
+func runConformance(h harness) {
+	for _, mode := range []events.Mode{events.Binary, events.Structured} {
+		mode := mode
+		Convey("In "+string(mode)+" mode", func() {
+			conform(h, mode)
+		})
+	}
+}
+
+func conform(h harness, mode events.Mode) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := h.open(mode)
+	So(err, ShouldBeNil)
+	defer p.Close()
+
+	Convey("Published events are delivered as versioned CloudEvents", func() {
+		before := &types.User{Nickname: "spy", Email: "spy@mi6.fake", Password: "old"}
+		after := &types.User{Nickname: "spy", Email: "bond@mi6.fake", Password: "new"}
+		sent := []events.Event{
+			events.New(events.UserCreated, "user-1", before),
+			events.New(events.UserCreated, "user-2", nil),
+			events.NewUpdate("user-1", before, after),
+			events.New(events.UserDeleted, "user-1", nil),
+		}
+		for _, e := range sent {
+			So(p.Publish(ctx, e), ShouldBeNil)
+		}
+
+		received := h.consume(ctx, len(sent))
+		So(received, ShouldHaveLength, len(sent))
+
+		byID := map[string]events.Event{}
+		for _, e := range sent {
+			byID[e.ID] = e
+		}
+		byUser := map[string][]string{}
+		for _, m := range received {
+			ce := m.Event
+			e, ok := byID[ce.ID]
+			So(ok, ShouldBeTrue)
+			So(ce.SpecVersion, ShouldEqual, events.SpecVersion)
+			So(ce.Type, ShouldEqual, events.CloudEventType(e.Type, events.SchemaVersion))
+			So(ce.Subject, ShouldEqual, e.UserID)
+			So(ce.DataSchema, ShouldEqual, events.SchemaURI(ce.Type))
+			So(ce.Time.Equal(e.OccurredAt), ShouldBeTrue)
+			So(m.Route, ShouldEqual, h.route(e))
+			So(string(ce.Data), ShouldNotContainSubstring, `"password":`)
+
+			data, err := ce.UserData()
+			So(err, ShouldBeNil)
+			So(data.UserID, ShouldEqual, e.UserID)
+			if e.Type == events.UserUpdated {
+				So(data.Before.Email, ShouldEqual, "spy@mi6.fake")
+				So(data.User.Email, ShouldEqual, "bond@mi6.fake")
+				So(data.ChangedFields, ShouldResemble, []string{"password", "email"})
+			}
+			byUser[data.UserID] = append(byUser[data.UserID], ce.Type)
+		}
+
+		Convey("And the events of a user keep their order", func() {
+			So(byUser["user-1"], ShouldResemble, []string{"com.spymaster.user.created.v1", "com.spymaster.user.updated.v1", "com.spymaster.user.deleted.v1"})
+			So(byUser["user-2"], ShouldResemble, []string{"com.spymaster.user.created.v1"})
+		})
+	})
+
+	Convey("Publishing with a canceled context fails", func() {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		So(p.Publish(canceled, events.New(events.UserCreated, "user-1", nil)), ShouldNotBeNil)
+	})
+
+	Convey("Publishing after closing fails", func() {
+		So(p.Close(), ShouldBeNil)
+		So(p.Publish(ctx, events.New(events.UserCreated, "user-1", nil)), ShouldNotBeNil)
+	})
+}
+
+// decode reads the CloudEvent back from a message whose binary mode attributes were sent as prefixed headers
+func decode(contentType string, headers map[string]string, prefix string, body []byte) events.CloudEvent {
+	m := events.Message{ContentType: contentType, Attributes: map[string]string{}, Body: body}
+	for k, v := range headers {
+		if strings.HasPrefix(k, prefix) {
+			m.Attributes[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	ce, err := events.Decode(m)
+	So(err, ShouldBeNil)
+	return ce
+}
@@ -0,0 +1,153 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"spymaster/src/events"
+	"spymaster/src/events/kafka"
+)
+
+const topic = "user-notifications"
+
+func TestKafkaPublisher(t *testing.T) {
+	Convey("Given an in-process Kafka cluster", t, func() {
+		cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, topic))
+		So(err, ShouldBeNil)
+		defer cluster.Close()
+
+		conf := kafka.Config{
+			Brokers:       cluster.ListenAddrs(),
+			Topic:         topic,
+			Acks:          "all",
+			Compression:   "snappy",
+			BatchMaxBytes: 1 << 20,
+			Linger:        time.Millisecond,
+			ClientID:      "spymaster-test",
+			Mode:          "binary",
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		Convey("It conforms to the events backend contract", func() {
+			runConformance(harness{
+				open: func(mode events.Mode) (events.Backend, error) {
+					conf.Mode = string(mode)
+					return kafka.New(conf)
+				},
+				consume: func(ctx context.Context, n int) []message {
+					var messages []message
+					for _, r := range consume(ctx, cluster.ListenAddrs(), n) {
+						headers := map[string]string{}
+						for _, h := range r.Headers {
+							headers[h.Key] = string(h.Value)
+						}
+						ce := decode(headers["content-type"], headers, kafka.HeaderPrefix, r.Value)
+						messages = append(messages, message{Route: string(r.Key), Event: ce})
+					}
+					return messages
+				},
+				route: func(e events.Event) string { return e.UserID },
+			})
+		})
+
+		Convey("Events are published keyed by user as binary mode CloudEvents", func() {
+			p, err := kafka.New(conf)
+			So(err, ShouldBeNil)
+			defer p.Close()
+
+			sent := []events.Event{
+				events.New(events.UserCreated, "user-1", nil),
+				events.New(events.UserCreated, "user-2", nil),
+				events.New(events.UserUpdated, "user-1", nil),
+				events.New(events.UserDeleted, "user-1", nil),
+			}
+			for _, e := range sent {
+				So(p.Publish(ctx, e), ShouldBeNil)
+			}
+
+			records := consume(ctx, cluster.ListenAddrs(), len(sent))
+			So(records, ShouldHaveLength, len(sent))
+
+			partitions := map[string]int32{}
+			byUser := map[string][]events.Type{}
+			for _, r := range records {
+				user := string(r.Key)
+				if partition, seen := partitions[user]; seen {
+					So(r.Partition, ShouldEqual, partition)
+				}
+				partitions[user] = r.Partition
+
+				So(header(r, "content-type"), ShouldEqual, "application/json")
+				So(header(r, "ce_specversion"), ShouldEqual, "1.0")
+				So(header(r, "ce_subject"), ShouldEqual, user)
+				t, _, err := events.ParseCloudEventType(header(r, "ce_type"))
+				So(err, ShouldBeNil)
+				byUser[user] = append(byUser[user], t)
+			}
+
+			Convey("And the events of a user keep their order", func() {
+				So(byUser["user-1"], ShouldResemble, []events.Type{events.UserCreated, events.UserUpdated, events.UserDeleted})
+			})
+		})
+
+		Convey("Acks and compression can be tuned", func() {
+			conf.Acks = "leader"
+			conf.Compression = "gzip"
+			p, err := kafka.New(conf)
+			So(err, ShouldBeNil)
+			defer p.Close()
+
+			So(p.Publish(ctx, events.New(events.UserCreated, "user-3", nil)), ShouldBeNil)
+			So(consume(ctx, cluster.ListenAddrs(), 1), ShouldHaveLength, 1)
+		})
+
+		Convey("Invalid settings are rejected", func() {
+			conf.Acks = "some"
+			_, err := kafka.New(conf)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Publishing gives up once the delivery timeout is over when the brokers are down", func() {
+			conf.DeliveryTimeout = time.Second
+			p, err := kafka.New(conf)
+			So(err, ShouldBeNil)
+			cluster.Close()
+
+			started := time.Now()
+			So(p.Publish(ctx, events.New(events.UserCreated, "user-1", nil)), ShouldNotBeNil)
+			So(time.Since(started), ShouldBeLessThan, 5*time.Second)
+			p.Close()
+		})
+	})
+}
+
+// consume reads n records from the start of the topic
+func consume(ctx context.Context, brokers []string, n int) []*kgo.Record {
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...), kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	So(err, ShouldBeNil)
+	defer client.Close()
+
+	var records []*kgo.Record
+	for len(records) < n && ctx.Err() == nil {
+		fetches := client.PollFetches(ctx)
+		fetches.EachRecord(func(r *kgo.Record) {
+			records = append(records, r)
+		})
+	}
+	return records
+}
+
+func header(r *kgo.Record, key string) string {
+	for _, h := range r.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package events_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/src/events/nats"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	Convey("Given an in-process NATS server with JetStream", t, func() {
+		srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+		So(err, ShouldBeNil)
+		srv.Start()
+		defer srv.Shutdown()
+		So(srv.ReadyForConnections(5*time.Second), ShouldBeTrue)
+
+		conf := nats.Config{
+			URL:             srv.ClientURL(),
+			Stream:          "SPYMASTER_USERS",
+			SubjectPrefix:   "spymaster",
+			DuplicateWindow: time.Minute,
+		}
+
+		Convey("It conforms to the events backend contract", func() {
+			runConformance(harness{
+				open: func(mode events.Mode) (events.Backend, error) {
+					conf.Mode = string(mode)
+					return nats.New(conf)
+				},
+				consume: func(ctx context.Context, n int) []message {
+					return consumeStream(ctx, conf, n)
+				},
+				route: func(e events.Event) string { return "spymaster." + string(e.Type) },
+			})
+		})
+
+		Convey("Events published twice are stored once", func() {
+			p, err := nats.New(conf)
+			So(err, ShouldBeNil)
+			defer p.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			e := events.New(events.UserCreated, "user-1", nil)
+			So(p.Publish(ctx, e), ShouldBeNil)
+			So(p.Publish(ctx, e), ShouldBeNil)
+			So(p.Publish(ctx, events.New(events.UserDeleted, "user-1", nil)), ShouldBeNil)
+
+			received := consumeStream(ctx, conf, 3)
+			So(received, ShouldHaveLength, 2)
+		})
+	})
+}
+
+// consumeStream reads up to n messages from the start of the stream
+func consumeStream(ctx context.Context, conf nats.Config, n int) []message {
+	conn, err := natsgo.Connect(conf.URL)
+	So(err, ShouldBeNil)
+	defer conn.Close()
+	js, err := jetstream.New(conn)
+	So(err, ShouldBeNil)
+	consumer, err := js.OrderedConsumer(ctx, conf.Stream, jetstream.OrderedConsumerConfig{})
+	So(err, ShouldBeNil)
+
+	batch, err := consumer.Fetch(n, jetstream.FetchMaxWait(time.Second))
+	So(err, ShouldBeNil)
+	var messages []message
+	for m := range batch.Messages() {
+		headers := map[string]string{}
+		for k := range m.Headers() {
+			headers[k] = m.Headers().Get(k)
+		}
+		ce := decode(headers["Content-Type"], headers, nats.HeaderPrefix, m.Data())
+		messages = append(messages, message{Route: m.Subject(), Event: ce})
+	}
+	return messages
+}
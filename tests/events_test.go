@@ -0,0 +1,231 @@
+package controllers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/src/mongo"
+	"spymaster/src/server"
+	"spymaster/types"
+)
+
+func TestStreamUserEvents(t *testing.T) {
+	Convey("When user events are streamed...", t, withCleanup(func() {
+		ctx := context.Background()
+		hastur, err := svc.CreateUser(ctx, &types.UserPost{Nickname: "hastur", Password: "Carcosa", Email: "hastur@lost.space"})
+		So(err, ShouldBeNil)
+		_, err = svc.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+		So(err, ShouldBeNil)
+
+		Convey("And the client resumes with Last-Event-ID", func() {
+			body := streamEvents("/users/events", "1", 200*time.Millisecond, nil)
+
+			Convey("Only the events after it are replayed", func() {
+				So(body, ShouldNotContainSubstring, "id:1\n")
+				So(body, ShouldContainSubstring, "id:2\n")
+				So(body, ShouldContainSubstring, "event:user.created\n")
+			})
+		})
+
+		Convey("And the client filters by user and type", func() {
+			body := streamEvents("/users/events?type=user.updated&user_id="+hastur.ID.Hex(), "0", 300*time.Millisecond, func() {
+				country := "UK"
+				svc.UpdateUser(ctx, hastur.ID.Hex(), &types.UserPatch{Country: &country})
+			})
+
+			Convey("Only matching events are sent, live ones included", func() {
+				So(body, ShouldNotContainSubstring, "event:user.created\n")
+				So(body, ShouldContainSubstring, "id:3\n")
+				So(body, ShouldContainSubstring, "event:user.updated\n")
+			})
+		})
+
+		Convey("And the client filters out most live events", func() {
+			store := &countingStore{Client: mc}
+			counted := events.NewJournal(store, nil)
+			counted.SetInline(broker)
+			router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker,
+				Journal: counted, Auth: auth})
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(ctx, "GET", "/users/events?user_id="+hastur.ID.Hex(), nil)
+			req.Header.Set("Last-Event-ID", "0")
+			done := make(chan struct{})
+			go func() {
+				router.ServeHTTP(recorder, req)
+				close(done)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			for _, nickname := range []string{"tank", "dozer", "mouse"} {
+				_, err := svc.CreateUser(ctx, &types.UserPost{Nickname: nickname, Password: "Nebuchadnezzar", Email: nickname + "@matrix.fake"})
+				So(err, ShouldBeNil)
+			}
+			country := "UK"
+			_, err := svc.UpdateUser(ctx, hastur.ID.Hex(), &types.UserPatch{Country: &country})
+			So(err, ShouldBeNil)
+			<-done
+
+			Convey("The journal is only read on reconnecting and after a gap, not for each of them", func() {
+				So(recorder.Body.String(), ShouldContainSubstring, "id:1\n")
+				So(recorder.Body.String(), ShouldContainSubstring, "id:6\n")
+				So(recorder.Body.String(), ShouldNotContainSubstring, "id:3\n")
+				So(atomic.LoadInt32(&store.listed), ShouldBeLessThanOrEqualTo, 2)
+			})
+		})
+
+		Convey("And Last-Event-ID is invalid", func() {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users/events", nil)
+			req.Header.Set("Last-Event-ID", "nope")
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	}))
+}
+
+func TestJournalOutbox(t *testing.T) {
+	Convey("Given a journal whose next publisher fails", t, withCleanup(func() {
+		ctx := context.Background()
+		failing := &flakyPublisher{err: errors.New("broker down")}
+		inline := &flakyPublisher{}
+		j := events.NewJournal(mc, failing)
+		j.SetInline(inline)
+		j.SetOrdered(true)
+
+		e := events.New(events.UserCreated, bson.NewObjectId().Hex(), nil)
+		So(j.Publish(ctx, e), ShouldNotBeNil)
+
+		Convey("The event is recorded but stays in the outbox", func() {
+			pending, err := mc.ListOutbox(ctx, time.Now().Add(time.Second), 10)
+			So(err, ShouldBeNil)
+			So(pending, ShouldHaveLength, 1)
+			So(pending[0].ID, ShouldEqual, e.ID)
+
+			Convey("Until it is relayed once old enough", func() {
+				n, err := j.Relay(ctx, failing, time.Hour)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+
+				failing.err = nil
+				n, err = j.Relay(ctx, failing, 0)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+				So(failing.published, ShouldHaveLength, 1)
+
+				n, err = j.Relay(ctx, failing, 0)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+			})
+
+			Convey("Later events of the same user wait behind it, others don't", func() {
+				failing.err = nil
+				later := events.New(events.UserUpdated, e.UserID, nil)
+				So(j.Publish(ctx, later), ShouldBeNil)
+				other := events.New(events.UserCreated, bson.NewObjectId().Hex(), nil)
+				So(j.Publish(ctx, other), ShouldBeNil)
+				So(failing.published, ShouldHaveLength, 1)
+				So(failing.published[0].ID, ShouldEqual, other.ID)
+
+				n, err := j.Relay(ctx, failing, 0)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 2)
+				So(failing.published[1].ID, ShouldEqual, e.ID)
+				So(failing.published[2].ID, ShouldEqual, later.ID)
+			})
+
+			Convey("While the inline publisher gets every event right away", func() {
+				failing.err = nil
+				later := events.New(events.UserUpdated, e.UserID, nil)
+				So(j.Publish(ctx, later), ShouldBeNil)
+				So(inline.published, ShouldHaveLength, 2)
+				So(inline.published[0].ID, ShouldEqual, e.ID)
+				So(inline.published[1].ID, ShouldEqual, later.ID)
+			})
+
+			Convey("Unless nothing relays the outbox, then later events aren't held back", func() {
+				j.SetOrdered(false)
+				failing.err = nil
+				later := events.New(events.UserUpdated, e.UserID, nil)
+				So(j.Publish(ctx, later), ShouldBeNil)
+				So(failing.published, ShouldHaveLength, 1)
+				So(failing.published[0].ID, ShouldEqual, later.ID)
+			})
+
+			Convey("And it survives retention while it does", func() {
+				n, err := j.Prune(ctx, time.Now().Add(time.Hour))
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Relayed events are pruned once past retention", func() {
+			failing.err = nil
+			So(j.Publish(ctx, events.New(events.UserDeleted, bson.NewObjectId().Hex(), nil)), ShouldBeNil)
+
+			n, err := j.Prune(ctx, time.Now().Add(-time.Hour))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+
+			n, err = j.Prune(ctx, time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+		})
+	}))
+}
+
+// flakyPublisher records what it publishes, failing with err when set
+type flakyPublisher struct {
+	err       error
+	published []events.Event
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, e events.Event) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, e)
+	return nil
+}
+
+// countingStore counts the reads of the event log
+type countingStore struct {
+	*mongo.Client
+	listed int32
+}
+
+func (s *countingStore) ListEvents(ctx context.Context, q events.Query) ([]events.Event, error) {
+	atomic.AddInt32(&s.listed, 1)
+	return s.Client.ListEvents(ctx, q)
+}
+
+// streamEvents opens the stream for the given duration, calling during (if any) once connected, and returns what was received
+func streamEvents(url, lastEventID string, d time.Duration, during func()) string {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Set("Last-Event-ID", lastEventID)
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(recorder, req)
+		close(done)
+	}()
+	if during != nil {
+		time.Sleep(50 * time.Millisecond)
+		during()
+	}
+	<-done
+	return recorder.Body.String()
+}
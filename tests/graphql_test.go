@@ -0,0 +1,96 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/types"
+)
+
+// graphqlResponse is a loosely typed GraphQL response
+type graphqlResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func TestGraphQL(t *testing.T) {
+	Convey("When the GraphQL endpoint is queried...", t, withCleanup(func() {
+		recorder := httptest.NewRecorder()
+
+		createUser(types.User{FirstName: "Yellow", Nickname: "hastur", Email: "hastur@lost.space", Country: "UK"})
+		createUser(types.User{FirstName: "Blue", Nickname: "fake_hastur", Email: "fake_hastur@lost.space", Country: "UK"})
+		createUser(types.User{FirstName: "Robin", Nickname: "genie", Email: "rwilliams@hollywood.fake", Country: "US"})
+
+		Convey("The users connection filters like GET /users", func() {
+			result := graphqlDo(recorder, `query($f: UserFilter) { users(filter: $f, first: 1) { totalCount edges { node { nickname } } pageInfo { hasNextPage } } }`,
+				map[string]interface{}{"f": map[string]string{"nickname": "hast", "country": "UK"}})
+
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(result.Errors, ShouldBeEmpty)
+			users := result.Data["users"].(map[string]interface{})
+			So(users["totalCount"], ShouldEqual, 2)
+			So(users["edges"], ShouldHaveLength, 1)
+			So(users["pageInfo"].(map[string]interface{})["hasNextPage"], ShouldBeTrue)
+		})
+
+		Convey("Users can be created through a mutation", func() {
+			result := graphqlDo(recorder, `mutation { createUser(input: {nickname: "cthulhu", password: "Rlyeh", email: "c@deep.sea"}) { id nickname } }`, nil)
+
+			So(result.Errors, ShouldBeEmpty)
+			created := result.Data["createUser"].(map[string]interface{})
+			u, err := getDBUser(created["id"].(string))
+			So(err, ShouldBeNil)
+			So(u.Nickname, ShouldEqual, "cthulhu")
+		})
+
+		Convey("Queries exceeding the complexity limit are rejected", func() {
+			result := graphqlDo(recorder, `{ users { edges { node { nickname } } pageInfo { a: hasNextPage } } users2: users(first: 100) { edges { node { nickname email country firstName lastName createdAt updatedAt id } } } }`, nil)
+
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(result.Errors, ShouldNotBeEmpty)
+		})
+
+		Convey("Mutations hashing passwords are expensive, a request can't batch too many of them", func() {
+			var mutation strings.Builder
+			mutation.WriteString("mutation {")
+			for i := 0; i < 11; i++ {
+				fmt.Fprintf(&mutation, ` u%d: createUser(input: {nickname: "cthulhu%d", password: "Rlyeh", email: "c%d@deep.sea"}) { id }`, i, i, i)
+			}
+			mutation.WriteString(" }")
+			result := graphqlDo(recorder, mutation.String(), nil)
+
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(result.Errors, ShouldNotBeEmpty)
+			count, err := mc.Database.C("users").Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+		})
+
+		Convey("A negative first can't lower the cost of a query, and is rejected", func() {
+			result := graphqlDo(recorder, `query($first: Int) { users(first: $first) { edges { node { nickname } } } }`,
+				map[string]interface{}{"first": -1000})
+
+			So(result.Errors, ShouldNotBeEmpty)
+			So(result.Errors[0].Message, ShouldEqual, "first must be greater than zero")
+			So(result.Data["users"], ShouldBeNil)
+		})
+	}))
+}
+
+func graphqlDo(recorder *httptest.ResponseRecorder, query string, variables map[string]interface{}) (result graphqlResponse) {
+	p, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req, err := http.NewRequest("POST", "/graphql", bytes.NewBuffer(p))
+	So(err, ShouldBeNil)
+	asAdmin(req)
+	serveAndUnmarshal(recorder, req, &result)
+	return
+}
@@ -0,0 +1,88 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/health"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("Given a registry", t, func() {
+		registry := health.NewRegistry(health.Config{Timeout: 50 * time.Millisecond, CacheTTL: time.Minute})
+		var runs int32
+		pass := func(name string, critical bool) health.Check {
+			return health.Ping(name, "component", critical, func(context.Context) error {
+				atomic.AddInt32(&runs, 1)
+				return nil
+			})
+		}
+		fail := func(name string, critical bool) health.Check {
+			return health.Ping(name, "component", critical, func(context.Context) error { return errors.New("unreachable") })
+		}
+
+		Convey("Without checks, it passes", func() {
+			So(registry.Readiness(context.Background()).Status, ShouldEqual, health.Pass)
+			var none *health.Registry
+			So(none.Readiness(context.Background()).Status, ShouldEqual, health.Pass)
+		})
+
+		Convey("With every check passing, it passes with their details", func() {
+			registry.Register(pass("db:responseTime", true))
+			registry.Register(pass("broker:connected", false))
+			report := registry.Readiness(context.Background())
+			So(report.Status, ShouldEqual, health.Pass)
+			So(report.Checks, ShouldHaveLength, 2)
+			res := report.Checks["db:responseTime"][0]
+			So(res.Status, ShouldEqual, health.Pass)
+			So(res.ComponentType, ShouldEqual, "component")
+			So(res.ObservedUnit, ShouldEqual, "ms")
+
+			Convey("And results are cached", func() {
+				registry.Readiness(context.Background())
+				So(atomic.LoadInt32(&runs), ShouldEqual, 2)
+			})
+		})
+
+		Convey("A non-critical check failing degrades it", func() {
+			registry.Register(pass("db:responseTime", true))
+			registry.Register(fail("broker:connected", false))
+			report := registry.Readiness(context.Background())
+			So(report.Status, ShouldEqual, health.Warn)
+			So(report.Output, ShouldEqual, "degraded: broker:connected")
+			So(report.Checks["broker:connected"][0].Output, ShouldEqual, "check failed")
+		})
+
+		Convey("A critical check failing fails it", func() {
+			registry.Register(fail("db:responseTime", true))
+			registry.Register(fail("broker:connected", false))
+			report := registry.Readiness(context.Background())
+			So(report.Status, ShouldEqual, health.Fail)
+			So(report.Output, ShouldEqual, "unavailable: broker:connected, db:responseTime")
+		})
+
+		Convey("A check taking too long fails", func() {
+			registry.Register(health.Check{Name: "slow:responseTime", Critical: true, Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) health.Result {
+				time.Sleep(time.Second)
+				return health.Result{Status: health.Pass}
+			}})
+			start := time.Now()
+			report := registry.Readiness(context.Background())
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			So(report.Status, ShouldEqual, health.Fail)
+			So(report.Checks["slow:responseTime"][0].Output, ShouldEqual, "timed out after 10ms")
+		})
+
+		Convey("Liveness doesn't depend on the checks", func() {
+			registry.Register(fail("db:responseTime", true))
+			report := registry.Liveness()
+			So(report.Status, ShouldEqual, health.Pass)
+			So(report.Checks["uptime"][0].ObservedUnit, ShouldEqual, "s")
+		})
+	})
+}
@@ -0,0 +1,147 @@
+package controllers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/jobs"
+	"spymaster/src/server"
+)
+
+func TestJobLeases(t *testing.T) {
+	Convey("Given two instances competing for a lease", t, withCleanup(func() {
+		ctx := context.Background()
+		lease := func(holder string, tick time.Time) jobs.Lease {
+			return jobs.Lease{Name: "test", Holder: holder, ExpiresAt: time.Now().Add(time.Minute), Tick: tick}
+		}
+
+		ok, err := mc.AcquireLease(ctx, lease("a", time.Time{}))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		Convey("Only the holder can renew it until it expires or is released", func() {
+			ok, err := mc.AcquireLease(ctx, lease("b", time.Time{}))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			ok, err = mc.AcquireLease(ctx, lease("a", time.Time{}))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			So(mc.ReleaseLease(ctx, "test", "a"), ShouldBeNil)
+			ok, err = mc.AcquireLease(ctx, lease("b", time.Time{}))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("A tick is only ever locked once", func() {
+			So(mc.ReleaseLease(ctx, "test", "a"), ShouldBeNil)
+			tick := time.Now().Truncate(time.Second)
+
+			ok, err := mc.AcquireLease(ctx, lease("a", tick))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(mc.ReleaseLease(ctx, "test", "a"), ShouldBeNil)
+
+			ok, err = mc.AcquireLease(ctx, lease("b", tick))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			ok, err = mc.AcquireLease(ctx, lease("b", tick.Add(time.Second)))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+		})
+	}))
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("Given a job scheduled on two instances", t, withCleanup(func() {
+		conf := jobs.Config{LeaseTTL: 300 * time.Millisecond, Timeout: time.Second}
+		var runs int32
+		work := func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&runs, 1)
+			return "did some work", nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		a, b := jobs.NewScheduler(mc, conf), jobs.NewScheduler(mc, conf)
+		for _, s := range []*jobs.Scheduler{a, b} {
+			So(s.Register("work", "@every 1s", work), ShouldBeNil)
+		}
+		stopped := make(chan struct{}, 2)
+		for _, s := range []*jobs.Scheduler{a, b} {
+			go func(s *jobs.Scheduler) {
+				s.Run(ctx)
+				stopped <- struct{}{}
+			}(s)
+		}
+		time.Sleep(2500 * time.Millisecond)
+		cancel()
+		<-stopped
+		<-stopped
+
+		Convey("A single instance leads and runs it once per scheduled time", func() {
+			So(atomic.LoadInt32(&runs), ShouldBeBetweenOrEqual, 1, 2)
+
+			recorded, found, err := a.Runs(context.Background(), "work", 10)
+			So(err, ShouldBeNil)
+			So(found, ShouldBeTrue)
+			So(recorded, ShouldHaveLength, int(atomic.LoadInt32(&runs)))
+			for _, run := range recorded {
+				So(run.Instance, ShouldEqual, recorded[0].Instance)
+			}
+			So(recorded[0].Status, ShouldEqual, jobs.Succeeded)
+			So(recorded[0].Summary, ShouldEqual, "did some work")
+		})
+
+		Convey("The admin endpoint lists it with its last run", func() {
+			router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Jobs: a, Auth: auth})
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/admin/jobs", nil)
+			So(err, ShouldBeNil)
+			router.ServeHTTP(recorder, asAdmin(req))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+
+			var result struct {
+				Instance string         `json:"instance"`
+				Jobs     []jobs.JobInfo `json:"jobs"`
+			}
+			So(json.Unmarshal(recorder.Body.Bytes(), &result), ShouldBeNil)
+			So(result.Instance, ShouldEqual, a.Instance())
+			So(result.Jobs, ShouldHaveLength, 1)
+			So(result.Jobs[0].Schedule, ShouldEqual, "@every 1s")
+			So(result.Jobs[0].LastRun, ShouldNotBeNil)
+
+			Convey("And its runs", func() {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "/admin/jobs/work/runs?limit=1", nil)
+				So(err, ShouldBeNil)
+				router.ServeHTTP(recorder, asAdmin(req))
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+
+				recorder = httptest.NewRecorder()
+				req, err = http.NewRequest("GET", "/admin/jobs/nope/runs", nil)
+				So(err, ShouldBeNil)
+				router.ServeHTTP(recorder, asAdmin(req))
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("But only to admins", func() {
+				for _, path := range []string{"/admin/jobs", "/admin/jobs/work/runs"} {
+					recorder := httptest.NewRecorder()
+					req, err := http.NewRequest("GET", path, nil)
+					So(err, ShouldBeNil)
+					router.ServeHTTP(recorder, req)
+					So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				}
+			})
+		})
+	}))
+}
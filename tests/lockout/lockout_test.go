@@ -0,0 +1,286 @@
+package lockout_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/lockout"
+)
+
+func TestTracker(t *testing.T) {
+	Convey("Given a tracker locking accounts out after 3 failures and IPs after 5", t, func() {
+		store := &memoryStore{records: map[string]lockout.Record{}}
+		conf := lockout.Config{Enabled: true, AccountAttempts: 3, IPAttempts: 5, Window: time.Minute, Duration: time.Minute, MaxDuration: 3 * time.Minute}
+		clock := newClock()
+		tracker := lockout.NewTracker(store, conf, clock)
+		ctx := context.Background()
+
+		fail := func(account, ip string) []lockout.Record {
+			attempt, _, err := tracker.Begin(ctx, account, ip)
+			So(err, ShouldBeNil)
+			locked, err := tracker.Fail(ctx, attempt)
+			So(err, ShouldBeNil)
+			return locked
+		}
+		// wait tells how long an attempt has to wait, without counting it
+		wait := func(account, ip string) time.Duration {
+			attempt, d, err := tracker.Begin(ctx, account, ip)
+			So(err, ShouldBeNil)
+			So(tracker.Release(ctx, attempt), ShouldBeNil)
+			return d
+		}
+
+		Convey("An account is locked out on its third failure, whatever the case of its login", func() {
+			So(fail("Ethan", "192.0.2.1"), ShouldBeEmpty)
+			So(fail("ethan", "192.0.2.2"), ShouldBeEmpty)
+			So(wait("ethan", "192.0.2.3"), ShouldEqual, 0)
+
+			locked := fail("ETHAN", "192.0.2.3")
+			So(locked, ShouldHaveLength, 1)
+			So(locked[0].Kind, ShouldEqual, lockout.Account)
+			So(locked[0].Key, ShouldEqual, "ethan")
+			So(wait("ethan", "192.0.2.4"), ShouldBeBetween, 59*time.Second, time.Minute)
+			So(wait("jim", "192.0.2.4"), ShouldEqual, 0)
+
+			Convey("Each following lockout lasts twice as long, up to the maximum", func() {
+				for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+					record := store.records[lockout.ID(lockout.Account, "ethan")]
+					past := clock.Now().Add(-time.Second)
+					record.LockedUntil = &past
+					store.records[record.ID] = record
+
+					fail("ethan", "192.0.2.5")
+					fail("ethan", "192.0.2.5")
+					locked := fail("ethan", "192.0.2.6")
+					So(locked, ShouldHaveLength, 1)
+					So(wait("ethan", "192.0.2.7"), ShouldBeBetween, expected-time.Second, expected)
+				}
+			})
+
+			Convey("Clearing the lockout lets the account in again", func() {
+				So(tracker.Clear(ctx, lockout.ID(lockout.Account, "ethan")), ShouldBeNil)
+				So(tracker.Clear(ctx, lockout.ID(lockout.Account, "ethan")), ShouldEqual, lockout.ErrNotFound)
+				So(wait("ethan", "192.0.2.4"), ShouldEqual, 0)
+			})
+		})
+
+		Convey("An IP trying many accounts is locked out, and a success doesn't clear it", func() {
+			for _, account := range []string{"a", "b", "c", "d"} {
+				So(fail(account, "192.0.2.1"), ShouldBeEmpty)
+			}
+			So(tracker.Succeed(ctx, "e"), ShouldBeNil)
+			locked := fail("f", "192.0.2.1")
+			So(locked, ShouldHaveLength, 1)
+			So(locked[0].Kind, ShouldEqual, lockout.IP)
+			So(wait("g", "192.0.2.1"), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("A released attempt isn't counted", func() {
+			earlier := []time.Time{clock.Now().Add(-2 * time.Second), clock.Now().Add(-time.Second)}
+			for _, id := range []string{lockout.ID(lockout.Account, "ethan"), lockout.ID(lockout.IP, "192.0.2.1")} {
+				store.records[id] = lockout.Record{ID: id, Failures: earlier}
+			}
+			attempt, wait, err := tracker.Begin(ctx, "ethan", "192.0.2.1")
+			So(err, ShouldBeNil)
+			So(wait, ShouldEqual, 0)
+			So(tracker.Release(ctx, attempt), ShouldBeNil)
+			So(store.records[lockout.ID(lockout.Account, "ethan")].Failures, ShouldHaveLength, 2)
+			So(store.records[lockout.ID(lockout.IP, "192.0.2.1")].Failures, ShouldHaveLength, 2)
+		})
+
+		Convey("A success clears the failures of the account", func() {
+			fail("ethan", "192.0.2.1")
+			fail("ethan", "192.0.2.1")
+			So(tracker.Succeed(ctx, "ethan"), ShouldBeNil)
+			So(fail("ethan", "192.0.2.2"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a tracker delaying attempts after failures", t, func() {
+		store := &memoryStore{records: map[string]lockout.Record{}}
+		conf := lockout.Config{Enabled: true, AccountAttempts: 10, IPAttempts: 10, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Minute,
+			Delay: time.Second, MaxDelay: 3 * time.Second}
+		tracker := lockout.NewTracker(store, conf, newClock())
+		ctx := context.Background()
+
+		Convey("The delay doubles with every failure, up to the maximum", func() {
+			for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+				attempt, _, err := tracker.Begin(ctx, "ethan", "192.0.2.1")
+				So(err, ShouldBeNil)
+				_, err = tracker.Fail(ctx, attempt)
+				So(err, ShouldBeNil)
+				probe, d, err := tracker.Begin(ctx, "ethan", "192.0.2.2")
+				So(err, ShouldBeNil)
+				So(tracker.Release(ctx, probe), ShouldBeNil)
+				So(d, ShouldBeBetween, expected-100*time.Millisecond, expected)
+			}
+		})
+	})
+
+	Convey("Given a tracker locking accounts out after 3 failures, with a delay between attempts", t, func() {
+		store := &memoryStore{records: map[string]lockout.Record{}}
+		conf := lockout.Config{Enabled: true, AccountAttempts: 3, IPAttempts: 100, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Minute,
+			Delay: time.Second, MaxDelay: 3 * time.Second}
+		tracker := lockout.NewTracker(store, conf, newClock())
+		ctx := context.Background()
+
+		Convey("Concurrent attempts can't skip the delay, and lock the account out", func() {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var allowed, locked int
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					attempt, wait, err := tracker.Begin(ctx, "ethan", fmt.Sprintf("192.0.2.%d", i))
+					if err != nil {
+						panic(err)
+					}
+					records, err := tracker.Fail(ctx, attempt)
+					if err != nil {
+						panic(err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if wait == 0 {
+						allowed++
+					}
+					locked += len(records)
+				}(i)
+			}
+			wg.Wait()
+
+			So(allowed, ShouldEqual, 1)
+			So(locked, ShouldEqual, 1)
+			_, d, err := tracker.Begin(ctx, "ethan", "192.0.2.100")
+			So(err, ShouldBeNil)
+			So(d, ShouldBeBetween, 59*time.Second, time.Minute)
+		})
+	})
+
+	Convey("A nil tracker never locks anyone out", t, func() {
+		var tracker *lockout.Tracker
+		attempt, d, err := tracker.Begin(context.Background(), "ethan", "192.0.2.1")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 0)
+		locked, err := tracker.Fail(context.Background(), attempt)
+		So(err, ShouldBeNil)
+		So(locked, ShouldBeEmpty)
+		So(tracker.Release(context.Background(), attempt), ShouldBeNil)
+	})
+}
+
+// clock moves a millisecond forward every time it's read, so the attempts of a test are never made at the same time
+// and releasing one can't forget another
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Now()}
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Millisecond)
+	return c.now
+}
+
+var errNotFound = errors.New("not found")
+
+// memoryStore keeps records as the MongoDB store does
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]lockout.Record
+}
+
+func (m *memoryStore) GetLockouts(_ context.Context, ids ...string) ([]lockout.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r []lockout.Record
+	for _, id := range ids {
+		if record, ok := m.records[id]; ok {
+			r = append(r, record)
+		}
+	}
+	return r, nil
+}
+
+func (m *memoryStore) RecordFailure(_ context.Context, r lockout.Record, t time.Time, keep int) (lockout.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.records[r.ID]
+	if !ok {
+		record = lockout.Record{ID: r.ID, Kind: r.Kind, Key: r.Key}
+	}
+	record.Failures = append(record.Failures, t)
+	if len(record.Failures) > keep {
+		record.Failures = record.Failures[len(record.Failures)-keep:]
+	}
+	if r.ExpiresAt.After(record.ExpiresAt) {
+		record.ExpiresAt = r.ExpiresAt
+	}
+	m.records[r.ID] = record
+	return record, nil
+}
+
+func (m *memoryStore) ForgetFailure(_ context.Context, id string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.records[id]
+	if !ok {
+		return errNotFound
+	}
+	var failures []time.Time
+	for _, failure := range record.Failures {
+		if !failure.Equal(t) {
+			failures = append(failures, failure)
+		}
+	}
+	record.Failures = failures
+	m.records[id] = record
+	return nil
+}
+
+func (m *memoryStore) LockOut(_ context.Context, id string, t, until, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.records[id]
+	if !ok || record.Locked(t) {
+		return false, nil
+	}
+	record.LockedUntil, record.ExpiresAt, record.Failures = &until, expiresAt, nil
+	record.Lockouts++
+	m.records[id] = record
+	return true, nil
+}
+
+func (m *memoryStore) ListLockouts(context.Context) ([]lockout.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r []lockout.Record
+	for _, record := range m.records {
+		r = append(r, record)
+	}
+	return r, nil
+}
+
+func (m *memoryStore) DeleteLockout(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.records[id]; !ok {
+		return errNotFound
+	}
+	delete(m.records, id)
+	return nil
+}
+
+func (m *memoryStore) IsNotFound(err error) bool { return err == errNotFound }
@@ -0,0 +1,125 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/logging"
+	"spymaster/src/requestid"
+	"spymaster/src/server"
+	"spymaster/src/tracing"
+	"spymaster/types"
+)
+
+func TestLogging(t *testing.T) {
+	Convey("Given a JSON logger", t, func() {
+		var out bytes.Buffer
+		logger := logging.New(logging.Config{Level: "info", Format: logging.JSON}, &out)
+		lines := func() []map[string]interface{} {
+			var records []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var record map[string]interface{}
+				So(json.Unmarshal([]byte(line), &record), ShouldBeNil)
+				records = append(records, record)
+			}
+			return records
+		}
+
+		Convey("Passwords, emails, nicknames and names are redacted wherever they are", func() {
+			nickname := "hastur"
+			user := types.User{ID: bson.NewObjectId(), FirstName: "Yellow", LastName: "King", Nickname: "hastur", Password: "$2a$hash", Email: "hastur@lost.space", Country: "UK"}
+			logger.Info("Redacted",
+				"user", user,
+				"users", []*types.User{&user},
+				"patch", types.UserPatch{Nickname: &nickname, Password: &nickname},
+				"criteria", map[string]interface{}{"email": "hastur@lost.space", "country": "UK"},
+				"password", "Carcosa",
+				"error", errors.New(`E11000 duplicate key error index: email_1 dup key: { email: "hastur@lost.space" }`),
+				"conflict", errors.New(`E11000 duplicate key error collection: spymaster.users index: nickname_1 dup key: { nickname: "hastur" }`),
+			)
+
+			So(out.String(), ShouldNotContainSubstring, "hastur@lost.space")
+			So(out.String(), ShouldNotContainSubstring, "Carcosa")
+			So(out.String(), ShouldNotContainSubstring, "$2a$hash")
+			So(out.String(), ShouldNotContainSubstring, "Yellow")
+			So(out.String(), ShouldNotContainSubstring, "King")
+
+			record := lines()[0]
+			logged := record["user"].(map[string]interface{})
+			So(out.String(), ShouldNotContainSubstring, "hastur")
+			So(logged["nickname"], ShouldEqual, logging.Redacted)
+			So(logged["country"], ShouldEqual, "UK")
+			So(logged["id"], ShouldEqual, user.ID.Hex())
+			So(logged["email"], ShouldEqual, logging.Redacted)
+			So(logged["first_name"], ShouldEqual, logging.Redacted)
+			So(record["patch"].(map[string]interface{})["nickname"], ShouldEqual, logging.Redacted)
+			So(record["criteria"].(map[string]interface{})["country"], ShouldEqual, "UK")
+			So(record["error"], ShouldContainSubstring, "dup key")
+			So(record["conflict"], ShouldContainSubstring, "index: nickname_1 dup key: { "+logging.Redacted+" }")
+		})
+
+		Convey("Records logged with a request context carry its request and trace IDs", func() {
+			ctx := requestid.NewContext(context.Background(), "req-1")
+			ctx = tracing.Extract(ctx, tracing.Carrier{TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+			logger.InfoContext(ctx, "With IDs")
+			logger.Info("Without")
+
+			records := lines()
+			So(records[0]["request_id"], ShouldEqual, "req-1")
+			So(records[0]["trace_id"], ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(records[1], ShouldNotContainKey, "request_id")
+		})
+
+		Convey("Records below the level are dropped", func() {
+			logger.Debug("Dropped")
+			logger.Warn("Kept")
+			So(out.String(), ShouldNotContainSubstring, "Dropped")
+			So(out.String(), ShouldContainSubstring, "Kept")
+		})
+
+		Convey("Served requests are logged with their ID and route, but not their query", func() {
+			previous := slog.Default()
+			slog.SetDefault(logger)
+			Reset(func() { slog.SetDefault(previous) })
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(server.RequestID(), server.Logging(), server.Recovery())
+			var requestID string
+			r.GET("/users/:id", func(c *gin.Context) {
+				requestID = requestid.FromContext(c.Request.Context())
+				panic("boom")
+			})
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", "/users/42?email=spy@mi6.fake", nil))
+			So(recorder.Code, ShouldEqual, 500)
+
+			records := lines()
+			So(records, ShouldHaveLength, 2)
+			So(records[0]["msg"], ShouldEqual, "Panic serving request")
+			So(records[1]["route"], ShouldEqual, "/users/:id")
+			So(records[1]["path"], ShouldEqual, "/users/42")
+			So(records[1]["level"], ShouldEqual, "ERROR")
+			So(requestID, ShouldNotBeEmpty)
+			So(records[0]["request_id"], ShouldEqual, requestID)
+			So(records[1]["request_id"], ShouldEqual, requestID)
+			So(out.String(), ShouldNotContainSubstring, "mi6")
+		})
+	})
+
+	Convey("Unknown levels and formats are refused", t, func() {
+		So(logging.Config{Level: "info", Format: logging.Text}.Validate(), ShouldBeNil)
+		So(logging.Config{Level: "loud", Format: logging.JSON}.Validate(), ShouldNotBeNil)
+		So(logging.Config{Level: "debug", Format: "xml"}.Validate(), ShouldNotBeNil)
+	})
+}
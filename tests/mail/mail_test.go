@@ -0,0 +1,146 @@
+package mail_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/mail"
+)
+
+var message = mail.Message{To: "Ethan Hunt <ethan@imf.fake>", Subject: "Your mission, should you choose to accept it", Body: "This message will self-destruct.\n"}
+
+func TestFileMailer(t *testing.T) {
+	Convey("Given a file mailer", t, func() {
+		dir := filepath.Join(t.TempDir(), "mail")
+		mailer, err := mail.NewFileMailer("Spymaster <no-reply@imf.fake>", dir)
+		So(err, ShouldBeNil)
+
+		Convey("Messages are written as .eml files only their owner reads", func() {
+			So(mailer.Send(context.Background(), message), ShouldBeNil)
+			files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 1)
+			info, err := os.Stat(files[0])
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0o600))
+
+			f, err := os.Open(files[0])
+			So(err, ShouldBeNil)
+			defer f.Close()
+			m, err := netmail.ReadMessage(f)
+			So(err, ShouldBeNil)
+			So(m.Header.Get("To"), ShouldEqual, `"Ethan Hunt" <ethan@imf.fake>`)
+			So(m.Header.Get("Subject"), ShouldEqual, message.Subject)
+			So(m.Header.Get("Message-Id"), ShouldEndWith, "@imf.fake>")
+		})
+
+		Convey("Recipients can't inject headers", func() {
+			err := mailer.Send(context.Background(), mail.Message{To: "ethan@imf.fake\r\nBcc: jim@imf.fake", Subject: "Hi"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMemoryMailer(t *testing.T) {
+	Convey("A memory mailer keeps the messages it's given until reset", t, func() {
+		mailer := &mail.MemoryMailer{}
+		So(mailer.Send(context.Background(), message), ShouldBeNil)
+		So(mailer.Send(context.Background(), mail.Message{To: "not an address"}), ShouldNotBeNil)
+		So(mailer.Messages(), ShouldResemble, []mail.Message{message})
+		mailer.Reset()
+		So(mailer.Messages(), ShouldBeEmpty)
+	})
+}
+
+func TestSMTPMailer(t *testing.T) {
+	Convey("Given an SMTP server", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		received := make(chan []string, 1)
+		go serveSMTP(l, received)
+
+		port := l.Addr().(*net.TCPAddr).Port
+		conf := mail.SMTPConfig{Host: "127.0.0.1", Port: port, TLS: mail.NoTLS, Timeout: 5 * time.Second}
+		So(conf.Validate(), ShouldBeNil)
+
+		Convey("Messages are handed to it", func() {
+			mailer := mail.NewSMTPMailer("Spymaster <no-reply@imf.fake>", conf)
+			So(mailer.Send(context.Background(), message), ShouldBeNil)
+
+			commands := <-received
+			So(commands, ShouldContain, "MAIL FROM:<no-reply@imf.fake> BODY=8BITMIME")
+			So(commands, ShouldContain, "RCPT TO:<ethan@imf.fake>")
+			So(commands, ShouldContain, "Subject: Your mission, should you choose to accept it")
+			So(commands, ShouldContain, "This message will self-destruct.")
+		})
+
+		Convey("Servers not supporting STARTTLS are refused when it's required", func() {
+			conf.TLS = mail.StartTLS
+			err := mail.NewSMTPMailer("Spymaster <no-reply@imf.fake>", conf).Send(context.Background(), message)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "STARTTLS")
+		})
+	})
+}
+
+func TestConfig(t *testing.T) {
+	Convey("The mail configuration is validated", t, func() {
+		So(mail.Config{Backend: mail.None}.Validate(), ShouldBeNil)
+		So(mail.Config{Backend: "pigeon"}.Validate(), ShouldNotBeNil)
+		So(mail.Config{Backend: mail.File, From: "no-reply@imf.fake"}.Validate(), ShouldNotBeNil)
+		So(mail.Config{Backend: mail.File, From: "not an address", Dir: "mail"}.Validate(), ShouldNotBeNil)
+		So(mail.Config{Backend: mail.SMTP, From: "no-reply@imf.fake", SMTP: mail.SMTPConfig{Port: 587, TLS: mail.StartTLS, Timeout: time.Second}}.Validate(), ShouldNotBeNil)
+		So(mail.Config{Backend: mail.SMTP, From: "no-reply@imf.fake", SMTP: mail.SMTPConfig{Host: "smtp.imf.fake", Port: 587, TLS: mail.StartTLS, Timeout: time.Second}}.Validate(), ShouldBeNil)
+	})
+}
+
+// serveSMTP answers a single SMTP session, just enough for net/smtp, sending the lines it received once over
+func serveSMTP(l net.Listener, received chan<- []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	var lines []string
+	defer func() { received <- lines }()
+
+	reply("220 imf.fake ESMTP")
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		switch {
+		case data && line == ".":
+			data = false
+			reply("250 OK")
+		case data:
+		case strings.HasPrefix(line, "EHLO"):
+			reply("250-imf.fake")
+			reply("250 8BITMIME")
+		case line == "DATA":
+			data = true
+			reply("354 Go ahead")
+		case line == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
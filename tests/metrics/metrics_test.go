@@ -0,0 +1,103 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/metrics"
+	"spymaster/src/server"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given a router recording metrics", t, func() {
+		r := gin.New()
+		r.Use(server.Metrics())
+		r.GET("/operations/:id", func(c *gin.Context) { c.Status(http.StatusAccepted) })
+		r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+		Convey("Requests are labelled with their route template rather than their path", func() {
+			for _, path := range []string{"/operations/1", "/operations/2", "/random/probe"} {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+
+			body := scrape(r)
+			So(body, ShouldContainSubstring, `spymaster_http_requests_total{method="GET",route="/operations/:id",status="202"} 2`)
+			So(body, ShouldContainSubstring, `spymaster_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+			So(body, ShouldContainSubstring, `spymaster_http_request_duration_seconds_bucket{method="GET",route="/operations/:id",status="202",le="+Inf"} 2`)
+			So(body, ShouldNotContainSubstring, "/operations/1")
+		})
+
+		Convey("Storage operations, page sizes and events are recorded", func() {
+			metrics.ObserveMongo("GetUser", time.Millisecond, false)
+			metrics.ObserveMongo("GetUser", time.Millisecond, true)
+			metrics.ObservePageSize(20)
+			metrics.EventRecorded("user.created")
+			metrics.EventPublished("user.created", time.Millisecond, errors.New("broker down"))
+			metrics.EventsRelayed(3)
+
+			body := scrape(r)
+			So(body, ShouldContainSubstring, `spymaster_mongo_operation_duration_seconds_count{method="GetUser"} 2`)
+			So(body, ShouldContainSubstring, `spymaster_mongo_operation_errors_total{method="GetUser"} 1`)
+			So(body, ShouldContainSubstring, `spymaster_http_page_size_bucket{le="20"} 1`)
+			So(body, ShouldContainSubstring, `spymaster_events_recorded_total{type="user.created"} 1`)
+			So(body, ShouldContainSubstring, `spymaster_events_published_total{outcome="failure",type="user.created"} 1`)
+			So(body, ShouldContainSubstring, `spymaster_outbox_relayed_total 3`)
+		})
+
+		Convey("The gauges of the stored data are read when scraped", func() {
+			registry := prometheus.NewRegistry()
+			oldest := time.Now().Add(-time.Minute)
+			counted := 0
+			registry.MustRegister(metrics.NewCollector(metrics.Sources{
+				UsersByCountry: func(context.Context) (map[string]int, error) {
+					counted++
+					return map[string]int{"UK": 2, "pt": 1, "PT": 1, "": 1, "Atlantis": 1, "<script>": 1}, nil
+				},
+				Outbox: func(context.Context) (int, time.Time, error) { return 4, oldest, nil },
+			}, time.Second, time.Minute))
+
+			families, err := registry.Gather()
+			So(err, ShouldBeNil)
+			values := map[string]float64{}
+			for _, f := range families {
+				for _, m := range f.GetMetric() {
+					name := f.GetName()
+					for _, l := range m.GetLabel() {
+						name += "/" + l.GetValue()
+					}
+					values[name] = m.GetGauge().GetValue()
+				}
+			}
+			So(values["spymaster_users/UK"], ShouldEqual, 2)
+			So(values["spymaster_users/PT"], ShouldEqual, 2)
+			So(values["spymaster_users/other"], ShouldEqual, 3)
+			So(values, ShouldHaveLength, 5)
+			So(values["spymaster_outbox_events"], ShouldEqual, 4)
+			So(values["spymaster_outbox_oldest_age_seconds"], ShouldBeGreaterThanOrEqualTo, 60)
+
+			Convey("Users are only counted again once their counts expired", func() {
+				_, err := registry.Gather()
+				So(err, ShouldBeNil)
+				So(counted, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func scrape(r *gin.Engine) string {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	return string(body)
+}
@@ -0,0 +1,165 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/spymaster"
+	"spymaster/src/totp"
+	"spymaster/types"
+)
+
+// mfaKey encrypts the MFA secrets of the tests, 32 bytes base64 encoded
+const mfaKey = "c3B5bWFzdGVyIHRlc3RzIG1mYSBrZXksIDMyIGJ5dGU="
+
+func TestMFA(t *testing.T) {
+	Convey("Given a user logged in", t, withCleanup(func() {
+		user, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+		session, err := auth.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+		So(err, ShouldBeNil)
+
+		post := func(path, token string, payload interface{}) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(payload)
+			req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Enrolling needs a session", func() {
+			So(post("/mfa/enroll", "", nil).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Enrolling gives a secret, stored encrypted", func() {
+			recorder := post("/mfa/enroll", session.Token, nil)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			var enrollment types.MFAEnrollment
+			So(json.Unmarshal(recorder.Body.Bytes(), &enrollment), ShouldBeNil)
+			uri, err := url.Parse(enrollment.URI)
+			So(err, ShouldBeNil)
+			So(uri.Query().Get("secret"), ShouldEqual, enrollment.Secret)
+
+			var stored bson.M
+			So(mc.Database.C("users").FindId(user.ID).One(&stored), ShouldBeNil)
+			So(stored["mfa"].(bson.M)["secret"], ShouldNotEqual, enrollment.Secret)
+			So(stored["mfa"].(bson.M)["secret"], ShouldNotContainSubstring, enrollment.Secret)
+
+			code := func(t time.Time) string {
+				c, err := totp.Code(enrollment.Secret, totp.Step(t))
+				So(err, ShouldBeNil)
+				return c
+			}
+
+			Convey("Which is never given out again", func() {
+				req, _ := http.NewRequest("GET", "/users?id="+user.ID.Hex(), nil)
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				So(recorder.Body.String(), ShouldNotContainSubstring, "mfa")
+				So(recorder.Body.String(), ShouldNotContainSubstring, enrollment.Secret)
+			})
+
+			Convey("Confirming with a wrong code leaves MFA disabled", func() {
+				So(post("/mfa/confirm", session.Token, types.MFACode{Code: "000000"}).Code, ShouldEqual, http.StatusBadRequest)
+				_, err := auth.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Confirming with a code enables MFA and gives recovery codes", func() {
+				recorder := post("/mfa/confirm", session.Token, types.MFACode{Code: code(time.Now())})
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				var codes types.RecoveryCodes
+				So(json.Unmarshal(recorder.Body.Bytes(), &codes), ShouldBeNil)
+				So(codes.RecoveryCodes, ShouldHaveLength, 3)
+				So(post("/mfa/enroll", session.Token, nil).Code, ShouldEqual, http.StatusConflict)
+
+				login := func() string {
+					recorder := post("/login", "", types.Login{Login: "ethan", Password: "impossible"})
+					So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+					var body struct {
+						MFAToken string `json:"mfa_token"`
+					}
+					So(json.Unmarshal(recorder.Body.Bytes(), &body), ShouldBeNil)
+					So(body.MFAToken, ShouldNotBeEmpty)
+					return body.MFAToken
+				}
+
+				Convey("Logging in then takes a code, which can't be used twice", func() {
+					mfaToken := login()
+					recorder := post("/login/mfa", "", types.MFALoginPost{MFAToken: mfaToken, Code: code(time.Now().Add(totp.Period))})
+					So(recorder.Code, ShouldEqual, http.StatusOK)
+					var token types.SessionToken
+					So(json.Unmarshal(recorder.Body.Bytes(), &token), ShouldBeNil)
+					So(token.UserID, ShouldEqual, user.ID.Hex())
+
+					So(post("/login/mfa", "", types.MFALoginPost{MFAToken: mfaToken, Code: code(time.Now().Add(totp.Period))}).Code,
+						ShouldEqual, http.StatusUnauthorized)
+					So(post("/login/mfa", "", types.MFALoginPost{MFAToken: login(), Code: code(time.Now())}).Code, ShouldEqual, http.StatusUnauthorized)
+				})
+
+				Convey("Or a recovery code, once", func() {
+					So(post("/login/mfa", "", types.MFALoginPost{MFAToken: login(), Code: codes.RecoveryCodes[0]}).Code, ShouldEqual, http.StatusOK)
+					So(post("/login/mfa", "", types.MFALoginPost{MFAToken: login(), Code: codes.RecoveryCodes[0]}).Code, ShouldEqual, http.StatusUnauthorized)
+				})
+
+				Convey("Wrong codes count as failed logins", func() {
+					mfaToken := login()
+					for i := 0; i < 3; i++ {
+						So(post("/login/mfa", "", types.MFALoginPost{MFAToken: mfaToken, Code: "000000"}).Code, ShouldEqual, http.StatusUnauthorized)
+					}
+					So(post("/login/mfa", "", types.MFALoginPost{MFAToken: mfaToken, Code: code(time.Now())}).Code, ShouldEqual, http.StatusTooManyRequests)
+				})
+
+				Convey("A login only takes so many codes, even without lockouts", func() {
+					lenient, err := spymaster.NewAuthenticator(svc, mc, nil, nil, spymaster.AuthConfig{SessionTTL: time.Hour,
+						MFA: spymaster.MFAConfig{Key: mfaKey, Skew: 1, ChallengeTTL: time.Minute, RecoveryCodes: 3, MaxAttempts: 2}})
+					So(err, ShouldBeNil)
+					_, err = lenient.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+					var required *spymaster.MFARequiredError
+					So(errors.As(err, &required), ShouldBeTrue)
+					for i := 0; i < 2; i++ {
+						_, err = lenient.LoginMFA(context.Background(), required.Token, "000000", "192.0.2.1")
+						So(err, ShouldEqual, spymaster.ErrInvalidCredentials)
+					}
+					_, err = lenient.LoginMFA(context.Background(), required.Token, code(time.Now()), "192.0.2.1")
+					So(err, ShouldEqual, spymaster.ErrInvalidToken)
+				})
+
+				Convey("Resetting it needs an admin", func() {
+					req, _ := http.NewRequest("DELETE", "/admin/users/"+user.ID.Hex()+"/mfa", nil)
+					req.Header.Set("Authorization", "Bearer "+session.Token)
+					recorder := httptest.NewRecorder()
+					r.ServeHTTP(recorder, req)
+					So(recorder.Code, ShouldEqual, http.StatusForbidden)
+
+					req.Header.Del("Authorization")
+					recorder = httptest.NewRecorder()
+					r.ServeHTTP(recorder, req)
+					So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+				})
+
+				Convey("Until an admin resets it", func() {
+					req, _ := http.NewRequest("DELETE", "/admin/users/"+user.ID.Hex()+"/mfa", nil)
+					recorder := httptest.NewRecorder()
+					r.ServeHTTP(recorder, asAdmin(req))
+					So(recorder.Code, ShouldEqual, http.StatusNoContent)
+					So(post("/login", "", types.Login{Login: "ethan", Password: "impossible"}).Code, ShouldEqual, http.StatusOK)
+				})
+			})
+		})
+	}))
+}
@@ -0,0 +1,200 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/operations"
+	"spymaster/src/server"
+	"spymaster/types"
+)
+
+func TestAsyncOperations(t *testing.T) {
+	Convey("When a write prefers to be processed asynchronously...", t, withCleanup(func() {
+		recorder := httptest.NewRecorder()
+
+		Convey("Creating a user answers with an operation which eventually holds the user", func() {
+			body := []byte(`{"nickname":"neo","password":"red pill","email":"neo@matrix.fake"}`)
+			req, err := http.NewRequest("POST", "/users", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			asAdmin(req)
+			req.Header.Set("Prefer", "wait=10, respond-async")
+
+			var op operations.Operation
+			serveAndUnmarshal(recorder, req, &op)
+			So(recorder.Code, ShouldEqual, http.StatusAccepted)
+			So(recorder.Header().Get("Location"), ShouldEqual, "/operations/"+op.ID)
+			So(recorder.Header().Get("Preference-Applied"), ShouldEqual, "respond-async")
+			So(op.Kind, ShouldEqual, operations.CreateUser)
+
+			op = waitOperation(op.ID)
+			So(op.Status, ShouldEqual, operations.Succeeded)
+			So(op.Result.Nickname, ShouldEqual, "neo")
+			So(op.Result.Password, ShouldBeEmpty)
+
+			Convey("And creating it again fails as the synchronous endpoint would", func() {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("POST", "/users", bytes.NewReader(body))
+				So(err, ShouldBeNil)
+				asAdmin(req)
+				req.Header.Set("Prefer", "respond-async")
+				serveAndUnmarshal(recorder, req, &op)
+
+				op = waitOperation(op.ID)
+				So(op.Status, ShouldEqual, operations.Failed)
+				So(op.Error, ShouldResemble, &operations.Error{Status: http.StatusConflict, Message: "User/Email already exists"})
+			})
+		})
+
+		Convey("Updating a user with an invalid ID fails", func() {
+			req, err := http.NewRequest("PATCH", "/users?id=nope", bytes.NewReader([]byte(`{"country":"ZW"}`)))
+			So(err, ShouldBeNil)
+			asAdmin(req)
+			req.Header.Set("Prefer", "respond-async")
+
+			var op operations.Operation
+			serveAndUnmarshal(recorder, req, &op)
+			So(recorder.Code, ShouldEqual, http.StatusAccepted)
+
+			op = waitOperation(op.ID)
+			So(op.Status, ShouldEqual, operations.Failed)
+			So(op.Error.Status, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Deleting a user which doesn't exist succeeds, as the synchronous endpoint does", func() {
+			req, err := http.NewRequest("DELETE", "/users?id="+bson.NewObjectId().Hex(), nil)
+			So(err, ShouldBeNil)
+			asAdmin(req)
+			req.Header.Set("Prefer", "respond-async")
+
+			var op operations.Operation
+			serveAndUnmarshal(recorder, req, &op)
+			So(recorder.Code, ShouldEqual, http.StatusAccepted)
+			op = waitOperation(op.ID)
+			So(op.Status, ShouldEqual, operations.Succeeded)
+			So(op.Error, ShouldBeNil)
+			So(op.Result, ShouldBeNil)
+		})
+
+		Convey("Operations have random IDs and are only found by whoever submitted them", func() {
+			_, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "morpheus", Password: "blue pill", Email: "morpheus@matrix.fake"})
+			So(err, ShouldBeNil)
+			session, err := auth.Login(context.Background(), "morpheus", "blue pill", "192.0.2.1")
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest("PATCH", "/users?id="+session.UserID, bytes.NewReader([]byte(`{"country":"ZW"}`)))
+			So(err, ShouldBeNil)
+			req.Header.Set("Prefer", "respond-async")
+			req.Header.Set("Authorization", "Bearer "+session.Token)
+			var op operations.Operation
+			serveAndUnmarshal(recorder, req, &op)
+			So(recorder.Code, ShouldEqual, http.StatusAccepted)
+			So(op.ID, ShouldHaveLength, 32)
+
+			get := func(token string) int {
+				req, err := http.NewRequest("GET", "/operations/"+op.ID, nil)
+				So(err, ShouldBeNil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				return recorder.Code
+			}
+			So(get(""), ShouldEqual, http.StatusNotFound)
+			So(get(session.Token), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Operations are not found when asynchronous processing is disabled", func() {
+			router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Auth: auth})
+			req, err := http.NewRequest("GET", "/operations/"+bson.NewObjectId().Hex(), nil)
+			So(err, ShouldBeNil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Commands queued when shutting down are still executed, and no new ones are accepted", func() {
+			dispatcher := operations.NewDispatcher(mc, svc, operations.Config{Workers: 1, Queue: 10, TTL: time.Minute, Timeout: 5 * time.Second})
+			var queued []operations.Operation
+			for _, nickname := range []string{"tank", "dozer", "mouse"} {
+				op, err := dispatcher.Submit(context.Background(), operations.Command{Kind: operations.CreateUser,
+					Create: &types.UserPost{Nickname: nickname, Password: "zion", Email: nickname + "@matrix.fake"}})
+				So(err, ShouldBeNil)
+				queued = append(queued, op)
+			}
+
+			go dispatcher.Run(context.Background())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			So(dispatcher.Shutdown(ctx), ShouldBeNil)
+			for _, op := range queued {
+				stored, err := mc.GetOperation(context.Background(), op.ID)
+				So(err, ShouldBeNil)
+				So(stored.Status, ShouldEqual, operations.Succeeded)
+			}
+
+			_, err := dispatcher.Submit(context.Background(), operations.Command{Kind: operations.DeleteUser, UserID: bson.NewObjectId().Hex()})
+			So(err, ShouldEqual, operations.ErrShutdown)
+		})
+
+		Convey("Invalid payloads are still rejected right away", func() {
+			req, err := http.NewRequest("POST", "/users", bytes.NewReader([]byte(`{"nickname":"neo"}`)))
+			So(err, ShouldBeNil)
+			asAdmin(req)
+			req.Header.Set("Prefer", "respond-async")
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Unknown and expired operations are not found", func() {
+			now := time.Now().UTC()
+			expired := operations.Operation{ID: bson.NewObjectId().Hex(), Kind: operations.DeleteUser, Status: operations.Succeeded, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(-time.Second)}
+			So(mc.SaveOperation(context.Background(), expired), ShouldBeNil)
+
+			for _, id := range []string{bson.NewObjectId().Hex(), expired.ID} {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", "/operations/"+id, nil)
+				So(err, ShouldBeNil)
+				r.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusNotFound)
+			}
+		})
+
+		Convey("Without the preference users are still written synchronously", func() {
+			body := []byte(`{"nickname":"trinity","password":"white rabbit","email":"trinity@matrix.fake"}`)
+			req, err := http.NewRequest("POST", "/users", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			asAdmin(req)
+
+			var user types.User
+			serveAndUnmarshal(recorder, req, &user)
+			So(recorder.Code, ShouldEqual, http.StatusCreated)
+			So(user.Nickname, ShouldEqual, "trinity")
+		})
+	}))
+}
+
+// waitOperation polls an operation until it's done
+func waitOperation(id string) operations.Operation {
+	var op operations.Operation
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/operations/"+id, nil)
+		So(err, ShouldBeNil)
+		asAdmin(req)
+		serveAndUnmarshal(recorder, req, &op)
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		if op.Done() {
+			return op
+		}
+		So(recorder.Header().Get("Retry-After"), ShouldEqual, "1")
+	}
+	return op
+}
@@ -0,0 +1,143 @@
+package password_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/password"
+)
+
+func TestPolicy(t *testing.T) {
+	Convey("Given a policy", t, func() {
+		conf := password.Config{MinLength: 8, MaxLength: 72, MinScore: 2}
+		policy := password.NewWithCorpus(conf, nil)
+		check := func(pw string) []string {
+			err := policy.Check(context.Background(), pw, "ethan", "ethan.hunt@imf.fake")
+			if err == nil {
+				return nil
+			}
+			return err.(*password.Error).Problems
+		}
+
+		Convey("Strong passwords are accepted", func() {
+			So(check("correct horse battery staple"), ShouldBeNil)
+			So(check("xK9#mQ2$vL"), ShouldBeNil)
+		})
+
+		Convey("Short and long passwords are refused", func() {
+			So(check("xK9#mQ2"), ShouldResemble, []string{"must be at least 8 characters long"})
+			So(check(strings.Repeat("xK9#mQ2$", 10)), ShouldResemble, []string{"must be at most 72 bytes long"})
+		})
+
+		Convey("Passwords holding the nickname or the email are refused, whatever the case", func() {
+			So(check("Ethan-was-here-42"), ShouldResemble, []string{"must not contain the nickname"})
+			So(check("xx-ETHAN.HUNT-xx"), ShouldResemble, []string{"must not contain the nickname", "must not contain the email"})
+		})
+
+		Convey("Guessable passwords are refused, saying why", func() {
+			problems := check("Password1")
+			So(problems, ShouldHaveLength, 1)
+			So(problems[0], ShouldStartWith, "is too easy to guess (strength 0 of 4, 2 needed)")
+			So(problems[0], ShouldContainSubstring, "avoid common words and passwords")
+			So(check("abcdefgh12345678")[0], ShouldContainSubstring, "avoid sequences like abc or 123")
+		})
+
+		Convey("A nil policy accepts anything", func() {
+			var none *password.Policy
+			So(none.Check(context.Background(), "x", "ethan", "ethan@imf.fake"), ShouldBeNil)
+		})
+	})
+
+	Convey("Password configurations are validated", t, func() {
+		So(password.Config{MinLength: 8, MaxLength: 72, MinScore: 2}.Validate(), ShouldBeNil)
+		So(password.Config{MinLength: 8, MaxLength: 100, MinScore: 2}.Validate(), ShouldNotBeNil)
+		So(password.Config{MinLength: 8, MaxLength: 72, MinScore: 5}.Validate(), ShouldNotBeNil)
+		So(password.Config{MinLength: 8, MaxLength: 72, BreachedFile: "/nonexistent"}.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestEstimate(t *testing.T) {
+	Convey("Passwords are scored as an attacker would try them", t, func() {
+		for pw, score := range map[string]int{
+			"password":                     0,
+			"Password1":                    0,
+			"aaaaaaaaaaaa":                 0,
+			"qwertyuiop":                   0,
+			"p@ssw0rd2020":                 0,
+			"abcdefgh12345678":             1,
+			"Tr0ub4dour&3":                 4,
+			"correct horse battery staple": 4,
+		} {
+			So(fmt.Sprintf("%s: %d", pw, password.Estimate(pw).Score), ShouldEqual, fmt.Sprintf("%s: %d", pw, score))
+		}
+	})
+
+	Convey("The user's own inputs are guessed first", t, func() {
+		So(password.Estimate("grumbleton1984").Score, ShouldBeGreaterThan, password.Estimate("grumbleton1984", "grumbleton").Score)
+	})
+}
+
+func TestFileCorpus(t *testing.T) {
+	Convey("Given a file of breached password hashes", t, func() {
+		var lines []string
+		breached := []string{"hunter2", "Carcosa", "correct horse battery staple"}
+		for _, pw := range breached {
+			lines = append(lines, hash(pw)+":42")
+		}
+		for i := 0; i < 5000; i++ {
+			lines = append(lines, hash(fmt.Sprintf("filler-%d", i))+":1")
+		}
+		sort.Strings(lines)
+		path := filepath.Join(t.TempDir(), "pwned.txt")
+		So(os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600), ShouldBeNil)
+
+		corpus, err := password.OpenFileCorpus(path)
+		So(err, ShouldBeNil)
+		defer corpus.Close()
+
+		Convey("Every hash is found by its prefix", func() {
+			for _, line := range lines {
+				suffixes, err := corpus.Range(context.Background(), line[:5])
+				So(err, ShouldBeNil)
+				So(suffixes, ShouldContain, line[5:40])
+			}
+		})
+
+		Convey("Prefixes no hash starts with, before, among or after them all, find nothing", func() {
+			for _, prefix := range []string{"00000", lines[0][:4] + "G", "FFFFF"} {
+				if strings.HasPrefix(lines[0], prefix) || strings.HasPrefix(lines[len(lines)-1], prefix) {
+					continue
+				}
+				suffixes, err := corpus.Range(context.Background(), prefix)
+				if prefix == lines[0][:4]+"G" {
+					So(err, ShouldEqual, password.ErrInvalidPrefix)
+					continue
+				}
+				So(err, ShouldBeNil)
+				So(suffixes, ShouldBeEmpty)
+			}
+		})
+
+		Convey("Breached passwords are refused by a policy screening against it", func() {
+			policy := password.NewWithCorpus(password.Config{MinLength: 1, MaxLength: 72}, corpus)
+			err := policy.Check(context.Background(), "correct horse battery staple", "ethan", "ethan@imf.fake")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "data breach")
+			So(policy.Check(context.Background(), "correct horse battery stapler", "ethan", "ethan@imf.fake"), ShouldBeNil)
+		})
+	})
+}
+
+func hash(pw string) string {
+	sum := sha1.Sum([]byte(pw))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
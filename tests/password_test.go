@@ -0,0 +1,80 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/password"
+	"spymaster/types"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	Convey("Given a password policy screening breached passwords", t, withCleanup(func() {
+		svc.SetPasswordPolicy(password.NewWithCorpus(password.Config{MinLength: 8, MaxLength: 72, MinScore: 2}, breached{"Carcosa-Yellow-King"}))
+		defer svc.SetPasswordPolicy(nil)
+
+		send := func(method, path string, payload interface{}) (int, errorResponse) {
+			body, _ := json.Marshal(payload)
+			req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, asAdmin(req))
+			var result errorResponse
+			json.Unmarshal(recorder.Body.Bytes(), &result)
+			return recorder.Code, result
+		}
+
+		Convey("Users can't be created with a weak password, and are told why", func() {
+			code, result := send("POST", "/users", types.UserPost{Nickname: "ethan", Password: "ethan1", Email: "ethan@imf.fake"})
+			So(code, ShouldEqual, http.StatusBadRequest)
+			So(result.Message, ShouldEqual, "Validation error")
+			So(result.Details["password"], ShouldStartWith, "Password must be at least 8 characters long, must not contain the nickname")
+		})
+
+		Convey("Users can't be created with a breached password", func() {
+			code, result := send("POST", "/users", types.UserPost{Nickname: "ethan", Password: "Carcosa-Yellow-King", Email: "ethan@imf.fake"})
+			So(code, ShouldEqual, http.StatusBadRequest)
+			So(result.Details["password"], ShouldContainSubstring, "data breach")
+		})
+
+		Convey("Given a user with a strong password", func() {
+			user, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "correct horse battery staple", Email: "hunt@imf.fake"})
+			So(err, ShouldBeNil)
+
+			Convey("Their password can't be changed to one holding their email", func() {
+				code, result := send("PATCH", "/users?id="+user.ID.Hex(), map[string]string{"password": "Hunt-Rogue-Nation-77"})
+				So(code, ShouldEqual, http.StatusBadRequest)
+				So(result.Details["password"], ShouldEqual, "Password must not contain the email")
+			})
+
+			Convey("Resetting it to a weak password keeps the token usable", func() {
+				So(postToken("/password/forgot", types.PasswordResetRequest{Login: "ethan"}), ShouldEqual, http.StatusAccepted)
+				token := mailedToken("hunt@imf.fake", "/reset-password")
+				So(postToken("/password/reset", types.PasswordReset{Token: token, Password: "password"}), ShouldEqual, http.StatusBadRequest)
+				So(postToken("/password/reset", types.PasswordReset{Token: token, Password: "Tr0ub4dour&3"}), ShouldEqual, http.StatusNoContent)
+			})
+		})
+	}))
+}
+
+// breached is a corpus of the passwords it holds
+type breached []string
+
+func (b breached) Range(_ context.Context, prefix string) ([]string, error) {
+	var suffixes []string
+	for _, pw := range b {
+		sum := sha1.Sum([]byte(pw))
+		if hash := strings.ToUpper(hex.EncodeToString(sum[:])); strings.HasPrefix(hash, prefix) {
+			suffixes = append(suffixes, hash[len(prefix):])
+		}
+	}
+	return suffixes, nil
+}
@@ -0,0 +1,158 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/controllers"
+	"spymaster/src/ratelimit"
+	"spymaster/src/server"
+)
+
+func TestLimiter(t *testing.T) {
+	Convey("Given a limiter allowing bursts of 3 requests and 10 per second", t, func() {
+		limiter := ratelimit.New(ratelimit.NewMemoryStore(), ratelimit.Config{Backend: ratelimit.Memory, Rate: 10, Burst: 3})
+		ctx := context.Background()
+
+		Convey("A burst is let through, then requests are turned down until a token comes back", func() {
+			for remaining := 2; remaining >= 0; remaining-- {
+				res, err := limiter.Allow(ctx, "ip:192.0.2.1")
+				So(err, ShouldBeNil)
+				So(res.Allowed, ShouldBeTrue)
+				So(res.Limit, ShouldEqual, 3)
+				So(res.Remaining, ShouldEqual, remaining)
+			}
+
+			res, err := limiter.Allow(ctx, "ip:192.0.2.1")
+			So(err, ShouldBeNil)
+			So(res.Allowed, ShouldBeFalse)
+			So(res.RetryAfter, ShouldBeGreaterThan, 0)
+			So(res.RetryAfter, ShouldBeLessThanOrEqualTo, 100*time.Millisecond)
+			So(res.Window, ShouldEqual, 300*time.Millisecond)
+
+			time.Sleep(res.RetryAfter)
+			res, err = limiter.Allow(ctx, "ip:192.0.2.1")
+			So(err, ShouldBeNil)
+			So(res.Allowed, ShouldBeTrue)
+			So(res.Remaining, ShouldEqual, 0)
+
+			Convey("While other clients have buckets of their own", func() {
+				res, err := limiter.Allow(ctx, "ip:192.0.2.2")
+				So(err, ShouldBeNil)
+				So(res.Allowed, ShouldBeTrue)
+				So(res.Remaining, ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Invalid configurations are reported", t, func() {
+		So(ratelimit.Config{Enabled: true, Backend: "redis", Rate: 1, Burst: 1}.Validate(), ShouldNotBeNil)
+		So(ratelimit.Config{Enabled: true, Backend: ratelimit.Memory, Rate: 0, Burst: 1}.Validate(), ShouldNotBeNil)
+		So(ratelimit.Config{Enabled: true, Backend: ratelimit.Mongo, Rate: 1, Burst: 0}.Validate(), ShouldNotBeNil)
+		So(ratelimit.Config{Enabled: false, Backend: "redis"}.Validate(), ShouldBeNil)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given a router limiting clients to bursts of 2 requests, 1 per second", t, func() {
+		limiter := ratelimit.New(ratelimit.NewMemoryStore(), ratelimit.Config{Backend: ratelimit.Memory, Rate: 1, Burst: 2})
+		r := gin.New()
+		r.Use(server.RequestID(), server.RateLimit(limiter))
+		r.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+		r.GET("/livez", func(c *gin.Context) { c.Status(http.StatusOK) })
+		serve := func(path, ip string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			req.RemoteAddr = ip + ":1234"
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Answers carry the state of the bucket", func() {
+			recorder := serve("/users", "192.0.2.1")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+			So(recorder.Header().Get("RateLimit-Remaining"), ShouldEqual, "1")
+			So(recorder.Header().Get("RateLimit-Reset"), ShouldEqual, "1")
+			So(recorder.Header().Get("RateLimit-Policy"), ShouldEqual, "2;w=2")
+
+			Convey("And clients going over their rate get a 429 telling them when to retry", func() {
+				So(serve("/users", "192.0.2.1").Code, ShouldEqual, http.StatusOK)
+				recorder := serve("/users", "192.0.2.1")
+				So(recorder.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(recorder.Header().Get("Retry-After"), ShouldEqual, "1")
+				So(recorder.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+				So(recorder.Body.String(), ShouldContainSubstring, `"request_id"`)
+
+				So(serve("/users", "192.0.2.2").Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("And probes aren't limited", func() {
+				for i := 0; i < 5; i++ {
+					recorder := serve("/livez", "192.0.2.1")
+					So(recorder.Code, ShouldEqual, http.StatusOK)
+					So(recorder.Header().Get("RateLimit-Limit"), ShouldBeEmpty)
+				}
+			})
+		})
+	})
+
+	Convey("Given a limiter whose store can't be reached", t, func() {
+		limiter := ratelimit.New(brokenStore{}, ratelimit.Config{Backend: ratelimit.Mongo, Rate: 1, Burst: 1})
+		r := gin.New()
+		r.Use(server.RateLimit(limiter))
+		r.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		Convey("Requests go through", func() {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", "/users", nil))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestPagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given listings capped at 50 per page", t, func() {
+		r := gin.New()
+		r.GET("/users", controllers.Pagination(50), func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"per_page": c.MustGet("per_page")})
+		})
+		serve := func(path string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+			return recorder
+		}
+
+		Convey("Larger pages are rejected", func() {
+			recorder := serve("/users?per_page=51")
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(recorder.Body.String(), ShouldContainSubstring, "expected an integer between 1 and 50")
+			So(serve("/users?per_page=50").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("The default page size is capped as well", func() {
+			So(serve("/users").Body.String(), ShouldEqual, `{"per_page":50}`)
+		})
+	})
+}
+
+type brokenStore struct{}
+
+func (brokenStore) GetBucket(context.Context, string) (time.Time, error) {
+	return time.Time{}, errors.New("no reachable servers")
+}
+
+func (brokenStore) SwapBucket(context.Context, string, time.Time, time.Time) (bool, error) {
+	return false, errors.New("no reachable servers")
+}
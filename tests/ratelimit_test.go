@@ -0,0 +1,53 @@
+package controllers_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/ratelimit"
+)
+
+func TestMongoRateLimit(t *testing.T) {
+	Convey("Given a limiter sharing its buckets through MongoDB", t, withCleanup(func() {
+		limiter := ratelimit.New(mc, ratelimit.Config{Backend: ratelimit.Mongo, Rate: 1, Burst: 5})
+		ctx := context.Background()
+
+		Convey("Concurrent requests take exactly as many tokens as the bucket holds", func() {
+			var allowed, denied int32
+			var wg sync.WaitGroup
+			for i := 0; i < 12; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res, err := limiter.Allow(ctx, "ip:192.0.2.1")
+					switch {
+					case err == ratelimit.ErrContended:
+					case err != nil:
+						panic(err)
+					case res.Allowed:
+						atomic.AddInt32(&allowed, 1)
+					default:
+						atomic.AddInt32(&denied, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			So(allowed, ShouldEqual, 5)
+			So(denied, ShouldBeGreaterThan, 0)
+
+			Convey("And clients aren't stored as they are", func() {
+				n, err := mc.Database.C("rate_limits").Find(bson.M{"_id": "ip:192.0.2.1"}).Count()
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 0)
+				n, err = mc.Database.C("rate_limits").Count()
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+			})
+		})
+	}))
+}
@@ -0,0 +1,65 @@
+package requestid_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/controllers"
+	"spymaster/src/requestid"
+	"spymaster/src/server"
+)
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given a router tagging requests with an ID", t, func() {
+		r := gin.New()
+		r.Use(server.RequestID())
+		var seen string
+		r.GET("/users", func(c *gin.Context) {
+			seen = requestid.FromContext(c.Request.Context())
+			controllers.Fail(c, http.StatusNotFound, gin.H{"message": "Not Found"})
+		})
+		serve := func(id string) (*httptest.ResponseRecorder, map[string]string) {
+			req := httptest.NewRequest("GET", "/users", nil)
+			if id != "" {
+				req.Header.Set(requestid.Header, id)
+			}
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			var body map[string]string
+			So(json.Unmarshal(recorder.Body.Bytes(), &body), ShouldBeNil)
+			return recorder, body
+		}
+
+		Convey("The caller's ID is kept, echoed and put in error bodies", func() {
+			recorder, body := serve("checkout-42:retry-1")
+			So(seen, ShouldEqual, "checkout-42:retry-1")
+			So(recorder.Header().Get(requestid.Header), ShouldEqual, "checkout-42:retry-1")
+			So(body["request_id"], ShouldEqual, "checkout-42:retry-1")
+			So(body["message"], ShouldEqual, "Not Found")
+		})
+
+		Convey("An ID is generated when the caller gives none", func() {
+			recorder, body := serve("")
+			So(seen, ShouldHaveLength, 32)
+			So(recorder.Header().Get(requestid.Header), ShouldEqual, seen)
+			So(body["request_id"], ShouldEqual, seen)
+		})
+
+		Convey("IDs which are too long or unsafe to log are replaced", func() {
+			for _, id := range []string{strings.Repeat("a", 129), "id\nINFO forged line", `{"$ne":1}`} {
+				recorder, _ := serve(id)
+				So(seen, ShouldNotEqual, id)
+				So(seen, ShouldHaveLength, 32)
+				So(recorder.Header().Get(requestid.Header), ShouldEqual, seen)
+			}
+		})
+	})
+}
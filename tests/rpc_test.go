@@ -0,0 +1,131 @@
+package controllers_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	"spymaster/src/rpc"
+	"spymaster/src/rpc/pb"
+	"spymaster/types"
+)
+
+func TestGRPCUsers(t *testing.T) {
+	Convey("When users are managed through the gRPC API...", t, withCleanup(func() {
+		conn, stop := dialGRPC()
+		defer stop()
+		client := pb.NewUserServiceClient(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+adminToken())
+
+		Convey("The health service reports SERVING", func() {
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			So(err, ShouldBeNil)
+			So(resp.GetStatus(), ShouldEqual, healthpb.HealthCheckResponse_SERVING)
+		})
+
+		Convey("And a user is created", func() {
+			created, err := client.CreateUser(ctx, &pb.CreateUserRequest{
+				FirstName: proto.String("Robin"),
+				Nickname:  "genie",
+				Password:  "Jumanji",
+				Email:     "rwilliams@hollywood.fake",
+				Country:   proto.String("US"),
+			})
+			So(err, ShouldBeNil)
+
+			Convey("It can be fetched and listed", func() {
+				u, err := client.GetUser(ctx, &pb.GetUserRequest{Id: created.GetId()})
+				So(err, ShouldBeNil)
+				So(u.GetNickname(), ShouldEqual, "genie")
+
+				list, err := client.ListUsers(ctx, &pb.ListUsersRequest{Nickname: "gen"})
+				So(err, ShouldBeNil)
+				So(list.GetTotalCount(), ShouldEqual, 1)
+				So(list.GetPerPage(), ShouldEqual, 100)
+			})
+
+			Convey("Listing without a page size fits under a lower maximum", func() {
+				svc.SetMaxPerPage(10)
+				defer svc.SetMaxPerPage(0)
+
+				list, err := client.ListUsers(ctx, &pb.ListUsersRequest{})
+				So(err, ShouldBeNil)
+				So(list.GetPerPage(), ShouldEqual, 10)
+
+				_, err = client.ListUsers(ctx, &pb.ListUsersRequest{PerPage: 11})
+				So(status.Code(err), ShouldEqual, codes.InvalidArgument)
+			})
+
+			Convey("Creating it again is rejected", func() {
+				_, err := client.CreateUser(ctx, &pb.CreateUserRequest{
+					Nickname: "genie",
+					Password: "Jumanji",
+					Email:    "rwilliams@hollywood.fake",
+				})
+				So(status.Code(err), ShouldEqual, codes.AlreadyExists)
+			})
+		})
+
+		Convey("And the user does not exist", func() {
+			_, err := client.GetUser(ctx, &pb.GetUserRequest{Id: "61ba6382df4bec585cf60e60"})
+			So(status.Code(err), ShouldEqual, codes.NotFound)
+
+			_, err = client.GetUser(ctx, &pb.GetUserRequest{Id: "nope"})
+			So(status.Code(err), ShouldEqual, codes.InvalidArgument)
+		})
+
+		Convey("And someone is watching for updates", func() {
+			dbUser, _ := createUser(types.User{Nickname: "hastur", Email: "hastur@lost.space"})
+
+			stream, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{
+				Types:  []pb.EventType{pb.EventType_EVENT_TYPE_UPDATED},
+				UserId: dbUser.ID.Hex(),
+			})
+			So(err, ShouldBeNil)
+			// wait for the subscription to be registered before writing
+			time.Sleep(100 * time.Millisecond)
+
+			_, err = client.UpdateUser(ctx, &pb.UpdateUserRequest{Id: dbUser.ID.Hex(), Country: proto.String("UK")})
+			So(err, ShouldBeNil)
+
+			ev, err := stream.Recv()
+			So(err, ShouldBeNil)
+			So(ev.GetType(), ShouldEqual, pb.EventType_EVENT_TYPE_UPDATED)
+			So(ev.GetUser().GetCountry(), ShouldEqual, "UK")
+		})
+	}))
+}
+
+// dialGRPC starts the gRPC server on an in-memory listener and connects to it
+func dialGRPC() (*grpc.ClientConn, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	gs := rpc.NewServer(svc, broker, auth)
+	go gs.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+	return conn, func() {
+		conn.Close()
+		gs.Stop()
+	}
+}
@@ -0,0 +1,56 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEventSchemas(t *testing.T) {
+	Convey("When the event schema registry is requested...", t, func() {
+		recorder := httptest.NewRecorder()
+
+		Convey("Every event type is listed with its versions", func() {
+			req, err := http.NewRequest("GET", "/schemas", nil)
+			So(err, ShouldBeNil)
+
+			var result struct {
+				Types []struct {
+					Type     string `json:"type"`
+					Latest   int    `json:"latest"`
+					Versions []struct {
+						Href string `json:"href"`
+					} `json:"versions"`
+				} `json:"types"`
+			}
+			serveAndUnmarshal(recorder, req, &result)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(result.Types, ShouldHaveLength, 4)
+			So(result.Types[0].Type, ShouldEqual, "com.spymaster.user.created")
+			So(result.Types[0].Latest, ShouldEqual, 1)
+
+			Convey("And each version links to its JSON schema", func() {
+				recorder := httptest.NewRecorder()
+				req, err := http.NewRequest("GET", result.Types[0].Versions[0].Href, nil)
+				So(err, ShouldBeNil)
+				r.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/schema+json")
+
+				var schema map[string]interface{}
+				So(json.Unmarshal(recorder.Body.Bytes(), &schema), ShouldBeNil)
+				So(schema["$id"], ShouldEqual, "urn:spymaster:schema:com.spymaster.user.created.v1")
+			})
+		})
+
+		Convey("Unknown types are not found", func() {
+			req, err := http.NewRequest("GET", "/schemas/com.spymaster.user.created.v9", nil)
+			So(err, ShouldBeNil)
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,151 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/scim"
+	"spymaster/types"
+)
+
+func TestSCIMUsers(t *testing.T) {
+	Convey("When an identity provider talks SCIM to the API...", t, withCleanup(func() {
+		recorder := httptest.NewRecorder()
+
+		Convey("And provisions a new user", func() {
+			payload := map[string]interface{}{
+				"schemas":   []string{"urn:ietf:params:scim:schemas:core:2.0:User"},
+				"userName":  "genie",
+				"name":      map[string]string{"givenName": "Robin", "familyName": "Williams"},
+				"emails":    []map[string]interface{}{{"value": "rwilliams@hollywood.fake", "primary": true}},
+				"addresses": []map[string]string{{"country": "US"}},
+			}
+			p, _ := json.Marshal(payload)
+			req, err := http.NewRequest("POST", "/scim/v2/Users", bytes.NewBuffer(p))
+			So(err, ShouldBeNil)
+			asAdmin(req)
+
+			var result scim.User
+			serveAndUnmarshal(recorder, req, &result)
+
+			Convey("The SCIM attributes are mapped onto the user", func() {
+				So(recorder.Code, ShouldEqual, http.StatusCreated)
+				So(recorder.Header().Get("Content-Type"), ShouldEqual, scim.ContentType)
+				u, err := getDBUser(result.ID)
+				So(err, ShouldBeNil)
+				So(u.Nickname, ShouldEqual, "genie")
+				So(u.FirstName, ShouldEqual, "Robin")
+				So(u.LastName, ShouldEqual, "Williams")
+				So(u.Country, ShouldEqual, "US")
+				So(u.Password, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("And there are users", func() {
+			hastur, _ := createUser(types.User{Nickname: "hastur", Email: "hastur@lost.space", Country: "UK"})
+			createUser(types.User{Nickname: "fake_hastur", Email: "fake_hastur@lost.space", Country: "UK"})
+
+			Convey("Filtering with userName eq returns a single match", func() {
+				filter := url.QueryEscape(`userName eq "hastur"`)
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?filter="+filter, nil)
+
+				var result scim.ListResponse
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(result.TotalResults, ShouldEqual, 1)
+			})
+
+			Convey("Filtering with userName eq ignores case, as userName isn't caseExact", func() {
+				filter := url.QueryEscape(`userName eq "HASTUR"`)
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?filter="+filter, nil)
+
+				var result scim.ListResponse
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(result.TotalResults, ShouldEqual, 1)
+				So(result.Resources[0].(map[string]interface{})["id"], ShouldEqual, hastur.ID.Hex())
+			})
+
+			Convey("Pages hold at most the advertised maxResults", func() {
+				for i := 0; i < 110; i++ {
+					_, err := createUser(types.User{Nickname: fmt.Sprintf("spawn_%03d", i), Email: fmt.Sprintf("spawn_%03d@lost.space", i)})
+					So(err, ShouldBeNil)
+				}
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?count=500", nil)
+
+				var result scim.ListResponse
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(result.TotalResults, ShouldEqual, 112)
+				So(result.ItemsPerPage, ShouldEqual, 100)
+			})
+
+			Convey("Starting too deep is rejected", func() {
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?startIndex=9999999999", nil)
+
+				var result scim.Error
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+				So(result.ScimType, ShouldEqual, "invalidValue")
+			})
+
+			Convey("Filtering with emails.value co returns partial matches", func() {
+				filter := url.QueryEscape(`emails.value co "lost.space"`)
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?count=1&filter="+filter, nil)
+
+				var result scim.ListResponse
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(result.TotalResults, ShouldEqual, 2)
+				So(result.ItemsPerPage, ShouldEqual, 1)
+			})
+
+			Convey("Unsupported filters are rejected", func() {
+				filter := url.QueryEscape(`userName gt "a"`)
+				req, _ := http.NewRequest("GET", "/scim/v2/Users?filter="+filter, nil)
+
+				var result scim.Error
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+				So(result.ScimType, ShouldEqual, "invalidFilter")
+			})
+
+			Convey("PATCH operations update the mapped fields", func() {
+				payload := map[string]interface{}{
+					"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+					"Operations": []map[string]interface{}{
+						{"op": "replace", "path": "name.givenName", "value": "Yellow"},
+						{"op": "remove", "path": "addresses"},
+					},
+				}
+				p, _ := json.Marshal(payload)
+				req, _ := http.NewRequest("PATCH", fmt.Sprintf("/scim/v2/Users/%s", hastur.ID.Hex()), bytes.NewBuffer(p))
+				asAdmin(req)
+
+				var result scim.User
+				serveAndUnmarshal(recorder, req, &result)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				u, err := getDBUser(hastur.ID.Hex())
+				So(err, ShouldBeNil)
+				So(u.FirstName, ShouldEqual, "Yellow")
+				So(u.Country, ShouldBeEmpty)
+			})
+		})
+
+		Convey("The discovery endpoints are served", func() {
+			for _, path := range []string{"/scim/v2/ServiceProviderConfig", "/scim/v2/Schemas", "/scim/v2/ResourceTypes"} {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", path, nil)
+				r.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusOK)
+			}
+		})
+	}))
+}
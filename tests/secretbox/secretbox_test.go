@@ -0,0 +1,55 @@
+package secretbox_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/secretbox"
+)
+
+func TestBox(t *testing.T) {
+	Convey("Given a box", t, func() {
+		key, err := secretbox.ParseKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, secretbox.KeySize)))
+		So(err, ShouldBeNil)
+		box, err := secretbox.New(key)
+		So(err, ShouldBeNil)
+
+		Convey("A value sealed for an owner opens for them only", func() {
+			sealed, err := box.Seal("JBSWY3DPEHPK3PXP", "ethan")
+			So(err, ShouldBeNil)
+			So(sealed, ShouldNotContainSubstring, "JBSWY3DPEHPK3PXP")
+
+			opened, err := box.Open(sealed, "ethan")
+			So(err, ShouldBeNil)
+			So(opened, ShouldEqual, "JBSWY3DPEHPK3PXP")
+
+			_, err = box.Open(sealed, "jim")
+			So(err, ShouldEqual, secretbox.ErrOpen)
+		})
+
+		Convey("Sealing twice gives different values", func() {
+			a, _ := box.Seal("secret", "ethan")
+			b, _ := box.Seal("secret", "ethan")
+			So(a, ShouldNotEqual, b)
+		})
+
+		Convey("Values sealed with another key don't open", func() {
+			other, _ := secretbox.New(bytes.Repeat([]byte{8}, secretbox.KeySize))
+			sealed, _ := other.Seal("secret", "ethan")
+			_, err := box.Open(sealed, "ethan")
+			So(err, ShouldEqual, secretbox.ErrOpen)
+			_, err = box.Open("garbage", "ethan")
+			So(err, ShouldEqual, secretbox.ErrOpen)
+		})
+	})
+
+	Convey("Keys must be base64 encoded 32 bytes", t, func() {
+		_, err := secretbox.ParseKey("short")
+		So(err, ShouldNotBeNil)
+		_, err = secretbox.ParseKey(base64.StdEncoding.EncodeToString([]byte("sixteen bytes!!!")))
+		So(err, ShouldNotBeNil)
+	})
+}
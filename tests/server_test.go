@@ -0,0 +1,300 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/config"
+	"spymaster/src/events"
+	"spymaster/src/gql"
+	"spymaster/src/health"
+	"spymaster/src/operations"
+	"spymaster/src/requestid"
+	"spymaster/src/server"
+	"spymaster/types"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	Convey("Given an instance that is shutting down", t, func() {
+		readiness := &health.Readiness{}
+		router := server.CreateRouter(server.ContextParams{
+			MongoClient: mc,
+			Service:     svc,
+			Broker:      broker,
+			Journal:     journal,
+			Readiness:   readiness,
+			GraphQL:     gql.Config{MaxDepth: 8, MaxComplexity: 1000},
+		})
+		readiness.Drain()
+
+		Convey("/health reports it as not ready", func() {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/health", nil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Body.String(), ShouldContainSubstring, "DRAINING")
+		})
+
+		Convey("Closing the broker ends every subscription", func() {
+			b := events.NewBroker()
+			ch, cancel := b.Subscribe(1)
+			b.Close()
+			_, ok := <-ch
+			So(ok, ShouldBeFalse)
+			So(cancel, ShouldNotPanic)
+
+			late, _ := b.Subscribe(1)
+			_, ok = <-late
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given an HTTP server with a short write timeout", t, func() {
+		slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(w, "late")
+		})
+		srv := server.NewHTTPServer(server.HTTPConfig{WriteTimeout: 100 * time.Millisecond, ReadHeaderTimeout: time.Second}, slow)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go srv.Serve(lis)
+		defer srv.Shutdown(context.Background())
+		base := "http://" + lis.Addr().String()
+
+		Convey("Regular responses are cut off", func() {
+			_, err := http.Get(base + "/users")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Even when they claim to accept an event stream", func() {
+			req, err := http.NewRequest("GET", base+"/users", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Accept", "text/event-stream")
+			_, err = http.DefaultClient.Do(req)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Event streams aren't", func() {
+			resp, err := http.Get(base + "/users/events")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			So(string(body), ShouldEqual, "late")
+		})
+	})
+}
+
+func TestHealthChecks(t *testing.T) {
+	Convey("Given an instance checking its dependencies", t, withCleanup(func() {
+		readiness := &health.Readiness{}
+		registry := health.NewRegistry(health.Config{Timeout: time.Second})
+		for _, check := range health.Mongo(mc) {
+			registry.Register(check)
+		}
+		registry.Register(health.OutboxLag(journal, time.Minute))
+		router := server.CreateRouter(server.ContextParams{
+			MongoClient: mc,
+			Service:     svc,
+			Broker:      broker,
+			Journal:     journal,
+			Readiness:   readiness,
+			Health:      registry,
+			GraphQL:     gql.Config{MaxDepth: 8, MaxComplexity: 1000},
+		})
+
+		Convey("/livez passes", func() {
+			recorder, report := getHealth(router, "/livez")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(report.Status, ShouldEqual, health.Pass)
+		})
+
+		Convey("/readyz passes with the details of every check", func() {
+			recorder, report := getHealth(router, "/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("Content-Type"), ShouldStartWith, health.ContentType)
+			So(report.Status, ShouldEqual, health.Pass)
+			So(report.Checks["mongo:responseTime"][0].Status, ShouldEqual, health.Pass)
+			So(report.Checks["mongo:indexes"][0].Status, ShouldEqual, health.Pass)
+			So(report.Checks["outbox:lag"][0].Status, ShouldEqual, health.Pass)
+		})
+
+		Convey("/readyz is degraded when events wait in the outbox for too long", func() {
+			e := events.New(events.UserCreated, "user-1", nil)
+			e.OccurredAt, e.Outbox = time.Now().Add(-time.Hour), true
+			_, err := mc.AppendEvent(context.Background(), e)
+			So(err, ShouldBeNil)
+
+			recorder, report := getHealth(router, "/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(report.Status, ShouldEqual, health.Warn)
+			So(report.Checks["outbox:lag"][0].Status, ShouldEqual, health.Warn)
+		})
+
+		Convey("/readyz fails once draining", func() {
+			readiness.Drain()
+			recorder, report := getHealth(router, "/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(report.Status, ShouldEqual, health.Fail)
+			So(report.Output, ShouldEqual, "draining")
+		})
+	}))
+}
+
+func getHealth(router *gin.Engine, path string) (*httptest.ResponseRecorder, health.Report) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	router.ServeHTTP(recorder, req)
+	var report health.Report
+	So(json.Unmarshal(recorder.Body.Bytes(), &report), ShouldBeNil)
+	return recorder, report
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Given stored users and events waiting in the outbox", t, withCleanup(func() {
+		for _, u := range []types.User{
+			{Nickname: "hastur", Email: "hastur@lost.space", Country: "UK"},
+			{Nickname: "fake_hastur", Email: "fake_hastur@lost.space", Country: "UK"},
+			{Nickname: "genie", Email: "rwilliams@hollywood.fake", Country: "US"},
+		} {
+			_, err := createUser(u)
+			So(err, ShouldBeNil)
+		}
+		e := events.New(events.UserCreated, "user-1", nil)
+		e.Outbox = true
+		_, err := mc.AppendEvent(context.Background(), e)
+		So(err, ShouldBeNil)
+
+		Convey("The gauges read them", func() {
+			counts, err := mc.CountUsersByCountry(context.Background())
+			So(err, ShouldBeNil)
+			So(counts, ShouldResemble, map[string]int{"UK": 2, "US": 1})
+
+			n, oldest, err := journal.Backlog(context.Background())
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(oldest.Unix(), ShouldEqual, e.OccurredAt.Unix())
+		})
+
+		Convey("/metrics counts the requests by route template and the storage calls", func() {
+			for _, path := range []string{"/users?per_page=20", "/users/" + bson.NewObjectId().Hex()} {
+				req, _ := http.NewRequest("GET", path, nil)
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/metrics", nil)
+			r.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			body := recorder.Body.String()
+			So(body, ShouldContainSubstring, `spymaster_http_requests_total{method="GET",route="/users",status="200"}`)
+			So(body, ShouldContainSubstring, `spymaster_http_requests_total{method="GET",route="/users/:id",status="404"}`)
+			So(body, ShouldContainSubstring, `spymaster_mongo_operation_duration_seconds_count{method="ListUsers"}`)
+			So(body, ShouldContainSubstring, `spymaster_mongo_operation_duration_seconds_count{method="GetUser"}`)
+			So(body, ShouldNotContainSubstring, `spymaster_mongo_operation_errors_total{method="GetUser"}`)
+		})
+	}))
+}
+
+func TestAdminConfig(t *testing.T) {
+	Convey("Given an instance serving its effective configuration", t, withCleanup(func() {
+		_, err := svc.CreateUser(context.Background(), &types.UserPost{Nickname: "ethan", Password: "impossible", Email: "ethan@imf.fake"})
+		So(err, ShouldBeNil)
+		effective := &config.Effective{
+			Values:  map[string]interface{}{"mongo": map[string]interface{}{"host": "db.imf.fake", "password": config.Redacted}},
+			Sources: map[string]config.Source{"mongo.host": config.Env, "mongo.password": config.Env},
+		}
+		router := server.CreateRouter(server.ContextParams{MongoClient: mc, Service: svc, Broker: broker, Journal: journal, Auth: auth,
+			Config: effective, GraphQL: gql.Config{MaxDepth: 8, MaxComplexity: 1000}})
+		get := func(req *http.Request) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Anonymous requests are turned down", func() {
+			req, _ := http.NewRequest("GET", "/admin/config", nil)
+			So(get(req).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Users who aren't admins are forbidden", func() {
+			session, err := auth.Login(context.Background(), "ethan", "impossible", "192.0.2.1")
+			So(err, ShouldBeNil)
+			req, _ := http.NewRequest("GET", "/admin/config", nil)
+			req.Header.Set("Authorization", "Bearer "+session.Token)
+			So(get(req).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Admins get it, secrets redacted", func() {
+			req, _ := http.NewRequest("GET", "/admin/config", nil)
+			recorder := get(asAdmin(req))
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			var served config.Effective
+			So(json.Unmarshal(recorder.Body.Bytes(), &served), ShouldBeNil)
+			So(served.Values["mongo"].(map[string]interface{})["password"], ShouldEqual, config.Redacted)
+			So(served.Sources["mongo.host"], ShouldEqual, config.Env)
+		})
+	}))
+}
+
+func TestRequestIDs(t *testing.T) {
+	Convey("Given requests tagged with an ID", t, withCleanup(func() {
+		create := func(id, prefer string) *httptest.ResponseRecorder {
+			body := []byte(`{"nickname":"neo","password":"red pill","email":"neo@matrix.fake"}`)
+			req, _ := http.NewRequest("POST", "/users", bytes.NewReader(body))
+			asAdmin(req)
+			req.Header.Set(requestid.Header, id)
+			if prefer != "" {
+				req.Header.Set("Prefer", prefer)
+			}
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			return recorder
+		}
+		recordedIDs := func() []string {
+			recorded, err := journal.Since(context.Background(), events.Query{})
+			So(err, ShouldBeNil)
+			var ids []string
+			for _, e := range recorded {
+				ids = append(ids, e.RequestID)
+			}
+			return ids
+		}
+
+		Convey("The ID is echoed and stamped on the events of the write", func() {
+			recorder := create("req-sync", "")
+			So(recorder.Code, ShouldEqual, http.StatusCreated)
+			So(recorder.Header().Get(requestid.Header), ShouldEqual, "req-sync")
+			So(recordedIDs(), ShouldResemble, []string{"req-sync"})
+
+			Convey("And error bodies carry it", func() {
+				recorder := create("req-dup", "")
+				So(recorder.Code, ShouldEqual, http.StatusConflict)
+				var body map[string]string
+				So(json.Unmarshal(recorder.Body.Bytes(), &body), ShouldBeNil)
+				So(body["request_id"], ShouldEqual, "req-dup")
+			})
+		})
+
+		Convey("Asynchronous operations keep the ID of the request which submitted them", func() {
+			recorder := create("req-async", "respond-async")
+			So(recorder.Code, ShouldEqual, http.StatusAccepted)
+			var op operations.Operation
+			So(json.Unmarshal(recorder.Body.Bytes(), &op), ShouldBeNil)
+			So(op.RequestID, ShouldEqual, "req-async")
+
+			So(waitOperation(op.ID).Status, ShouldEqual, operations.Succeeded)
+			So(recordedIDs(), ShouldResemble, []string{"req-async"})
+		})
+	}))
+}
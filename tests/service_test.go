@@ -0,0 +1,174 @@
+package controllers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/src/spymaster"
+	"spymaster/types"
+)
+
+func TestService(t *testing.T) {
+	Convey("Given a Service backed by an in-memory store", t, func() {
+		store := &memoryStore{users: map[string]types.User{}}
+		bus := events.NewBroker()
+		received, cancel := bus.Subscribe(10)
+		defer cancel()
+		now := time.Date(2021, 12, 15, 10, 0, 0, 0, time.UTC)
+		s := spymaster.NewService(store, bus, fixedClock{now}, plainHasher{})
+		ctx := context.Background()
+
+		Convey("Creating a user stores a hashed password and emits an event", func() {
+			user, err := s.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+			So(err, ShouldBeNil)
+			So(user.Password, ShouldBeEmpty)
+			So(user.CreatedAt, ShouldEqual, now)
+			So(store.users[user.ID.Hex()].Password, ShouldEqual, "hashed:Jumanji")
+
+			e := <-received
+			So(e.Type, ShouldEqual, events.UserCreated)
+			So(e.UserID, ShouldEqual, user.ID.Hex())
+
+			Convey("Updating it emits both snapshots and what changed, without passwords", func() {
+				email, password := "robin@hollywood.fake", "Hook"
+				updated, err := s.UpdateUser(ctx, user.ID.Hex(), &types.UserPatch{Email: &email, Password: &password})
+				So(err, ShouldBeNil)
+				So(updated.Email, ShouldEqual, email)
+				So(updated.Password, ShouldBeEmpty)
+
+				e := <-received
+				So(e.Type, ShouldEqual, events.UserUpdated)
+				So(e.Before.Email, ShouldEqual, "rwilliams@hollywood.fake")
+				So(e.User.Email, ShouldEqual, email)
+				So(e.Before.Password, ShouldBeEmpty)
+				So(e.User.Password, ShouldBeEmpty)
+				So(e.ChangedFields, ShouldResemble, []string{"password", "email"})
+			})
+
+			Convey("Creating it again reports a duplicate", func() {
+				store.dup = true
+				_, err := s.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+				So(err, ShouldEqual, spymaster.ErrDup)
+			})
+		})
+
+		Convey("Listing pages larger than allowed is refused", func() {
+			s.SetMaxPerPage(10)
+			_, err := s.ListUsers(ctx, nil, nil, 11, 1)
+			So(err, ShouldEqual, spymaster.ErrInvalidPage)
+			_, err = s.ListUsers(ctx, nil, nil, 10, 1<<40)
+			So(err, ShouldEqual, spymaster.ErrInvalidPage)
+			_, err = s.ListUsersFrom(ctx, nil, nil, 0, 11)
+			So(err, ShouldEqual, spymaster.ErrInvalidPage)
+		})
+
+		Convey("Listing by offset reads at most two pages of the window", func() {
+			var nicknames []string
+			for i := 0; i < 7; i++ {
+				user, err := s.CreateUser(ctx, &types.UserPost{Nickname: fmt.Sprintf("agent%d", i), Password: "Jumanji", Email: fmt.Sprintf("agent%d@imf.fake", i)})
+				So(err, ShouldBeNil)
+				nicknames = append(nicknames, user.Nickname)
+			}
+			listed := func(offset, limit int) []string {
+				result, err := s.ListUsersFrom(ctx, nil, nil, offset, limit)
+				So(err, ShouldBeNil)
+				So(result.TotalCount, ShouldEqual, 7)
+				var r []string
+				for _, u := range result.Users {
+					r = append(r, u.Nickname)
+				}
+				return r
+			}
+			So(listed(0, 3), ShouldResemble, nicknames[0:3])
+			So(listed(3, 3), ShouldResemble, nicknames[3:6])
+			So(listed(2, 3), ShouldResemble, nicknames[2:5])
+			So(listed(5, 3), ShouldResemble, nicknames[5:7])
+			So(listed(9, 3), ShouldBeEmpty)
+		})
+
+		Convey("Deleting a missing user reports it as not found", func() {
+			err := s.DeleteUser(ctx, bson.NewObjectId().Hex())
+			So(err, ShouldEqual, spymaster.ErrNotFound)
+			So(received, ShouldBeEmpty)
+		})
+	})
+}
+
+// Utils
+
+var errMemoryNotFound = errors.New("not found")
+var errMemoryDup = errors.New("duplicate")
+
+type memoryStore struct {
+	users map[string]types.User
+	dup   bool
+}
+
+func (m *memoryStore) ListUsers(ctx context.Context, exact map[string]interface{}, partial map[string]string, perPage, pageNumber int) ([]types.User, int, error) {
+	var r []types.User
+	for _, u := range m.users {
+		r = append(r, u)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	start := min((pageNumber-1)*perPage, len(r))
+	return r[start:min(start+perPage, len(r))], len(r), nil
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, id string) (types.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return u, errMemoryNotFound
+	}
+	return u, nil
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, u types.User) error {
+	if m.dup {
+		return errMemoryDup
+	}
+	m.users[u.ID.Hex()] = u
+	return nil
+}
+
+func (m *memoryStore) UpdateUser(ctx context.Context, id string, p types.UserPatch) (types.User, types.User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return u, u, errMemoryNotFound
+	}
+	m.users[id] = p.Apply(u)
+	return u, m.users[id], nil
+}
+
+func (m *memoryStore) DeleteUser(ctx context.Context, id string) error {
+	if _, ok := m.users[id]; !ok {
+		return errMemoryNotFound
+	}
+	delete(m.users, id)
+	return nil
+}
+
+func (m *memoryStore) IsDup(err error) bool       { return err == errMemoryDup }
+func (m *memoryStore) IsNotFound(err error) bool  { return err == errMemoryNotFound }
+func (m *memoryStore) IsInvalidID(err error) bool { return false }
+
+type fixedClock struct{ t time.Time }
+
+func (c fixedClock) Now() time.Time { return c.t }
+
+type plainHasher struct{}
+
+func (plainHasher) Hash(p string) (string, error) { return "hashed:" + p, nil }
+func (plainHasher) Compare(h, p string) error {
+	if h != "hashed:"+p {
+		return errors.New("mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package tls_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/certs"
+	"spymaster/src/mongo"
+	"spymaster/src/server"
+)
+
+func TestHTTPS(t *testing.T) {
+	Convey("Given locally generated certificates", t, func() {
+		dir := t.TempDir()
+		ca := newCA("spymaster-ca")
+		ca.issue(dir, "server", 1, false)
+		ca.issue(dir, "client", 2, true)
+		ca.save(dir)
+		rogue := newCA("rogue-ca")
+		rogue.issue(dir, "rogue", 3, true)
+
+		serve := func(conf server.TLSConfig) (string, *certs.Reloader) {
+			reloader, err := certs.NewReloader(conf.CertFile, conf.KeyFile)
+			So(err, ShouldBeNil)
+			srv := server.NewHTTPServer(server.HTTPConfig{ReadHeaderTimeout: time.Second, TLS: conf}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			srv.TLSConfig, err = server.NewTLSConfig(conf, reloader)
+			So(err, ShouldBeNil)
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go srv.ServeTLS(lis, "", "")
+			Reset(func() { srv.Close() })
+			return "https://" + lis.Addr().String(), reloader
+		}
+		conf := server.TLSConfig{CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server.key")}
+
+		Convey("HTTPS is served with the certificate, which is reloaded once renewed", func() {
+			url, reloader := serve(conf)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go reloader.Watch(ctx, 10*time.Millisecond)
+
+			So(serverSerial(url, dir, ""), ShouldEqual, 1)
+
+			ca.issue(dir, "server", 4, false)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(conf.CertFile, later, later)
+			So(func() int64 {
+				deadline := time.Now().Add(2 * time.Second)
+				for time.Now().Before(deadline) {
+					if serial := serverSerial(url, dir, ""); serial != 1 {
+						return serial
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return 1
+			}(), ShouldEqual, 4)
+		})
+
+		Convey("When client certificates are required", func() {
+			conf.ClientAuth, conf.ClientCAFile = "require", filepath.Join(dir, "ca.pem")
+			url, _ := serve(conf)
+
+			Convey("Callers without one are refused", func() {
+				So(serverSerial(url, dir, ""), ShouldEqual, 0)
+			})
+			Convey("Callers with one issued by the client CA get through", func() {
+				So(serverSerial(url, dir, "client"), ShouldEqual, 1)
+			})
+			Convey("Callers with one issued by another CA are refused", func() {
+				So(serverSerial(url, dir, "rogue"), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When client certificates are optional", func() {
+			conf.ClientAuth, conf.ClientCAFile = "optional", filepath.Join(dir, "ca.pem")
+			url, _ := serve(conf)
+
+			So(serverSerial(url, dir, ""), ShouldEqual, 1)
+			So(serverSerial(url, dir, "client"), ShouldEqual, 1)
+			So(serverSerial(url, dir, "rogue"), ShouldEqual, 0)
+		})
+
+		Convey("Invalid configurations are reported", func() {
+			reloader, err := certs.NewReloader(conf.CertFile, conf.KeyFile)
+			So(err, ShouldBeNil)
+			_, err = server.NewTLSConfig(server.TLSConfig{ClientAuth: "require"}, reloader)
+			So(err, ShouldNotBeNil)
+			_, err = server.NewTLSConfig(server.TLSConfig{ClientAuth: "maybe"}, reloader)
+			So(err, ShouldNotBeNil)
+			_, err = certs.NewReloader(conf.CertFile, filepath.Join(dir, "missing.key"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMongoTLS(t *testing.T) {
+	Convey("Given locally generated certificates", t, func() {
+		dir := t.TempDir()
+		ca := newCA("spymaster-ca")
+		ca.issue(dir, "server", 1, false)
+		ca.issue(dir, "client", 2, true)
+		ca.save(dir)
+		combined := filepath.Join(dir, "client-combined.pem")
+		cert, _ := os.ReadFile(filepath.Join(dir, "client.pem"))
+		key, _ := os.ReadFile(filepath.Join(dir, "client.key"))
+		So(os.WriteFile(combined, append(cert, key...), 0600), ShouldBeNil)
+
+		Convey("The client configuration verifies the server and presents the client certificate", func() {
+			clientConf, err := certs.ClientConfig(filepath.Join(dir, "ca.pem"), combined)
+			So(err, ShouldBeNil)
+			subject, err := certs.Subject(clientConf)
+			So(err, ShouldBeNil)
+			So(subject, ShouldEqual, "CN=client,O=Spymaster")
+
+			pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+			So(err, ShouldBeNil)
+			pool, err := certs.LoadPool(filepath.Join(dir, "ca.pem"))
+			So(err, ShouldBeNil)
+			lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool})
+			So(err, ShouldBeNil)
+			defer lis.Close()
+			peers := make(chan string, 1)
+			go func() {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() == nil {
+					peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				}
+			}()
+
+			conn, err := tls.Dial("tcp", lis.Addr().String(), clientConf)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(conn.Handshake(), ShouldBeNil)
+			So(<-peers, ShouldEqual, "client")
+		})
+
+		Convey("Invalid configurations are reported before dialing", func() {
+			_, err := mongo.Connect(mongo.Config{Hosts: []string{"127.0.0.1:1"}, AuthMechanism: mongo.X509})
+			So(err, ShouldNotBeNil)
+			_, err = mongo.Connect(mongo.Config{Hosts: []string{"127.0.0.1:1"}, TLS: true, AuthMechanism: mongo.X509})
+			So(err, ShouldNotBeNil)
+			_, err = mongo.Connect(mongo.Config{Hosts: []string{"127.0.0.1:1"}, TLS: true, TLSCAFile: filepath.Join(dir, "missing.pem")})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// serverSerial connects to url, trusting the CA in dir and presenting the named client certificate if any,
+// and returns the serial number of the server certificate, 0 when the connection fails
+func serverSerial(url, dir, client string) int64 {
+	pool, err := certs.LoadPool(filepath.Join(dir, "ca.pem"))
+	So(err, ShouldBeNil)
+	conf := &tls.Config{RootCAs: pool}
+	if client != "" {
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, client+".pem"), filepath.Join(dir, client+".key"))
+		So(err, ShouldBeNil)
+		// presented whatever CAs the server asks for, so it's the server rejecting a rogue certificate
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: conf, DisableKeepAlives: true}, Timeout: time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+// authority is a throwaway certificate authority
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCA(name string) authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	return authority{cert: cert, key: key, der: der}
+}
+
+// save writes the CA certificate to dir/ca.pem
+func (a authority) save(dir string) {
+	writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", a.der)
+}
+
+// issue writes a certificate for 127.0.0.1 and its key to dir/name.pem and dir/name.key
+func (a authority) issue(dir, name string, serial int64, client bool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Spymaster"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	So(err, ShouldBeNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+	writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(path, kind string, der []byte) {
+	So(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600), ShouldBeNil)
+}
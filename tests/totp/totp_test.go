@@ -0,0 +1,78 @@
+package totp_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/totp"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	Convey("Codes match the RFC 6238 test vectors, truncated to 6 digits", t, func() {
+		for unix, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+			code, err := totp.Code(rfcSecret, totp.Step(time.Unix(unix, 0)))
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, expected)
+		}
+	})
+
+	Convey("Invalid secrets are reported", t, func() {
+		_, err := totp.Code("not base32!", 1)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Given a new secret", t, func() {
+		secret, err := totp.NewSecret()
+		So(err, ShouldBeNil)
+		now := time.Unix(1700000000, 0)
+		code := func(t time.Time) string {
+			c, err := totp.Code(secret, totp.Step(t))
+			So(err, ShouldBeNil)
+			return c
+		}
+
+		Convey("The current code is valid, and tells its step", func() {
+			step, ok := totp.Validate(secret, code(now), now, 1)
+			So(ok, ShouldBeTrue)
+			So(step, ShouldEqual, totp.Step(now))
+		})
+
+		Convey("Codes of the steps around the current one are valid within the skew", func() {
+			_, ok := totp.Validate(secret, code(now.Add(-totp.Period)), now, 1)
+			So(ok, ShouldBeTrue)
+			_, ok = totp.Validate(secret, code(now.Add(totp.Period)), now, 1)
+			So(ok, ShouldBeTrue)
+			_, ok = totp.Validate(secret, code(now.Add(-2*totp.Period)), now, 1)
+			So(ok, ShouldBeFalse)
+			_, ok = totp.Validate(secret, code(now.Add(-totp.Period)), now, 0)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Malformed codes are invalid", func() {
+			_, ok := totp.Validate(secret, "12345", now, 1)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestURI(t *testing.T) {
+	Convey("The otpauth URI names the issuer and the account", t, func() {
+		u, err := url.Parse(totp.URI("Spymaster", "ethan", rfcSecret))
+		So(err, ShouldBeNil)
+		So(u.Scheme, ShouldEqual, "otpauth")
+		So(u.Host, ShouldEqual, "totp")
+		So(u.Path, ShouldEqual, "/Spymaster:ethan")
+		So(u.Query().Get("secret"), ShouldEqual, rfcSecret)
+		So(u.Query().Get("issuer"), ShouldEqual, "Spymaster")
+		So(u.Query().Get("digits"), ShouldEqual, "6")
+		So(u.Query().Get("period"), ShouldEqual, "30")
+	})
+}
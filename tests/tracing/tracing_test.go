@@ -0,0 +1,94 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"spymaster/src/events"
+	"spymaster/src/server"
+	"spymaster/src/tracing"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestShape(t *testing.T) {
+	Convey("Query shapes keep fields and operators but no values", t, func() {
+		So(tracing.Shape(bson.M{
+			"country":  "PT",
+			"nickname": bson.RegEx{Pattern: "hastur", Options: "i"},
+			"_id":      bson.NewObjectId(),
+		}), ShouldEqual, `{"_id":"?","country":"?","nickname":{"$regex":"?"}}`)
+
+		So(tracing.Shape(bson.M{
+			"sequence": bson.M{"$gt": 42},
+			"type":     bson.M{"$in": []events.Type{events.UserCreated, events.UserDeleted}},
+			"$or":      []bson.M{{"holder": "me"}, {"expires_at": bson.M{"$lte": time.Now()}}},
+		}), ShouldEqual, `{"$or":[{"holder":"?"},{"expires_at":{"$lte":"?"}}],"sequence":{"$gt":"?"},"type":{"$in":"?"}}`)
+
+		So(tracing.Shape([]bson.M{{"$group": bson.M{"_id": "$country", "count": bson.M{"$sum": 1}}}}), ShouldEqual, `[{"$group":{"_id":"?","count":{"$sum":"?"}}}]`)
+	})
+}
+
+func TestTracing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given spans recorded in memory", t, func() {
+		_, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.None})
+		So(err, ShouldBeNil)
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(provider)
+		Reset(func() { otel.SetTracerProvider(previous) })
+
+		Convey("Requests continue the trace of the caller, named after the route", func() {
+			r := gin.New()
+			r.Use(server.Tracing())
+			var carrier tracing.Carrier
+			r.GET("/users/:id", func(c *gin.Context) {
+				carrier = tracing.Inject(c.Request.Context())
+				c.Status(http.StatusInternalServerError)
+			})
+
+			req := httptest.NewRequest("GET", "/users/42?email=spy@mi6.fake", nil)
+			req.Header.Set("traceparent", traceParent)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := recorder.Ended()
+			So(spans, ShouldHaveLength, 1)
+			span := spans[0]
+			So(span.Name(), ShouldEqual, "GET /users/:id")
+			So(span.SpanContext().TraceID().String(), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(span.Parent().SpanID().String(), ShouldEqual, "00f067aa0ba902b7")
+			So(span.Status().Code.String(), ShouldEqual, "Error")
+			for _, attr := range span.Attributes() {
+				So(attr.Value.Emit(), ShouldNotContainSubstring, "spy@mi6.fake")
+			}
+
+			So(carrier.TraceParent, ShouldStartWith, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanContext().SpanID().String())
+		})
+
+		Convey("Trace context carried by an event is picked up again", func() {
+			ctx := tracing.Extract(context.Background(), tracing.Carrier{TraceParent: traceParent})
+			So(tracing.TraceID(ctx), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(tracing.TraceID(context.Background()), ShouldBeEmpty)
+			So(tracing.Inject(context.Background()).TraceParent, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Unknown exporters and ratios are refused", t, func() {
+		So(tracing.Config{Exporter: "jaeger"}.Validate(), ShouldNotBeNil)
+		So(tracing.Config{Exporter: tracing.Stdout, SampleRatio: 2}.Validate(), ShouldNotBeNil)
+		So(tracing.Config{Exporter: tracing.OTLP, Endpoint: "localhost:4318", SampleRatio: 0.5}.Validate(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,82 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"spymaster/src/events"
+	"spymaster/src/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Given spans recorded in memory", t, withCleanup(func() {
+		_, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.None})
+		So(err, ShouldBeNil)
+		// the admin key is created before spans are recorded, outside of the traced requests
+		adminToken()
+		recorder := tracetest.NewSpanRecorder()
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		Reset(func() { otel.SetTracerProvider(previous) })
+
+		const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+			b, _ := json.Marshal(body)
+			req, _ := http.NewRequest(method, path, bytes.NewReader(b))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, asAdmin(req))
+			return rec
+		}
+		spans := func() map[string]sdktrace.ReadOnlySpan {
+			byName := map[string]sdktrace.ReadOnlySpan{}
+			for _, span := range recorder.Ended() {
+				So(span.SpanContext().TraceID().String(), ShouldEqual, traceID)
+				byName[span.Name()] = span
+			}
+			return byName
+		}
+
+		Convey("A creation is traced through every layer down to the event it publishes", func() {
+			rec := serve("POST", "/users", map[string]string{"nickname": "hastur", "email": "hastur@lost.space", "password": "Carcosa"})
+			So(rec.Code, ShouldEqual, http.StatusCreated)
+
+			byName := spans()
+			for _, name := range []string{"POST /users", "spymaster.CreateUser", "spymaster.HashPassword", "mongo.CreateUser", "events.Publish", "mongo.AppendEvent", "mongo.MarkRelayed"} {
+				So(byName, ShouldContainKey, name)
+			}
+			So(byName["spymaster.CreateUser"].Parent().SpanID(), ShouldEqual, byName["POST /users"].SpanContext().SpanID())
+			So(byName["mongo.CreateUser"].Parent().SpanID(), ShouldEqual, byName["spymaster.CreateUser"].SpanContext().SpanID())
+
+			recorded, err := journal.Since(context.Background(), events.Query{})
+			So(err, ShouldBeNil)
+			So(recorded, ShouldHaveLength, 1)
+			So(recorded[0].TraceParent, ShouldStartWith, "00-"+traceID+"-"+byName["events.Publish"].SpanContext().SpanID().String())
+		})
+
+		Convey("Queries are traced with their shape, never the values searched for", func() {
+			rec := serve("GET", "/users?nickname=hastur&country=UK", nil)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+
+			span := spans()["mongo.ListUsers"]
+			So(span, ShouldNotBeNil)
+			var text string
+			for _, attr := range span.Attributes() {
+				if attr.Key == "db.query.text" {
+					text = attr.Value.AsString()
+				}
+			}
+			So(text, ShouldEqual, `{"country":"?","nickname":{"$regex":"?"}}`)
+		})
+	}))
+}
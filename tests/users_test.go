@@ -200,6 +200,7 @@ func TestCreateUser(t *testing.T) {
 
 				req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(p))
 				So(err, ShouldBeNil)
+				asAdmin(req)
 
 				var result types.User
 				serveAndUnmarshal(recorder, req, &result)
@@ -227,6 +228,7 @@ func TestCreateUser(t *testing.T) {
 
 				req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(p))
 				So(err, ShouldBeNil)
+				asAdmin(req)
 
 				r.ServeHTTP(recorder, req)
 				resp := recorder.Result()
@@ -260,6 +262,7 @@ func TestCreateUser(t *testing.T) {
 
 			req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(p))
 			So(err, ShouldBeNil)
+			asAdmin(req)
 
 			var result types.User
 			serveAndUnmarshal(recorder, req, &result)
@@ -297,6 +300,7 @@ func TestUpdateUser(t *testing.T) {
 
 				req, err := http.NewRequest("PATCH", fmt.Sprintf("/users?id=%s", userId), bytes.NewBuffer(p))
 				So(err, ShouldBeNil)
+				asAdmin(req)
 
 				var result types.User
 				serveAndUnmarshal(recorder, req, &result)
@@ -325,6 +329,7 @@ func TestUpdateUser(t *testing.T) {
 
 				req, err := http.NewRequest("PATCH", fmt.Sprintf("/users?id=%s", userId), bytes.NewBuffer(p))
 				So(err, ShouldBeNil)
+				asAdmin(req)
 
 				r.ServeHTTP(recorder, req)
 				resp := recorder.Result()
@@ -346,6 +351,7 @@ func TestUpdateUser(t *testing.T) {
 
 			req, err := http.NewRequest("PATCH", fmt.Sprintf("/users?id=61ba6382df4bec585cf60e60"), bytes.NewBuffer(p))
 			So(err, ShouldBeNil)
+			asAdmin(req)
 
 			r.ServeHTTP(recorder, req)
 			resp := recorder.Result()
@@ -361,6 +367,7 @@ func TestDeleteUser(t *testing.T) {
 		Convey("And the user does not exist", func() {
 			req, err := http.NewRequest("DELETE", "/users?id=61ba6382df4bec585cf60e60", nil)
 			So(err, ShouldBeNil)
+			asAdmin(req)
 
 			r.ServeHTTP(recorder, req)
 			resp := recorder.Result()
@@ -381,6 +388,7 @@ func TestDeleteUser(t *testing.T) {
 
 			req, err := http.NewRequest("DELETE", fmt.Sprintf("/users?id=%s", userId), nil)
 			So(err, ShouldBeNil)
+			asAdmin(req)
 
 			r.ServeHTTP(recorder, req)
 			resp := recorder.Result()
@@ -0,0 +1,131 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"spymaster/src/events"
+	"spymaster/src/watcher"
+	"spymaster/types"
+)
+
+func TestWatcher(t *testing.T) {
+	// change streams need a replica set, the bundled standalone MongoDB won't do
+	stream, err := mc.Database.C("users").Watch(nil, mgo.ChangeStreamOptions{})
+	if err != nil {
+		t.Skipf("Change streams are not available: %s", err)
+	}
+	stream.Close()
+
+	Convey("When the users collection is being watched...", t, withCleanup(func() {
+		mc.Database.C("resume_tokens").RemoveAll(nil)
+		received, cancel := broker.Subscribe(10)
+		defer cancel()
+
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go watcher.New(mc, journal, watcher.Config{DeleteGrace: time.Second, RetryInterval: time.Second}).Run(ctx)
+		time.Sleep(500 * time.Millisecond)
+
+		Convey("Users inserted straight into the database are announced", func() {
+			u, err := createUser(types.User{Nickname: "hastur", Email: "hastur@lost.space"})
+			So(err, ShouldBeNil)
+
+			e := nextEvent(received)
+			So(e.Type, ShouldEqual, events.UserCreated)
+			So(e.UserID, ShouldEqual, u.ID.Hex())
+		})
+
+		Convey("Users created through the API are announced only once", func() {
+			_, err := svc.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+			So(err, ShouldBeNil)
+
+			So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+			So(nextEvent(received).ID, ShouldBeEmpty)
+		})
+
+		Convey("Users updated straight into the database are announced with the changed fields the schema knows of", func() {
+			u, err := createUser(types.User{Nickname: "hastur", Email: "hastur@lost.space"})
+			So(err, ShouldBeNil)
+			So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+
+			So(mc.Database.C("users").UpdateId(u.ID, bson.M{"$set": bson.M{"nickname": "king", "legacy_id": 42, "updated_at": time.Now().UTC()}}), ShouldBeNil)
+
+			e := nextEvent(received)
+			So(e.Type, ShouldEqual, events.UserUpdated)
+			So(e.ChangedFields, ShouldResemble, []string{"nickname"})
+		})
+
+		Convey("Users replaced straight into the database are announced, even carrying the event of an API write", func() {
+			u, err := svc.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+			So(err, ShouldBeNil)
+			So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+
+			var stored types.User
+			So(mc.Database.C("users").FindId(u.ID).One(&stored), ShouldBeNil)
+			So(stored.EventID, ShouldNotBeEmpty)
+			stored.Nickname, stored.UpdatedAt = "jafar", time.Now().UTC()
+			So(mc.Database.C("users").UpdateId(u.ID, stored), ShouldBeNil)
+
+			e := nextEvent(received)
+			So(e.Type, ShouldEqual, events.UserUpdated)
+			So(e.User.Nickname, ShouldEqual, "jafar")
+		})
+
+		Convey("Users inserted carrying the event of an API write are announced once it's clearly not theirs", func() {
+			u, err := svc.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+			So(err, ShouldBeNil)
+			So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+
+			var copied types.User
+			So(mc.Database.C("users").FindId(u.ID).One(&copied), ShouldBeNil)
+			copied.ID, copied.Nickname, copied.Email = bson.NewObjectId(), "jafar", "jafar@agrabah.fake"
+			So(mc.Database.C("users").Insert(copied), ShouldBeNil)
+
+			e := nextEvent(received)
+			So(e.Type, ShouldEqual, events.UserCreated)
+			So(e.UserID, ShouldEqual, copied.ID.Hex())
+		})
+
+		Convey("Users deleted straight into the database in bulk are announced without waiting on each other", func() {
+			for _, nickname := range []string{"hastur", "cthulhu", "dagon"} {
+				_, err := createUser(types.User{Nickname: nickname, Email: nickname + "@lost.space"})
+				So(err, ShouldBeNil)
+				So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+			}
+
+			start := time.Now()
+			_, err := mc.Database.C("users").RemoveAll(nil)
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(nextEvent(received).Type, ShouldEqual, events.UserDeleted)
+			}
+			So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+		})
+
+		Convey("Users deleted through the API are announced only once", func() {
+			u, err := svc.CreateUser(ctx, &types.UserPost{Nickname: "genie", Password: "Jumanji", Email: "rwilliams@hollywood.fake"})
+			So(err, ShouldBeNil)
+			So(nextEvent(received).Type, ShouldEqual, events.UserCreated)
+
+			So(svc.DeleteUser(ctx, u.ID.Hex()), ShouldBeNil)
+			So(nextEvent(received).Type, ShouldEqual, events.UserDeleted)
+			So(nextEvent(received).ID, ShouldBeEmpty)
+		})
+	}))
+}
+
+// nextEvent waits a little for an event, returning an empty one if none comes
+func nextEvent(ch <-chan events.Event) events.Event {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(2 * time.Second):
+		return events.Event{}
+	}
+}
@@ -12,11 +12,17 @@ type User struct {
 	FirstName string        `bson:"first_name" json:"first_name"`
 	LastName  string        `bson:"last_name" json:"last_name"`
 	Nickname  string        `bson:"nickname" json:"nickname"`
-	Password  string        `bson:"password" json:"password"`
+	Password  string        `bson:"password" json:"password,omitempty"`
 	Email     string        `bson:"email" json:"email"`
 	Country   string        `bson:"country" json:"country"`
 	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time     `bson:"updated_at" json:"updated_at"`
+	// EmailVerifiedAt is when the user proved owning their email, nil until then and again after changing it
+	EmailVerifiedAt *time.Time `bson:"email_verified_at,omitempty" json:"email_verified_at,omitempty"`
+	// MFA is the second factor of the user, nil until they enroll; it's never serialized
+	MFA *MFA `bson:"mfa,omitempty" json:"-"`
+	// EventID is the event emitted by the last write made through the API
+	EventID string `bson:"event_id,omitempty" json:"-"`
 }
 
 // UsersResult stores GetUsers response
@@ -27,6 +33,9 @@ type UsersResult struct {
 	TotalCount int    `json:"total_count"`
 }
 
+// EqualFold is an exact search criterion which matches regardless of case
+type EqualFold string
+
 // UserPost holds body for user creation request
 type UserPost struct {
 	// ID is set internaly
@@ -47,4 +56,183 @@ type UserPatch struct {
 	Email     *string   `bson:"email,omitempty" json:"email,omitempty"`
 	Country   *string   `bson:"country,omitempty" json:"country,omitempty"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	EventID   string    `bson:"event_id,omitempty" json:"-"`
+	// EmailVerifiedAt is only set by the email verification, never by clients
+	EmailVerifiedAt *time.Time `bson:"email_verified_at,omitempty" json:"-"`
+}
+
+// Apply returns u with the fields set in the patch overwritten, as the store does
+// - changing the email drops its verification
+func (p UserPatch) Apply(u User) User {
+	if p.Email != nil && *p.Email != u.Email {
+		u.EmailVerifiedAt = nil
+	}
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&u.FirstName, p.FirstName)
+	set(&u.LastName, p.LastName)
+	set(&u.Nickname, p.Nickname)
+	set(&u.Password, p.Password)
+	set(&u.Email, p.Email)
+	set(&u.Country, p.Country)
+	u.UpdatedAt = p.UpdatedAt
+	if p.EmailVerifiedAt != nil {
+		u.EmailVerifiedAt = p.EmailVerifiedAt
+	}
+	if p.EventID != "" {
+		u.EventID = p.EventID
+	}
+	return u
+}
+
+// Login holds body for login request; login is the nickname or the email of the user
+type Login struct {
+	Login    string `json:"login" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// Session is a user logged in, known by the hash of its token; the token itself is only given to the user
+type Session struct {
+	ID        string    `bson:"_id" json:"-"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// SessionToken is the answer to a successful login
+type SessionToken struct {
+	Token     string    `json:"token"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Token purposes
+const (
+	VerifyEmail   = "verify_email"
+	ResetPassword = "reset_password"
+	// MFALogin tokens are given to users who logged in with their password, to finish with a code
+	MFALogin = "mfa_login"
+)
+
+// Token is a single-use token mailed to a user, known by its hash; the token itself is only given to the user
+type Token struct {
+	ID      string `bson:"_id" json:"-"`
+	Purpose string `bson:"purpose" json:"purpose"`
+	UserID  string `bson:"user_id" json:"user_id"`
+	// Email is the address the token was mailed to, a verification only holds while the user still has it
+	Email string `bson:"email" json:"email"`
+	// Login is what an MFA login was started with, failed codes are counted against it
+	Login string `bson:"login,omitempty" json:"-"`
+	// Attempts counts the codes given with an MFA login token, it's used up after too many
+	Attempts  int       `bson:"attempts,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// TokenPost holds body for requests confirming a mailed token
+type TokenPost struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// PasswordResetRequest holds body for password reset request; login is the nickname or the email of the user
+type PasswordResetRequest struct {
+	Login string `json:"login" binding:"required"`
+}
+
+// PasswordReset holds body for password reset confirmation
+type PasswordReset struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// MFA is a TOTP second factor
+type MFA struct {
+	// Secret is the TOTP secret, encrypted for the user
+	Secret string `bson:"secret"`
+	// EnabledAt is when the user confirmed having the secret with a code; logins only ask for codes from then on
+	EnabledAt *time.Time `bson:"enabled_at,omitempty"`
+	// LastStep is the time step of the last code accepted, codes can't be used twice
+	LastStep int64 `bson:"last_step"`
+	// RecoveryCodes are the hashes of the single-use codes left, standing in for a lost authenticator
+	RecoveryCodes []string `bson:"recovery_codes,omitempty"`
+}
+
+// MFAEnrollment is the answer to an MFA enrollment, the only time the secret is given out
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth URI of the secret, the payload of the QR code authenticator apps scan
+	URI string `json:"uri"`
+}
+
+// MFACode holds body for requests confirming a code
+type MFACode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFALoginPost holds body for the MFA step of a login; code is a TOTP or a recovery code
+type MFALoginPost struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// RecoveryCodes is the answer to an MFA confirmation, the only time the recovery codes are given out
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// API key scopes, what a key may do
+const (
+	ScopeUsersRead   = "users:read"
+	ScopeUsersWrite  = "users:write"
+	ScopeUsersDelete = "users:delete"
+	// ScopeAdmin allows the /admin routes, managing API keys included
+	ScopeAdmin = "admin"
+)
+
+// Scopes are the scopes API keys may be given
+var Scopes = []string{ScopeUsersRead, ScopeUsersWrite, ScopeUsersDelete, ScopeAdmin}
+
+// APIKeyPrefix starts every API key, telling them apart from session tokens and making leaked ones easy to scan for
+const APIKeyPrefix = "spy_"
+
+// APIKey lets a service call the API without logging in, known by its ID and the hash of the key; the key itself is
+// only given out when created
+type APIKey struct {
+	// ID follows APIKeyPrefix in the key, so a key is looked up by it before its hash is compared
+	ID     string   `bson:"_id" json:"id"`
+	Name   string   `bson:"name" json:"name"`
+	Hash   string   `bson:"hash" json:"-"`
+	Scopes []string `bson:"scopes" json:"scopes"`
+	// CreatedBy is the user whose session created the key, if any
+	CreatedBy  string     `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// Allows tells whether the key was given scope
+func (k APIKey) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyPost holds body for API key creation; keys expire after the configured TTL unless expires_at is given
+type APIKeyPost struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// NewAPIKey is the answer to an API key creation, the only time the key is given out
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
 }